@@ -1,24 +1,67 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Host string `json:"host"`
+	Host   string `json:"host"`
+	APIKey string `json:"api_key"`
 }
 
 type CreateNotificationRequest struct {
-	Title   string `json:"title"`
-	Message string `json:"message"`
-	Type    string `json:"type,omitempty"`
+	Title    string   `json:"title"`
+	Message  string   `json:"message"`
+	Type     string   `json:"type,omitempty"`
+	Priority string   `json:"priority,omitempty"`
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Sound    string   `json:"sound,omitempty"`
+	UserID   string   `json:"user_id,omitempty"`
+	// -attachで指定したURL
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+type Attachment struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+// newAttachment はURLの拡張子からContent-Typeを推測する。不明な場合はapplication/octet-stream
+func newAttachment(rawURL string) Attachment {
+	contentType := "application/octet-stream"
+	if u, err := url.Parse(rawURL); err == nil {
+		if t := mime.TypeByExtension(path.Ext(u.Path)); t != "" {
+			contentType = t
+		}
+	}
+	return Attachment{URL: rawURL, ContentType: contentType}
+}
+
+type Notification struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Priority  string    `json:"priority"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
 }
 
 func loadConfig() (*Config, error) {
@@ -44,6 +87,259 @@ func loadConfig() (*Config, error) {
 	return &config, nil
 }
 
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// apiKey はサーバーでAPIキーによる認証が有効な場合に送信するキー
+var apiKey string
+
+// httpClient のタイムアウトは -timeout で変更できる
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// do はAPIキーを付与してリクエストを送信する
+func do(req *http.Request) (*http.Response, error) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return httpClient.Do(req)
+}
+
+// stringSliceFlag は繰り返し指定できるフラグ
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func markAsRead(host, id string) error {
+	req, err := http.NewRequest(http.MethodPut, host+"/api/notifications/"+url.PathEscape(id)+"/read", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func clearNotifications(host string) error {
+	req, err := http.NewRequest(http.MethodDelete, host+"/api/notifications", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func listNotifications(host string, mine bool) ([]Notification, error) {
+	path := "/api/notifications"
+	if mine {
+		path += "?mine=true"
+	}
+	req, err := http.NewRequest(http.MethodGet, host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result NotificationsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Notifications, nil
+}
+
+// ackPollInterval は-waitでackを確認する間隔
+const ackPollInterval = 500 * time.Millisecond
+
+// errNotFound は通知がまだ保存されていないか、削除された場合に返す
+var errNotFound = errors.New("notification not found")
+
+// ackCount は通知の受信を確認 (ack) したクライアント数を返す
+func ackCount(host, id string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, host+"/api/notifications/"+url.PathEscape(id), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		AckedBy int `json:"acked_by"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.AckedBy, nil
+}
+
+// waitForAck はtimeoutまでにいずれかのクライアントが通知をackするのを待ち、終了コードを返す
+// waitForAck はqueuedの場合、キューのワーカーが保存するまでの404を期限まで待つ
+func waitForAck(host, id string, timeout time.Duration, queued bool) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		count, err := ackCount(host, id)
+		stored := true
+		if errors.Is(err, errNotFound) && queued {
+			stored, err = false, nil
+		}
+		if err != nil {
+			fmt.Printf("Error checking acknowledgement: %v\n", err)
+			return 1
+		}
+		if count > 0 {
+			fmt.Printf("Acknowledged by %d client(s)\n", count)
+			return 0
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if stored {
+				fmt.Printf("No client acknowledged %s within %s\n", id, timeout)
+			} else {
+				fmt.Printf("Queued notification %s was not stored within %s\n", id, timeout)
+			}
+			return 1
+		}
+		time.Sleep(min(ackPollInterval, remaining))
+	}
+}
+
+// filterNotifications はタイトルまたはメッセージに大文字小文字を区別せずqueryを含む通知を返す
+func filterNotifications(notifications []Notification, query string) []Notification {
+	if query == "" {
+		return notifications
+	}
+	query = strings.ToLower(query)
+	filtered := make([]Notification, 0, len(notifications))
+	for _, n := range notifications {
+		if strings.Contains(strings.ToLower(n.Title), query) || strings.Contains(strings.ToLower(n.Message), query) {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+func runList(host, query string, mine bool) int {
+	notifications, err := listNotifications(host, mine)
+	if err != nil {
+		fmt.Printf("Error listing notifications: %v\n", err)
+		return 1
+	}
+
+	for _, n := range filterNotifications(notifications, query) {
+		fmt.Printf("%s [%s] %s: %s (%s)\n", n.Timestamp.Local().Format("2006-01-02 15:04:05"), n.Priority, n.Title, n.Message, n.ID)
+	}
+	return 0
+}
+
+// runMarkRead は各IDを既読にして結果を表示し、終了コードを返す
+func runMarkRead(host string, ids []string) int {
+	failed := 0
+	for _, id := range ids {
+		if err := markAsRead(host, id); err != nil {
+			fmt.Printf("Failed to mark %s as read: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Marked %s as read\n", id)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// confirm はpromptを表示し、yまたはyesが入力された場合にtrueを返す
+func confirm(in io.Reader, prompt string) bool {
+	fmt.Printf("%s [y/N]: ", prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// runClear は確認後に全ての通知を削除し、終了コードを返す。yesがtrueの場合は確認しない
+func runClear(host string, yes bool, in io.Reader) int {
+	if !yes && !confirm(in, fmt.Sprintf("Clear all notifications on %s?", host)) {
+		fmt.Println("Aborted")
+		return 1
+	}
+
+	if err := clearNotifications(host); err != nil {
+		fmt.Printf("Error clearing notifications: %v\n", err)
+		return 1
+	}
+	fmt.Println("Cleared all notifications")
+	return 0
+}
+
 func main() {
 	config, err := loadConfig()
 	if err != nil {
@@ -55,10 +351,43 @@ func main() {
 	var title = flag.String("title", "", "Notification title")
 	var message = flag.String("message", "", "Notification message")
 	var notifType = flag.String("type", "", "Notification type (success, info, warning, error)")
+	var priority = flag.String("priority", "", "Notification priority (low, normal, high, critical)")
+	var category = flag.String("category", "", "Notification category")
+	var tags = flag.String("tags", "", "Comma-separated notification tags")
+	var sound = flag.String("sound", "", "Notification sound hint (default, silent, alert)")
+	var user = flag.String("user", "", "Target user ID (empty sends to everyone)")
+	var attachments stringSliceFlag
+	flag.Var(&attachments, "attach", "URL of a file or image to attach (repeatable)")
+	var source = flag.String("source", filepath.Base(os.Args[0]), "Source name sent as X-Notibag-Source")
+	var readIDs stringSliceFlag
+	flag.Var(&readIDs, "read", "Mark the notification with the given ID as read (repeatable)")
+	var list = flag.Bool("list", false, "List unread notifications")
+	var filter = flag.String("filter", "", "Case-insensitive substring to filter listed notifications by title or message")
+	var mine = flag.Bool("mine", false, "List only notifications created with the API key")
+	var clear = flag.Bool("clear", false, "Delete all notifications after confirmation")
+	var yes = flag.Bool("yes", false, "Skip the confirmation of -clear")
+	var wait = flag.Duration("wait", 0, "Wait up to this long for a client to acknowledge the sent notification and exit 1 if none does (0 disables)")
+	flag.StringVar(&apiKey, "api-key", config.APIKey, "API key sent as a Bearer token")
+	flag.DurationVar(&httpClient.Timeout, "timeout", httpClient.Timeout, "Timeout of each request to the server")
 	flag.Parse()
 
+	if *clear {
+		os.Exit(runClear(*host, *yes, os.Stdin))
+	}
+
+	if *list {
+		os.Exit(runList(*host, *filter, *mine))
+	}
+
+	if len(readIDs) > 0 {
+		os.Exit(runMarkRead(*host, readIDs))
+	}
+
 	if *title == "" || *message == "" {
-		fmt.Println("Usage: send -title <title> -message <message> [-type <type>] [-host <host>]")
+		fmt.Println("Usage: send -title <title> -message <message> [-type <type>] [-priority <priority>] [-category <category>] [-tags <tags>] [-sound <sound>] [-user <user>] [-attach <url>...] [-wait <duration>] [-host <host>]")
+		fmt.Println("       send -list [-filter <text>] [-mine] [-host <host>]")
+		fmt.Println("       send -read <id> [-read <id>...] [-host <host>]")
+		fmt.Println("       send -clear [-yes] [-host <host>]")
 		os.Exit(1)
 	}
 
@@ -68,36 +397,99 @@ func main() {
 		os.Exit(1)
 	}
 
+	validPriorities := map[string]bool{"low": true, "normal": true, "high": true, "critical": true, "": true}
+	if !validPriorities[*priority] {
+		fmt.Printf("Invalid priority: %s (must be one of: low, normal, high, critical)\n", *priority)
+		os.Exit(1)
+	}
+
+	validSounds := map[string]bool{"default": true, "silent": true, "alert": true, "": true}
+	if !validSounds[*sound] {
+		fmt.Printf("Invalid sound: %s (must be one of: default, silent, alert)\n", *sound)
+		os.Exit(1)
+	}
+
 	req := CreateNotificationRequest{
-		Title:   *title,
-		Message: *message,
-		Type:    *notifType,
+		Title:    *title,
+		Message:  *message,
+		Type:     *notifType,
+		Priority: *priority,
+		Category: *category,
+		Tags:     splitList(*tags),
+		Sound:    *sound,
+		UserID:   *user,
+	}
+	for _, attachment := range attachments {
+		req.Attachments = append(req.Attachments, newAttachment(attachment))
 	}
 
+	os.Exit(runSend(*host, *source, req, *wait))
+}
+
+// runSend は通知を作成して結果を表示し、waitが0より大きい場合はackを待つ
+func runSend(host, source string, req CreateNotificationRequest, wait time.Duration) int {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
 		fmt.Printf("Error marshaling JSON: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
-	url := *host + "/api/notifications"
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	httpReq, err := http.NewRequest(http.MethodPost, host+"/api/notifications", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("Error creating request: %v\n", err)
+		return 1
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if source != "" {
+		httpReq.Header.Set("X-Notibag-Source", source)
+	}
+	resp, err := do(httpReq)
 	if err != nil {
 		fmt.Printf("Error sending request: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		fmt.Printf("Error reading response: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
-	if resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		fmt.Printf("Error: %s\n", string(body))
-		os.Exit(1)
+		return 1
+	}
+
+	// サーバーは処理結果をstatusで返す (delivered, stored, held, duplicate, suppressed, queued)
+	var result struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(body, &result)
+	switch result.Status {
+	case "stored":
+		fmt.Println("Notification stored (no client has received it yet)")
+	case "held":
+		fmt.Println("Notification stored and held (it is sent when quiet hours, do not disturb or the batch window ends)")
+	case "duplicate":
+		fmt.Printf("Duplicate of existing notification %s\n", result.ID)
+	case "suppressed":
+		fmt.Printf("Notification suppressed: %s\n", result.Reason)
+	case "queued":
+		fmt.Println("Notification queued (it is stored and sent asynchronously)")
+	default:
+		fmt.Println("Notification sent successfully")
 	}
 
-	fmt.Println("Notification sent successfully")
+	if wait > 0 {
+		// 抑制された通知はどのクライアントにも届かない
+		if result.ID == "" {
+			fmt.Printf("Not waiting for acknowledgement: the notification was %s and will not be delivered\n", result.Status)
+			return 1
+		}
+		return waitForAck(host, result.ID, wait, result.Status == "queued")
+	}
+	return 0
 }
\ No newline at end of file
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureOutput はfnが標準出力に書いた内容を返す
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+// newNotificationServer は作成のレスポンスとしてcreatedを返し、GET /api/notifications/:idにはgetで応答するサーバーを起動する
+func newNotificationServer(t *testing.T, created map[string]any, get http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/notifications", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(created)
+	})
+	if get != nil {
+		mux.HandleFunc("GET /api/notifications/{id}", get)
+	}
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestRunSendWaitSuppressed(t *testing.T) {
+	ts := newNotificationServer(t, map[string]any{"status": "suppressed", "reason": "category deploy is cooling down"}, nil)
+
+	var code int
+	output := captureOutput(t, func() {
+		code = runSend(ts.URL, "", CreateNotificationRequest{Title: "t", Message: "m"}, time.Second)
+	})
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	for _, want := range []string{"category deploy is cooling down", "Not waiting for acknowledgement: the notification was suppressed"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q does not contain %q", output, want)
+		}
+	}
+}
+
+func TestRunSendWaitQueuedRetriesUntilStored(t *testing.T) {
+	var polls atomic.Int32
+	ts := newNotificationServer(t, map[string]any{"id": "1", "status": "queued"}, func(w http.ResponseWriter, r *http.Request) {
+		// キューのワーカーが保存するまでは404を返す
+		if polls.Add(1) < 3 {
+			http.Error(w, `{"error": "notification not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": "1", "acked_by": 1})
+	})
+
+	var code int
+	output := captureOutput(t, func() {
+		code = runSend(ts.URL, "", CreateNotificationRequest{Title: "t", Message: "m"}, 5*time.Second)
+	})
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0: %s", code, output)
+	}
+	if !strings.Contains(output, "Acknowledged by 1 client(s)") {
+		t.Errorf("output = %q", output)
+	}
+}
+
+func TestWaitForAck(t *testing.T) {
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "notification not found"}`, http.StatusNotFound)
+	}
+	unacked := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"id": "1", "acked_by": 0})
+	}
+	tests := []struct {
+		name   string
+		get    http.HandlerFunc
+		queued bool
+		want   string
+	}{
+		{"queued notification never stored", notFound, true, "Queued notification 1 was not stored within"},
+		{"stored notification deleted", notFound, false, "Error checking acknowledgement: notification not found"},
+		{"no acknowledgement", unacked, false, "No client acknowledged 1 within"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newNotificationServer(t, nil, tt.get)
+			var code int
+			output := captureOutput(t, func() {
+				code = waitForAck(ts.URL, "1", 100*time.Millisecond, tt.queued)
+			})
+			if code != 1 {
+				t.Errorf("exit code = %d, want 1", code)
+			}
+			if !strings.Contains(output, tt.want) {
+				t.Errorf("output %q does not contain %q", output, tt.want)
+			}
+		})
+	}
+}
+
+// newReadServer はknownに含まれるIDの既読のみを受け付け、既読にしたIDをreadに記録するサーバーを起動する
+func newReadServer(t *testing.T, known ...string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var read []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /api/notifications/{id}/read", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !slices.Contains(known, id) {
+			http.Error(w, `{"error": "notification not found"}`, http.StatusNotFound)
+			return
+		}
+		read = append(read, id)
+		w.Write([]byte(`{"success": true}`))
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts, &read
+}
+
+func TestRunMarkRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		ids      []string
+		wantCode int
+		wantRead []string
+		want     []string
+	}{
+		{"success", []string{"1", "2"}, 0, []string{"1", "2"}, []string{"Marked 1 as read", "Marked 2 as read"}},
+		{"missing", []string{"9"}, 1, nil, []string{"Failed to mark 9 as read: 404 Not Found"}},
+		{"mixed", []string{"1", "9", "2"}, 1, []string{"1", "2"}, []string{"Marked 1 as read", "Failed to mark 9 as read", "Marked 2 as read"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, read := newReadServer(t, "1", "2")
+			var code int
+			output := captureOutput(t, func() { code = runMarkRead(ts.URL, tt.ids) })
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !slices.Equal(*read, tt.wantRead) {
+				t.Errorf("marked %v, want %v", *read, tt.wantRead)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("output %q does not contain %q", output, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterNotifications(t *testing.T) {
+	notifications := []Notification{
+		{ID: "1", Title: "Deploy finished", Message: "api v2"},
+		{ID: "2", Title: "ビルド失敗", Message: "デプロイを中止しました"},
+		{ID: "3", Title: "Ошибка", Message: "ДИСК ПОЛОН"},
+		{ID: "4", Title: "Backup", Message: "ok"},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"1", "2", "3", "4"}},
+		{"deploy", []string{"1"}},
+		{"API V2", []string{"1"}},
+		{"デプロイ", []string{"2"}},
+		{"ビルド", []string{"2"}},
+		{"диск", []string{"3"}},
+		{"ошибка", []string{"3"}},
+		{"restore", nil},
+		{"ロイを中止", []string{"2"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, n := range filterNotifications(notifications, tt.query) {
+			got = append(got, n.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("filter %q = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRunListFilter(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/notifications", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(NotificationsResponse{Notifications: []Notification{
+			{ID: "1", Title: "Deploy finished", Message: "api", Priority: "normal"},
+			{ID: "2", Title: "Backup", Message: "ok", Priority: "low"},
+		}})
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	var code int
+	output := captureOutput(t, func() { code = runList(ts.URL, "DEPLOY", false) })
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	if !strings.Contains(output, "Deploy finished: api (1)") || strings.Contains(output, "Backup") {
+		t.Errorf("output = %q, want only the matching notification", output)
+	}
+
+	output = captureOutput(t, func() { code = runList(ts.URL, "nothing", false) })
+	if code != 0 || output != "" {
+		t.Errorf("non-matching filter: exit code %d, output %q", code, output)
+	}
+}
+
+func TestRunSendSetsSource(t *testing.T) {
+	for _, source := range []string{"deploy-bot", ""} {
+		var got []string
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /api/notifications", func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Values("X-Notibag-Source")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{"id": "1", "status": "delivered"})
+		})
+		ts := httptest.NewServer(mux)
+
+		var code int
+		captureOutput(t, func() { code = runSend(ts.URL, source, CreateNotificationRequest{Title: "t", Message: "m"}, 0) })
+		ts.Close()
+		if code != 0 {
+			t.Errorf("source %q: exit code = %d", source, code)
+		}
+		want := []string{source}
+		if source == "" {
+			want = nil
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("source %q: X-Notibag-Source = %v, want %v", source, got, want)
+		}
+	}
+}
+
+func TestRunClear(t *testing.T) {
+	tests := []struct {
+		name        string
+		yes         bool
+		input       string
+		wantCode    int
+		wantCleared bool
+		want        string
+	}{
+		{"confirmed", false, "y\n", 0, true, "Cleared all notifications"},
+		{"confirmed with yes", false, "YES\n", 0, true, "Cleared all notifications"},
+		{"declined", false, "n\n", 1, false, "Aborted"},
+		{"no answer", false, "", 1, false, "Aborted"},
+		{"-yes", true, "", 0, true, "Cleared all notifications"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cleared atomic.Bool
+			mux := http.NewServeMux()
+			mux.HandleFunc("DELETE /api/notifications", func(w http.ResponseWriter, r *http.Request) {
+				cleared.Store(true)
+				w.Write([]byte(`{"success": true}`))
+			})
+			ts := httptest.NewServer(mux)
+			t.Cleanup(ts.Close)
+
+			var code int
+			output := captureOutput(t, func() { code = runClear(ts.URL, tt.yes, strings.NewReader(tt.input)) })
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if cleared.Load() != tt.wantCleared {
+				t.Errorf("cleared = %v, want %v", cleared.Load(), tt.wantCleared)
+			}
+			if !strings.Contains(output, tt.want) {
+				t.Errorf("output %q does not contain %q", output, tt.want)
+			}
+			if prompted := strings.Contains(output, "Clear all notifications on "+ts.URL+"?"); prompted == tt.yes {
+				t.Errorf("prompted = %v with -yes %v", prompted, tt.yes)
+			}
+		})
+	}
+}
+
+func TestRunClearError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "storage unavailable"}`, http.StatusInternalServerError)
+	}))
+	t.Cleanup(ts.Close)
+
+	var code int
+	output := captureOutput(t, func() { code = runClear(ts.URL, true, strings.NewReader("")) })
+	if code != 1 || !strings.Contains(output, "Error clearing notifications") {
+		t.Errorf("exit code %d, output %q", code, output)
+	}
+}
+
+func TestRunSendWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		ackAfter int32
+		timeout  time.Duration
+		wantCode int
+		want     string
+	}{
+		// 2回目の確認でクライアントが確認応答したことを返す
+		{"acking client", 2, 5 * time.Second, 0, "Acknowledged by 1 client(s)"},
+		{"no acking client", 0, 200 * time.Millisecond, 1, "No client acknowledged 1 within"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int32
+			ts := newNotificationServer(t, map[string]any{"id": "1", "status": "delivered"}, func(w http.ResponseWriter, r *http.Request) {
+				acked := 0
+				if n := polls.Add(1); tt.ackAfter > 0 && n >= tt.ackAfter {
+					acked = 1
+				}
+				json.NewEncoder(w).Encode(map[string]any{"id": "1", "acked_by": acked})
+			})
+
+			var code int
+			output := captureOutput(t, func() {
+				code = runSend(ts.URL, "", CreateNotificationRequest{Title: "t", Message: "m", Priority: "high"}, tt.timeout)
+			})
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d: %s", code, tt.wantCode, output)
+			}
+			if !strings.Contains(output, tt.want) {
+				t.Errorf("output %q does not contain %q", output, tt.want)
+			}
+		})
+	}
+}
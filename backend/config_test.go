@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags はparseServerConfigの一部のフラグを定義したFlagSet
+type testFlags struct {
+	fs          *flag.FlagSet
+	addr        *string
+	store       *string
+	corsOrigins *string
+	apiKeys     *string
+	webhookURLs *string
+	maxConns    *int
+	redact      *bool
+	timeout     *time.Duration
+}
+
+func newTestFlags() *testFlags {
+	fs := flag.NewFlagSet("notibag", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return &testFlags{
+		fs:          fs,
+		addr:        fs.String("addr", ":8080", ""),
+		store:       fs.String("store", "memory", ""),
+		corsOrigins: fs.String("cors-origins", "", ""),
+		apiKeys:     fs.String("api-keys", "", ""),
+		webhookURLs: fs.String("webhook-urls", "", ""),
+		maxConns:    fs.Int("ws-max-connections-per-ip", 0, ""),
+		redact:      fs.Bool("log-redact", false, ""),
+		timeout:     fs.Duration("read-timeout", 10*time.Second, ""),
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	configs := map[string]string{
+		"notibag.json": `{
+			"addr": ":9090",
+			"store": "file",
+			"cors_origins": ["https://a.example", "https://b.example"],
+			"api-keys": {"ci": "secret", "bot": "token"},
+			"webhook_urls": ["https://hooks.example/notify"],
+			"ws_max_connections_per_ip": 12345678901,
+			"log_redact": true,
+			"read_timeout": "30s"
+		}`,
+		"notibag.yaml": `
+addr: ":9090"
+store: file
+cors_origins:
+  - https://a.example
+  - https://b.example
+api-keys:
+  ci: secret
+  bot: token
+webhook_urls: [https://hooks.example/notify]
+ws_max_connections_per_ip: 12345678901
+log_redact: true
+read_timeout: 30s
+`,
+	}
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			flags := newTestFlags()
+			if err := loadConfigFile(flags.fs, writeConfig(t, name, content)); err != nil {
+				t.Fatal(err)
+			}
+			if *flags.addr != ":9090" || *flags.store != "file" {
+				t.Errorf("addr/store = %s/%s", *flags.addr, *flags.store)
+			}
+			if *flags.corsOrigins != "https://a.example,https://b.example" {
+				t.Errorf("cors-origins = %q", *flags.corsOrigins)
+			}
+			if *flags.apiKeys != "bot=token,ci=secret" {
+				t.Errorf("api-keys = %q", *flags.apiKeys)
+			}
+			if *flags.webhookURLs != "https://hooks.example/notify" {
+				t.Errorf("webhook-urls = %q", *flags.webhookURLs)
+			}
+			if *flags.maxConns != 12345678901 || !*flags.redact || *flags.timeout != 30*time.Second {
+				t.Errorf("ws-max-connections-per-ip/log-redact/read-timeout = %d/%v/%s", *flags.maxConns, *flags.redact, *flags.timeout)
+			}
+		})
+	}
+}
+
+func TestConfigFileFlagPrecedence(t *testing.T) {
+	path := writeConfig(t, "notibag.json", `{"addr": ":9090", "store": "file"}`)
+	flags := newTestFlags()
+	if err := flags.fs.Parse([]string{"-addr", ":7070"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(flags.fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *flags.addr != ":7070" {
+		t.Errorf("addr = %s, want the flag value :7070", *flags.addr)
+	}
+	if *flags.store != "file" {
+		t.Errorf("store = %s, want the file value", *flags.store)
+	}
+	if *flags.corsOrigins != "" {
+		t.Errorf("cors-origins = %q, want the default", *flags.corsOrigins)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"notibag.json", `{"addr": ":9090", "adress": ":1", "config": "other.json"}`, "unknown keys: adress, config"},
+		{"notibag.json", `{"addr": `, "failed to parse"},
+		{"notibag.yaml", "addr: [unclosed", "failed to parse"},
+		{"notibag.json", `{"ws_max_connections_per_ip": "many"}`, `invalid value for "ws_max_connections_per_ip"`},
+		{"notibag.json", `{"addr": null}`, `invalid value for "addr"`},
+	}
+	for _, tt := range tests {
+		err := loadConfigFile(newTestFlags().fs, writeConfig(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.content, err, tt.want)
+		}
+	}
+
+	if err := loadConfigFile(newTestFlags().fs, filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: error = %v", err)
+	}
+}
@@ -0,0 +1,1669 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestExportNDJSON(t *testing.T) {
+	ts := startTestServer(t)
+	for _, title := range []string{"a", "b", "c"} {
+		ts.create(t, CreateNotificationRequest{Title: title, Message: "m"})
+		ts.Clock.Advance(time.Second)
+	}
+
+	res, data := ts.request(t, http.MethodGet, "/api/notifications/export?format=ndjson", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", res.StatusCode, data)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var got []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var object map[string]any
+		if err := json.Unmarshal(line, &object); err != nil {
+			t.Fatalf("line %q is not a JSON object: %v", line, err)
+		}
+		var notification Notification
+		decode(t, line, &notification)
+		got = append(got, notification.ID)
+	}
+	if !slicesEqual(got, []string{"3", "2", "1"}) {
+		t.Errorf("exported %v, want [3 2 1]", got)
+	}
+}
+
+func TestExportDoesNotBlockWrites(t *testing.T) {
+	ts := startTestServer(t)
+	ts.create(t, CreateNotificationRequest{Title: "a", Message: "m"})
+
+	done := make(chan error, 1)
+	go func() {
+		// 書き出し中に通知を作成しても、リポジトリのロックを待たずに完了する
+		done <- ts.Service.ExportNotifications(func(Notification) error {
+			_, err := ts.Service.CreateNotification(t.Context(), CreateNotificationRequest{Title: "b", Message: "m"})
+			return err
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wsTestTimeout):
+		t.Fatal("creating a notification blocked while exporting")
+	}
+}
+
+// listIDs はGET /api/notificationsのqueryで返された通知のIDを返す
+func (ts *TestServer) listIDs(t *testing.T, query string) []string {
+	t.Helper()
+	var list NotificationsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications"+query, nil), &list)
+	return ids(list.Notifications)
+}
+
+func TestListSortByPriority(t *testing.T) {
+	ts := startTestServer(t)
+	for _, priority := range []string{PriorityLow, PriorityCritical, PriorityNormal, PriorityHigh} {
+		ts.create(t, CreateNotificationRequest{Title: priority, Message: "m", Priority: priority})
+		ts.Clock.Advance(time.Second)
+	}
+
+	if got := ts.listIDs(t, "?sort=priority"); !slicesEqual(got, []string{"2", "4", "3", "1"}) {
+		t.Errorf("sort=priority: %v, want critical, high, normal, low ([2 4 3 1])", got)
+	}
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"4", "3", "2", "1"}) {
+		t.Errorf("default: %v, want newest first", got)
+	}
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?sort=unknown", nil)
+}
+
+func TestCategoryAllowlist(t *testing.T) {
+	allowlist := func(cfg *testConfig) { cfg.Service.AllowedCategories = []string{"deploy", "system"} }
+
+	t.Run("allowed", func(t *testing.T) {
+		ts := startTestServer(t, allowlist)
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy"}); created.Category != "deploy" {
+			t.Errorf("category = %q, want deploy", created.Category)
+		}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		ts := startTestServer(t, allowlist)
+		data := ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Category: "billing"})
+		if !bytes.Contains(data, []byte("category not allowed: billing")) {
+			t.Errorf("error = %s", data)
+		}
+	})
+
+	t.Run("empty allowlist accepts any category", func(t *testing.T) {
+		ts := startTestServer(t)
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "billing"}); created.Category != "billing" {
+			t.Errorf("category = %q, want billing", created.Category)
+		}
+	})
+}
+
+func TestDeleteNotifications(t *testing.T) {
+	deleteIDs := func(t *testing.T, ts *TestServer, ids []string) DeleteNotificationsResponse {
+		t.Helper()
+		var res DeleteNotificationsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/delete", DeleteNotificationsRequest{IDs: ids}), &res)
+		return res
+	}
+	seed := func(t *testing.T) *TestServer {
+		ts := startTestServer(t)
+		for range 3 {
+			ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		}
+		return ts
+	}
+
+	t.Run("all found", func(t *testing.T) {
+		ts := seed(t)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+		res := deleteIDs(t, ts, []string{"1", "3"})
+		if !slicesEqual(res.Deleted, []string{"3", "1"}) || len(res.NotFound) != 0 {
+			t.Errorf("response = %+v", res)
+		}
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"2"}) {
+			t.Errorf("remaining = %v, want [2]", got)
+		}
+		for _, want := range []string{"3", "1"} {
+			if msg := client.next(t, "notification_deleted"); msg.NotificationID != want {
+				t.Errorf("notification_deleted %s, want %s", msg.NotificationID, want)
+			}
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		ts := seed(t)
+		res := deleteIDs(t, ts, []string{"2", "missing"})
+		if !slicesEqual(res.Deleted, []string{"2"}) || !slicesEqual(res.NotFound, []string{"missing"}) {
+			t.Errorf("response = %+v", res)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		ts := seed(t)
+		res := deleteIDs(t, ts, []string{})
+		if len(res.Deleted) != 0 || len(res.NotFound) != 0 {
+			t.Errorf("response = %+v", res)
+		}
+		if got := ts.listIDs(t, ""); len(got) != 3 {
+			t.Errorf("remaining = %v, want all 3", got)
+		}
+	})
+}
+
+// withAdminToken は管理用APIを有効にする
+func withAdminToken(token string) testOption {
+	return func(cfg *testConfig) { cfg.Server.AdminToken = token }
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	ts := startTestServer(t, withAdminToken("admin"))
+	admin := []string{"Authorization", "Bearer admin"}
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	ts.create(t, CreateNotificationRequest{Title: "before", Message: "m"})
+
+	setMaintenance := func(enabled bool) {
+		t.Helper()
+		var res MaintenanceResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/admin/maintenance", map[string]bool{"enabled": enabled}, admin...), &res)
+		if res.Maintenance != enabled {
+			t.Fatalf("maintenance = %v, want %v", res.Maintenance, enabled)
+		}
+		if msg := client.next(t, "maintenance"); msg.Maintenance == nil || *msg.Maintenance != enabled {
+			t.Errorf("maintenance event = %v, want %v", msg.Maintenance, enabled)
+		}
+	}
+
+	setMaintenance(true)
+	ts.expectStatus(t, http.StatusServiceUnavailable, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "during", Message: "m"})
+	ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/1", nil)
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"1"}) {
+		t.Errorf("list during maintenance = %v, want [1]", got)
+	}
+
+	setMaintenance(false)
+	ts.create(t, CreateNotificationRequest{Title: "after", Message: "m"})
+
+	ts.expectStatus(t, http.StatusUnauthorized, http.MethodPost, "/api/admin/maintenance", map[string]bool{"enabled": true})
+}
+
+func TestNotificationSound(t *testing.T) {
+	ts := startTestServer(t)
+	for _, sound := range []string{SoundDefault, SoundSilent, SoundAlert} {
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: sound, Sound: sound}); created.Sound != sound {
+			t.Errorf("sound = %q, want %q", created.Sound, sound)
+		}
+	}
+	if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "omitted"}); created.Sound != SoundDefault {
+		t.Errorf("omitted sound = %q, want %q", created.Sound, SoundDefault)
+	}
+	data := ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Sound: "siren"})
+	if !bytes.Contains(data, []byte("invalid sound: siren")) {
+		t.Errorf("error = %s", data)
+	}
+}
+
+func TestReadinessAndLiveness(t *testing.T) {
+	t.Run("repository unavailable", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) {
+			cfg.Repository = func() NotificationRepository {
+				return unhealthyRepository{InMemoryNotificationRepository: newTestRepository()}
+			}
+		})
+		data := ts.expectStatus(t, http.StatusServiceUnavailable, http.MethodGet, "/api/health/ready", nil)
+		if !bytes.Contains(data, []byte("database is unreachable")) {
+			t.Errorf("readiness = %s", data)
+		}
+		ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health/live", nil)
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		ts := startTestServer(t)
+		ts.Handler.SetReady(false)
+		ts.expectStatus(t, http.StatusServiceUnavailable, http.MethodGet, "/api/health/ready", nil)
+		ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health/live", nil)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		ts := startTestServer(t)
+		ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health/ready", nil)
+	})
+}
+
+func TestResponseTimeZone(t *testing.T) {
+	timestamp := func(t *testing.T, ts *TestServer, path string) string {
+		t.Helper()
+		var list struct {
+			Notifications []struct {
+				Timestamp string `json:"timestamp"`
+			} `json:"notifications"`
+		}
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &list)
+		if len(list.Notifications) != 1 {
+			t.Fatalf("%s: %d notifications", path, len(list.Notifications))
+		}
+		return list.Notifications[0].Timestamp
+	}
+
+	ts := startTestServer(t)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if got := timestamp(t, ts, "/api/notifications"); got != "2024-01-01T00:00:00Z" {
+		t.Errorf("default = %s, want UTC", got)
+	}
+	if got := timestamp(t, ts, "/api/notifications?tz=Asia/Tokyo"); got != "2024-01-01T09:00:00+09:00" {
+		t.Errorf("tz=Asia/Tokyo: %s", got)
+	}
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?tz=Mars/Olympus", nil)
+
+	configured := startTestServer(t, func(cfg *testConfig) { cfg.Handler.Location = time.FixedZone("EST", -5*60*60) })
+	configured.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if got := timestamp(t, configured, "/api/notifications"); got != "2023-12-31T19:00:00-05:00" {
+		t.Errorf("configured location: %s", got)
+	}
+}
+
+func TestListETag(t *testing.T) {
+	ts := startTestServer(t)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+
+	res, _ := ts.request(t, http.MethodGet, "/api/notifications", nil)
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("first: status %d, ETag %q", res.StatusCode, etag)
+	}
+
+	res, body := ts.request(t, http.MethodGet, "/api/notifications", nil, "If-None-Match", etag)
+	if res.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Fatalf("unchanged: status %d, body %q, want 304 without a body", res.StatusCode, body)
+	}
+	if got := res.Header.Get("ETag"); got != etag {
+		t.Errorf("unchanged ETag = %q, want %q", got, etag)
+	}
+
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	res, body = ts.request(t, http.MethodGet, "/api/notifications", nil, "If-None-Match", etag)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("changed: status %d, want 200", res.StatusCode)
+	}
+	if got := res.Header.Get("ETag"); got == etag {
+		t.Errorf("ETag did not change after creating a notification")
+	}
+	var list NotificationsResponse
+	decode(t, body, &list)
+	if len(list.Notifications) != 2 {
+		t.Errorf("changed list = %v, want 2 notifications", ids(list.Notifications))
+	}
+}
+
+func TestArchive(t *testing.T) {
+	t.Run("archive", func(t *testing.T) {
+		ts := startTestServer(t)
+		for i := 0; i < 2; i++ {
+			ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		}
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/1/archive", nil)
+		if msg := client.next(t, "notification_archived"); msg.NotificationID != "1" {
+			t.Errorf("archived event for %s, want 1", msg.NotificationID)
+		}
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"2"}) {
+			t.Errorf("default list = %v, want [2]", got)
+		}
+		if got := ts.listIDs(t, "?archived=true"); !slicesEqual(got, []string{"1"}) {
+			t.Errorf("archived list = %v, want [1]", got)
+		}
+
+		var archived Notification
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/1", nil), &archived)
+		if !archived.Archived || archived.ArchivedAt == nil || !archived.ArchivedAt.Equal(TestServerStart) {
+			t.Errorf("archived = %v at %v, want archived at %v", archived.Archived, archived.ArchivedAt, TestServerStart)
+		}
+
+		ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/notifications/missing/archive", nil)
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?archived=maybe", nil)
+	})
+
+	t.Run("clear in archive mode", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.ArchiveOnClear = true })
+		for i := 0; i < 2; i++ {
+			ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		}
+		ts.expectStatus(t, http.StatusOK, http.MethodDelete, "/api/notifications", nil)
+		if got := ts.listIDs(t, ""); len(got) != 0 {
+			t.Errorf("default list after clearing = %v, want none", got)
+		}
+		if got := ts.listIDs(t, "?archived=true"); len(got) != 2 {
+			t.Errorf("archived list after clearing = %v, want both", got)
+		}
+	})
+
+	t.Run("clear without archive mode", func(t *testing.T) {
+		ts := startTestServer(t)
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		ts.expectStatus(t, http.StatusOK, http.MethodDelete, "/api/notifications", nil)
+		if got := ts.listIDs(t, "?archived=true"); len(got) != 0 {
+			t.Errorf("archived list after deleting = %v, want none", got)
+		}
+		ts.expectStatus(t, http.StatusNotFound, http.MethodGet, "/api/notifications/1", nil)
+	})
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		s         string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"こんにちは", 5, "こんにちは", false},
+		{"こんにちは世界", 5, "こんにち…", true},
+		{"🔔🔔🔔🔔🔔🔔", 3, "🔔🔔…", true},
+		{"a", 1, "a", false},
+		{"abcd", 1, "…", true},
+		{"", 3, "", false},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateRunes(tt.s, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("truncateRunes(%q, %d) = %q, %v; want %q, %v", tt.s, tt.max, got, truncated, tt.want, tt.truncated)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateRunes(%q, %d) split a character: %q", tt.s, tt.max, got)
+		}
+	}
+}
+
+func TestListPreview(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Handler.PreviewLength = 5 })
+	long := ts.create(t, CreateNotificationRequest{Title: "t", Message: "通知のプレビュー表示"})
+	exact := ts.create(t, CreateNotificationRequest{Title: "t", Message: "ちょうど五"})
+
+	var list NotificationsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications?preview=true", nil), &list)
+	got := map[string]Notification{}
+	for _, n := range list.Notifications {
+		got[n.ID] = n
+	}
+	if n := got[long.ID]; n.Message != "通知のプ…" || !n.Truncated {
+		t.Errorf("long preview = %q (truncated %v), want 通知のプ…", n.Message, n.Truncated)
+	}
+	if n := got[exact.ID]; n.Message != "ちょうど五" || n.Truncated {
+		t.Errorf("boundary preview = %q (truncated %v), want the full message", n.Message, n.Truncated)
+	}
+
+	var full NotificationsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications", nil), &full)
+	for _, n := range full.Notifications {
+		if n.Truncated {
+			t.Errorf("%s truncated without preview=true", n.ID)
+		}
+	}
+
+	var detail Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+long.ID, nil), &detail)
+	if detail.Message != "通知のプレビュー表示" || detail.Truncated {
+		t.Errorf("detail = %q (truncated %v), want the full message", detail.Message, detail.Truncated)
+	}
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?preview=yes", nil)
+}
+
+func TestRequestID(t *testing.T) {
+	ts := startTestServer(t)
+
+	t.Run("provided", func(t *testing.T) {
+		logs := captureLogs(t)
+		res, _ := ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"}, "X-Request-ID", "trace-123")
+		if got := res.Header.Get("X-Request-ID"); got != "trace-123" {
+			t.Errorf("X-Request-ID = %q, want trace-123", got)
+		}
+		if !strings.Contains(logs.String(), `"request_id":"trace-123"`) {
+			t.Errorf("creation was not logged with the request ID: %s", logs)
+		}
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		first, _ := ts.request(t, http.MethodGet, "/api/notifications", nil)
+		second, _ := ts.request(t, http.MethodGet, "/api/notifications", nil)
+		a, b := first.Header.Get("X-Request-ID"), second.Header.Get("X-Request-ID")
+		if len(a) != 32 || a == b {
+			t.Errorf("generated IDs = %q, %q, want distinct 32 character IDs", a, b)
+		}
+	})
+
+	t.Run("invalid header is replaced", func(t *testing.T) {
+		res, _ := ts.request(t, http.MethodGet, "/api/notifications", nil, "X-Request-ID", strings.Repeat("x", 200))
+		if got := res.Header.Get("X-Request-ID"); len(got) != 32 {
+			t.Errorf("X-Request-ID = %q, want a generated ID", got)
+		}
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		var resp ErrorResponse
+		decode(t, ts.expectStatus(t, http.StatusNotFound, http.MethodGet, "/api/notifications/missing", nil, "X-Request-ID", "trace-404"), &resp)
+		if resp.RequestID != "trace-404" {
+			t.Errorf("request_id = %q, want trace-404", resp.RequestID)
+		}
+	})
+}
+
+func TestListMaxAge(t *testing.T) {
+	ts := startTestServer(t)
+	ts.create(t, CreateNotificationRequest{Title: "old", Message: "m"})
+	ts.Clock.Advance(2 * time.Hour)
+	ts.create(t, CreateNotificationRequest{Title: "recent", Message: "m"})
+	ts.Clock.Advance(30 * time.Minute)
+	ts.create(t, CreateNotificationRequest{Title: "latest", Message: "m"})
+
+	tests := []struct {
+		maxAge string
+		want   []string
+	}{
+		{"", []string{"3", "2", "1"}},
+		{"1h", []string{"3", "2"}},
+		{"30m", []string{"3", "2"}},
+		{"29m", []string{"3"}},
+		{"3h", []string{"3", "2", "1"}},
+	}
+	for _, tt := range tests {
+		query := ""
+		if tt.maxAge != "" {
+			query = "?max_age=" + tt.maxAge
+		}
+		if got := ts.listIDs(t, query); !slicesEqual(got, tt.want) {
+			t.Errorf("max_age=%s: %v, want %v", tt.maxAge, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"yesterday", "-1h", "0"} {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?max_age="+invalid, nil)
+	}
+}
+
+func TestPinNotifications(t *testing.T) {
+	ts := startTestServer(t)
+	ts.create(t, CreateNotificationRequest{Title: "low", Message: "m", Priority: PriorityLow})
+	ts.Clock.Advance(time.Minute)
+	ts.create(t, CreateNotificationRequest{Title: "critical", Message: "m", Priority: PriorityCritical})
+	ts.Clock.Advance(time.Minute)
+	ts.create(t, CreateNotificationRequest{Title: "normal", Message: "m"})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/1/pin", nil)
+	if msg := client.next(t, "notification_pinned"); msg.NotificationID != "1" || msg.Pinned == nil || !*msg.Pinned {
+		t.Errorf("pin event = %+v, want 1 pinned", msg)
+	}
+	var pinned Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/1", nil), &pinned)
+	if !pinned.Pinned {
+		t.Error("notification is not pinned")
+	}
+
+	// ピン留めした通知はどの並び順でも先頭に表示する
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"1", "3", "2"}) {
+		t.Errorf("newest first with a pin = %v, want [1 3 2]", got)
+	}
+	if got := ts.listIDs(t, "?sort=priority"); !slicesEqual(got, []string{"1", "2", "3"}) {
+		t.Errorf("by priority with a pin = %v, want [1 2 3]", got)
+	}
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/1/unpin", nil)
+	if msg := client.next(t, "notification_pinned"); msg.NotificationID != "1" || msg.Pinned == nil || *msg.Pinned {
+		t.Errorf("unpin event = %+v, want 1 unpinned", msg)
+	}
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"3", "2", "1"}) {
+		t.Errorf("newest first after unpinning = %v, want [3 2 1]", got)
+	}
+
+	ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/notifications/missing/pin", nil)
+}
+
+func TestListStates(t *testing.T) {
+	ts := startTestServer(t)
+	for i := 0; i < 4; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		ts.Clock.Advance(time.Second)
+	}
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/2/read", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/3/read", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/4/archive", nil)
+
+	tests := []struct {
+		states string
+		want   []string
+	}{
+		{"", []string{"1"}},
+		{"unread", []string{"1"}},
+		{"read", []string{"3", "2"}},
+		{"unread,read", []string{"3", "2", "1"}},
+		{"read, unread", []string{"3", "2", "1"}},
+	}
+	for _, tt := range tests {
+		var list NotificationsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications?states="+url.QueryEscape(tt.states), nil), &list)
+		if got := ids(list.Notifications); !slicesEqual(got, tt.want) {
+			t.Errorf("states=%q: %v, want %v", tt.states, got, tt.want)
+		}
+		for _, n := range list.Notifications {
+			if want := n.ID != "1"; n.Read != want {
+				t.Errorf("states=%q: %s read = %v, want %v", tt.states, n.ID, n.Read, want)
+			}
+		}
+	}
+
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?states=archived", nil)
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?states=read&archived=true", nil)
+}
+
+func TestUnknownRoutesReturnJSON(t *testing.T) {
+	ts := startTestServer(t)
+	tests := []struct {
+		method, path string
+		status       int
+		message      string
+	}{
+		{http.MethodGet, "/api/unknown", http.StatusNotFound, "route not found: GET /api/unknown"},
+		{http.MethodGet, "/nowhere", http.StatusNotFound, "route not found: GET /nowhere"},
+		{http.MethodPatch, "/api/notifications", http.StatusMethodNotAllowed, "method not allowed: PATCH /api/notifications"},
+		{http.MethodDelete, "/api/notifications/1/read", http.StatusMethodNotAllowed, "method not allowed: DELETE /api/notifications/1/read"},
+	}
+	for _, tt := range tests {
+		res, body := ts.request(t, tt.method, tt.path, nil, "X-Request-ID", "unknown-route")
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, res.StatusCode, tt.status)
+		}
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s %s: Content-Type %q, want JSON", tt.method, tt.path, ct)
+		}
+		var resp ErrorResponse
+		decode(t, body, &resp)
+		if resp.Error != tt.message || resp.RequestID != "unknown-route" {
+			t.Errorf("%s %s: %+v, want %q", tt.method, tt.path, resp, tt.message)
+		}
+	}
+}
+
+func TestCreateStatusCodes(t *testing.T) {
+	req := CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy"}
+	tests := []struct {
+		name   string
+		opts   []testOption
+		client bool
+		before int
+		status int
+		want   string
+	}{
+		{name: "delivered", client: true, status: http.StatusCreated, want: CreateStatusDelivered},
+		{name: "no clients", status: http.StatusAccepted, want: CreateStatusStored},
+		{name: "held", opts: []testOption{func(cfg *testConfig) { cfg.WS.BatchWindow = time.Second }}, client: true, status: http.StatusAccepted, want: CreateStatusHeld},
+		{name: "duplicate", opts: []testOption{func(cfg *testConfig) { cfg.Service.DedupWindow = time.Minute }}, before: 1, status: http.StatusOK, want: CreateStatusDuplicate},
+		{name: "suppressed", opts: []testOption{func(cfg *testConfig) { cfg.Service.CategoryCooldowns = map[string]time.Duration{"deploy": time.Minute} }}, before: 1, status: http.StatusAccepted, want: CreateStatusSuppressed},
+		{name: "queued", opts: []testOption{func(cfg *testConfig) { cfg.Handler.Ingest = IngestConfig{QueueSize: 10} }}, status: http.StatusAccepted, want: CreateStatusQueued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startTestServer(t, tt.opts...)
+			if tt.client {
+				dialWS(t, ts.WebSocketURL(), nil)
+				waitClients(t, ts.WSManager, 1)
+			}
+			for i := 0; i < tt.before; i++ {
+				ts.create(t, req)
+			}
+			res, body := ts.request(t, http.MethodPost, "/api/notifications", req)
+			var created struct {
+				Status string `json:"status"`
+			}
+			decode(t, body, &created)
+			if res.StatusCode != tt.status || created.Status != tt.want {
+				t.Errorf("got %d %q, want %d %q", res.StatusCode, created.Status, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationSource(t *testing.T) {
+	t.Run("header", func(t *testing.T) {
+		ts := startTestServer(t)
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, "X-Notibag-Source", " ci "); created.Source != "ci" {
+			t.Errorf("source = %q, want ci", created.Source)
+		}
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, "X-Notibag-Source", "monitoring")
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+
+		var stored Notification
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/1", nil), &stored)
+		if stored.Source != "ci" {
+			t.Errorf("stored source = %q, want ci", stored.Source)
+		}
+		if got := ts.listIDs(t, "?source=ci"); !slicesEqual(got, []string{"1"}) {
+			t.Errorf("source=ci: %v, want [1]", got)
+		}
+		if got := ts.listIDs(t, "?source=monitoring"); !slicesEqual(got, []string{"2"}) {
+			t.Errorf("source=monitoring: %v, want [2]", got)
+		}
+		if got := ts.listIDs(t, "?source=unknown"); len(got) != 0 {
+			t.Errorf("source=unknown: %v, want none", got)
+		}
+		if got := ts.listIDs(t, ""); len(got) != 3 {
+			t.Errorf("unfiltered: %v, want all", got)
+		}
+	})
+
+	t.Run("api key name", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(map[string]string{"deployer": "secret"}))
+		created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, "Authorization", "Bearer secret", "X-Notibag-Source", "spoofed")
+		if created.Source != "deployer" {
+			t.Errorf("source = %q, want the API key name", created.Source)
+		}
+	})
+}
+
+func TestListMine(t *testing.T) {
+	ts := startTestServer(t, withAPIKeys(map[string]string{"ci": "ci-key", "monitoring": "mon-key"}))
+	ci := []string{"Authorization", "Bearer ci-key"}
+	monitoring := []string{"Authorization", "Bearer mon-key"}
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, ci...)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, monitoring...)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, ci...)
+
+	list := func(header []string, query string) []string {
+		t.Helper()
+		var resp NotificationsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications"+query, nil, header...), &resp)
+		return ids(resp.Notifications)
+	}
+	if got := list(ci, "?mine=true"); !slicesEqual(got, []string{"3", "1"}) {
+		t.Errorf("ci mine=true: %v, want [3 1]", got)
+	}
+	if got := list(monitoring, "?mine=true"); !slicesEqual(got, []string{"2"}) {
+		t.Errorf("monitoring mine=true: %v, want [2]", got)
+	}
+	if got := list(ci, ""); len(got) != 3 {
+		t.Errorf("ci without mine: %v, want all", got)
+	}
+	if got := list(ci, "?mine=true&source=ci"); !slicesEqual(got, []string{"3", "1"}) {
+		t.Errorf("mine=true with the same source: %v", got)
+	}
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?mine=true&source=monitoring", nil, ci...)
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?mine=maybe", nil, ci...)
+}
+
+func TestListMineRequiresAPIKey(t *testing.T) {
+	ts := startTestServer(t)
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications?mine=true", nil)
+}
+
+// withRedactedLogs はテストの間、ログに出力する通知の内容を伏せる
+func withRedactedLogs(t *testing.T) {
+	t.Helper()
+	redactLogs = true
+	t.Cleanup(func() { redactLogs = false })
+}
+
+func TestLogRedaction(t *testing.T) {
+	req := CreateNotificationRequest{Title: "パスワード再設定", Message: "token=hunter2", Category: "auth"}
+
+	t.Run("disabled", func(t *testing.T) {
+		ts := startTestServer(t)
+		logs := captureLogs(t)
+		ts.create(t, req)
+		if !strings.Contains(logs.String(), "token=hunter2") {
+			t.Errorf("message not logged without redaction: %s", logs)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		withRedactedLogs(t)
+		ts := startTestServer(t)
+		logs := captureLogs(t)
+		created := ts.create(t, req)
+		output := logs.String()
+		for _, secret := range []string{"hunter2", req.Title} {
+			if strings.Contains(output, secret) {
+				t.Errorf("logs contain %q: %s", secret, output)
+			}
+		}
+		for _, want := range []string{`"id":"` + created.ID + `"`, `"title_length":8`, `"category":"auth"`} {
+			if !strings.Contains(output, want) {
+				t.Errorf("logs do not contain %s: %s", want, output)
+			}
+		}
+	})
+}
+
+func TestDebugRuntimeStats(t *testing.T) {
+	ts := startTestServer(t, withAdminToken("admin"))
+	admin := []string{"Authorization", "Bearer admin"}
+	dialWS(t, ts.WebSocketURL(), nil)
+	dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 2)
+	runtime.GC()
+
+	body := ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/admin/debug", nil, admin...)
+	var fields map[string]json.RawMessage
+	decode(t, body, &fields)
+	for _, field := range []string{"goroutines", "heap_alloc_bytes", "heap_objects", "websocket_clients", "gc"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("missing field %s: %s", field, body)
+		}
+	}
+
+	var debug DebugResponse
+	decode(t, body, &debug)
+	// 接続ごとに読み取りと書き込みのgoroutineがある
+	if debug.Goroutines < 4 || debug.Goroutines > 10000 {
+		t.Errorf("goroutines = %d", debug.Goroutines)
+	}
+	if debug.HeapAllocBytes == 0 || debug.HeapObjects == 0 {
+		t.Errorf("heap = %d bytes, %d objects", debug.HeapAllocBytes, debug.HeapObjects)
+	}
+	if debug.WebSocketClients != 2 {
+		t.Errorf("websocket_clients = %d, want 2", debug.WebSocketClients)
+	}
+	if debug.GC.NumGC == 0 || debug.GC.LastGC == nil || debug.GC.NextGCBytes == 0 {
+		t.Errorf("gc = %+v, want at least one collection", debug.GC)
+	}
+	if time.Since(*debug.GC.LastGC) > time.Minute {
+		t.Errorf("last_gc = %s, want the collection just run", debug.GC.LastGC)
+	}
+
+	ts.expectStatus(t, http.StatusUnauthorized, http.MethodGet, "/api/admin/debug", nil)
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	ts := startTestServer(t)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	path := "/api/notifications/" + created.ID
+	version := func() (int, string) {
+		t.Helper()
+		res, body := ts.request(t, http.MethodGet, path, nil)
+		var n Notification
+		decode(t, body, &n)
+		return n.Version, res.Header.Get("ETag")
+	}
+	if v, etag := version(); v != 1 || etag != `"1"` {
+		t.Fatalf("initial version = %d (ETag %s), want 1", v, etag)
+	}
+
+	// 一致するバージョンは成功し、バージョンが増える
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, path+"/pin", nil, "If-Match", `"1"`)
+	if v, etag := version(); v != 2 || etag != `"2"` {
+		t.Errorf("version after pinning = %d (ETag %s), want 2", v, etag)
+	}
+
+	// 古いバージョンは409で、変更しない
+	var conflict ErrorResponse
+	decode(t, ts.expectStatus(t, http.StatusConflict, http.MethodPut, path+"/read", nil, "If-Match", `"1"`), &conflict)
+	if conflict.Error == "" {
+		t.Error("conflict without an error message")
+	}
+	var n Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &n)
+	if n.Read || n.Version != 2 {
+		t.Errorf("after a conflict: read %v version %d, want unchanged", n.Read, n.Version)
+	}
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, path+"/read", nil, "If-Match", `W/"2"`)
+	if v, _ := version(); v != 3 {
+		t.Errorf("version after marking read = %d, want 3", v)
+	}
+	// If-Matchを省略した場合は確認しない
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, path+"/tags/prod", nil)
+	if v, _ := version(); v != 4 {
+		t.Errorf("version after tagging = %d, want 4", v)
+	}
+	ts.expectStatus(t, http.StatusConflict, http.MethodPost, path+"/archive", nil, "If-Match", `"3"`)
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodPut, path+"/read", nil, "If-Match", "latest")
+}
+
+func TestIngestQueue(t *testing.T) {
+	t.Run("processing", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.Handler.Ingest = IngestConfig{QueueSize: 10, Workers: 2} })
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+		for i := 0; i < 5; i++ {
+			res, body := ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"})
+			var created CreateNotificationResponse
+			decode(t, body, &created)
+			if res.StatusCode != http.StatusAccepted || created.Status != CreateStatusQueued || created.ID == "" {
+				t.Fatalf("enqueue: %d %s %q", res.StatusCode, created.Status, created.ID)
+			}
+		}
+		waitFor(t, "the queue to be processed", func() bool { return ts.Handler.ingest.Stats().Processed == 5 })
+		if got := ts.listIDs(t, ""); len(got) != 5 {
+			t.Errorf("stored %v, want 5 notifications", got)
+		}
+		for i := 0; i < 5; i++ {
+			client.next(t, "notification")
+		}
+	})
+
+	t.Run("full queue", func(t *testing.T) {
+		release := make(chan struct{})
+		block := processorFunc(func(ctx context.Context, n *Notification) error {
+			<-release
+			return nil
+		})
+		ts := startTestServer(t, func(cfg *testConfig) {
+			cfg.Handler.Ingest = IngestConfig{QueueSize: 1, Workers: 1}
+			cfg.Service.Processors = []NotificationProcessor{block}
+		})
+		defer close(release)
+
+		// 1件目はワーカーが処理中で、2件目でキューが一杯になる
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		waitFor(t, "the worker to take the first notification", func() bool { return ts.Handler.ingest.Stats().QueueDepth == 0 })
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		var resp ErrorResponse
+		decode(t, ts.expectStatus(t, http.StatusServiceUnavailable, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"}), &resp)
+		if resp.Error != "notification queue is full" {
+			t.Errorf("error = %q", resp.Error)
+		}
+		if s := ts.Handler.ingest.Stats(); s.Rejected != 1 || s.QueueDepth != 1 {
+			t.Errorf("stats = %+v, want 1 rejected and 1 queued", s)
+		}
+
+		release <- struct{}{}
+		release <- struct{}{}
+		waitFor(t, "the queue to drain", func() bool { return ts.Handler.ingest.Stats().Processed == 2 })
+	})
+
+	t.Run("invalid requests are rejected before queueing", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.Handler.Ingest = IngestConfig{QueueSize: 10} })
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Priority: "urgent"})
+		if s := ts.Handler.ingest.Stats(); s.QueueDepth != 0 || s.Processed != 0 {
+			t.Errorf("stats = %+v, want nothing queued", s)
+		}
+	})
+}
+
+func TestCategoryColors(t *testing.T) {
+	colors, err := parseColorMap("deploy=#1E90FF, alert=#f00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Handler.Categories = []string{"deploy", "alert"}
+		cfg.Handler.CategoryColors = colors
+		cfg.WS.CategoryColors = colors
+	})
+
+	var config CategoriesConfigResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/config/categories", nil), &config)
+	if config.Colors["deploy"] != "#1e90ff" || config.Colors["alert"] != "#f00" || len(config.Colors) != 2 {
+		t.Errorf("colors = %v, want the configured mapping in lower case", config.Colors)
+	}
+	if !slicesEqual(config.Allowed, []string{"deploy", "alert"}) {
+		t.Errorf("allowed = %v", config.Allowed)
+	}
+
+	// 配信する通知には色を付与する
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if msg := client.next(t, "notification"); msg.Notification.Color != "#1e90ff" {
+		t.Errorf("embedded color = %q, want #1e90ff", msg.Notification.Color)
+	}
+	if msg := client.next(t, "notification"); msg.Notification.Color != "" {
+		t.Errorf("color without a category = %q", msg.Notification.Color)
+	}
+}
+
+func TestParseColorMapRejectsInvalidColors(t *testing.T) {
+	tests := []struct {
+		value   string
+		allowed []string
+		want    string
+	}{
+		{"deploy=blue", nil, "invalid color for deploy: blue"},
+		{"deploy=#12345", nil, "invalid color"},
+		{"deploy=#ggg", nil, "invalid color"},
+		{"deploy=123456", nil, "invalid color"},
+		{"deploy=#fff", []string{"alert"}, "category not allowed: deploy"},
+	}
+	for _, tt := range tests {
+		if _, err := parseColorMap(tt.value, tt.allowed); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestListCursorPagination(t *testing.T) {
+	ts := startTestServer(t)
+	for i := 0; i < 7; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		ts.Clock.Advance(time.Second)
+	}
+
+	var pages [][]string
+	query := "?limit=3"
+	for {
+		var page NotificationsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications"+query, nil), &page)
+		pages = append(pages, ids(page.Notifications))
+		if len(pages) == 1 {
+			// ページの間に通知が追加されても、続きのページは変わらない
+			ts.create(t, CreateNotificationRequest{Title: "new", Message: "m"})
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "?limit=3&after=" + url.QueryEscape(page.NextCursor)
+	}
+
+	want := [][]string{{"7", "6", "5"}, {"4", "3", "2"}, {"1"}}
+	if len(pages) != len(want) {
+		t.Fatalf("pages = %v, want %v", pages, want)
+	}
+	for i := range want {
+		if !slicesEqual(pages[i], want[i]) {
+			t.Errorf("page %d = %v, want %v", i, pages[i], want[i])
+		}
+	}
+	if got := ts.listIDs(t, "?limit=1"); !slicesEqual(got, []string{"8"}) {
+		t.Errorf("first page after the insert = %v, want [8]", got)
+	}
+}
+
+func TestListCursorErrors(t *testing.T) {
+	ts := startTestServer(t)
+	for i := 0; i < 3; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	}
+	var page NotificationsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications?limit=1", nil), &page)
+
+	for _, query := range []string{
+		"?after=not-a-cursor",
+		// 並び順が異なるカーソルは使えない
+		"?sort=priority&after=" + url.QueryEscape(page.NextCursor),
+		"?limit=0",
+	} {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications"+query, nil)
+	}
+}
+
+func TestListHead(t *testing.T) {
+	ts := startTestServer(t)
+	first := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+first.ID+"/read", nil)
+
+	get, _ := ts.request(t, http.MethodGet, "/api/notifications", nil)
+	head, body := ts.request(t, http.MethodHead, "/api/notifications", nil)
+	if head.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Fatalf("HEAD: status %d, body %q, want 200 without a body", head.StatusCode, body)
+	}
+	if got := head.Header.Get(unreadCountHeader); got != "1" {
+		t.Errorf("%s = %q, want 1", unreadCountHeader, got)
+	}
+	for _, name := range []string{"ETag", "Content-Type", unreadCountHeader} {
+		if head.Header.Get(name) == "" || head.Header.Get(name) != get.Header.Get(name) {
+			t.Errorf("%s: HEAD %q, GET %q", name, head.Header.Get(name), get.Header.Get(name))
+		}
+	}
+
+	res, body := ts.request(t, http.MethodHead, "/api/notifications", nil, "If-None-Match", get.Header.Get("ETag"))
+	if res.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("conditional HEAD: status %d, body %q, want 304", res.StatusCode, body)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ts := startTestServer(t)
+	var got VersionResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/version", nil), &got)
+	if got != (VersionResponse{Version: "dev", Commit: "dev", BuildTime: "dev"}) {
+		t.Errorf("default version = %+v, want dev", got)
+	}
+
+	// -ldflags -Xで埋め込んだ場合と同じ値を設定する
+	saved := buildInfo()
+	version, commit, buildTime = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	t.Cleanup(func() { version, commit, buildTime = saved.Version, saved.Commit, saved.BuildTime })
+	want := VersionResponse{Version: "v1.2.3", Commit: "abc1234", BuildTime: "2024-01-02T03:04:05Z"}
+
+	got = VersionResponse{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/version", nil), &got)
+	if got != want {
+		t.Errorf("version = %+v, want %+v", got, want)
+	}
+	var health struct {
+		Build VersionResponse `json:"build"`
+	}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health", nil), &health)
+	if health.Build != want {
+		t.Errorf("health build = %+v, want %+v", health.Build, want)
+	}
+}
+
+func TestNotificationActions(t *testing.T) {
+	callbacks := make(chan ActionCallbackEvent, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ActionCallbackEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid callback payload: %v", err)
+		}
+		callbacks <- event
+	}))
+	t.Cleanup(callback.Close)
+
+	ts := startTestServer(t)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Actions: []Action{
+		{ID: "approve", Label: "Approve", CallbackURL: callback.URL},
+		{ID: "dismiss", Label: "Dismiss"},
+	}})
+	path := "/api/notifications/" + created.ID + "/action"
+
+	t.Run("undefined action", func(t *testing.T) {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, path, TakeActionRequest{ActionID: "delete"})
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, path, map[string]string{})
+		ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/notifications/missing/action", TakeActionRequest{ActionID: "approve"})
+	})
+
+	t.Run("without callback", func(t *testing.T) {
+		ts.expectStatus(t, http.StatusOK, http.MethodPost, path, TakeActionRequest{ActionID: "dismiss"})
+		var got Notification
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &got)
+		if got.ActionTaken != "dismiss" || got.ActionTakenAt == nil {
+			t.Errorf("recorded action = %q at %v", got.ActionTaken, got.ActionTakenAt)
+		}
+		select {
+		case event := <-callbacks:
+			t.Errorf("unexpected callback %+v", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		ts.expectStatus(t, http.StatusOK, http.MethodPost, path, TakeActionRequest{ActionID: "approve"})
+		select {
+		case event := <-callbacks:
+			if event.NotificationID != created.ID || event.ActionID != "approve" || !event.Timestamp.Equal(TestServerStart) {
+				t.Errorf("callback = %+v", event)
+			}
+		case <-time.After(wsTestTimeout):
+			t.Fatal("callback was not invoked")
+		}
+	})
+}
+
+func TestValidateActions(t *testing.T) {
+	for _, actions := range [][]Action{
+		{{Label: "No ID"}},
+		{{ID: "a", Label: "A"}, {ID: "a", Label: "B"}},
+		{{ID: "a"}},
+		{{ID: "a", Label: "A", CallbackURL: "ftp://example.com"}},
+		{{ID: "a", Label: "A", CallbackURL: "/relative"}},
+	} {
+		if err := validateActions(actions); err == nil {
+			t.Errorf("validateActions(%+v) = nil, want an error", actions)
+		}
+	}
+}
+
+func TestMarkReadBefore(t *testing.T) {
+	ts := startTestServer(t)
+	var created []CreateNotificationResponse
+	for i := 0; i < 4; i++ {
+		created = append(created, ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}))
+		ts.Clock.Advance(time.Minute)
+	}
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	// 2件目の作成時刻ちょうどの通知は対象外
+	cutoff := url.QueryEscape(TestServerStart.Add(time.Minute).Format(time.RFC3339))
+	var resp MarkReadBeforeResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/read?before="+cutoff, nil), &resp)
+	if resp.Marked != 1 {
+		t.Errorf("marked = %d, want 1", resp.Marked)
+	}
+	if msg := client.next(t, "notification_read"); msg.NotificationID != created[0].ID {
+		t.Errorf("notification_read for %s, want %s", msg.NotificationID, created[0].ID)
+	}
+
+	cutoff = url.QueryEscape(TestServerStart.Add(150 * time.Second).Format(time.RFC3339))
+	resp = MarkReadBeforeResponse{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/read?before="+cutoff, nil), &resp)
+	if resp.Marked != 2 {
+		t.Errorf("marked = %d, want 2 (already read notifications are not counted)", resp.Marked)
+	}
+	if got := ts.listIDs(t, "?states=unread"); !slicesEqual(got, []string{created[3].ID}) {
+		t.Errorf("unread = %v, want only the notification after the cutoff", got)
+	}
+	if got := ts.Service.CountUnreadNotifications(); got != 1 {
+		t.Errorf("unread count = %d, want 1", got)
+	}
+
+	for _, query := range []string{"", "?before=yesterday", "?before=2024-01-02"} {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPut, "/api/notifications/read"+query, nil)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	ts := startTestServer(t)
+	tests := []struct {
+		name string
+		path string
+		body any
+		want []FieldError
+	}{
+		{"missing title", "/api/notifications", `{"message": "m"}`, []FieldError{{Field: "title", Reason: "required"}}},
+		{"missing message", "/api/notifications", `{"title": "t"}`, []FieldError{{Field: "message", Reason: "required"}}},
+		{"missing both", "/api/notifications", `{}`, []FieldError{{Field: "title", Reason: "required"}, {Field: "message", Reason: "required"}}},
+		{"wrong type", "/api/notifications", `{"title": 1, "message": "m"}`, []FieldError{{Field: "title", Reason: "must be string"}}},
+		{"validate endpoint", "/api/notifications/validate", `{"title": "t"}`, []FieldError{{Field: "message", Reason: "required"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			decode(t, ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, tt.path, tt.body), &resp)
+			if resp.Error != "validation failed" {
+				t.Errorf("error = %q, want validation failed", resp.Error)
+			}
+			if len(resp.Errors) != len(tt.want) {
+				t.Fatalf("errors = %+v, want %+v", resp.Errors, tt.want)
+			}
+			for i := range tt.want {
+				if resp.Errors[i] != tt.want[i] {
+					t.Errorf("errors[%d] = %+v, want %+v", i, resp.Errors[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	// 構文が不正な場合はフィールドを特定できない
+	var resp ErrorResponse
+	decode(t, ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", `{"title": `), &resp)
+	if resp.Error == "" || len(resp.Errors) != 0 {
+		t.Errorf("malformed body: %+v", resp)
+	}
+}
+
+func TestCountByFilter(t *testing.T) {
+	ts := startTestServer(t)
+	for _, req := range []CreateNotificationRequest{
+		{Title: "1", Message: "m", Category: "deploy", Priority: PriorityHigh, Tags: []string{"ci"}},
+		{Title: "2", Message: "m", Category: "deploy", Priority: PriorityLow},
+		{Title: "3", Message: "m", Category: "alert", Priority: PriorityHigh, Tags: []string{"ci"}},
+		{Title: "4", Message: "m", Category: "alert", Priority: PriorityCritical},
+		{Title: "5", Message: "m", Category: "deploy", Priority: PriorityHigh},
+	} {
+		ts.create(t, req)
+		ts.Clock.Advance(time.Minute)
+	}
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/2/read", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/4/archive", nil)
+
+	at := func(minutes int) string {
+		return url.QueryEscape(TestServerStart.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339))
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"?category=deploy", 2},
+		{"?category=deploy&read=any", 3},
+		{"?category=deploy&read=true", 1},
+		{"?priority=high&tag=ci", 2},
+		{"?category=alert&priority=high&tag=ci", 1},
+		{"?since=" + at(2), 2},
+		{"?since=" + at(1) + "&until=" + at(4) + "&read=any", 2},
+		{"?archived=true&read=any", 1},
+		{"?category=none", 0},
+	}
+	for _, tt := range tests {
+		var resp CountResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/count"+tt.query, nil), &resp)
+		if resp.Count != tt.want || resp.Unread != 3 {
+			t.Errorf("count%s = %d (unread %d), want %d (unread 3)", tt.query, resp.Count, resp.Unread, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?priority=urgent", "?since=yesterday", "?read=maybe", "?archived=yes"} {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications/count"+query, nil)
+	}
+}
+
+func TestValidateNotification(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.AllowedCategories = []string{"deploy"}
+		cfg.Service.MaxTags = 2
+	})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	var valid ValidateResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/validate", CreateNotificationRequest{
+		Title: "t", Message: "m", Priority: PriorityHigh, Category: "deploy", Tags: []string{"ci"},
+		Actions:     []Action{{ID: "open", Label: "Open", CallbackURL: "https://example.com/cb"}},
+		Attachments: []Attachment{{URL: "https://example.com/a.png", ContentType: "image/png"}},
+	}), &valid)
+	if !valid.Valid {
+		t.Error("valid = false for a valid payload")
+	}
+	// 検証のみで保存や配信はしない
+	if got := ts.listIDs(t, ""); len(got) != 0 {
+		t.Errorf("validated payload was stored: %v", got)
+	}
+	client.expectNone(t, "notification", 50*time.Millisecond)
+
+	tests := []struct {
+		name string
+		req  CreateNotificationRequest
+		want string
+	}{
+		{"priority", CreateNotificationRequest{Title: "t", Message: "m", Priority: "urgent"}, "priority"},
+		{"category", CreateNotificationRequest{Title: "t", Message: "m", Category: "system"}, "category"},
+		{"tags", CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy", Tags: []string{"a", "b", "c"}}, "tags"},
+		{"callback url", CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy", Actions: []Action{{ID: "a", Label: "A", CallbackURL: "ftp://x"}}}, "actions"},
+		{"attachment url", CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy", Attachments: []Attachment{{URL: "x", ContentType: "text/plain"}}}, "attachments"},
+		{"sound", CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy", Sound: "bell"}, "sound"},
+		{"ttl", CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy", TTL: "-1m"}, "ttl"},
+		{"missing title", CreateNotificationRequest{Message: "m"}, "title"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			decode(t, ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications/validate", tt.req), &resp)
+			if resp.Error != "validation failed" || len(resp.Errors) != 1 || resp.Errors[0].Field != tt.want || resp.Errors[0].Reason == "" {
+				t.Errorf("response = %+v, want one error for %s", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateFieldErrorsMatchValidate(t *testing.T) {
+	// 作成、キュー経由の作成、検証のいずれも同じ形式でフィールドのエラーを返す
+	direct := startTestServer(t)
+	queued := startTestServer(t, func(cfg *testConfig) { cfg.Handler.Ingest = IngestConfig{QueueSize: 10} })
+	req := CreateNotificationRequest{Title: "t", Message: "m", Priority: "urgent"}
+	want := FieldError{Field: "priority", Reason: "invalid priority: urgent"}
+	for _, tt := range []struct {
+		name string
+		ts   *TestServer
+		path string
+	}{
+		{"create", direct, "/api/notifications"},
+		{"ingest", queued, "/api/notifications"},
+		{"validate", direct, "/api/notifications/validate"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			decode(t, tt.ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, tt.path, req), &resp)
+			if resp.Error != "validation failed" || len(resp.Errors) != 1 || resp.Errors[0] != want {
+				t.Errorf("response = %+v, want %+v", resp, want)
+			}
+		})
+	}
+
+	// 保存に失敗した場合はリクエストの誤りではない
+	t.Run("repository failure", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) {
+			cfg.Repository = func() NotificationRepository {
+				return &failingRepository{InMemoryNotificationRepository: newTestRepository(), fail: true}
+			}
+		})
+		var resp ErrorResponse
+		decode(t, ts.expectStatus(t, http.StatusInternalServerError, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"}), &resp)
+		if resp.Error == "" || len(resp.Errors) != 0 {
+			t.Errorf("response = %+v", resp)
+		}
+	})
+}
+
+func TestDedupeNotifications(t *testing.T) {
+	// 1, 3, 4 と 2, 5 がそれぞれ重複している
+	createSet := func(t *testing.T, ts *TestServer) {
+		t.Helper()
+		for _, n := range []struct {
+			title string
+			after time.Duration
+		}{{"A", time.Minute}, {"B", time.Minute}, {"A", 58 * time.Minute}, {"A", time.Minute}, {"B", time.Minute}, {"C", 0}} {
+			ts.create(t, CreateNotificationRequest{Title: n.title, Message: "m"})
+			ts.Clock.Advance(n.after)
+		}
+	}
+	checkGroups := func(t *testing.T, got, want []DedupeGroup) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("groups = %+v, want %+v", got, want)
+		}
+		for i := range want {
+			if got[i].Kept != want[i].Kept || !slicesEqual(got[i].Deleted, want[i].Deleted) {
+				t.Errorf("groups[%d] = %+v, want %+v", i, got[i], want[i])
+			}
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		ts := startTestServer(t)
+		createSet(t, ts)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		var resp DedupeResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/dedupe", nil), &resp)
+		// 各グループで最新の通知を残す
+		checkGroups(t, resp.Groups, []DedupeGroup{{Kept: "5", Deleted: []string{"2"}}, {Kept: "4", Deleted: []string{"3", "1"}}})
+		if resp.Deleted != 3 {
+			t.Errorf("deleted = %d, want 3", resp.Deleted)
+		}
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"6", "5", "4"}) {
+			t.Errorf("survivors = %v, want [6 5 4]", got)
+		}
+		for _, want := range []string{"2", "3", "1"} {
+			if msg := client.next(t, "notification_deleted"); msg.NotificationID != want {
+				t.Errorf("notification_deleted for %s, want %s", msg.NotificationID, want)
+			}
+		}
+
+		// 重複がなければ何も削除しない
+		resp = DedupeResponse{}
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/dedupe", nil), &resp)
+		if len(resp.Groups) != 0 || resp.Deleted != 0 {
+			t.Errorf("second dedupe = %+v, want nothing merged", resp)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		ts := startTestServer(t)
+		createSet(t, ts)
+		var resp DedupeResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/dedupe?window=10m", nil), &resp)
+		checkGroups(t, resp.Groups, []DedupeGroup{{Kept: "3", Deleted: []string{"1"}}})
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"6", "5", "4", "3", "2"}) {
+			t.Errorf("survivors = %v", got)
+		}
+	})
+
+	t.Run("invalid window", func(t *testing.T) {
+		ts := startTestServer(t)
+		for _, window := range []string{"soon", "0s", "-1m"} {
+			ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications/dedupe?window="+window, nil)
+		}
+	})
+}
+
+// openStream は/api/streamに接続し、受信したnotificationイベントをチャネルに送る
+// レスポンスを返した時点で購読は登録済み
+func openStream(t *testing.T, ts *TestServer, query string) <-chan Notification {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/stream"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		res.Body.Close()
+		t.Fatalf("stream%s: status %d, Content-Type %q", query, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	events := make(chan Notification, 16)
+	go func() {
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var n Notification
+			if err := json.Unmarshal([]byte(data), &n); err != nil {
+				t.Errorf("invalid stream event %q: %v", data, err)
+				continue
+			}
+			events <- n
+		}
+	}()
+	return events
+}
+
+func TestFilteredStream(t *testing.T) {
+	ts := startTestServer(t)
+	filtered := openStream(t, ts, "?category=deploy&priority=high")
+	tagged := openStream(t, ts, "?tag=ci")
+	user := openStream(t, ts, "?user_id=bob")
+	all := openStream(t, ts, "")
+
+	var created []string
+	for _, req := range []CreateNotificationRequest{
+		{Title: "t", Message: "m", Category: "deploy", Priority: PriorityHigh},
+		{Title: "t", Message: "m", Category: "deploy", Priority: PriorityLow, Tags: []string{"ci"}},
+		{Title: "t", Message: "m", Category: "system", Priority: PriorityHigh, UserID: "alice"},
+		{Title: "t", Message: "m", Category: "deploy", Priority: PriorityHigh, Tags: []string{"ci"}, UserID: "bob"},
+	} {
+		created = append(created, ts.create(t, req).ID)
+	}
+
+	tests := []struct {
+		name   string
+		events <-chan Notification
+		want   []string
+	}{
+		{"category and priority", filtered, []string{created[0], created[3]}},
+		{"tag", tagged, []string{created[1], created[3]}},
+		{"user", user, []string{created[0], created[1], created[3]}},
+		{"unfiltered", all, created},
+	}
+	for _, tt := range tests {
+		var got []string
+		for range tt.want {
+			select {
+			case n := <-tt.events:
+				got = append(got, n.ID)
+			case <-time.After(wsTestTimeout):
+				t.Fatalf("%s: received %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		if !slicesEqual(got, tt.want) {
+			t.Errorf("%s: received %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// 一致しない通知は届かない
+	select {
+	case n := <-filtered:
+		t.Errorf("filtered stream received %s", n.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/stream?priority=urgent", nil)
+}
+
+func TestPartialUpdates(t *testing.T) {
+	ts := startTestServer(t)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Tags: []string{"ci"}, Metadata: map[string]string{"team": "api"}})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	base := "/api/notifications/" + created.ID
+
+	update := func(t *testing.T, method, path string, body any, changed bool) Notification {
+		t.Helper()
+		var n Notification
+		decode(t, ts.expectStatus(t, http.StatusOK, method, base+path, body), &n)
+		if changed {
+			if msg := client.next(t, "notification_updated"); msg.Notification.Version != n.Version {
+				t.Errorf("broadcast version %d, want %d", msg.Notification.Version, n.Version)
+			}
+		} else {
+			// 変更がない場合はブロードキャストしない
+			client.expectNone(t, "notification_updated", 50*time.Millisecond)
+		}
+		return n
+	}
+
+	t.Run("tags", func(t *testing.T) {
+		n := update(t, http.MethodPost, "/tags/deploy", nil, true)
+		if !slicesEqual(n.Tags, []string{"ci", "deploy"}) {
+			t.Errorf("tags after adding = %v", n.Tags)
+		}
+		version := n.Version
+		if n = update(t, http.MethodPost, "/tags/deploy", nil, false); n.Version != version {
+			t.Errorf("adding an existing tag changed the version to %d", n.Version)
+		}
+		if n = update(t, http.MethodDelete, "/tags/missing", nil, false); n.Version != version || !slicesEqual(n.Tags, []string{"ci", "deploy"}) {
+			t.Errorf("removing a missing tag: version %d, tags %v", n.Version, n.Tags)
+		}
+		if n = update(t, http.MethodDelete, "/tags/ci", nil, true); !slicesEqual(n.Tags, []string{"deploy"}) {
+			t.Errorf("tags after removing = %v", n.Tags)
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		n := update(t, http.MethodPut, "/metadata/env", SetMetadataRequest{Value: "prod"}, true)
+		if n.Metadata["env"] != "prod" || n.Metadata["team"] != "api" {
+			t.Errorf("metadata after setting = %v", n.Metadata)
+		}
+		update(t, http.MethodPut, "/metadata/env", SetMetadataRequest{Value: "prod"}, false)
+		if n = update(t, http.MethodPut, "/metadata/env", SetMetadataRequest{Value: "staging"}, true); n.Metadata["env"] != "staging" {
+			t.Errorf("metadata after overwriting = %v", n.Metadata)
+		}
+		update(t, http.MethodDelete, "/metadata/missing", nil, false)
+		if n = update(t, http.MethodDelete, "/metadata/env", nil, true); len(n.Metadata) != 1 || n.Metadata["team"] != "api" {
+			t.Errorf("metadata after unsetting = %v", n.Metadata)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/notifications/missing/tags/ci", nil)
+		ts.expectStatus(t, http.StatusNotFound, http.MethodDelete, "/api/notifications/missing/metadata/env", nil)
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPut, base+"/metadata/%20env", SetMetadataRequest{Value: "prod"})
+		ts.expectStatus(t, http.StatusConflict, http.MethodPost, base+"/tags/new", nil, "If-Match", `"1"`)
+	})
+}
+
+func TestListLimits(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Handler.DefaultLimit = 2
+		cfg.Handler.MaxLimit = 3
+	})
+	for i := 0; i < 5; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		ts.Clock.Advance(time.Second)
+	}
+
+	tests := []struct {
+		query   string
+		want    []string
+		clamped string
+	}{
+		{"", []string{"5", "4"}, ""},
+		{"?limit=3", []string{"5", "4", "3"}, ""},
+		{"?limit=1", []string{"5"}, ""},
+		{"?limit=100", []string{"5", "4", "3"}, "3"},
+	}
+	for _, tt := range tests {
+		res, body := ts.request(t, http.MethodGet, "/api/notifications"+tt.query, nil)
+		var list NotificationsResponse
+		decode(t, body, &list)
+		if got := ids(list.Notifications); !slicesEqual(got, tt.want) {
+			t.Errorf("list%s = %v, want %v", tt.query, got, tt.want)
+		}
+		if got := res.Header.Get(limitClampedHeader); got != tt.clamped {
+			t.Errorf("list%s: %s = %q, want %q", tt.query, limitClampedHeader, got, tt.clamped)
+		}
+		if list.NextCursor == "" {
+			t.Errorf("list%s: next_cursor is empty with more notifications", tt.query)
+		}
+	}
+}
+
+func TestValidateListLimits(t *testing.T) {
+	tests := []struct {
+		cfg HandlerConfig
+		ok  bool
+	}{
+		{HandlerConfig{}, true},
+		{HandlerConfig{DefaultLimit: 50}, true},
+		{HandlerConfig{DefaultLimit: 50, MaxLimit: 100}, true},
+		{HandlerConfig{DefaultLimit: 100, MaxLimit: 100}, true},
+		{HandlerConfig{DefaultLimit: 101, MaxLimit: 100}, false},
+		{HandlerConfig{MaxLimit: 100}, false},
+		{HandlerConfig{DefaultLimit: -1}, false},
+		{HandlerConfig{DefaultLimit: 1, MaxLimit: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("default %d, max %d: Validate() = %v, want ok %v", tt.cfg.DefaultLimit, tt.cfg.MaxLimit, err, tt.ok)
+		}
+	}
+}
+
+func TestLatestNotification(t *testing.T) {
+	ts := startTestServer(t)
+	if res, body := ts.request(t, http.MethodGet, "/api/notifications/latest", nil); res.StatusCode != http.StatusNoContent || len(body) != 0 {
+		t.Fatalf("empty: status %d, body %q, want 204", res.StatusCode, body)
+	}
+
+	deploy := ts.create(t, CreateNotificationRequest{Title: "deploy", Message: "m", Category: "deploy"})
+	ts.Clock.Advance(time.Second)
+	ts.create(t, CreateNotificationRequest{Title: "backup", Message: "m", Category: "backup"})
+	ts.Clock.Advance(time.Second)
+	newest := ts.create(t, CreateNotificationRequest{Title: "alert", Message: "m", Category: "alert"})
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+newest.ID+"/read", nil)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", newest.ID},
+		{"?read=any", newest.ID},
+		{"?read=true", newest.ID},
+		{"?read=false", "2"},
+		{"?category=deploy", deploy.ID},
+		{"?category=deploy&read=true", ""},
+		{"?category=unknown", ""},
+	}
+	for _, tt := range tests {
+		res, body := ts.request(t, http.MethodGet, "/api/notifications/latest"+tt.query, nil)
+		if tt.want == "" {
+			if res.StatusCode != http.StatusNoContent {
+				t.Errorf("%q: status = %d, want 204", tt.query, res.StatusCode)
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%q: status = %d: %s", tt.query, res.StatusCode, body)
+			continue
+		}
+		var latest NotificationDetailResponse
+		decode(t, body, &latest)
+		if latest.ID != tt.want {
+			t.Errorf("%q: latest = %s, want %s", tt.query, latest.ID, tt.want)
+		}
+	}
+
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodGet, "/api/notifications/latest?read=maybe", nil)
+}
@@ -1,400 +1,6276 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
 )
 
 // Domain models
 type Notification struct {
-	ID        string    `json:"id"`
-	Title     string    `json:"title"`
-	Message   string    `json:"message"`
-	Type      string    `json:"type"`
-	Timestamp time.Time `json:"timestamp"`
-	Read      bool      `json:"read"`
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Message    string     `json:"message"`
+	Type       string     `json:"type"`
+	Priority   string     `json:"priority"`
+	Category   string     `json:"category,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Sound      string     `json:"sound"`
+	UserID     string     `json:"user_id,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Read       bool       `json:"read"`
+	Archived   bool       `json:"archived"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// ピン留めした通知は並び順に関わらず一覧の先頭に表示する
+	Pinned bool `json:"pinned"`
+	// 作成時に1で、状態が変わるたびに増える。If-Matchでの競合検出に使う
+	Version int `json:"version"`
+	// クライアントにackを求めるかどうかのヒント
+	RequiresAck bool `json:"requires_ack,omitempty"`
+	// trueの場合、1つ以上のクライアントに配信した時点で既読にする
+	AutoRead bool `json:"auto_read_on_delivery,omitempty"`
+	// 設定されている場合、この時刻を過ぎると一覧から除外され、削除される
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// クライアントに表示するボタン。実行されたアクションはActionTakenに記録する
+	Actions       []Action   `json:"actions,omitempty"`
+	ActionTaken   string     `json:"action_taken,omitempty"`
+	ActionTakenAt *time.Time `json:"action_taken_at,omitempty"`
+	// 参照するファイルや画像。内容はサーバーに保存しない
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// 作成元が自由に設定できるキーと値。キーごとに変更できる
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// 一覧のプレビューでメッセージが省略された場合にtrue
+	Truncated bool `json:"truncated,omitempty"`
+	// 設定されている場合、ブロードキャスト時にカテゴリの色を付与する (保存はしない)
+	Color string `json:"color,omitempty"`
+	// ackされないためにエスカレーションで再送した回数 (保存はしない)
+	Escalation int `json:"escalation,omitempty"`
 }
 
-// Request/Response types
-type CreateNotificationRequest struct {
-	Title   string `json:"title" binding:"required"`
-	Message string `json:"message" binding:"required"`
-	Type    string `json:"type"`
+// 通知の添付ファイルへの参照
+type Attachment struct {
+	// Dataを指定した場合は省略できる
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"content_type"`
+	// バイト数。0の場合は不明
+	Size int64 `json:"size,omitempty"`
+	// 小さなファイルを埋め込む場合の、base64でエンコードした内容
+	Data string `json:"data,omitempty"`
 }
 
-type NotificationsResponse struct {
-	Notifications []Notification `json:"notifications"`
+// 通知のボタン。CallbackURLが設定されている場合、実行時にPOSTする
+type Action struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
-type SuccessResponse struct {
-	Success bool `json:"success"`
+// サーバー起動時に設定され、以降は変更されない
+var redactLogs bool
+
+// LogValue はログに出力する通知の内容を返す
+// redactLogsがtrueの場合はタイトルとメッセージを出力せず、タイトルの長さのみを出力する
+func (n Notification) LogValue() slog.Value {
+	if redactLogs {
+		return slog.GroupValue(
+			slog.String("id", n.ID),
+			slog.Int("title_length", utf8.RuneCountInString(n.Title)),
+			slog.String("category", n.Category),
+		)
+	}
+	return slog.GroupValue(
+		slog.String("id", n.ID),
+		slog.String("title", n.Title),
+		slog.String("message", n.Message),
+		slog.String("category", n.Category),
+	)
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// Notification priorities
+const (
+	PriorityLow      = "low"
+	PriorityNormal   = "normal"
+	PriorityHigh     = "high"
+	PriorityCritical = "critical"
+)
+
+// 数値が大きいほど優先度が高い
+var priorityRanks = map[string]int{
+	PriorityLow:      0,
+	PriorityNormal:   1,
+	PriorityHigh:     2,
+	PriorityCritical: 3,
 }
 
-// WebSocket message types
-type WSMessage struct {
-	Type           string        `json:"type"`
-	Notification   *Notification `json:"notification,omitempty"`
-	Notifications  []Notification `json:"notifications,omitempty"`
-	NotificationID string        `json:"notification_id,omitempty"`
+// Notification sound hints
+const (
+	SoundDefault = "default"
+	SoundSilent  = "silent"
+	SoundAlert   = "alert"
+)
+
+var validSounds = map[string]bool{
+	SoundDefault: true,
+	SoundSilent:  true,
+	SoundAlert:   true,
 }
 
-// Repository interface
-type NotificationRepository interface {
-	GetUnread() []Notification
-	GetAll() []Notification
-	Create(notification Notification) error
-	MarkAsRead(id string) error
-	Clear() error
+// Priority policy
+// リクエストで省略された場合に、優先度に応じて適用する値
+type PriorityHints struct {
+	// 空の場合はdefault
+	Sound       string
+	RequiresAck bool
+	// 0の場合は期限切れにしない
+	TTL time.Duration
 }
 
-// Service interface
-type NotificationService interface {
-	GetUnreadNotifications() []Notification
-	CreateNotification(title, message, notifType string) (*Notification, error)
-	MarkNotificationAsRead(id string) error
-	ClearAllNotifications() error
+type PriorityHintsResponse struct {
+	Sound       string `json:"sound"`
+	RequiresAck bool   `json:"requires_ack"`
+	TTL         string `json:"ttl,omitempty"`
 }
 
-// WebSocket manager interface
-type WSManager interface {
-	AddClient(conn *websocket.Conn)
-	RemoveClient(conn *websocket.Conn)
-	BroadcastNotification(notification Notification)
-	HandleMessage(conn *websocket.Conn, msg WSMessage) error
+type PrioritiesConfigResponse struct {
+	Priorities map[string]PriorityHintsResponse `json:"priorities"`
 }
 
-// In-memory repository implementation
-type InMemoryNotificationRepository struct {
-	notifications []Notification
-	mu           sync.RWMutex
+// List options
+type ListOptions struct {
+	SortByPriority bool
+	// trueの場合はアーカイブ済みの通知を返す
+	Archived bool
+	// trueの場合はメッセージを省略したプレビューを返す
+	Preview bool
+	// 0より大きい場合、これより古い通知を除外する
+	MaxAge time.Duration
+	// アーカイブされていない通知のうち、一覧に含める既読状態 (両方falseの場合は未読のみ)
+	States ReadStates
+	// 空でない場合、作成元が一致する通知のみを返す
+	Source string
+	// カテゴリ・優先度・タグ・期間での絞り込み (ReadとArchivedは使わない)
+	Filter NotificationFilter
 }
 
-func NewInMemoryNotificationRepository() *InMemoryNotificationRepository {
-	return &InMemoryNotificationRepository{
-		notifications: []Notification{
-			{
-				ID:        "1",
-				Title:     "システム起動",
-				Message:   "Notibagが正常に起動しました",
-				Type:      "info",
-				Timestamp: time.Now().Add(-5 * time.Minute),
-				Read:      false,
-			},
-			{
-				ID:        "2",
-				Title:     "重要な更新",
-				Message:   "新しいバージョンが利用可能です。アップデートを確認してください。",
-				Type:      "warning",
-				Timestamp: time.Now().Add(-2 * time.Minute),
-				Read:      false,
-			},
-		},
+// Notification filter
+// 空のフィールドは条件にしない
+type NotificationFilter struct {
+	// nilの場合は既読状態で絞り込まない
+	Read     *bool
+	Archived bool
+	Category string
+	Priority string
+	Tag      string
+	Source   string
+	// 作成日時がSince以降、Until より前の通知に絞り込む
+	Since time.Time
+	Until time.Time
+	// ゼロでない場合、この時刻に期限切れの通知を除外する
+	ExpiredAt time.Time
+}
+
+// Matches は通知が全ての条件に一致するかを返す
+func (f NotificationFilter) Matches(n Notification) bool {
+	if n.Archived != f.Archived {
+		return false
 	}
+	if f.Read != nil && n.Read != *f.Read {
+		return false
+	}
+	if !f.ExpiredAt.IsZero() && expired(n, f.ExpiredAt) {
+		return false
+	}
+	return f.matchesAttributes(n)
 }
 
-func (r *InMemoryNotificationRepository) GetUnread() []Notification {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	
-	unread := make([]Notification, 0)
-	for _, notification := range r.notifications {
-		if !notification.Read {
-			unread = append(unread, notification)
-		}
+// matchesAttributes は既読・アーカイブの状態以外の条件を確認する
+func (f NotificationFilter) matchesAttributes(n Notification) bool {
+	if f.Category != "" && n.Category != f.Category {
+		return false
 	}
-	return unread
+	if f.Priority != "" && n.Priority != f.Priority {
+		return false
+	}
+	if f.Tag != "" && !slices.Contains(n.Tags, f.Tag) {
+		return false
+	}
+	if f.Source != "" && n.Source != f.Source {
+		return false
+	}
+	if !f.Since.IsZero() && n.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !n.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
 }
 
-func (r *InMemoryNotificationRepository) GetAll() []Notification {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	
-	result := make([]Notification, len(r.notifications))
-	copy(result, r.notifications)
-	return result
+type ReadStates struct {
+	Unread bool
+	Read   bool
 }
 
-func (r *InMemoryNotificationRepository) Create(notification Notification) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	
-	r.notifications = append([]Notification{notification}, r.notifications...)
-	return nil
+// Request/Response types
+type CreateNotificationRequest struct {
+	Title    string   `json:"title" binding:"required"`
+	Message  string   `json:"message" binding:"required"`
+	Type     string   `json:"type"`
+	Priority string   `json:"priority"`
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+	Sound    string   `json:"sound"`
+	// 省略した場合は優先度の設定に従う
+	RequiresAck *bool `json:"requires_ack"`
+	// 省略した場合は -auto-read-on-delivery の設定に従う
+	AutoRead *bool `json:"auto_read_on_delivery"`
+	// 有効期間 (例: 30m)。空の場合は優先度の設定に従う
+	TTL     string   `json:"ttl"`
+	Actions []Action `json:"actions"`
+	// 添付ファイルのURL・Content-Type・サイズ
+	Attachments []Attachment      `json:"attachments"`
+	Metadata    map[string]string `json:"metadata"`
+	// 空の場合は全ユーザー宛て
+	UserID string `json:"user_id"`
+	// 作成元のシステム。X-Notibag-Sourceヘッダーから設定する
+	Source string `json:"-"`
 }
 
-func (r *InMemoryNotificationRepository) MarkAsRead(id string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	
-	for i := range r.notifications {
-		if r.notifications[i].ID == id {
-			r.notifications[i].Read = true
-			return nil
-		}
-	}
-	return errors.New("notification not found")
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
+	// limitで打ち切った場合に、続きを取得するためのafterの値
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
-func (r *InMemoryNotificationRepository) Clear() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	
-	r.notifications = []Notification{}
-	return nil
+type DeleteNotificationsRequest struct {
+	IDs []string `json:"ids"`
 }
 
-// Service implementation
-type NotificationServiceImpl struct {
-	repo NotificationRepository
+type DeleteNotificationsResponse struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"not_found"`
 }
 
-func NewNotificationService(repo NotificationRepository) *NotificationServiceImpl {
-	return &NotificationServiceImpl{repo: repo}
+// DedupeGroup は同じ内容の通知のうち、残した最新の通知と削除した通知
+type DedupeGroup struct {
+	Kept    string   `json:"kept"`
+	Deleted []string `json:"deleted"`
 }
 
-func (s *NotificationServiceImpl) GetUnreadNotifications() []Notification {
-	return s.repo.GetUnread()
+type DedupeResponse struct {
+	Groups  []DedupeGroup `json:"groups"`
+	Deleted int           `json:"deleted"`
 }
 
-func (s *NotificationServiceImpl) CreateNotification(title, message, notifType string) (*Notification, error) {
-	if title == "" || message == "" {
-		return nil, errors.New("title and message are required")
-	}
+type CountResponse struct {
+	Unread int `json:"unread"`
+	// 絞り込みの条件に一致する件数 (条件がない場合はunreadと同じ)
+	Count int `json:"count"`
+}
 
-	if notifType == "" {
-		notifType = "info"
-	}
+type MarkReadBeforeResponse struct {
+	Marked int `json:"marked"`
+}
 
-	notification := Notification{
-		ID:        generateID(),
-		Title:     title,
-		Message:   message,
-		Type:      notifType,
-		Timestamp: time.Now(),
-		Read:      false,
-	}
-	
-	if err := s.repo.Create(notification); err != nil {
-		return nil, err
-	}
-	
-	return &notification, nil
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
 }
 
-func (s *NotificationServiceImpl) MarkNotificationAsRead(id string) error {
-	if id == "" {
-		return errors.New("notification ID is required")
-	}
-	return s.repo.MarkAsRead(id)
+type MaintenanceResponse struct {
+	Maintenance bool `json:"maintenance"`
 }
 
-func (s *NotificationServiceImpl) ClearAllNotifications() error {
-	return s.repo.Clear()
+type DrainRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+	// trueの場合、drainを開始した時点で接続中のクライアントにreconnectを送信する
+	Reconnect bool `json:"reconnect"`
 }
 
-// connWithMu wraps a websocket.Conn with a write mutex
-type connWithMu struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
+type DrainResponse struct {
+	Draining bool `json:"draining"`
+	// 全ての名前空間で接続中のクライアント数
+	Clients int `json:"clients"`
 }
 
-func (c *connWithMu) WriteJSON(v interface{}) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.conn.WriteJSON(v)
+// Create statuses
+// 作成レスポンスのstatusで、通知がどのように処理されたかを表す
+const (
+	// 保存し、1つ以上のWebSocketクライアントに送信した (201)
+	CreateStatusDelivered = "delivered"
+	// 保存したが、接続中のクライアントがいない・配信が無効なため、まだ届いていない (202)
+	CreateStatusStored = "stored"
+	// 保存したが、静音時間・おやすみモード・まとめて送信する期間のため送信を保留した (202)
+	CreateStatusHeld = "held"
+	// 同じ内容の通知が既にあるため保存せず、既存の通知を返した (200)
+	CreateStatusDuplicate = "duplicate"
+	// クールダウン中のため保存しなかった (202)
+	CreateStatusSuppressed = "suppressed"
+	// 検証のみ行い、保存と送信はキューのワーカーが行う (202)
+	CreateStatusQueued = "queued"
+)
+
+type CreateNotificationResponse struct {
+	Notification
+	Status string `json:"status"`
 }
 
-func (c *connWithMu) WritePing() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.conn.WriteMessage(websocket.PingMessage, nil)
+type SuppressedResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
 }
 
-// WebSocket manager implementation
-type WSManagerImpl struct {
-	clients  map[*websocket.Conn]*connWithMu
-	mu       sync.RWMutex
-	service  NotificationService
-	upgrader websocket.Upgrader
+// NotificationDetailResponse は通知と、受信を確認したクライアント数を返す
+type NotificationDetailResponse struct {
+	Notification
+	AckedBy int `json:"acked_by"`
 }
 
-func NewWSManager(service NotificationService) *WSManagerImpl {
-	return &WSManagerImpl{
-		clients: make(map[*websocket.Conn]*connWithMu),
-		service: service,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // 開発環境用、本番では適切に設定
-			},
-		},
-	}
+// Engagement は接続中のクライアントのうち、通知をack・既読にした割合
+type Engagement struct {
+	NotificationID string `json:"notification_id"`
+	// 通知を受け取れる (宛先に一致する) 接続中のクライアントの数
+	Clients int `json:"clients"`
+	Acked   int `json:"acked"`
+	Read    int `json:"read"`
+	// Clientsが0の場合は0
+	AckRatio  float64 `json:"ack_ratio"`
+	ReadRatio float64 `json:"read_ratio"`
 }
 
-func (w *WSManagerImpl) AddClient(conn *websocket.Conn) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.clients[conn] = &connWithMu{conn: conn}
+// CategoriesConfigResponse はクライアントの表示に使うカテゴリの設定
+type CategoriesConfigResponse struct {
+	// 空の場合は任意のカテゴリを許可する
+	Allowed []string          `json:"allowed,omitempty"`
+	Colors  map[string]string `json:"colors"`
 }
 
-func (w *WSManagerImpl) RemoveClient(conn *websocket.Conn) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	delete(w.clients, conn)
+type RebroadcastResponse struct {
+	Delivered int `json:"delivered"`
+	// 静音時間などのため送信を保留した場合はtrue
+	Held bool `json:"held,omitempty"`
 }
 
-func (w *WSManagerImpl) GetClient(conn *websocket.Conn) *connWithMu {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
-	return w.clients[conn]
+type SuccessResponse struct {
+	Success bool `json:"success"`
 }
 
-func (w *WSManagerImpl) BroadcastNotification(notification Notification) {
-	message := WSMessage{
-		Type:         "notification",
-		Notification: &notification,
-	}
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+	// リクエストボディの検証に失敗した場合の、フィールドごとのエラー
+	Errors []FieldError `json:"errors,omitempty"`
+}
 
-	w.mu.RLock()
-	clients := make([]*connWithMu, 0, len(w.clients))
-	for _, c := range w.clients {
-		clients = append(clients, c)
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type ValidateResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// WebSocket message types
+type WSMessage struct {
+	Type           string        `json:"type"`
+	Notification   *Notification `json:"notification,omitempty"`
+	Notifications  []Notification `json:"notifications,omitempty"`
+	NotificationID string        `json:"notification_id,omitempty"`
+	Categories     []string      `json:"categories,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	Maintenance    *bool         `json:"maintenance,omitempty"`
+	Read           *bool         `json:"read,omitempty"`
+	Pinned         *bool         `json:"pinned,omitempty"`
+	Time           *time.Time    `json:"time,omitempty"`
+	Seq            uint64        `json:"seq,omitempty"`
+	Count          *int          `json:"count,omitempty"`
+	// authで送信するAPIキー
+	Token string `json:"token,omitempty"`
+}
+
+// newReadStateMessage は既読状態の変更を他のクライアントに伝えるメッセージを生成する
+func newReadStateMessage(id string, read bool) WSMessage {
+	return WSMessage{
+		Type:           "notification_read",
+		NotificationID: id,
+		Read:           &read,
 	}
-	w.mu.RUnlock()
+}
 
-	for _, c := range clients {
-		if err := c.WriteJSON(message); err != nil {
-			log.Printf("Error broadcasting to client: %v", err)
-			c.conn.Close()
-		}
+// newPinStateMessage はピン留め状態の変更を伝えるメッセージを生成する
+func newPinStateMessage(id string, pinned bool) WSMessage {
+	return WSMessage{
+		Type:           "notification_pinned",
+		NotificationID: id,
+		Pinned:         &pinned,
 	}
 }
 
-func (w *WSManagerImpl) HandleMessage(conn *websocket.Conn, msg WSMessage) error {
-	switch msg.Type {
-	case "get_notifications":
-		notifications := w.service.GetUnreadNotifications()
-		response := WSMessage{
-			Type:          "notifications_list",
-			Notifications: notifications,
-		}
-		c := w.GetClient(conn)
-		if c == nil {
-			return errors.New("client not found")
-		}
-		return c.WriteJSON(response)
+// WebSocket message format versions
+const (
+	// 全フィールドをomitemptyで出力する旧形式
+	WSMessageVersionLegacy = 1
+	// Typeごとに関連するフィールドのみを出力する形式
+	WSMessageVersionTyped = 2
+	// {"v":1,"type":...,"payload":{...}} のエンベロープ形式
+	WSMessageVersionEnvelope = 3
+)
 
-	case "mark_read":
-		if msg.NotificationID != "" {
-			return w.service.MarkNotificationAsRead(msg.NotificationID)
-		}
-		return errors.New("notification ID is required")
+// エンベロープ形式のバージョン (vフィールドの値)
+const wsEnvelopeVersion = 1
 
-	case "clear_all":
-		return w.service.ClearAllNotifications()
+// サーバー起動時に設定され、以降は変更されない
+var wsMessageVersion = WSMessageVersionTyped
 
-	default:
-		return fmt.Errorf("unknown message type: %s", msg.Type)
-	}
+type legacyWSMessage WSMessage
+
+type wsNotificationMessage struct {
+	Type         string        `json:"type"`
+	Notification *Notification `json:"notification"`
+	Seq          uint64        `json:"seq,omitempty"`
 }
 
-// HTTP handlers
-type NotificationHandler struct {
-	service   NotificationService
-	wsManager WSManager
+type wsNotificationsListMessage struct {
+	Type          string         `json:"type"`
+	Notifications []Notification `json:"notifications"`
+	Seq           uint64         `json:"seq,omitempty"`
 }
 
-func NewNotificationHandler(service NotificationService, wsManager WSManager) *NotificationHandler {
-	return &NotificationHandler{
-		service:   service,
-		wsManager: wsManager,
-	}
+type wsNotificationIDMessage struct {
+	Type           string `json:"type"`
+	NotificationID string `json:"notification_id"`
+	Seq            uint64 `json:"seq,omitempty"`
 }
 
-func (h *NotificationHandler) HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status":  "ok",
-		"message": "Notibag server is running",
-	})
+type wsReadStateMessage struct {
+	Type           string `json:"type"`
+	NotificationID string `json:"notification_id"`
+	Read           bool   `json:"read"`
+	Seq            uint64 `json:"seq,omitempty"`
 }
 
-func (h *NotificationHandler) CreateNotification(c *gin.Context) {
-	var req CreateNotificationRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
+type wsPinStateMessage struct {
+	Type           string `json:"type"`
+	NotificationID string `json:"notification_id"`
+	Pinned         bool   `json:"pinned"`
+	Seq            uint64 `json:"seq,omitempty"`
+}
+
+type wsHeartbeatMessage struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+}
+
+type wsUnreadCountMessage struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+type wsMaintenanceMessage struct {
+	Type        string `json:"type"`
+	Maintenance bool   `json:"maintenance"`
+	Seq         uint64 `json:"seq,omitempty"`
+}
+
+func (m WSMessage) MarshalJSON() ([]byte, error) {
+	switch wsMessageVersion {
+	case WSMessageVersionLegacy:
+		return json.Marshal(legacyWSMessage(m))
+	case WSMessageVersionEnvelope:
+		return json.Marshal(wsEnvelope{V: wsEnvelopeVersion, Type: m.Type, Seq: m.Seq, Payload: m.payload()})
 	}
 
-	notification, err := h.service.CreateNotification(req.Title, req.Message, req.Type)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		return
+	switch m.Type {
+	case "notification", "notification_updated":
+		return json.Marshal(wsNotificationMessage{Type: m.Type, Notification: m.Notification, Seq: m.Seq})
+	case "notifications_list", "notifications_batch":
+		notifications := m.Notifications
+		if notifications == nil {
+			notifications = []Notification{}
+		}
+		return json.Marshal(wsNotificationsListMessage{Type: m.Type, Notifications: notifications, Seq: m.Seq})
+	case "notification_deleted", "notification_archived":
+		return json.Marshal(wsNotificationIDMessage{Type: m.Type, NotificationID: m.NotificationID, Seq: m.Seq})
+	case "notification_read":
+		return json.Marshal(wsReadStateMessage{Type: m.Type, NotificationID: m.NotificationID, Read: m.Read != nil && *m.Read, Seq: m.Seq})
+	case "notification_pinned":
+		return json.Marshal(wsPinStateMessage{Type: m.Type, NotificationID: m.NotificationID, Pinned: m.Pinned != nil && *m.Pinned, Seq: m.Seq})
+	case "heartbeat":
+		var t time.Time
+		if m.Time != nil {
+			t = *m.Time
+		}
+		return json.Marshal(wsHeartbeatMessage{Type: m.Type, Time: t})
+	case "unread_count":
+		return json.Marshal(wsUnreadCountMessage{Type: m.Type, Count: derefInt(m.Count)})
+	case "maintenance":
+		return json.Marshal(wsMaintenanceMessage{Type: m.Type, Maintenance: m.Maintenance != nil && *m.Maintenance, Seq: m.Seq})
+	default:
+		return json.Marshal(legacyWSMessage(m))
 	}
+}
 
-	// WebSocketクライアントに通知を送信
-	h.wsManager.BroadcastNotification(*notification)
+// WebSocket message envelope
+// Payloadはtypeごとに異なる構造体で、送信時はseqをエンベロープに置く
+type wsEnvelope struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
 
-	c.JSON(http.StatusCreated, notification)
+// 受信時にpayloadをtypeに応じて後から解釈するための形式
+type wsRawEnvelope struct {
+	V       *int            `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
 }
 
-func (h *NotificationHandler) GetNotifications(c *gin.Context) {
-	notifications := h.service.GetUnreadNotifications()
-	c.JSON(http.StatusOK, NotificationsResponse{Notifications: notifications})
+type wsNotificationPayload struct {
+	Notification *Notification `json:"notification"`
 }
 
-func (h *NotificationHandler) GetAllNotifications(c *gin.Context) {
-	// デバッグ用：全ての通知を返す
-	repo := h.service.(*NotificationServiceImpl).repo
-	notifications := repo.GetAll()
-	c.JSON(http.StatusOK, NotificationsResponse{Notifications: notifications})
+type wsNotificationsPayload struct {
+	Notifications []Notification `json:"notifications"`
 }
 
-func (h *NotificationHandler) MarkAsRead(c *gin.Context) {
-	id := c.Param("id")
-	if err := h.service.MarkNotificationAsRead(id); err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+type wsNotificationIDPayload struct {
+	NotificationID string `json:"notification_id"`
 }
 
-func (h *NotificationHandler) ClearAll(c *gin.Context) {
-	if err := h.service.ClearAllNotifications(); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
-		return
-	}
-	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+type wsReadStatePayload struct {
+	NotificationID string `json:"notification_id"`
+	Read           bool   `json:"read"`
 }
 
-const (
-	pingInterval = 30 * time.Second
-	pongWait     = 45 * time.Second
-)
+type wsPinStatePayload struct {
+	NotificationID string `json:"notification_id"`
+	Pinned         bool   `json:"pinned"`
+}
 
-func (h *NotificationHandler) HandleWebSocket(c *gin.Context) {
-	conn, err := h.wsManager.(*WSManagerImpl).upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
+type wsHeartbeatPayload struct {
+	Time time.Time `json:"time"`
+}
 
-	// クライアントを登録
-	h.wsManager.AddClient(conn)
-	log.Println("WebSocket connection established")
+type wsUnreadCountPayload struct {
+	Count int `json:"count"`
+}
 
-	// 接続解除時にクライアントを削除
-	defer h.wsManager.RemoveClient(conn)
+type wsMaintenancePayload struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+type wsAuthPayload struct {
+	Token string `json:"token"`
+}
+
+type wsSubscribePayload struct {
+	Categories []string `json:"categories"`
+	Tags       []string `json:"tags"`
+}
+
+func derefInt(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// payload はエンベロープ形式で送信するtype固有の内容を返す
+func (m WSMessage) payload() interface{} {
+	switch m.Type {
+	case "notification", "notification_updated":
+		return wsNotificationPayload{Notification: m.Notification}
+	case "notifications_list", "notifications_batch":
+		notifications := m.Notifications
+		if notifications == nil {
+			notifications = []Notification{}
+		}
+		return wsNotificationsPayload{Notifications: notifications}
+	case "notification_deleted", "notification_archived":
+		return wsNotificationIDPayload{NotificationID: m.NotificationID}
+	case "notification_read":
+		return wsReadStatePayload{NotificationID: m.NotificationID, Read: m.Read != nil && *m.Read}
+	case "notification_pinned":
+		return wsPinStatePayload{NotificationID: m.NotificationID, Pinned: m.Pinned != nil && *m.Pinned}
+	case "heartbeat":
+		var t time.Time
+		if m.Time != nil {
+			t = *m.Time
+		}
+		return wsHeartbeatPayload{Time: t}
+	case "unread_count":
+		return wsUnreadCountPayload{Count: derefInt(m.Count)}
+	case "maintenance":
+		return wsMaintenancePayload{Maintenance: m.Maintenance != nil && *m.Maintenance}
+	default:
+		return nil
+	}
+}
+
+// decodeWSMessage はクライアントからのメッセージを解釈する
+// vフィールドがない場合は旧来のフラットな形式として扱う
+func decodeWSMessage(data []byte) (WSMessage, error) {
+	var envelope wsRawEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return WSMessage{}, err
+	}
+	if envelope.V == nil {
+		var msg WSMessage
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	}
+	if *envelope.V != wsEnvelopeVersion {
+		return WSMessage{}, fmt.Errorf("unsupported message version: %d", *envelope.V)
+	}
+
+	msg := WSMessage{Type: envelope.Type}
+	switch envelope.Type {
+	case "get_notifications", "clear_all":
+		return msg, nil
+	case "mark_read", "ack":
+		var p wsNotificationIDPayload
+		if err := decodePayload(envelope.Payload, &p); err != nil {
+			return WSMessage{}, err
+		}
+		msg.NotificationID = p.NotificationID
+	case "subscribe":
+		var p wsSubscribePayload
+		if err := decodePayload(envelope.Payload, &p); err != nil {
+			return WSMessage{}, err
+		}
+		msg.Categories, msg.Tags = p.Categories, p.Tags
+	case "auth":
+		var p wsAuthPayload
+		if err := decodePayload(envelope.Payload, &p); err != nil {
+			return WSMessage{}, err
+		}
+		msg.Token = p.Token
+	default:
+		return WSMessage{}, fmt.Errorf("unknown message type: %s", envelope.Type)
+	}
+	return msg, nil
+}
+
+func decodePayload(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("payload is required")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	return nil
+}
+
+// WebSocket subscription
+// 空のフィールドはその条件で絞り込まないことを表す
+type Subscription struct {
+	Categories map[string]bool
+	Tags       map[string]bool
+}
+
+func NewSubscription(categories, tags []string) *Subscription {
+	sub := &Subscription{}
+	if len(categories) > 0 {
+		sub.Categories = make(map[string]bool, len(categories))
+		for _, category := range categories {
+			sub.Categories[category] = true
+		}
+	}
+	if len(tags) > 0 {
+		sub.Tags = make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			sub.Tags[tag] = true
+		}
+	}
+	return sub
+}
+
+// UserSubscription はユーザーごとに保存する購読条件。接続時に自動で適用する
+type UserSubscription struct {
+	Categories []string `json:"categories"`
+	Tags       []string `json:"tags"`
+}
+
+func (u UserSubscription) Subscription() *Subscription {
+	return NewSubscription(u.Categories, u.Tags)
+}
+
+// Matches はカテゴリが一致し、かつタグのいずれかが一致する場合にtrueを返す
+func (s *Subscription) Matches(notification Notification) bool {
+	if s == nil {
+		return true
+	}
+	if s.Categories != nil && !s.Categories[notification.Category] {
+		return false
+	}
+	if s.Tags != nil {
+		for _, tag := range notification.Tags {
+			if s.Tags[tag] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// visibleTo はuserIDのユーザーが通知を受け取れるかを判定する
+// ユーザーが特定されていない接続は従来通り全ての通知を受け取る
+func visibleTo(notification Notification, userID string) bool {
+	return userID == "" || notification.UserID == "" || notification.UserID == userID
+}
+
+// Clock interface
+// テストで時刻とタイマーを差し替えられるようにする
+type Clock interface {
+	Now() time.Time
+	// AfterFunc はdが経過した後にfを呼び出す
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer はClock.AfterFuncで作成したタイマー
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ID generator interface
+// テストで予測できるIDを使えるようにする
+type IDGenerator interface {
+	NewID(prefix string) string
+}
+
+// timestampIDs は作成時刻と連番からIDを生成する
+type timestampIDs struct {
+	clock Clock
+}
+
+func (g timestampIDs) NewID(prefix string) string {
+	return generateID(prefix, g.clock.Now())
+}
+
+// Processor interface
+// 保存前の通知を加工 (付加情報の追加・振り分けなど) する。エラーを返すと通知の作成を拒否する
+type NotificationProcessor interface {
+	Process(ctx context.Context, notification *Notification) error
+}
+
+// Repository interface
+type NotificationRepository interface {
+	Get(id string) (Notification, error)
+	GetUnread() []Notification
+	// CountUnread は全件を走査せずに未読件数を返す
+	CountUnread() int
+	// Count は条件に一致する通知の件数を、一覧をコピーせずに数える
+	Count(filter NotificationFilter) int
+	// Latest は条件に一致する通知のうちTimestampが最も新しいものを、一覧をコピーせずに返す。一致しない場合はfalseを返す
+	Latest(filter NotificationFilter) (Notification, bool)
+	GetAll() []Notification
+	Create(notification Notification) error
+	GetArchived() []Notification
+	// ForEach は新しい順に全件を走査し、fnがエラーを返した時点で中断する
+	ForEach(fn func(Notification) error) error
+	// MarkAsRead, Archive, SetPinned はversionが0以外で現在のVersionと異なる場合、変更せずにErrVersionConflictを返す
+	MarkAsRead(id string, version int) error
+	// MarkReadBefore はcutoffより前に作成された未読の通知を既読にし、そのIDを返す
+	MarkReadBefore(cutoff time.Time) []string
+	DeleteMany(ids []string) (deleted, notFound []string)
+	Archive(id string, at time.Time, version int) error
+	ArchiveAll(at time.Time) error
+	// ArchiveForUser はuserID宛ての通知のみをアーカイブする
+	ArchiveForUser(userID string, at time.Time) error
+	SetPinned(id string, pinned bool, version int) error
+	// RecordAction は実行されたアクションを記録する。versionの扱いはMarkAsReadと同じ
+	RecordAction(id, actionID string, at time.Time, version int) error
+	// AddTag, RemoveTag, SetMetadata, UnsetMetadata は指定したタグ・キーのみを変更し、変更後の通知と変更があったかを返す
+	// versionの扱いはMarkAsReadと同じ
+	AddTag(id, tag string, version int) (Notification, bool, error)
+	RemoveTag(id, tag string, version int) (Notification, bool, error)
+	SetMetadata(id, key, value string, version int) (Notification, bool, error)
+	UnsetMetadata(id, key string, version int) (Notification, bool, error)
+	Clear() error
+	ClearForUser(userID string) error
+	// GetSubscription はユーザーの購読条件を返す。保存されていない場合はfalseを返す
+	GetSubscription(userID string) (UserSubscription, bool)
+	SetSubscription(userID string, sub UserSubscription) error
+	Ping() error
+}
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// ErrVersionConflict は指定したバージョンが現在の通知のバージョンと一致しないことを表す
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrUnknownAction は通知に定義されていないアクションが指定されたことを表す
+var ErrUnknownAction = errors.New("unknown action")
+
+// InvalidFieldError は作成する通知のどのフィールドが不正かを表す。メッセージは元のエラーのまま
+type InvalidFieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *InvalidFieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidFieldError) Unwrap() error {
+	return e.Err
+}
+
+func invalidField(field string, err error) error {
+	return &InvalidFieldError{Field: field, Err: err}
+}
+
+// Service interface
+type NotificationService interface {
+	GetNotification(id string) (*Notification, error)
+	GetUnreadNotifications(opts ListOptions) []Notification
+	CountUnreadNotifications() int
+	// CountUnreadByUser は宛先のユーザーごとの未読数を返す。全員宛ての通知は空のキーに数える
+	CountUnreadByUser() map[string]int
+	CountNotifications(filter NotificationFilter) int
+	// GetLatestNotification は期限切れを除き、条件に一致する最新の通知を返す。一致しない場合はfalseを返す
+	GetLatestNotification(filter NotificationFilter) (*Notification, bool)
+	GetArchivedNotifications(opts ListOptions) []Notification
+	GetNotificationsByState(opts ListOptions) []Notification
+	ExportNotifications(fn func(Notification) error) error
+	CreateNotification(ctx context.Context, req CreateNotificationRequest) (*Notification, error)
+	// NewNotification はリクエストを検証して保存前の通知を生成し、SaveNotification はそれを保存する
+	// CreateNotification はこの2つを続けて行う
+	NewNotification(req CreateNotificationRequest) (Notification, error)
+	SaveNotification(ctx context.Context, notification Notification) (*Notification, error)
+	MarkNotificationAsRead(id string, version int) error
+	MarkNotificationsReadBefore(cutoff time.Time) []string
+	DeleteNotifications(ids []string) (deleted, notFound []string)
+	// DedupeNotifications は保存済みの同じ内容の通知のうち最新の1件を残して削除する
+	// windowが0より大きい場合、残す通知からwindow以内に作成されたものだけを重複とする
+	DedupeNotifications(window time.Duration) []DedupeGroup
+	ArchiveNotification(id string, version int) error
+	PinNotification(id string, pinned bool, version int) error
+	// TakeAction は実行されたアクションを記録し、CallbackURLが設定されていれば非同期にPOSTする
+	TakeAction(id, actionID string, version int) (*Action, error)
+	// AddTag, RemoveTag, SetMetadata, UnsetMetadata は変更後の通知と、変更があったかを返す
+	AddTag(id, tag string, version int) (*Notification, bool, error)
+	RemoveTag(id, tag string, version int) (*Notification, bool, error)
+	SetMetadata(id, key, value string, version int) (*Notification, bool, error)
+	UnsetMetadata(id, key string, version int) (*Notification, bool, error)
+	ClearAllNotifications() error
+	ClearNotificationsForUser(userID string) error
+	// GetUserSubscription は保存されていない場合、全ての通知を受け取る空の条件を返す
+	GetUserSubscription(userID string) UserSubscription
+	SetUserSubscription(userID string, sub UserSubscription) (UserSubscription, error)
+	CheckHealth() error
+}
+
+// WebSocket manager interface
+type WSManager interface {
+	AddClient(conn *websocket.Conn, userID string)
+	// AddClientSince は接続を登録し、sinceSeqより後のブロードキャストを再送してから通常の配信を始める
+	AddClientSince(conn *websocket.Conn, userID string, sinceSeq uint64) int
+	RemoveClient(conn *websocket.Conn)
+	Broadcast(message WSMessage) int
+	// BroadcastNotification は送信できたクライアント数を返す。送信を保留した場合はheldがtrueになる
+	BroadcastNotification(notification Notification) (delivered int, held bool)
+	BroadcastReadState(id string, read bool)
+	// BroadcastArchived はアーカイブしたことを、その通知を受け取れるクライアントに送信する
+	BroadcastArchived(id string)
+	// BroadcastPinState はピン留め状態の変更を、その通知を受け取れるクライアントに送信する
+	BroadcastPinState(id string, pinned bool)
+	// BroadcastUpdate はタグやメタデータを変更した通知を、その通知を受け取れるクライアントに送信する
+	BroadcastUpdate(notification Notification)
+	HandleMessage(conn *websocket.Conn, msg WSMessage) error
+	// ApplySubscription は接続中のユーザーの全ての接続の購読条件を置き換える
+	ApplySubscription(userID string, sub *Subscription)
+	// DoNotDisturb はユーザーのおやすみモードの状態を返す。終了している場合は無効の状態を返す
+	DoNotDisturb(userID string) DoNotDisturb
+	// SetDoNotDisturb はおやすみモードを設定する。無効にした場合は保留した通知をすぐに送信する
+	SetDoNotDisturb(userID string, dnd DoNotDisturb) error
+	// SubscribeStream はブロードキャストする通知のうちfilterに一致するものを受け取るチャネルを返す
+	// 受け取りが追いつかない場合は破棄する。不要になったら返した関数で解除する
+	SubscribeStream(userID string, filter NotificationFilter) (<-chan Notification, func())
+	// AckCount は通知の受信を確認 (ack) した接続の数を返す
+	AckCount(id string) int
+	// Engagement は接続中のクライアントのうち通知をack・既読にした数と割合を返す
+	Engagement(notification Notification) Engagement
+	Connections() []ConnectionInfo
+	// Disconnect はクローズフレームを送信して接続を切断する
+	Disconnect(id string) error
+	Stats() WSStats
+	// Health は接続数と直近の送信の失敗率からWebSocketの状態を返す
+	Health() WSHealth
+}
+
+// ErrConnectionNotFound は指定したIDの接続が存在しないことを表す
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// WebSocket connection information
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// 最後にクライアントからメッセージかPingを受信した時刻
+	LastActivityAt time.Time `json:"last_activity_at"`
+	// ネゴシエーションしたサブプロトコル (指定されなかった場合は空)
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type ConnectionsResponse struct {
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// WebSocket manager statistics
+type WSStats struct {
+	Clients             int     `json:"clients"`
+	TotalConnections    int64   `json:"total_connections"`
+	TotalBroadcasts     int64   `json:"total_broadcasts"`
+	BroadcastFailures   int64   `json:"broadcast_failures"`
+	DroppedMessages     int64   `json:"dropped_messages"`
+	AverageFanoutMillis float64 `json:"average_fanout_ms"`
+	// 実行中のブロードキャストの数と、上限に達したため破棄した数
+	InFlight       int64 `json:"in_flight_broadcasts"`
+	ShedBroadcasts int64 `json:"shed_broadcasts"`
+}
+
+// WSHealth は/api/healthに含めるWebSocketの状態
+type WSHealth struct {
+	// ok、または直近の送信の失敗率が閾値を超えた場合はdegraded
+	Status      string `json:"status"`
+	Initialized bool   `json:"initialized"`
+	Clients     int    `json:"clients"`
+	// 直近1〜2分間のクライアントへの送信のうち失敗した割合
+	ErrorRate            float64    `json:"error_rate"`
+	LastBroadcastError   string     `json:"last_broadcast_error,omitempty"`
+	LastBroadcastErrorAt *time.Time `json:"last_broadcast_error_at,omitempty"`
+}
+
+// In-memory repository implementation
+type InMemoryNotificationRepository struct {
+	// 作成時に末尾へ追加できるよう古い順に保持し、読み取りは末尾から新しい順に行う
+	notifications []Notification
+	mu           sync.RWMutex
+
+	// unreadCount は未読かつ未アーカイブの件数。更新系の操作で差分更新する
+	unreadCount int
+
+	// ユーザーIDごとの購読条件
+	subscriptions map[string]UserSubscription
+}
+
+func NewInMemoryNotificationRepository() *InMemoryNotificationRepository {
+	r := &InMemoryNotificationRepository{
+		notifications: []Notification{
+			{
+				ID:        "2",
+				Title:     "重要な更新",
+				Message:   "新しいバージョンが利用可能です。アップデートを確認してください。",
+				Type:      "warning",
+				Priority:  PriorityHigh,
+				Sound:     SoundDefault,
+				Timestamp: time.Now().Add(-2 * time.Minute),
+				Read:      false,
+				Version:   1,
+			},
+			{
+				ID:        "1",
+				Title:     "システム起動",
+				Message:   "Notibagが正常に起動しました",
+				Type:      "info",
+				Priority:  PriorityNormal,
+				Sound:     SoundDefault,
+				Timestamp: time.Now().Add(-5 * time.Minute),
+				Read:      false,
+				Version:   1,
+			},
+		},
+	}
+	r.unreadCount = countUnread(r.notifications)
+	return r
+}
+
+// isUnread は未読一覧に含まれる通知かどうかを返す
+func isUnread(n Notification) bool {
+	return !n.Read && !n.Archived
+}
+
+func countUnread(notifications []Notification) int {
+	count := 0
+	for _, n := range notifications {
+		if isUnread(n) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *InMemoryNotificationRepository) Get(id string) (Notification, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, notification := range slices.Backward(r.notifications) {
+		if notification.ID == id {
+			return notification, nil
+		}
+	}
+	return Notification{}, ErrNotificationNotFound
+}
+
+func (r *InMemoryNotificationRepository) GetUnread() []Notification {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	
+	unread := make([]Notification, 0, r.unreadCount)
+	for _, notification := range slices.Backward(r.notifications) {
+		// 未読をすべて集めたら残りは走査しない
+		if len(unread) == r.unreadCount {
+			break
+		}
+		if isUnread(notification) {
+			unread = append(unread, notification)
+		}
+	}
+	return unread
+}
+
+func (r *InMemoryNotificationRepository) CountUnread() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.unreadCount
+}
+
+func (r *InMemoryNotificationRepository) Count(filter NotificationFilter) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := 0
+	for _, notification := range slices.Backward(r.notifications) {
+		if filter.Matches(notification) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *InMemoryNotificationRepository) Latest(filter NotificationFilter) (Notification, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// 保存順とTimestampの順は一致するとは限らないため、最初に一致したものでは打ち切らない
+	var latest Notification
+	found := false
+	for _, notification := range slices.Backward(r.notifications) {
+		if filter.Matches(notification) && (!found || newerThan(notification, latest)) {
+			latest = notification
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// newerThan はaがbより新しいかを返す。Timestampが同じ場合は一覧と同じくIDで比較する
+func newerThan(a, b Notification) bool {
+	if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+		return c > 0
+	}
+	return a.ID > b.ID
+}
+
+func (r *InMemoryNotificationRepository) GetArchived() []Notification {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	archived := make([]Notification, 0)
+	for _, notification := range slices.Backward(r.notifications) {
+		if notification.Archived {
+			archived = append(archived, notification)
+		}
+	}
+	return archived
+}
+
+func (r *InMemoryNotificationRepository) GetAll() []Notification {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	
+	result := slices.Clone(r.notifications)
+	slices.Reverse(result)
+	return result
+}
+
+// ForEach はコピーを作らずに走査するため、fnの実行中は書き込みがブロックされる
+func (r *InMemoryNotificationRepository) ForEach(fn func(Notification) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, notification := range slices.Backward(r.notifications) {
+		if err := fn(notification); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) Create(notification Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.notifications = append(r.notifications, notification)
+	if isUnread(notification) {
+		r.unreadCount++
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) MarkAsRead(id string, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	n, err := r.findForUpdate(id, version)
+	if err != nil {
+		return err
+	}
+	if !n.Read {
+		if isUnread(*n) {
+			r.unreadCount--
+		}
+		n.Read = true
+		n.Version++
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) MarkReadBefore(cutoff time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var marked []string
+	for i := range slices.Backward(r.notifications) {
+		n := &r.notifications[i]
+		if n.Read || !n.Timestamp.Before(cutoff) {
+			continue
+		}
+		if isUnread(*n) {
+			r.unreadCount--
+		}
+		n.Read = true
+		n.Version++
+		marked = append(marked, n.ID)
+	}
+	return marked
+}
+
+// findForUpdate は変更する通知を探し、versionを確認する。r.muを保持した状態で呼び出す
+func (r *InMemoryNotificationRepository) findForUpdate(id string, version int) (*Notification, error) {
+	for i := range r.notifications {
+		if r.notifications[i].ID == id {
+			if version != 0 && r.notifications[i].Version != version {
+				return nil, fmt.Errorf("%w: current version is %d", ErrVersionConflict, r.notifications[i].Version)
+			}
+			return &r.notifications[i], nil
+		}
+	}
+	return nil, ErrNotificationNotFound
+}
+
+func (r *InMemoryNotificationRepository) Archive(id string, at time.Time, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.findForUpdate(id, version)
+	if err != nil {
+		return err
+	}
+	if isUnread(*n) {
+		r.unreadCount--
+	}
+	if !n.Archived {
+		n.Archived = true
+		n.ArchivedAt = &at
+		n.Version++
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) ArchiveAll(at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.notifications {
+		if !r.notifications[i].Archived {
+			r.notifications[i].Archived = true
+			r.notifications[i].ArchivedAt = &at
+			r.notifications[i].Version++
+		}
+	}
+	r.unreadCount = 0
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) ArchiveForUser(userID string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.notifications {
+		if n := &r.notifications[i]; n.UserID == userID && !n.Archived {
+			if isUnread(*n) {
+				r.unreadCount--
+			}
+			n.Archived = true
+			n.ArchivedAt = &at
+			n.Version++
+		}
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) SetPinned(id string, pinned bool, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.findForUpdate(id, version)
+	if err != nil {
+		return err
+	}
+	if n.Pinned != pinned {
+		n.Pinned = pinned
+		n.Version++
+	}
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) RecordAction(id, actionID string, at time.Time, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.findForUpdate(id, version)
+	if err != nil {
+		return err
+	}
+	n.ActionTaken = actionID
+	n.ActionTakenAt = &at
+	n.Version++
+	return nil
+}
+
+// update はロックした状態で通知をfnで変更し、fnがtrueを返した場合はVersionを上げる
+// 返した通知と共有しないよう、fnはスライスやマップを複製してから変更する
+func (r *InMemoryNotificationRepository) update(id string, version int, fn func(n *Notification) bool) (Notification, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.findForUpdate(id, version)
+	if err != nil {
+		return Notification{}, false, err
+	}
+	changed := fn(n)
+	if changed {
+		n.Version++
+	}
+	return *n, changed, nil
+}
+
+func (r *InMemoryNotificationRepository) AddTag(id, tag string, version int) (Notification, bool, error) {
+	return r.update(id, version, func(n *Notification) bool {
+		if slices.Contains(n.Tags, tag) {
+			return false
+		}
+		n.Tags = append(slices.Clip(n.Tags), tag)
+		return true
+	})
+}
+
+func (r *InMemoryNotificationRepository) RemoveTag(id, tag string, version int) (Notification, bool, error) {
+	return r.update(id, version, func(n *Notification) bool {
+		i := slices.Index(n.Tags, tag)
+		if i < 0 {
+			return false
+		}
+		n.Tags = slices.Delete(slices.Clone(n.Tags), i, i+1)
+		return true
+	})
+}
+
+func (r *InMemoryNotificationRepository) SetMetadata(id, key, value string, version int) (Notification, bool, error) {
+	return r.update(id, version, func(n *Notification) bool {
+		if current, ok := n.Metadata[key]; ok && current == value {
+			return false
+		}
+		metadata := maps.Clone(n.Metadata)
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = value
+		n.Metadata = metadata
+		return true
+	})
+}
+
+func (r *InMemoryNotificationRepository) UnsetMetadata(id, key string, version int) (Notification, bool, error) {
+	return r.update(id, version, func(n *Notification) bool {
+		if _, ok := n.Metadata[key]; !ok {
+			return false
+		}
+		metadata := maps.Clone(n.Metadata)
+		delete(metadata, key)
+		n.Metadata = metadata
+		return true
+	})
+}
+
+func (r *InMemoryNotificationRepository) DeleteMany(ids []string) (deleted, notFound []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	targets := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		targets[id] = true
+	}
+
+	deleted = make([]string, 0, len(ids))
+	remaining := r.notifications[:0]
+	for _, notification := range r.notifications {
+		if targets[notification.ID] {
+			deleted = append(deleted, notification.ID)
+			delete(targets, notification.ID)
+			if isUnread(notification) {
+				r.unreadCount--
+			}
+			continue
+		}
+		remaining = append(remaining, notification)
+	}
+	r.notifications = remaining
+	// 削除したIDは一覧と同じ新しい順で返す
+	slices.Reverse(deleted)
+
+	notFound = make([]string, 0)
+	for _, id := range ids {
+		if targets[id] {
+			notFound = append(notFound, id)
+			delete(targets, id)
+		}
+	}
+	return deleted, notFound
+}
+
+func (r *InMemoryNotificationRepository) Clear() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.notifications = []Notification{}
+	r.unreadCount = 0
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) ClearForUser(userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remaining := r.notifications[:0]
+	for _, notification := range r.notifications {
+		if notification.UserID != userID {
+			remaining = append(remaining, notification)
+		} else if isUnread(notification) {
+			r.unreadCount--
+		}
+	}
+	r.notifications = remaining
+	return nil
+}
+
+func (r *InMemoryNotificationRepository) GetSubscription(userID string) (UserSubscription, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subscriptions[userID]
+	return sub, ok
+}
+
+func (r *InMemoryNotificationRepository) SetSubscription(userID string, sub UserSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscriptions == nil {
+		r.subscriptions = make(map[string]UserSubscription)
+	}
+	r.subscriptions[userID] = sub
+	return nil
+}
+
+// allSubscriptions は保存用に購読条件のコピーを返す
+func (r *InMemoryNotificationRepository) allSubscriptions() map[string]UserSubscription {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subs := make(map[string]UserSubscription, len(r.subscriptions))
+	for userID, sub := range r.subscriptions {
+		subs[userID] = sub
+	}
+	return subs
+}
+
+func (r *InMemoryNotificationRepository) Ping() error {
+	return nil
+}
+
+// Repository configuration
+type RepositoryConfig struct {
+	// memory または file
+	Store string
+	// fileストアの保存先
+	Path string
+	// trueの場合、memoryストアをサンプルの通知なしで開始する
+	Empty bool
+}
+
+// NewRepository は設定に応じたリポジトリを生成する
+func NewRepository(cfg RepositoryConfig) (NotificationRepository, error) {
+	switch cfg.Store {
+	case "", "memory":
+		if cfg.Empty {
+			return &InMemoryNotificationRepository{notifications: []Notification{}}, nil
+		}
+		return NewInMemoryNotificationRepository(), nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, errors.New("store path is required for file store")
+		}
+		return NewFileNotificationRepository(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown store: %s (must be one of: memory, file)", cfg.Store)
+	}
+}
+
+// File-backed repository implementation
+// 変更のたびに全件をJSONファイルへ書き出す
+type FileNotificationRepository struct {
+	*InMemoryNotificationRepository
+	path   string
+	saveMu sync.Mutex
+	// 購読条件は通知一覧の形式を変えないよう別のファイルに保存する
+	subscriptionsPath string
+}
+
+func NewFileNotificationRepository(path string) (*FileNotificationRepository, error) {
+	notifications := []Notification{}
+	if err := readJSONFile(path, &notifications); err != nil {
+		return nil, err
+	}
+	// ファイルには新しい順に保存している
+	slices.Reverse(notifications)
+	subscriptionsPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".subscriptions.json"
+	subscriptions := map[string]UserSubscription{}
+	if err := readJSONFile(subscriptionsPath, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return &FileNotificationRepository{
+		InMemoryNotificationRepository: &InMemoryNotificationRepository{
+			notifications: notifications,
+			unreadCount:   countUnread(notifications),
+			subscriptions: subscriptions,
+		},
+		path:              path,
+		subscriptionsPath: subscriptionsPath,
+	}, nil
+}
+
+// readJSONFile はファイルが存在する場合にvへ読み込む
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return nil
+}
+
+// save は現在の全件をファイルに書き出す
+func (r *FileNotificationRepository) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	data, err := json.Marshal(r.GetAll())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, data)
+}
+
+func (r *FileNotificationRepository) Create(notification Notification) error {
+	if err := r.InMemoryNotificationRepository.Create(notification); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) MarkAsRead(id string, version int) error {
+	if err := r.InMemoryNotificationRepository.MarkAsRead(id, version); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) MarkReadBefore(cutoff time.Time) []string {
+	marked := r.InMemoryNotificationRepository.MarkReadBefore(cutoff)
+	if len(marked) > 0 {
+		if err := r.save(); err != nil {
+			slog.Error("Error saving notifications", "error", err)
+		}
+	}
+	return marked
+}
+
+func (r *FileNotificationRepository) DeleteMany(ids []string) (deleted, notFound []string) {
+	deleted, notFound = r.InMemoryNotificationRepository.DeleteMany(ids)
+	if len(deleted) > 0 {
+		if err := r.save(); err != nil {
+			slog.Error("Error saving notifications", "error", err)
+		}
+	}
+	return deleted, notFound
+}
+
+func (r *FileNotificationRepository) Archive(id string, at time.Time, version int) error {
+	if err := r.InMemoryNotificationRepository.Archive(id, at, version); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) SetPinned(id string, pinned bool, version int) error {
+	if err := r.InMemoryNotificationRepository.SetPinned(id, pinned, version); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) RecordAction(id, actionID string, at time.Time, version int) error {
+	if err := r.InMemoryNotificationRepository.RecordAction(id, actionID, at, version); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) ArchiveAll(at time.Time) error {
+	if err := r.InMemoryNotificationRepository.ArchiveAll(at); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) ArchiveForUser(userID string, at time.Time) error {
+	if err := r.InMemoryNotificationRepository.ArchiveForUser(userID, at); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileNotificationRepository) AddTag(id, tag string, version int) (Notification, bool, error) {
+	return r.saveIfChanged(r.InMemoryNotificationRepository.AddTag(id, tag, version))
+}
+
+func (r *FileNotificationRepository) RemoveTag(id, tag string, version int) (Notification, bool, error) {
+	return r.saveIfChanged(r.InMemoryNotificationRepository.RemoveTag(id, tag, version))
+}
+
+func (r *FileNotificationRepository) SetMetadata(id, key, value string, version int) (Notification, bool, error) {
+	return r.saveIfChanged(r.InMemoryNotificationRepository.SetMetadata(id, key, value, version))
+}
+
+func (r *FileNotificationRepository) UnsetMetadata(id, key string, version int) (Notification, bool, error) {
+	return r.saveIfChanged(r.InMemoryNotificationRepository.UnsetMetadata(id, key, version))
+}
+
+// saveIfChanged は部分的な更新で変更があった場合のみファイルに書き出す
+func (r *FileNotificationRepository) saveIfChanged(n Notification, changed bool, err error) (Notification, bool, error) {
+	if err != nil || !changed {
+		return n, changed, err
+	}
+	return n, changed, r.save()
+}
+
+func (r *FileNotificationRepository) SetSubscription(userID string, sub UserSubscription) error {
+	if err := r.InMemoryNotificationRepository.SetSubscription(userID, sub); err != nil {
+		return err
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	data, err := json.Marshal(r.allSubscriptions())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.subscriptionsPath, data)
+}
+
+func (r *FileNotificationRepository) ClearForUser(userID string) error {
+	if err := r.InMemoryNotificationRepository.ClearForUser(userID); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+// Ping は保存先のディレクトリにアクセスできるかを確認する
+func (r *FileNotificationRepository) Ping() error {
+	_, err := os.Stat(filepath.Dir(r.path))
+	return err
+}
+
+func (r *FileNotificationRepository) Clear() error {
+	if err := r.InMemoryNotificationRepository.Clear(); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+// Service configuration
+type ServiceConfig struct {
+	// 空の場合は任意のカテゴリを許可する
+	AllowedCategories []string
+	// カテゴリごとの通知の最小間隔
+	CategoryCooldowns map[string]time.Duration
+	// 同じタイトル・メッセージの通知を抑制する期間 (0以下の場合は抑制しない)
+	DedupWindow time.Duration
+	// trueの場合、全件クリアは削除ではなくアーカイブとして扱う
+	ArchiveOnClear bool
+	// リクエストで省略された場合に使用する値
+	DefaultPriority string
+	DefaultCategory string
+	// 1件の通知に付けられるタグの数と、タグの最大文字数 (0以下の場合は無制限)
+	MaxTags      int
+	MaxTagLength int
+	// 1件の通知に付けられる添付ファイルの数と、添付ファイルの最大サイズ (0以下の場合は無制限)
+	MaxAttachments    int
+	MaxAttachmentSize int64
+	// 添付ファイルのDataに埋め込めるデコード後の最大バイト数 (0以下の場合は16KiB)
+	MaxAttachmentData int64
+	// 優先度ごとに、リクエストで省略された通知音・ack・有効期間に適用する値
+	PriorityPolicy map[string]PriorityHints
+	// カテゴリごとの有効期間。リクエストで省略された場合に、優先度の有効期間より優先して適用する (0の場合は期限切れにしない)
+	CategoryTTLs map[string]time.Duration
+	// リクエストで省略された場合に、配信した時点で既読にするかどうか
+	AutoRead bool
+	// 作成元ごとにIDの先頭に付ける文字列 (例: cli → cli-)
+	IDPrefixes map[string]string
+	// nilの場合は現在時刻を使用する
+	Clock Clock
+	// nilの場合は作成時刻と連番からIDを生成する
+	IDs IDGenerator
+	// 保存前に登録順で実行する (空の場合は何もしない)
+	Processors []NotificationProcessor
+	// nilの場合はWebhookを送信しない
+	Webhooks *WebhookDispatcher
+}
+
+// Validate は起動時に設定値の整合性を確認する
+func (cfg ServiceConfig) Validate() error {
+	for priority, hints := range cfg.PriorityPolicy {
+		if _, ok := priorityRanks[priority]; !ok {
+			return fmt.Errorf("invalid priority in policy: %s", priority)
+		}
+		if hints.Sound != "" && !validSounds[hints.Sound] {
+			return fmt.Errorf("invalid sound for %s: %s", priority, hints.Sound)
+		}
+		if hints.TTL < 0 {
+			return fmt.Errorf("invalid ttl for %s: %s", priority, hints.TTL)
+		}
+	}
+	for category, ttl := range cfg.CategoryTTLs {
+		if ttl < 0 {
+			return fmt.Errorf("invalid ttl for %s: %s", category, ttl)
+		}
+		if len(cfg.AllowedCategories) > 0 && !slices.Contains(cfg.AllowedCategories, category) {
+			return fmt.Errorf("category not allowed: %s", category)
+		}
+	}
+	if cfg.DefaultPriority != "" {
+		if _, ok := priorityRanks[cfg.DefaultPriority]; !ok {
+			return fmt.Errorf("invalid default priority: %s", cfg.DefaultPriority)
+		}
+	}
+	if cfg.DefaultCategory != "" && len(cfg.AllowedCategories) > 0 {
+		allowed := false
+		for _, category := range cfg.AllowedCategories {
+			if category == cfg.DefaultCategory {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("default category not allowed: %s", cfg.DefaultCategory)
+		}
+	}
+	for source, prefix := range cfg.IDPrefixes {
+		if !validIDPrefix(prefix) {
+			return fmt.Errorf("invalid id prefix for %s: %q", source, prefix)
+		}
+	}
+	return nil
+}
+
+// validIDPrefix はIDをURLのパスにそのまま使えるよう、英数字と-_のみを許可する
+func validIDPrefix(prefix string) bool {
+	if len(prefix) > 32 {
+		return false
+	}
+	for _, r := range prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrSuppressed はクールダウン中のため通知が抑制されたことを表す
+var ErrSuppressed = errors.New("notification suppressed by category cooldown")
+
+// ErrDuplicate は同じ内容の通知が直前に作成されたため抑制されたことを表す
+var ErrDuplicate = errors.New("duplicate notification suppressed")
+
+// ErrRejected はプロセッサーが通知の作成を拒否したことを表す
+var ErrRejected = errors.New("rejected by processor")
+
+// Service implementation
+type NotificationServiceImpl struct {
+	repo              NotificationRepository
+	clock             Clock
+	ids               IDGenerator
+	allowedCategories map[string]bool
+	cooldowns         map[string]time.Duration
+	lastNotified      map[string]time.Time
+	cooldownMu        sync.Mutex
+	dedupWindow       time.Duration
+	seenContent       map[string]seenNotification
+	lastPruned        time.Time
+	dedupMu           sync.Mutex
+	archiveOnClear    bool
+	defaultPriority   string
+	defaultCategory   string
+	maxTags           int
+	maxTagLength      int
+	maxAttachments    int
+	maxAttachSize     int64
+	maxAttachData     int64
+	priorityPolicy    map[string]PriorityHints
+	categoryTTLs      map[string]time.Duration
+	autoRead          bool
+	idPrefixes        map[string]string
+	processors        []NotificationProcessor
+	webhooks          *WebhookDispatcher
+	// 未読数が変わる可能性のある操作の後に呼び出す
+	onUnreadChange func()
+}
+
+func NewNotificationService(repo NotificationRepository, cfg ServiceConfig) *NotificationServiceImpl {
+	s := &NotificationServiceImpl{
+		repo:            repo,
+		clock:           cfg.Clock,
+		ids:             cfg.IDs,
+		cooldowns:       cfg.CategoryCooldowns,
+		lastNotified:    make(map[string]time.Time),
+		dedupWindow:     cfg.DedupWindow,
+		seenContent:     make(map[string]seenNotification),
+		archiveOnClear:  cfg.ArchiveOnClear,
+		defaultPriority: cfg.DefaultPriority,
+		defaultCategory: cfg.DefaultCategory,
+		maxTags:         cfg.MaxTags,
+		maxTagLength:    cfg.MaxTagLength,
+		maxAttachments:  cfg.MaxAttachments,
+		maxAttachSize:   cfg.MaxAttachmentSize,
+		maxAttachData:   cfg.MaxAttachmentData,
+		priorityPolicy:  cfg.PriorityPolicy,
+		categoryTTLs:    cfg.CategoryTTLs,
+		autoRead:        cfg.AutoRead,
+		idPrefixes:      cfg.IDPrefixes,
+		processors:      cfg.Processors,
+		webhooks:        cfg.Webhooks,
+	}
+	if s.clock == nil {
+		s.clock = realClock{}
+	}
+	if s.ids == nil {
+		s.ids = timestampIDs{clock: s.clock}
+	}
+	if s.defaultPriority == "" {
+		s.defaultPriority = PriorityNormal
+	}
+	if s.maxAttachData <= 0 {
+		s.maxAttachData = defaultMaxAttachmentData
+	}
+	if len(cfg.AllowedCategories) > 0 {
+		s.allowedCategories = make(map[string]bool, len(cfg.AllowedCategories))
+		for _, category := range cfg.AllowedCategories {
+			s.allowedCategories[category] = true
+		}
+	}
+	return s
+}
+
+// SetUnreadCountListener は未読数が変わる可能性のある操作の後に呼び出す関数を設定する
+// リクエストの処理を始める前に設定する
+func (s *NotificationServiceImpl) SetUnreadCountListener(fn func()) {
+	s.onUnreadChange = fn
+}
+
+func (s *NotificationServiceImpl) unreadCountChanged() {
+	if s.onUnreadChange != nil {
+		s.onUnreadChange()
+	}
+}
+
+func (s *NotificationServiceImpl) GetNotification(id string) (*Notification, error) {
+	notification, err := s.repo.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return &notification, nil
+}
+
+func (s *NotificationServiceImpl) GetUnreadNotifications(opts ListOptions) []Notification {
+	return s.applyListOptions(s.repo.GetUnread(), opts)
+}
+
+func (s *NotificationServiceImpl) CountUnreadNotifications() int {
+	return s.repo.CountUnread()
+}
+
+func (s *NotificationServiceImpl) CountUnreadByUser() map[string]int {
+	counts := make(map[string]int)
+	s.repo.ForEach(func(n Notification) error {
+		if isUnread(n) {
+			counts[n.UserID]++
+		}
+		return nil
+	})
+	return counts
+}
+
+func (s *NotificationServiceImpl) CountNotifications(filter NotificationFilter) int {
+	filter.ExpiredAt = s.clock.Now()
+	return s.repo.Count(filter)
+}
+
+func (s *NotificationServiceImpl) GetLatestNotification(filter NotificationFilter) (*Notification, bool) {
+	filter.ExpiredAt = s.clock.Now()
+	notification, ok := s.repo.Latest(filter)
+	if !ok {
+		return nil, false
+	}
+	return &notification, true
+}
+
+func (s *NotificationServiceImpl) GetArchivedNotifications(opts ListOptions) []Notification {
+	return s.applyListOptions(s.repo.GetArchived(), opts)
+}
+
+// GetNotificationsByState はアーカイブされていない通知のうち、opts.Statesに一致するものを返す
+func (s *NotificationServiceImpl) GetNotificationsByState(opts ListOptions) []Notification {
+	if !opts.States.Read {
+		return s.GetUnreadNotifications(opts)
+	}
+	notifications := make([]Notification, 0)
+	for _, notification := range s.repo.GetAll() {
+		if notification.Archived {
+			continue
+		}
+		if (notification.Read && opts.States.Read) || (!notification.Read && opts.States.Unread) {
+			notifications = append(notifications, notification)
+		}
+	}
+	return s.applyListOptions(notifications, opts)
+}
+
+// applyListOptions は一覧の絞り込みと並べ替えを行う
+func (s *NotificationServiceImpl) applyListOptions(notifications []Notification, opts ListOptions) []Notification {
+	// 削除される前の期限切れの通知は返さない
+	now := s.clock.Now()
+	filtered := notifications[:0]
+	for _, notification := range notifications {
+		if !expired(notification, now) {
+			filtered = append(filtered, notification)
+		}
+	}
+	notifications = filtered
+	if opts.MaxAge > 0 {
+		cutoff := s.clock.Now().Add(-opts.MaxAge)
+		filtered := notifications[:0]
+		for _, notification := range notifications {
+			if !notification.Timestamp.Before(cutoff) {
+				filtered = append(filtered, notification)
+			}
+		}
+		notifications = filtered
+	}
+	if opts.Source != "" {
+		filtered := notifications[:0]
+		for _, notification := range notifications {
+			if notification.Source == opts.Source {
+				filtered = append(filtered, notification)
+			}
+		}
+		notifications = filtered
+	}
+	if opts.Filter != (NotificationFilter{}) {
+		filtered := notifications[:0]
+		for _, notification := range notifications {
+			if opts.Filter.matchesAttributes(notification) {
+				filtered = append(filtered, notification)
+			}
+		}
+		notifications = filtered
+	}
+	sortForList(notifications, opts.SortByPriority)
+	return notifications
+}
+
+func expired(notification Notification, now time.Time) bool {
+	return notification.ExpiresAt != nil && !now.Before(*notification.ExpiresAt)
+}
+
+// PriorityPolicy は優先度ごとに適用される値を、設定されていない優先度も含めて返す
+func (s *NotificationServiceImpl) PriorityPolicy() map[string]PriorityHints {
+	policy := make(map[string]PriorityHints, len(priorityRanks))
+	for priority := range priorityRanks {
+		hints := s.priorityPolicy[priority]
+		if hints.Sound == "" {
+			hints.Sound = SoundDefault
+		}
+		policy[priority] = hints
+	}
+	return policy
+}
+
+// ExpireNotifications は有効期限を過ぎた通知を削除し、削除したIDを返す
+func (s *NotificationServiceImpl) ExpireNotifications() []string {
+	now := s.clock.Now()
+	var ids []string
+	s.repo.ForEach(func(notification Notification) error {
+		if expired(notification, now) {
+			ids = append(ids, notification.ID)
+		}
+		return nil
+	})
+	if len(ids) == 0 {
+		return nil
+	}
+	deleted, _ := s.DeleteNotifications(ids)
+	return deleted
+}
+
+// 期限切れの通知を削除する間隔
+const expiryInterval = 10 * time.Second
+
+// RunExpiry は停止されるまで、interval ごとに期限切れの通知を削除し、削除したIDでonExpiredを呼び出す
+func (s *NotificationServiceImpl) RunExpiry(ctx context.Context, interval time.Duration, onExpired func(ids []string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ids := s.ExpireNotifications(); len(ids) > 0 {
+				onExpired(ids)
+			}
+		}
+	}
+}
+
+// ExportNotifications はスナップショットを走査するため、fnで時間のかかる書き込みをしてもリポジトリをブロックしない
+func (s *NotificationServiceImpl) ExportNotifications(fn func(Notification) error) error {
+	for _, notification := range s.repo.GetAll() {
+		if err := fn(notification); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *NotificationServiceImpl) CreateNotification(ctx context.Context, req CreateNotificationRequest) (*Notification, error) {
+	notification, err := s.NewNotification(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.SaveNotification(ctx, notification)
+}
+
+func (s *NotificationServiceImpl) NewNotification(req CreateNotificationRequest) (Notification, error) {
+	if req.Title == "" {
+		return Notification{}, invalidField("title", errors.New("title and message are required"))
+	}
+	if req.Message == "" {
+		return Notification{}, invalidField("message", errors.New("title and message are required"))
+	}
+
+	notifType := req.Type
+	if notifType == "" {
+		notifType = "info"
+	}
+
+	priority := req.Priority
+	if priority == "" {
+		priority = s.defaultPriority
+	}
+	if _, ok := priorityRanks[priority]; !ok {
+		return Notification{}, invalidField("priority", fmt.Errorf("invalid priority: %s", priority))
+	}
+
+	hints := s.priorityPolicy[priority]
+	sound := req.Sound
+	if sound == "" {
+		sound = hints.Sound
+	}
+	if sound == "" {
+		sound = SoundDefault
+	}
+	if !validSounds[sound] {
+		return Notification{}, invalidField("sound", fmt.Errorf("invalid sound: %s", sound))
+	}
+
+	requiresAck := hints.RequiresAck
+	if req.RequiresAck != nil {
+		requiresAck = *req.RequiresAck
+	}
+	autoRead := s.autoRead
+	if req.AutoRead != nil {
+		autoRead = *req.AutoRead
+	}
+
+	category := req.Category
+	if category == "" {
+		category = s.defaultCategory
+	}
+	if category != "" && s.allowedCategories != nil && !s.allowedCategories[category] {
+		return Notification{}, invalidField("category", fmt.Errorf("category not allowed: %s", category))
+	}
+
+	// リクエスト、カテゴリ、優先度の順に有効期間を決める
+	ttl, ok := s.categoryTTLs[category]
+	if !ok {
+		ttl = hints.TTL
+	}
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			return Notification{}, invalidField("ttl", fmt.Errorf("invalid ttl: %s", req.TTL))
+		}
+		ttl = d
+	}
+
+	tags, err := s.normalizeTags(req.Tags)
+	if err != nil {
+		return Notification{}, invalidField("tags", err)
+	}
+	if err := validateActions(req.Actions); err != nil {
+		return Notification{}, invalidField("actions", err)
+	}
+	if err := s.validateAttachments(req.Attachments); err != nil {
+		return Notification{}, invalidField("attachments", err)
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return Notification{}, invalidField("metadata", err)
+	}
+
+	now := s.clock.Now()
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := now.Add(ttl)
+		expiresAt = &t
+	}
+
+	return Notification{
+		ID:          s.ids.NewID(s.idPrefixes[req.Source]),
+		Title:       req.Title,
+		Message:     req.Message,
+		Type:        notifType,
+		Priority:    priority,
+		Category:    category,
+		Tags:        tags,
+		Sound:       sound,
+		UserID:      req.UserID,
+		Source:      req.Source,
+		Timestamp:   now,
+		Read:        false,
+		Version:     1,
+		RequiresAck: requiresAck,
+		AutoRead:    autoRead,
+		ExpiresAt:   expiresAt,
+		Actions:     req.Actions,
+		Attachments: req.Attachments,
+		Metadata:    req.Metadata,
+	}, nil
+}
+
+func (s *NotificationServiceImpl) SaveNotification(ctx context.Context, notification Notification) (*Notification, error) {
+	for _, processor := range s.processors {
+		if err := processor.Process(ctx, &notification); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+	}
+
+	// プロセッサーがカテゴリや内容を変更する場合があるため、加工後の通知で判定する
+	now := s.clock.Now()
+	if duplicateOf, err := s.admit(notification, now); err != nil {
+		// 重複の場合は、削除されていなければ既存の通知を返す
+		if errors.Is(err, ErrDuplicate) {
+			if existing, getErr := s.repo.Get(duplicateOf); getErr == nil {
+				return &existing, err
+			}
+		}
+		return nil, err
+	}
+	
+	if err := s.repo.Create(notification); err != nil {
+		// 保存できなかった通知で、同じ内容の再送やカテゴリの次の通知を抑制しない
+		s.revokeAdmission(notification, now)
+		return nil, err
+	}
+	s.webhooks.Notify(WebhookEventCreated, notification)
+	s.unreadCountChanged()
+	
+	return &notification, nil
+}
+
+// normalizeTags は前後の空白を取り除き、空のタグや上限を超えるタグを拒否する
+func (s *NotificationServiceImpl) normalizeTags(tags []string) ([]string, error) {
+	if s.maxTags > 0 && len(tags) > s.maxTags {
+		return nil, fmt.Errorf("too many tags: %d (max %d)", len(tags), s.maxTags)
+	}
+	if len(tags) == 0 {
+		return tags, nil
+	}
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, errors.New("tags must not be empty")
+		}
+		if s.maxTagLength > 0 && utf8.RuneCountInString(tag) > s.maxTagLength {
+			return nil, fmt.Errorf("tag too long: %q (max %d characters)", tag, s.maxTagLength)
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+// validateActions はアクションのIDが重複せず、コールバックURLがhttp(s)であることを確認する
+func validateActions(actions []Action) error {
+	seen := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		if action.ID == "" {
+			return errors.New("action id is required")
+		}
+		if seen[action.ID] {
+			return fmt.Errorf("duplicate action id: %s", action.ID)
+		}
+		seen[action.ID] = true
+		if action.Label == "" {
+			return fmt.Errorf("action label is required: %s", action.ID)
+		}
+		if action.CallbackURL != "" {
+			u, err := url.Parse(action.CallbackURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid callback url for action %s: %s", action.ID, action.CallbackURL)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAttachments は添付ファイルの数とサイズが上限以内で、URLがhttp(s)であることを確認する
+// Dataを埋め込んだ添付ファイルはURLを省略できる
+func (s *NotificationServiceImpl) validateAttachments(attachments []Attachment) error {
+	if s.maxAttachments > 0 && len(attachments) > s.maxAttachments {
+		return fmt.Errorf("too many attachments: %d (max %d)", len(attachments), s.maxAttachments)
+	}
+	for _, attachment := range attachments {
+		if attachment.Data == "" || attachment.URL != "" {
+			u, err := url.Parse(attachment.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid attachment url: %s", attachment.URL)
+			}
+		}
+		if _, _, err := mime.ParseMediaType(attachment.ContentType); err != nil {
+			return fmt.Errorf("invalid attachment content type: %q", attachment.ContentType)
+		}
+		if attachment.Size < 0 {
+			return fmt.Errorf("invalid attachment size: %d", attachment.Size)
+		}
+		if s.maxAttachSize > 0 && attachment.Size > s.maxAttachSize {
+			return fmt.Errorf("attachment too large: %d bytes (max %d)", attachment.Size, s.maxAttachSize)
+		}
+		if attachment.Data != "" {
+			if err := s.validateAttachmentData(attachment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// defaultMaxAttachmentData は添付ファイルに埋め込めるデータの大きさのデフォルト
+// 一覧やブロードキャストに毎回含まれるため、サムネイル程度の大きさに抑える
+const defaultMaxAttachmentData = 16 * 1024
+
+// validateAttachmentData はDataが改行などを含まない標準のbase64で、デコード後の大きさが上限以内であることを確認する
+// sizeを指定した場合はデコード後の大きさと一致する必要がある
+func (s *NotificationServiceImpl) validateAttachmentData(attachment Attachment) error {
+	encoding := base64.StdEncoding.Strict()
+	// 上限を大きく超えるデータはデコードせずに拒否する
+	if int64(encoding.DecodedLen(len(attachment.Data))) > s.maxAttachData+2 {
+		return fmt.Errorf("inline attachment too large (max %d bytes)", s.maxAttachData)
+	}
+	// デコーダーは改行を読み飛ばすため、先に拒否する
+	if i := strings.IndexAny(attachment.Data, "\r\n"); i >= 0 {
+		return fmt.Errorf("invalid attachment data: %w", base64.CorruptInputError(i))
+	}
+	data, err := encoding.DecodeString(attachment.Data)
+	if err != nil {
+		return fmt.Errorf("invalid attachment data: %w", err)
+	}
+	if int64(len(data)) > s.maxAttachData {
+		return fmt.Errorf("inline attachment too large (max %d bytes)", s.maxAttachData)
+	}
+	if attachment.Size != 0 && attachment.Size != int64(len(data)) {
+		return fmt.Errorf("attachment size %d does not match data (%d bytes)", attachment.Size, len(data))
+	}
+	return nil
+}
+
+// seenNotification は重複判定のために記録した通知
+type seenNotification struct {
+	id string
+	at time.Time
+}
+
+// admit は重複とクールダウンを確認し、通知を作成してよければ記録してnilを返す
+// 重複の場合は既存の通知のIDとErrDuplicateを返す
+func (s *NotificationServiceImpl) admit(notification Notification, now time.Time) (duplicateOf string, err error) {
+	if s.dedupWindow <= 0 {
+		if !s.acquireCooldown(notification.Category, now) {
+			return "", ErrSuppressed
+		}
+		return "", nil
+	}
+
+	// 同じ内容の通知が同時に作成されても1件だけ通すよう、確認と記録をまとめてロックする
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	hash := contentHash(notification)
+	if seen, ok := s.seenContent[hash]; ok && now.Sub(seen.at) < s.dedupWindow {
+		return seen.id, ErrDuplicate
+	}
+	if !s.acquireCooldown(notification.Category, now) {
+		return "", ErrSuppressed
+	}
+	if now.Sub(s.lastPruned) >= s.dedupWindow {
+		for h, seen := range s.seenContent {
+			if now.Sub(seen.at) >= s.dedupWindow {
+				delete(s.seenContent, h)
+			}
+		}
+		s.lastPruned = now
+	}
+	s.seenContent[hash] = seenNotification{id: notification.ID, at: now}
+	return "", nil
+}
+
+// revokeAdmission はadmitで記録した重複判定とクールダウンを取り消す
+// 他の通知が既に記録を上書きしている場合はそのままにする
+func (s *NotificationServiceImpl) revokeAdmission(notification Notification, now time.Time) {
+	if s.dedupWindow > 0 {
+		s.dedupMu.Lock()
+		hash := contentHash(notification)
+		if seen, ok := s.seenContent[hash]; ok && seen.id == notification.ID {
+			delete(s.seenContent, hash)
+		}
+		s.dedupMu.Unlock()
+	}
+
+	s.cooldownMu.Lock()
+	defer s.cooldownMu.Unlock()
+	if last, ok := s.lastNotified[notification.Category]; ok && last.Equal(now) {
+		delete(s.lastNotified, notification.Category)
+	}
+}
+
+// contentHash は空白を正規化したタイトルとメッセージから重複判定用のハッシュを計算する
+// 宛先ユーザーが異なる通知は重複として扱わない
+func contentHash(notification Notification) string {
+	h := sha256.New()
+	for _, field := range []string{notification.UserID, notification.Title, notification.Message} {
+		h.Write([]byte(strings.Join(strings.Fields(field), " ")))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// acquireCooldown はカテゴリのクールダウンが経過していれば通知時刻を記録してtrueを返す
+func (s *NotificationServiceImpl) acquireCooldown(category string, now time.Time) bool {
+	cooldown, ok := s.cooldowns[category]
+	if category == "" || !ok || cooldown <= 0 {
+		return true
+	}
+
+	s.cooldownMu.Lock()
+	defer s.cooldownMu.Unlock()
+
+	if last, ok := s.lastNotified[category]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	s.lastNotified[category] = now
+	return true
+}
+
+// MarkNotificationAsRead, ArchiveNotification, PinNotification はversionが0の場合、バージョンを確認しない
+func (s *NotificationServiceImpl) MarkNotificationAsRead(id string, version int) error {
+	if id == "" {
+		return errors.New("notification ID is required")
+	}
+	// 既に既読の通知ではreadイベントを送信しない
+	wasRead := false
+	if s.webhooks.Wants(WebhookEventRead) {
+		if n, err := s.repo.Get(id); err == nil {
+			wasRead = n.Read
+		}
+	}
+	if err := s.repo.MarkAsRead(id, version); err != nil {
+		return err
+	}
+	s.unreadCountChanged()
+	if !wasRead {
+		s.notifyWebhooks(WebhookEventRead, s.lookup(WebhookEventRead, []string{id}))
+	}
+	return nil
+}
+
+func (s *NotificationServiceImpl) MarkNotificationsReadBefore(cutoff time.Time) []string {
+	marked := s.repo.MarkReadBefore(cutoff)
+	if len(marked) > 0 {
+		s.unreadCountChanged()
+		s.notifyWebhooks(WebhookEventRead, s.lookup(WebhookEventRead, marked))
+	}
+	return marked
+}
+
+func (s *NotificationServiceImpl) DeleteNotifications(ids []string) (deleted, notFound []string) {
+	// 削除後は内容を取得できないため、先に取得しておく
+	targets := s.lookup(WebhookEventDeleted, ids)
+	deleted, notFound = s.repo.DeleteMany(ids)
+	if len(deleted) > 0 {
+		s.unreadCountChanged()
+		s.notifyWebhooks(WebhookEventDeleted, slices.DeleteFunc(targets, func(n Notification) bool {
+			return !slices.Contains(deleted, n.ID)
+		}))
+	}
+	return deleted, notFound
+}
+
+// lookup はidsの通知を1回の走査で取得する。eventを受け取るWebhookがない場合は取得しない
+func (s *NotificationServiceImpl) lookup(event string, ids []string) []Notification {
+	if !s.webhooks.Wants(event) {
+		return nil
+	}
+	targets := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		targets[id] = true
+	}
+	var found []Notification
+	s.repo.ForEach(func(n Notification) error {
+		if targets[n.ID] {
+			found = append(found, n)
+		}
+		return nil
+	})
+	return found
+}
+
+func (s *NotificationServiceImpl) notifyWebhooks(event string, notifications []Notification) {
+	for _, n := range notifications {
+		s.webhooks.Notify(event, n)
+	}
+}
+
+func (s *NotificationServiceImpl) DedupeNotifications(window time.Duration) []DedupeGroup {
+	// ForEachは新しい順のため、最初に見つかった通知を残す
+	groups := []DedupeGroup{}
+	survivors := make(map[string]int)
+	var kept []Notification
+	var ids []string
+	s.repo.ForEach(func(n Notification) error {
+		hash := contentHash(n)
+		if i, ok := survivors[hash]; ok && (window <= 0 || kept[i].Timestamp.Sub(n.Timestamp) <= window) {
+			groups[i].Deleted = append(groups[i].Deleted, n.ID)
+			ids = append(ids, n.ID)
+			return nil
+		}
+		survivors[hash] = len(groups)
+		groups = append(groups, DedupeGroup{Kept: n.ID})
+		kept = append(kept, n)
+		return nil
+	})
+	if len(ids) == 0 {
+		return []DedupeGroup{}
+	}
+
+	// 走査後に削除された通知は結果に含めない
+	deleted, _ := s.DeleteNotifications(ids)
+	removed := make(map[string]bool, len(deleted))
+	for _, id := range deleted {
+		removed[id] = true
+	}
+	merged := []DedupeGroup{}
+	for _, group := range groups {
+		group.Deleted = slices.DeleteFunc(group.Deleted, func(id string) bool { return !removed[id] })
+		if len(group.Deleted) > 0 {
+			merged = append(merged, group)
+		}
+	}
+	return merged
+}
+
+func (s *NotificationServiceImpl) ArchiveNotification(id string, version int) error {
+	if id == "" {
+		return errors.New("notification ID is required")
+	}
+	if err := s.repo.Archive(id, s.clock.Now(), version); err != nil {
+		return err
+	}
+	s.unreadCountChanged()
+	return nil
+}
+
+func (s *NotificationServiceImpl) PinNotification(id string, pinned bool, version int) error {
+	if id == "" {
+		return errors.New("notification ID is required")
+	}
+	return s.repo.SetPinned(id, pinned, version)
+}
+
+// AddTag はタグを作成時と同じように正規化し、タグの数の上限を確認して追加する
+func (s *NotificationServiceImpl) AddTag(id, tag string, version int) (*Notification, bool, error) {
+	tags, err := s.normalizeTags([]string{tag})
+	if err != nil {
+		return nil, false, err
+	}
+	if s.maxTags > 0 {
+		current, err := s.repo.Get(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if !slices.Contains(current.Tags, tags[0]) && len(current.Tags) >= s.maxTags {
+			return nil, false, fmt.Errorf("too many tags: %d (max %d)", len(current.Tags)+1, s.maxTags)
+		}
+	}
+	return updated(s.repo.AddTag(id, tags[0], version))
+}
+
+func (s *NotificationServiceImpl) RemoveTag(id, tag string, version int) (*Notification, bool, error) {
+	return updated(s.repo.RemoveTag(id, strings.TrimSpace(tag), version))
+}
+
+func (s *NotificationServiceImpl) SetMetadata(id, key, value string, version int) (*Notification, bool, error) {
+	if err := validateMetadata(map[string]string{key: value}); err != nil {
+		return nil, false, err
+	}
+	return updated(s.repo.SetMetadata(id, key, value, version))
+}
+
+func (s *NotificationServiceImpl) UnsetMetadata(id, key string, version int) (*Notification, bool, error) {
+	return updated(s.repo.UnsetMetadata(id, key, version))
+}
+
+func updated(n Notification, changed bool, err error) (*Notification, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	return &n, changed, nil
+}
+
+// validateMetadata はキーが空でなく、前後に空白を含まないことを確認する
+func validateMetadata(metadata map[string]string) error {
+	for key := range metadata {
+		if key == "" || strings.TrimSpace(key) != key {
+			return fmt.Errorf("invalid metadata key: %q", key)
+		}
+	}
+	return nil
+}
+
+// Action callback payload
+type ActionCallbackEvent struct {
+	NotificationID string    `json:"notification_id"`
+	ActionID       string    `json:"action_id"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+const actionCallbackTimeout = 5 * time.Second
+
+func (s *NotificationServiceImpl) TakeAction(id, actionID string, version int) (*Action, error) {
+	notification, err := s.repo.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(notification.Actions, func(a Action) bool { return a.ID == actionID })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAction, actionID)
+	}
+	action := notification.Actions[i]
+
+	now := s.clock.Now()
+	if err := s.repo.RecordAction(id, actionID, now, version); err != nil {
+		return nil, err
+	}
+	if action.CallbackURL != "" {
+		go s.postActionCallback(action.CallbackURL, ActionCallbackEvent{NotificationID: id, ActionID: actionID, Timestamp: now})
+	}
+	return &action, nil
+}
+
+// postActionCallback はアクションのコールバックを1回だけ送信し、失敗した場合はログに残す
+func (s *NotificationServiceImpl) postActionCallback(callbackURL string, event ActionCallbackEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding action callback payload", "error", err)
+		return
+	}
+	client := &http.Client{Timeout: actionCallbackTimeout}
+	resp, err := client.Post(callbackURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		slog.Warn("Action callback failed", "url", callbackURL, "notification_id", event.NotificationID, "action_id", event.ActionID, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		slog.Warn("Action callback failed", "url", callbackURL, "notification_id", event.NotificationID, "action_id", event.ActionID, "status", resp.StatusCode)
+	}
+}
+
+func (s *NotificationServiceImpl) ClearAllNotifications() error {
+	var err error
+	if s.archiveOnClear {
+		err = s.repo.ArchiveAll(s.clock.Now())
+	} else {
+		err = s.repo.Clear()
+	}
+	if err != nil {
+		return err
+	}
+	s.unreadCountChanged()
+	s.webhooks.NotifyEvent(WebhookEvent{Event: WebhookEventCleared})
+	return nil
+}
+
+func (s *NotificationServiceImpl) ClearNotificationsForUser(userID string) error {
+	if userID == "" {
+		return errors.New("user ID is required")
+	}
+	var err error
+	if s.archiveOnClear {
+		err = s.repo.ArchiveForUser(userID, s.clock.Now())
+	} else {
+		err = s.repo.ClearForUser(userID)
+	}
+	if err != nil {
+		return err
+	}
+	s.unreadCountChanged()
+	s.webhooks.NotifyEvent(WebhookEvent{Event: WebhookEventCleared, UserID: userID})
+	return nil
+}
+
+func (s *NotificationServiceImpl) GetUserSubscription(userID string) UserSubscription {
+	sub, ok := s.repo.GetSubscription(userID)
+	if !ok {
+		return UserSubscription{Categories: []string{}, Tags: []string{}}
+	}
+	return sub
+}
+
+// SetUserSubscription はカテゴリが許可されていることを確認し、タグを正規化して保存する
+func (s *NotificationServiceImpl) SetUserSubscription(userID string, sub UserSubscription) (UserSubscription, error) {
+	if userID == "" {
+		return UserSubscription{}, errors.New("user ID is required")
+	}
+	for _, category := range sub.Categories {
+		if s.allowedCategories != nil && !s.allowedCategories[category] {
+			return UserSubscription{}, fmt.Errorf("category not allowed: %s", category)
+		}
+	}
+	tags, err := s.normalizeTags(sub.Tags)
+	if err != nil {
+		return UserSubscription{}, err
+	}
+	sub.Tags = tags
+	if sub.Categories == nil {
+		sub.Categories = []string{}
+	}
+	if sub.Tags == nil {
+		sub.Tags = []string{}
+	}
+	if err := s.repo.SetSubscription(userID, sub); err != nil {
+		return UserSubscription{}, err
+	}
+	return sub, nil
+}
+
+func (s *NotificationServiceImpl) CheckHealth() error {
+	return s.repo.Ping()
+}
+
+// sortForList は一覧の並び順に並べ替える
+func sortForList(notifications []Notification, byPriority bool) {
+	slices.SortStableFunc(notifications, func(a, b Notification) int {
+		return compareListOrder(a, b, byPriority)
+	})
+}
+
+// compareListOrder はピン留めした通知を先頭に、byPriorityの場合は優先度の高い順に、その中では新しい順に並べる
+// カーソルによるページングで位置が一意に決まるよう、最後はIDで比較する
+func compareListOrder(a, b Notification, byPriority bool) int {
+	if a.Pinned != b.Pinned {
+		if a.Pinned {
+			return -1
+		}
+		return 1
+	}
+	if byPriority {
+		if c := cmp.Compare(priorityRanks[b.Priority], priorityRanks[a.Priority]); c != 0 {
+			return c
+		}
+	}
+	if c := b.Timestamp.Compare(a.Timestamp); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.ID, a.ID)
+}
+
+// connWithMu wraps a websocket.Conn with a write mutex
+type connWithMu struct {
+	id          string
+	conn        *websocket.Conn
+	mu          sync.Mutex
+	connectedAt time.Time
+	// 空の場合はユーザーが特定されていない接続
+	userID string
+	// Sec-WebSocket-Protocolでネゴシエーションしたサブプロトコル。空の場合は指定なし
+	protocol     string
+	subscription atomic.Pointer[Subscription]
+	// ブロードキャストは送信キューを経由し、接続ごとのgoroutineが書き込む
+	send     chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+	// 最後にクライアントからメッセージかPingを受信した時刻 (UnixNano)
+	lastActivity atomic.Int64
+}
+
+// touch はクライアントからの受信を記録する
+func (c *connWithMu) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *connWithMu) lastActivityAt() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+func (c *connWithMu) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+func (c *connWithMu) WritePing() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+// writeMessage は書き込みが止まった接続で送信goroutineが詰まらないよう、期限付きで書き込む
+func (c *connWithMu) writeMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// writeJSONBefore はハンドシェイク中の書き込みに使用し、deadlineまでに書き込めない場合はエラーを返す
+func (c *connWithMu) writeJSONBefore(v interface{}, deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(deadline)
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return c.conn.WriteJSON(v)
+}
+
+// stop は送信goroutineを終了させる
+func (c *connWithMu) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// writeClose はクローズフレームを送信する
+func (c *connWithMu) writeClose(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+}
+
+// Quiet hours
+// StartからEndまでの間 (EndがStartより前の場合は日をまたぐ) は、critical以外の通知の配信を保留する
+type QuietHours struct {
+	// 0時からの経過時間
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// Active はnowが静音時間内かどうかを返す。nilの場合は常にfalse
+func (q *QuietHours) Active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	now = now.In(q.Location)
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if q.Start <= q.End {
+		return offset >= q.Start && offset < q.End
+	}
+	return offset >= q.Start || offset < q.End
+}
+
+// parseQuietHours は "22:00-07:00" の形式の静音時間を解析する。空の場合はnilを返す
+func parseQuietHours(s string, loc *time.Location) (*QuietHours, error) {
+	if s == "" {
+		return nil, nil
+	}
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours: %s (expected HH:MM-HH:MM)", s)
+	}
+	q := &QuietHours{Location: loc}
+	var err error
+	if q.Start, err = parseTimeOfDay(start); err != nil {
+		return nil, fmt.Errorf("invalid quiet hours: %s (expected HH:MM-HH:MM)", s)
+	}
+	if q.End, err = parseTimeOfDay(end); err != nil {
+		return nil, fmt.Errorf("invalid quiet hours: %s (expected HH:MM-HH:MM)", s)
+	}
+	if q.Start == q.End {
+		return nil, fmt.Errorf("invalid quiet hours: %s (start and end must differ)", s)
+	}
+	return q, nil
+}
+
+// Do not disturb
+// ユーザーごとのおやすみモード。有効な間はそのユーザー宛ての通知の配信を保留し、終了後に送信する
+type DoNotDisturb struct {
+	Enabled bool `json:"enabled"`
+	// 空の場合は解除するまで続く
+	Until *time.Time `json:"until,omitempty"`
+	// trueの場合、criticalの通知はおやすみモード中でも送信する
+	AllowCritical bool `json:"allow_critical"`
+}
+
+// Active はnowがおやすみモード中かどうかを返す
+func (d DoNotDisturb) Active(now time.Time) bool {
+	return d.Enabled && (d.Until == nil || now.Before(*d.Until))
+}
+
+// SetDoNotDisturbRequest はPUT /api/users/:id/dndのリクエスト
+type SetDoNotDisturbRequest struct {
+	Enabled       *bool      `json:"enabled" binding:"required"`
+	Until         *time.Time `json:"until"`
+	AllowCritical bool       `json:"allow_critical"`
+}
+
+// doNotDisturbState はおやすみモードの設定と、その間に保留した通知
+type doNotDisturbState struct {
+	DoNotDisturb
+	held []Notification
+}
+
+// parseTimeOfDay は "HH:MM" を0時からの経過時間に変換する
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// WebSocket subprotocols
+// クライアントがSec-WebSocket-Protocolで指定できるプロトコル。先頭ほど優先する
+const WSSubprotocolV1 = "notibag.v1"
+
+var wsSubprotocols = []string{WSSubprotocolV1}
+
+// Backpressure policies
+// 送信キューが一杯になった場合の動作
+const (
+	BackpressureDropClient       = "drop_client"
+	BackpressureDropOldest       = "drop_oldest"
+	BackpressureDropNewest       = "drop_newest"
+	BackpressureBlockWithTimeout = "block_with_timeout"
+)
+
+// In-flight policies
+// 同時に実行しているブロードキャストが上限に達した場合の動作
+const (
+	// 実行中のブロードキャストが終わるまで待つ
+	InFlightQueue = "queue"
+	// 待たずにブロードキャストを破棄する
+	InFlightShed = "shed"
+)
+
+const (
+	defaultSendBufferSize = 256
+	defaultSendTimeout    = time.Second
+)
+
+// logSampler は多数のクライアントが同時に失敗した場合にログが溢れないよう、
+// interval ごとに最初のlimit件だけを出力し、残りは件数のみを出力する
+type logSampler struct {
+	limit    int
+	interval time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	logged      int
+	suppressed  int
+}
+
+// Allow はログを出力してよい場合にtrueを返す。nilまたはlimitが0以下の場合は常にtrue
+func (s *logSampler) Allow() bool {
+	if s == nil || s.limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.windowStart) >= s.interval {
+		s.windowStart = now
+		s.logged = 0
+	}
+	if s.logged < s.limit {
+		s.logged++
+		return true
+	}
+	if s.suppressed == 0 {
+		// 以降の失敗がなくても件数が出力されるよう、期間の終わりにまとめて出力する
+		time.AfterFunc(s.windowStart.Add(s.interval).Sub(now), s.flush)
+	}
+	s.suppressed++
+	return false
+}
+
+func (s *logSampler) flush() {
+	s.mu.Lock()
+	suppressed := s.suppressed
+	s.suppressed = 0
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		slog.Warn("Suppressed WebSocket client error logs", "count", suppressed, "interval", s.interval)
+	}
+}
+
+// sendErrorRate は現在と直前のwindowの送信数・失敗数から、直近の送信の失敗率を数える
+type sendErrorRate struct {
+	window time.Duration
+
+	mu           sync.Mutex
+	windowStart  time.Time
+	sends        int64
+	failures     int64
+	prevSends    int64
+	prevFailures int64
+	lastError    string
+	lastErrorAt  time.Time
+}
+
+// rotate はwindowを過ぎていれば現在の件数を直前の件数に移す
+func (r *sendErrorRate) rotate(now time.Time) {
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < r.window {
+		return
+	}
+	r.prevSends, r.prevFailures = 0, 0
+	if elapsed < 2*r.window {
+		r.prevSends, r.prevFailures = r.sends, r.failures
+	}
+	r.sends, r.failures = 0, 0
+	r.windowStart = now
+}
+
+func (r *sendErrorRate) addSends(now time.Time, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate(now)
+	r.sends += int64(n)
+}
+
+func (r *sendErrorRate) addFailure(now time.Time, err string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate(now)
+	r.failures++
+	r.lastError = err
+	r.lastErrorAt = now
+}
+
+// Rate は失敗率と、その計算に使った送信数を返す
+func (r *sendErrorRate) Rate(now time.Time) (float64, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rotate(now)
+	sends := r.sends + r.prevSends
+	if sends == 0 {
+		return 0, 0
+	}
+	return min(float64(r.failures+r.prevFailures)/float64(sends), 1), sends
+}
+
+// LastFailure は最後に失敗した送信のエラーと時刻を返す。失敗していない場合の時刻はゼロ値
+func (r *sendErrorRate) LastFailure() (string, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastError, r.lastErrorAt
+}
+
+// WebSocket manager configuration
+type WSConfig struct {
+	// クライアントから受信するメッセージの最大バイト数 (0以下は無制限)
+	MaxMessageSize int64
+	// 接続ごとに1秒あたり受信できるメッセージ数と、一時的に超えてよい件数 (0以下の場合は無制限)
+	// 超えた接続はpolicy violationで切断する
+	MaxMessageRate  float64
+	MaxMessageBurst int
+	// 0の場合はgorilla/websocketのデフォルト (4096バイト) を使用する
+	ReadBufferSize  int
+	WriteBufferSize int
+	// trueの場合、接続間で書き込みバッファを共有してアロケーションを減らす
+	UseBufferPool bool
+	// trueの場合、ユーザーが特定されていない接続のclear_allで全件を削除できる
+	AllowGlobalClear bool
+	// 接続ごとの送信キューの長さ (0以下の場合は256)
+	SendBufferSize int
+	// 送信キューが一杯になった場合の動作 (空の場合はdrop_client)
+	BackpressurePolicy string
+	// block_with_timeoutで空きを待つ最大時間 (0以下の場合は1秒)
+	SendTimeout time.Duration
+	// クライアントごとの送信エラーのログを、ErrorLogIntervalごとにこの件数までに抑える (0以下の場合は無制限)
+	ErrorLogLimit    int
+	ErrorLogInterval time.Duration
+	// 直近の送信の失敗率がこれを超えた場合、ヘルスチェックでdegradedとする (0以下の場合は判定しない)
+	HealthErrorRate float64
+	// 0より大きい場合、この期間内に続けて作成された通知をnotifications_batchにまとめて送信する
+	BatchWindow time.Duration
+	// 再接続時に再送するため保持する直近のブロードキャストの件数 (0以下の場合は無効)
+	ReplayBufferSize int
+	// 0より大きい場合、これより古いブロードキャストは再送しない
+	ReplayMaxAge time.Duration
+	// 空でない場合、再送用のブロードキャストをこのファイルに保存し、再起動後も再送する
+	ReplayPath string
+	// trueの場合、全てのブロードキャストにseqを付与し、各クライアントにseqの順で送信する
+	OrderedBroadcasts bool
+	// nilでない場合、ブロードキャストする通知にカテゴリの色を付与する
+	CategoryColors map[string]string
+	// 接続元IPごとの同時接続数の上限 (0以下の場合は無制限)
+	MaxConnsPerIP int
+	// nilでない場合、静音時間中はcritical以外の通知を保留し、終了後に送信する
+	QuietHours *QuietHours
+	// nilでない場合、ackされないcriticalの通知を再送する
+	Escalation *EscalationPolicy
+	// 0より大きい場合、接続後この期間内に認証と初回の通知一覧の送信を終えない接続を切断する
+	HandshakeTimeout time.Duration
+	// 空でない場合、接続時のBearerヘッダーかtokenクエリ、または最初のauthメッセージでいずれかのAPIキーを送信させる
+	APIKeys map[string]string
+	// 0より大きい場合、同時に実行するブロードキャストの数をこの数までに制限する
+	MaxInFlightBroadcasts int
+	// 上限に達した場合の動作 (空の場合はqueue)
+	InFlightPolicy string
+	// nilの場合は現在時刻を使用する
+	Clock Clock
+}
+
+// EscalationPolicy はackされないcriticalの通知を、Afterごとに最大MaxEscalations回再送する
+type EscalationPolicy struct {
+	After          time.Duration
+	MaxEscalations int
+	// nilでない場合、再送のたびにescalatedイベントを送信する (Slackなどへの転送用)
+	Webhooks *WebhookDispatcher
+}
+
+// Validate は起動時に設定値の整合性を確認する
+func (cfg WSConfig) Validate() error {
+	if cfg.Escalation != nil && (cfg.Escalation.After <= 0 || cfg.Escalation.MaxEscalations < 1) {
+		return fmt.Errorf("invalid escalation policy: after %s, max %d", cfg.Escalation.After, cfg.Escalation.MaxEscalations)
+	}
+	if cfg.MaxMessageRate > 0 && cfg.MaxMessageBurst < 1 {
+		return fmt.Errorf("invalid message burst: %d", cfg.MaxMessageBurst)
+	}
+	if cfg.HealthErrorRate > 1 {
+		return fmt.Errorf("invalid health error rate: %g (must be at most 1)", cfg.HealthErrorRate)
+	}
+	switch cfg.InFlightPolicy {
+	case "", InFlightQueue, InFlightShed:
+	default:
+		return fmt.Errorf("invalid in-flight policy: %s", cfg.InFlightPolicy)
+	}
+	switch cfg.BackpressurePolicy {
+	case "", BackpressureDropClient, BackpressureDropOldest, BackpressureDropNewest, BackpressureBlockWithTimeout:
+		return nil
+	default:
+		return fmt.Errorf("invalid backpressure policy: %s", cfg.BackpressurePolicy)
+	}
+}
+
+// rateLimiter はトークンバケットで受信メッセージの頻度を制限する。1つの読み取りループからのみ使用する
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter はrateが0以下の場合、常に許可するnilを返す
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (l *rateLimiter) Allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// WebSocket manager implementation
+type WSManagerImpl struct {
+	clients          map[*websocket.Conn]*connWithMu
+	mu               sync.RWMutex
+	service          NotificationService
+	upgrader         websocket.Upgrader
+	maxMessageSize   int64
+	messageRate      float64
+	messageBurst     int
+	allowGlobalClear bool
+	handshakeTimeout time.Duration
+	apiKeys          map[string]string
+	nextConnID       atomic.Uint64
+	sendBufferSize   int
+	policy           string
+	sendTimeout      time.Duration
+	errorLogs        *logSampler
+	sendErrors       *sendErrorRate
+	healthErrorRate  float64
+	categoryColors   map[string]string
+
+	// 送信を保留している通知。batchOpenの間に作成された通知を期間の終わりにまとめて送る
+	batchWindow time.Duration
+	batchOpen   bool
+	pending     []Notification
+	batchMu     sync.Mutex
+
+	// 静音時間中に保留した通知
+	quietHours *QuietHours
+	clock      Clock
+	held       []Notification
+	heldMu     sync.Mutex
+
+	// ユーザーごとのおやすみモードと保留した通知
+	dnd   map[string]*doNotDisturbState
+	dndMu sync.Mutex
+
+	// ackを待っているcriticalの通知
+	escalation   *EscalationPolicy
+	escalations  map[string]*pendingEscalation
+	escalationMu sync.Mutex
+
+	// 未読数の変更をまとめて送信するためのタイマー。lastUnreadは接続のユーザーごとに最後に送信した未読数
+	// (ユーザーを指定していない接続は空のキー)
+	unreadTimer Timer
+	lastUnread  map[string]int
+	unreadMu    sync.Mutex
+
+	// 通知IDごとにack・既読にした接続IDを保持する
+	acks   map[string]map[string]struct{}
+	reads  map[string]map[string]struct{}
+	acksMu sync.Mutex
+
+	// 直近のブロードキャストのリングバッファ。seqの採番と送信先の決定もreplayMuで直列化する
+	replay      []replayEntry
+	replayStart int
+	replayLen   int
+	seq         uint64
+	replayMu    sync.Mutex
+	// 空でない場合はreplayをファイルに保存する。ブロードキャストではreplayDirtyを立て、RunReplayPersistenceがまとめて書き込む
+	replayPath   string
+	replayDirty  bool
+	replayMaxAge time.Duration
+	// 古いスナップショットで新しいファイルを上書きしないよう、ファイルへの書き込みを直列化する
+	replaySaveMu sync.Mutex
+	// trueの場合、送信キューへの追加を終えるまでreplayMuを保持し、採番した順に送信する
+	ordered bool
+
+	// SSEの購読者
+	streams   map[*streamSubscriber]struct{}
+	streamsMu sync.Mutex
+
+	// 接続元IPごとの接続数。アップグレード前に確保し、切断時に解放する
+	maxPerIP int
+	ipConns  map[string]int
+	ipMu     sync.Mutex
+
+	// 同時に実行しているブロードキャストを制限するセマフォ (nilの場合は無制限)
+	inFlight       chan struct{}
+	inFlightPolicy string
+
+	totalConnections  atomic.Int64
+	totalBroadcasts   atomic.Int64
+	broadcastFailures atomic.Int64
+	droppedMessages   atomic.Int64
+	fanoutNanos       atomic.Int64
+	inFlightCount     atomic.Int64
+	shedBroadcasts    atomic.Int64
+}
+
+func NewWSManager(service NotificationService, cfg WSConfig) (*WSManagerImpl, error) {
+	w := &WSManagerImpl{
+		clients:          make(map[*websocket.Conn]*connWithMu),
+		acks:             make(map[string]map[string]struct{}),
+		reads:            make(map[string]map[string]struct{}),
+		streams:          make(map[*streamSubscriber]struct{}),
+		escalations:      make(map[string]*pendingEscalation),
+		service:          service,
+		maxMessageSize:   cfg.MaxMessageSize,
+		messageRate:      cfg.MaxMessageRate,
+		messageBurst:     cfg.MaxMessageBurst,
+		allowGlobalClear: cfg.AllowGlobalClear,
+		handshakeTimeout: cfg.HandshakeTimeout,
+		apiKeys:          cfg.APIKeys,
+		sendBufferSize:   cfg.SendBufferSize,
+		policy:           cfg.BackpressurePolicy,
+		sendTimeout:      cfg.SendTimeout,
+		errorLogs:        &logSampler{limit: cfg.ErrorLogLimit, interval: cfg.ErrorLogInterval},
+		sendErrors:       &sendErrorRate{window: wsHealthWindow},
+		healthErrorRate:  cfg.HealthErrorRate,
+		categoryColors:   cfg.CategoryColors,
+		batchWindow:      cfg.BatchWindow,
+		lastUnread:       make(map[string]int),
+		maxPerIP:         cfg.MaxConnsPerIP,
+		ipConns:          make(map[string]int),
+		dnd:              make(map[string]*doNotDisturbState),
+		quietHours:       cfg.QuietHours,
+		escalation:       cfg.Escalation,
+		clock:            cfg.Clock,
+		replayPath:       cfg.ReplayPath,
+		replayMaxAge:     cfg.ReplayMaxAge,
+		ordered:          cfg.OrderedBroadcasts,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.WriteBufferSize,
+			Subprotocols:    wsSubprotocols,
+			CheckOrigin: func(r *http.Request) bool {
+				return true // 開発環境用、本番では適切に設定
+			},
+		},
+	}
+	if cfg.UseBufferPool {
+		w.upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	if cfg.ReplayBufferSize > 0 {
+		w.replay = make([]replayEntry, cfg.ReplayBufferSize)
+	}
+	if cfg.MaxInFlightBroadcasts > 0 {
+		w.inFlight = make(chan struct{}, cfg.MaxInFlightBroadcasts)
+		w.inFlightPolicy = cfg.InFlightPolicy
+	}
+	if w.sendBufferSize <= 0 {
+		w.sendBufferSize = defaultSendBufferSize
+	}
+	if w.policy == "" {
+		w.policy = BackpressureDropClient
+	}
+	if w.sendTimeout <= 0 {
+		w.sendTimeout = defaultSendTimeout
+	}
+	if w.clock == nil {
+		w.clock = realClock{}
+	}
+	if w.replayPath != "" && len(w.replay) > 0 {
+		if err := w.loadReplay(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// acquireIP は接続元IPの接続数を増やす。上限に達している場合は増やさずにfalseを返す
+func (w *WSManagerImpl) acquireIP(ip string) bool {
+	w.ipMu.Lock()
+	defer w.ipMu.Unlock()
+	if w.maxPerIP > 0 && w.ipConns[ip] >= w.maxPerIP {
+		return false
+	}
+	w.ipConns[ip]++
+	return true
+}
+
+func (w *WSManagerImpl) releaseIP(ip string) {
+	w.ipMu.Lock()
+	defer w.ipMu.Unlock()
+	if w.ipConns[ip] <= 1 {
+		delete(w.ipConns, ip)
+		return
+	}
+	w.ipConns[ip]--
+}
+
+func (w *WSManagerImpl) AddClient(conn *websocket.Conn, userID string) {
+	w.addClient(conn, userID)
+}
+
+// AddClientSince は再送したメッセージ数を返す。sinceSeqがバッファより古い場合は残っている分のみ再送する
+func (w *WSManagerImpl) AddClientSince(conn *websocket.Conn, userID string, sinceSeq uint64) int {
+	// 登録と再送の間に送られたブロードキャストが重複・欠落しないよう、採番を止めて行う
+	w.replayMu.Lock()
+	defer w.replayMu.Unlock()
+	c := w.addClient(conn, userID)
+
+	now := w.clock.Now()
+	replayed := 0
+	for i := 0; i < w.replayLen; i++ {
+		entry := w.replay[(w.replayStart+i)%len(w.replay)]
+		if entry.message.Seq <= sinceSeq || (entry.filter != nil && !entry.filter(c)) {
+			continue
+		}
+		if w.replayMaxAge > 0 && now.Sub(entry.at) > w.replayMaxAge {
+			continue
+		}
+		data, err := json.Marshal(entry.message)
+		if err != nil {
+			slog.Error("Error encoding WebSocket message", "type", entry.message.Type, "error", err)
+			continue
+		}
+		if !w.enqueue(c, data) {
+			break
+		}
+		replayed++
+	}
+	return replayed
+}
+
+func (w *WSManagerImpl) addClient(conn *websocket.Conn, userID string) *connWithMu {
+	// 保存された購読条件があれば、subscribeを待たずに適用する
+	var sub *Subscription
+	if userID != "" {
+		sub = w.service.GetUserSubscription(userID).Subscription()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := &connWithMu{
+		id:          strconv.FormatUint(w.nextConnID.Add(1), 10),
+		conn:        conn,
+		connectedAt: time.Now(),
+		userID:      userID,
+		protocol:    conn.Subprotocol(),
+		send:        make(chan []byte, w.sendBufferSize),
+		done:        make(chan struct{}),
+	}
+	c.touch()
+	c.subscription.Store(sub)
+	w.clients[conn] = c
+	w.totalConnections.Add(1)
+	go w.writeLoop(c)
+	return c
+}
+
+// replayEntry は再送用に保持するブロードキャスト。filterは再接続したクライアントに対して評価する
+type replayEntry struct {
+	message WSMessage
+	filter  func(c *connWithMu) bool
+	at      time.Time
+}
+
+// persistedReplay はファイルに保存する再送用のブロードキャスト
+// filterは保存できないため、読み込み時にメッセージの内容から復元する
+type persistedReplay struct {
+	Seq     uint64                 `json:"seq"`
+	Entries []persistedReplayEntry `json:"entries"`
+}
+
+type persistedReplayEntry struct {
+	// バージョンごとの形式ではなく、全フィールドを保存する
+	Message legacyWSMessage `json:"message"`
+	At      time.Time       `json:"at"`
+}
+
+// loadReplay は保存されたブロードキャストを読み込む。ReplayMaxAgeより古いものは読み込まない
+func (w *WSManagerImpl) loadReplay() error {
+	data, err := os.ReadFile(w.replayPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var persisted persistedReplay
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", w.replayPath, err)
+	}
+
+	// 再起動前のseqに続けて採番し、クライアントのsince_seqと比較できるようにする
+	w.seq = persisted.Seq
+	entries := persisted.Entries
+	if len(entries) > len(w.replay) {
+		entries = entries[len(entries)-len(w.replay):]
+	}
+	now := w.clock.Now()
+	for _, entry := range entries {
+		if w.replayMaxAge > 0 && now.Sub(entry.At) > w.replayMaxAge {
+			continue
+		}
+		message := WSMessage(entry.Message)
+		w.replay[w.replayLen] = replayEntry{message: message, filter: w.replayFilter(message), at: entry.At}
+		w.replayLen++
+	}
+	return nil
+}
+
+// replayFilter は保存したメッセージの送信先の条件を、ブロードキャスト時と同じように復元する
+func (w *WSManagerImpl) replayFilter(message WSMessage) func(c *connWithMu) bool {
+	switch {
+	case message.Notification != nil:
+		return notificationFilter(*message.Notification)
+	case message.Type == "notification_read", message.Type == "notification_archived", message.Type == "notification_pinned":
+		return w.readStateFilter(message.NotificationID)
+	}
+	return nil
+}
+
+// SaveReplay は前回の保存以降にバッファが変更されていればファイルに保存する
+// ブロードキャストを止めないよう、replayMuはバッファのコピーを作る間だけ保持する
+func (w *WSManagerImpl) SaveReplay() {
+	if w.replayPath == "" {
+		return
+	}
+	w.replaySaveMu.Lock()
+	defer w.replaySaveMu.Unlock()
+
+	w.replayMu.Lock()
+	if !w.replayDirty {
+		w.replayMu.Unlock()
+		return
+	}
+	persisted := persistedReplay{Seq: w.seq, Entries: make([]persistedReplayEntry, 0, w.replayLen)}
+	for i := 0; i < w.replayLen; i++ {
+		entry := w.replay[(w.replayStart+i)%len(w.replay)]
+		persisted.Entries = append(persisted.Entries, persistedReplayEntry{Message: legacyWSMessage(entry.message), At: entry.at})
+	}
+	w.replayDirty = false
+	w.replayMu.Unlock()
+
+	data, err := json.Marshal(persisted)
+	if err == nil {
+		err = writeFileAtomic(w.replayPath, data)
+	}
+	if err != nil {
+		slog.Error("Error saving WebSocket replay history", "path", w.replayPath, "error", err)
+		// 次の保存で再試行する
+		w.replayMu.Lock()
+		w.replayDirty = true
+		w.replayMu.Unlock()
+	}
+}
+
+// RunReplayPersistence は停止されるまで、replaySaveIntervalごとに変更されたバッファを保存する
+// 停止時にも保存するが、シャットダウン中のブロードキャストも保存するにはその後にSaveReplayを呼び出す
+func (w *WSManagerImpl) RunReplayPersistence(ctx context.Context) {
+	ticker := time.NewTicker(replaySaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.SaveReplay()
+			return
+		case <-ticker.C:
+			w.SaveReplay()
+		}
+	}
+}
+
+// record はバッファが有効な場合にseqを採番してメッセージを保持し、seqを返す
+// replayMuを保持した状態で呼び出す
+func (w *WSManagerImpl) record(message WSMessage, filter func(c *connWithMu) bool) uint64 {
+	if len(w.replay) == 0 {
+		// 再送しない場合も、クライアントが順序を確認できるようseqを付与する
+		if w.ordered {
+			w.seq++
+			return w.seq
+		}
+		return 0
+	}
+	w.seq++
+	message.Seq = w.seq
+	w.replayDirty = true
+	entry := replayEntry{message: message, filter: filter, at: w.clock.Now()}
+	if w.replayLen < len(w.replay) {
+		w.replay[(w.replayStart+w.replayLen)%len(w.replay)] = entry
+		w.replayLen++
+	} else {
+		w.replay[w.replayStart] = entry
+		w.replayStart = (w.replayStart + 1) % len(w.replay)
+	}
+	return w.seq
+}
+
+func (w *WSManagerImpl) RemoveClient(conn *websocket.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c, ok := w.clients[conn]; ok {
+		c.stop()
+		delete(w.clients, conn)
+	}
+}
+
+// writeLoop は送信キューのメッセージを順に書き込む
+func (w *WSManagerImpl) writeLoop(c *connWithMu) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			if err := c.writeMessage(data); err != nil {
+				select {
+				case <-c.done:
+					// 切断済みの接続への書き込みエラーは失敗として数えない
+					return
+				default:
+				}
+				if w.errorLogs.Allow() {
+					slog.Warn("Error writing to client", "connection_id", c.id, "error", err)
+				}
+				w.broadcastFailures.Add(1)
+				w.sendErrors.addFailure(w.clock.Now(), err.Error())
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// enqueue は送信キューにメッセージを追加し、キューが一杯の場合はポリシーに従う
+// メッセージをキューに追加できた場合にtrueを返す
+func (w *WSManagerImpl) enqueue(c *connWithMu, data []byte) bool {
+	select {
+	case c.send <- data:
+		return true
+	default:
+	}
+
+	switch w.policy {
+	case BackpressureDropNewest:
+		w.droppedMessages.Add(1)
+		return false
+
+	case BackpressureDropOldest:
+		for {
+			select {
+			case <-c.send:
+				w.droppedMessages.Add(1)
+			default:
+			}
+			select {
+			case c.send <- data:
+				return true
+			default:
+			}
+		}
+
+	case BackpressureBlockWithTimeout:
+		timer := time.NewTimer(w.sendTimeout)
+		defer timer.Stop()
+		select {
+		case c.send <- data:
+			return true
+		case <-c.done:
+			return false
+		case <-timer.C:
+		}
+	}
+
+	// 受信が追いつかないクライアントを切断する。読み取りループの終了時に削除される
+	if w.errorLogs.Allow() {
+		slog.Warn("WebSocket client too slow, closing connection", "connection_id", c.id, "policy", w.policy)
+	}
+	w.broadcastFailures.Add(1)
+	w.sendErrors.addFailure(w.clock.Now(), "client too slow ("+w.policy+")")
+	c.stop()
+	c.conn.Close()
+	return false
+}
+
+func (w *WSManagerImpl) GetClient(conn *websocket.Conn) *connWithMu {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.clients[conn]
+}
+
+func (w *WSManagerImpl) Connections() []ConnectionInfo {
+	w.mu.RLock()
+	connections := make([]ConnectionInfo, 0, len(w.clients))
+	for _, c := range w.clients {
+		connections = append(connections, ConnectionInfo{
+			ID:             c.id,
+			UserID:         c.userID,
+			ConnectedAt:    c.connectedAt,
+			LastActivityAt: c.lastActivityAt(),
+			Protocol:       c.protocol,
+		})
+	}
+	w.mu.RUnlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ConnectedAt.Before(connections[j].ConnectedAt)
+	})
+	return connections
+}
+
+func (w *WSManagerImpl) Disconnect(id string) error {
+	var target *connWithMu
+	w.mu.RLock()
+	for _, c := range w.clients {
+		if c.id == id {
+			target = c
+			break
+		}
+	}
+	w.mu.RUnlock()
+	if target == nil {
+		return ErrConnectionNotFound
+	}
+
+	w.closeClient(target, websocket.ClosePolicyViolation, "disconnected by administrator")
+	return nil
+}
+
+// closeClient はクローズフレームを送信して接続を閉じる
+func (w *WSManagerImpl) closeClient(c *connWithMu, code int, reason string) {
+	if err := c.writeClose(code, reason); err != nil {
+		slog.Warn("Error sending close frame", "connection_id", c.id, "error", err)
+	}
+
+	// 読み取りループもエラーで終了し、そちらからも削除される
+	c.conn.Close()
+	w.RemoveClient(c.conn)
+}
+
+// RunIdleCheck は停止されるまで、timeout を超えて何も受信していないクライアントを切断する
+// 確認はtimeoutの半分ごとに行うため、実際に切断されるまでには最大で1.5倍かかる
+func (w *WSManagerImpl) RunIdleCheck(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.disconnectIdle(now, timeout)
+		}
+	}
+}
+
+// disconnectIdle はtimeoutを超えてアイドル状態のクライアントを切断し、その数を返す
+func (w *WSManagerImpl) disconnectIdle(now time.Time, timeout time.Duration) int {
+	idle := w.clientList(func(c *connWithMu) bool {
+		return now.Sub(c.lastActivityAt()) > timeout
+	})
+	for _, c := range idle {
+		slog.Info("Disconnecting idle WebSocket client", "connection_id", c.id, "last_activity_at", c.lastActivityAt())
+		w.closeClient(c, websocket.ClosePolicyViolation, "idle timeout")
+	}
+	return len(idle)
+}
+
+// Shutdown は全クライアントにクローズフレームを送信し、ctxが終了するまで切断を待つ
+// 期限までに切断しなかった接続は強制的に閉じ、その数を返す
+func (w *WSManagerImpl) Shutdown(ctx context.Context) int {
+	for _, c := range w.clientList(nil) {
+		// クローズフレームの後に通知が送られないよう、先に送信goroutineを止める
+		c.stop()
+		if err := c.writeClose(websocket.CloseGoingAway, "server shutting down"); err != nil {
+			slog.Warn("Error sending close frame", "connection_id", c.id, "error", err)
+		}
+	}
+
+	// クライアントがクローズフレームを返すと読み取りループが終了し、一覧から削除される
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for len(w.clientList(nil)) > 0 {
+		select {
+		case <-ctx.Done():
+			remaining := w.clientList(nil)
+			for _, c := range remaining {
+				c.conn.Close()
+				w.RemoveClient(c.conn)
+			}
+			return len(remaining)
+		case <-ticker.C:
+		}
+	}
+	return 0
+}
+
+func (w *WSManagerImpl) Broadcast(message WSMessage) int {
+	return w.broadcast(message, nil)
+}
+
+// BroadcastNotification は通知を送信し、送信できたクライアント数を返す
+// 静音時間・おやすみモード・まとめて送信するために保留した場合は0とtrueを返す
+func (w *WSManagerImpl) BroadcastNotification(notification Notification) (int, bool) {
+	if notification.Priority != PriorityCritical && w.quietHours.Active(w.clock.Now()) {
+		w.heldMu.Lock()
+		w.held = append(w.held, notification)
+		w.heldMu.Unlock()
+		return 0, true
+	}
+	if w.holdForDoNotDisturb(notification) {
+		return 0, true
+	}
+	if w.batchWindow > 0 {
+		// 期間内の通知は全て期間の終わりにまとめて送信する
+		w.batchMu.Lock()
+		w.pending = append(w.pending, notification)
+		if !w.batchOpen {
+			w.batchOpen = true
+			w.clock.AfterFunc(w.batchWindow, w.flushBatch)
+		}
+		w.batchMu.Unlock()
+		return 0, true
+	}
+	return w.broadcastNotification(notification), false
+}
+
+func (w *WSManagerImpl) broadcastNotification(notification Notification) int {
+	notification = w.withColor(notification)
+	message := WSMessage{
+		Type:         "notification",
+		Notification: &notification,
+	}
+	delivered := w.broadcast(message, notificationFilter(notification))
+	w.publishStream(notification)
+	w.trackEscalation(notification)
+	if delivered > 0 {
+		w.markDelivered(notification)
+	}
+	return delivered
+}
+
+// markDelivered はauto_read_on_deliveryが有効な未読の通知を、配信後に既読にする
+func (w *WSManagerImpl) markDelivered(notification Notification) {
+	if !notification.AutoRead || notification.Read {
+		return
+	}
+	if err := w.service.MarkNotificationAsRead(notification.ID, 0); err != nil {
+		slog.Warn("Error marking delivered notification as read", "id", notification.ID, "error", err)
+		return
+	}
+	w.BroadcastReadState(notification.ID, true)
+}
+
+// streamSubscriber はSSEで通知を受け取る購読者
+type streamSubscriber struct {
+	userID string
+	filter NotificationFilter
+	ch     chan Notification
+}
+
+// streamBufferSize はSSEの購読者ごとに送信待ちにできる通知の数
+const streamBufferSize = 64
+
+func (w *WSManagerImpl) SubscribeStream(userID string, filter NotificationFilter) (<-chan Notification, func()) {
+	sub := &streamSubscriber{userID: userID, filter: filter, ch: make(chan Notification, streamBufferSize)}
+	w.streamsMu.Lock()
+	w.streams[sub] = struct{}{}
+	w.streamsMu.Unlock()
+	return sub.ch, func() {
+		w.streamsMu.Lock()
+		delete(w.streams, sub)
+		w.streamsMu.Unlock()
+	}
+}
+
+// publishStream は宛先と条件に一致するSSEの購読者に通知を送る
+func (w *WSManagerImpl) publishStream(notification Notification) {
+	w.streamsMu.Lock()
+	defer w.streamsMu.Unlock()
+	for sub := range w.streams {
+		if !visibleTo(notification, sub.userID) || !sub.filter.matchesAttributes(notification) {
+			continue
+		}
+		select {
+		case sub.ch <- notification:
+		default:
+			w.droppedMessages.Add(1)
+		}
+	}
+}
+
+// notificationFilter は通知を受け取れる (宛先と購読条件に一致する) クライアントを選ぶ
+func notificationFilter(notification Notification) func(c *connWithMu) bool {
+	return func(c *connWithMu) bool {
+		return visibleTo(notification, c.userID) && c.subscription.Load().Matches(notification)
+	}
+}
+
+// Escalation
+type pendingEscalation struct {
+	level int
+	due   time.Time
+}
+
+// trackEscalation はcriticalの通知を最初に送信した時点から、ackを待つ期間を数え始める
+func (w *WSManagerImpl) trackEscalation(notification Notification) {
+	if w.escalation == nil || notification.Priority != PriorityCritical || notification.Escalation > 0 {
+		return
+	}
+	w.escalationMu.Lock()
+	defer w.escalationMu.Unlock()
+	w.escalations[notification.ID] = &pendingEscalation{due: w.clock.Now().Add(w.escalation.After)}
+}
+
+// RunEscalation は停止されるまで、ackされないまま期限を過ぎた通知をエスカレーションする
+func (w *WSManagerImpl) RunEscalation(ctx context.Context) {
+	ticker := time.NewTicker(escalationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.escalate()
+		}
+	}
+}
+
+// escalate は期限を過ぎた通知をescalationを1つ上げて再送し、再送した件数を返す
+// ackされた通知と、既読・アーカイブ・削除された通知はエスカレーションをやめる
+func (w *WSManagerImpl) escalate() int {
+	now := w.clock.Now()
+	levels := make(map[string]int)
+	w.escalationMu.Lock()
+	for id, pending := range w.escalations {
+		if now.Before(pending.due) {
+			continue
+		}
+		pending.level++
+		pending.due = now.Add(w.escalation.After)
+		levels[id] = pending.level
+		if pending.level >= w.escalation.MaxEscalations {
+			delete(w.escalations, id)
+		}
+	}
+	w.escalationMu.Unlock()
+
+	escalated := 0
+	for id, level := range levels {
+		notification, err := w.service.GetNotification(id)
+		if w.AckCount(id) > 0 || err != nil || notification.Read || notification.Archived {
+			w.escalationMu.Lock()
+			delete(w.escalations, id)
+			w.escalationMu.Unlock()
+			continue
+		}
+		escalatedNotification := *notification
+		escalatedNotification.Escalation = level
+		slog.Warn("Escalating unacknowledged notification", "id", id, "escalation", level)
+		w.broadcastNotification(escalatedNotification)
+		w.escalation.Webhooks.Notify("escalated", escalatedNotification)
+		escalated++
+	}
+	return escalated
+}
+
+// RunQuietHours は停止されるまで、静音時間が終わったら保留した通知を送信する
+func (w *WSManagerImpl) RunQuietHours(ctx context.Context) {
+	ticker := time.NewTicker(quietHoursCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.releaseHeld()
+		}
+	}
+}
+
+// releaseHeld は静音時間外であれば保留した通知を送信し、送信した件数を返す
+// 保留中に既読・削除された通知は送信しない
+func (w *WSManagerImpl) releaseHeld() int {
+	if w.quietHours.Active(w.clock.Now()) {
+		return 0
+	}
+	w.heldMu.Lock()
+	held := w.held
+	w.held = nil
+	w.heldMu.Unlock()
+
+	released := 0
+	for _, notification := range held {
+		current, err := w.service.GetNotification(notification.ID)
+		if err != nil || !isUnread(*current) {
+			continue
+		}
+		w.BroadcastNotification(*current)
+		released++
+	}
+	if len(held) > 0 {
+		slog.Info("Released notifications held during quiet hours", "held", len(held), "released", released)
+	}
+	return released
+}
+
+// holdForDoNotDisturb は宛先のユーザーがおやすみモード中であれば通知を保留し、trueを返す
+// 全員宛ての通知は保留しない
+func (w *WSManagerImpl) holdForDoNotDisturb(notification Notification) bool {
+	if notification.UserID == "" {
+		return false
+	}
+	w.dndMu.Lock()
+	defer w.dndMu.Unlock()
+	state, ok := w.dnd[notification.UserID]
+	if !ok || !state.Active(w.clock.Now()) {
+		return false
+	}
+	if notification.Priority == PriorityCritical && state.AllowCritical {
+		return false
+	}
+	state.held = append(state.held, notification)
+	return true
+}
+
+func (w *WSManagerImpl) DoNotDisturb(userID string) DoNotDisturb {
+	w.dndMu.Lock()
+	defer w.dndMu.Unlock()
+	state, ok := w.dnd[userID]
+	if !ok || !state.Active(w.clock.Now()) {
+		return DoNotDisturb{}
+	}
+	return state.DoNotDisturb
+}
+
+func (w *WSManagerImpl) SetDoNotDisturb(userID string, dnd DoNotDisturb) error {
+	if dnd.Enabled && dnd.Until != nil && !dnd.Until.After(w.clock.Now()) {
+		return errors.New("until must be in the future")
+	}
+	if !dnd.Enabled {
+		dnd.Until = nil
+	}
+	w.dndMu.Lock()
+	state, ok := w.dnd[userID]
+	if !ok {
+		state = &doNotDisturbState{}
+		w.dnd[userID] = state
+	}
+	state.DoNotDisturb = dnd
+	w.dndMu.Unlock()
+	w.releaseDoNotDisturb()
+	return nil
+}
+
+// RunDoNotDisturb は停止されるまで、おやすみモードが終わったユーザーに保留した通知を送信する
+func (w *WSManagerImpl) RunDoNotDisturb(ctx context.Context) {
+	ticker := time.NewTicker(doNotDisturbCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.releaseDoNotDisturb()
+		}
+	}
+}
+
+// releaseDoNotDisturb はおやすみモードが終わったユーザーの保留した通知を送信し、送信した件数を返す
+// 保留中に既読・削除された通知は送信しない
+func (w *WSManagerImpl) releaseDoNotDisturb() int {
+	now := w.clock.Now()
+	var held []Notification
+	w.dndMu.Lock()
+	for userID, state := range w.dnd {
+		if !state.Active(now) {
+			held = append(held, state.held...)
+			delete(w.dnd, userID)
+		}
+	}
+	w.dndMu.Unlock()
+
+	released := 0
+	for _, notification := range held {
+		current, err := w.service.GetNotification(notification.ID)
+		if err != nil || !isUnread(*current) {
+			continue
+		}
+		w.BroadcastNotification(*current)
+		released++
+	}
+	if len(held) > 0 {
+		slog.Info("Released notifications held during do not disturb", "held", len(held), "released", released)
+	}
+	return released
+}
+
+// withColor はカテゴリの色を付与した通知を返す
+func (w *WSManagerImpl) withColor(notification Notification) Notification {
+	if color, ok := w.categoryColors[notification.Category]; ok {
+		notification.Color = color
+	}
+	return notification
+}
+
+// flushBatch は期間を閉じ、保留中の通知を送信する。期間内の通知が1件のみの場合はnotificationとして送信する
+func (w *WSManagerImpl) flushBatch() {
+	w.batchMu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.batchOpen = false
+	w.batchMu.Unlock()
+
+	switch len(batch) {
+	case 0:
+	case 1:
+		w.broadcastNotification(batch[0])
+	default:
+		w.broadcastBatch(batch)
+	}
+}
+
+// broadcastBatch は各クライアントが受け取れる通知だけをnotifications_batchで送信する
+// 再送用には通知ごとに個別のnotificationメッセージとして保持する
+func (w *WSManagerImpl) broadcastBatch(batch []Notification) {
+	if !w.acquireBroadcast() {
+		return
+	}
+	defer w.releaseBroadcast()
+
+	seqs := make([]uint64, len(batch))
+	w.replayMu.Lock()
+	unlock := sync.OnceFunc(w.replayMu.Unlock)
+	defer unlock()
+	for i := range batch {
+		batch[i] = w.withColor(batch[i])
+		notification := batch[i]
+		seqs[i] = w.record(WSMessage{Type: "notification", Notification: &notification}, notificationFilter(notification))
+	}
+	clients := w.clientList(nil)
+	if !w.ordered {
+		unlock()
+	}
+
+	start := time.Now()
+	delivered := make([]bool, len(batch))
+	for _, c := range clients {
+		subscription := c.subscription.Load()
+		notifications := make([]Notification, 0, len(batch))
+		indexes := make([]int, 0, len(batch))
+		var seq uint64
+		for i, notification := range batch {
+			if visibleTo(notification, c.userID) && subscription.Matches(notification) {
+				notifications = append(notifications, notification)
+				indexes = append(indexes, i)
+				seq = seqs[i]
+			}
+		}
+
+		// まとめたメッセージには含まれる最後の通知のseqを付与する
+		var message WSMessage
+		switch len(notifications) {
+		case 0:
+			continue
+		case 1:
+			message = WSMessage{Type: "notification", Notification: &notifications[0], Seq: seq}
+		default:
+			message = WSMessage{Type: "notifications_batch", Notifications: notifications, Seq: seq}
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			slog.Error("Error encoding WebSocket message", "type", message.Type, "error", err)
+			continue
+		}
+		w.sendErrors.addSends(w.clock.Now(), 1)
+		if w.enqueue(c, data) {
+			for _, i := range indexes {
+				delivered[i] = true
+			}
+		}
+	}
+	unlock()
+	w.fanoutNanos.Add(int64(time.Since(start)))
+	w.totalBroadcasts.Add(1)
+
+	for i, notification := range batch {
+		w.publishStream(notification)
+		w.trackEscalation(notification)
+		if delivered[i] {
+			w.markDelivered(notification)
+		}
+	}
+}
+
+func (w *WSManagerImpl) BroadcastUpdate(notification Notification) {
+	notification = w.withColor(notification)
+	w.broadcast(WSMessage{Type: "notification_updated", Notification: &notification}, func(c *connWithMu) bool {
+		return visibleTo(notification, c.userID)
+	})
+}
+
+// BroadcastReadState は既読状態の変更を、その通知を受け取れるクライアントに送信する
+func (w *WSManagerImpl) BroadcastReadState(id string, read bool) {
+	w.broadcast(newReadStateMessage(id, read), w.readStateFilter(id))
+}
+
+// BroadcastArchived はアーカイブしたことを、その通知を受け取れるクライアントに送信する
+func (w *WSManagerImpl) BroadcastArchived(id string) {
+	w.broadcast(WSMessage{Type: "notification_archived", NotificationID: id}, w.readStateFilter(id))
+}
+
+// BroadcastPinState はピン留め状態の変更を、その通知を受け取れるクライアントに送信する
+func (w *WSManagerImpl) BroadcastPinState(id string, pinned bool) {
+	w.broadcast(newPinStateMessage(id, pinned), w.readStateFilter(id))
+}
+
+// readStateFilter は既読・アーカイブなどの状態の変更を、その通知の宛先のユーザーの接続に限定する
+func (w *WSManagerImpl) readStateFilter(id string) func(c *connWithMu) bool {
+	var userID string
+	if notification, err := w.service.GetNotification(id); err == nil {
+		userID = notification.UserID
+	}
+	return func(c *connWithMu) bool {
+		return userID == "" || c.userID == "" || c.userID == userID
+	}
+}
+
+// clientList はfilterがnilまたはtrueを返すクライアントの一覧を返す
+// 送信中にロックを保持しないよう、接続の追加・削除とは独立したスライスにする
+func (w *WSManagerImpl) clientList(filter func(c *connWithMu) bool) []*connWithMu {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	clients := make([]*connWithMu, 0, len(w.clients))
+	for _, c := range w.clients {
+		if filter == nil || filter(c) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// RunHeartbeat は停止されるまで、interval ごとに全クライアントへheartbeatを送信する
+func (w *WSManagerImpl) RunHeartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.sendHeartbeat(now)
+		}
+	}
+}
+
+// sendHeartbeat は通知の送信と同じキューを使い、順序を崩さずにheartbeatを送る
+func (w *WSManagerImpl) sendHeartbeat(now time.Time) {
+	w.sendAll(WSMessage{Type: "heartbeat", Time: &now})
+}
+
+// ScheduleUnreadCount は未読数の変更を通知する。短時間に続いた変更はunreadCountDebounce後にまとめて1回送信する
+func (w *WSManagerImpl) ScheduleUnreadCount() {
+	w.unreadMu.Lock()
+	defer w.unreadMu.Unlock()
+	if w.unreadTimer == nil {
+		w.unreadTimer = w.clock.AfterFunc(unreadCountDebounce, w.sendUnreadCount)
+	}
+}
+
+// sendUnreadCount は各接続に、そのユーザーが受け取れる通知の未読数をunread_countで送信する
+// 最後に送信した値から変わっているユーザーの接続にのみ送信する
+func (w *WSManagerImpl) sendUnreadCount() {
+	byUser := w.service.CountUnreadByUser()
+	total := 0
+	for _, n := range byUser {
+		total += n
+	}
+	clients := w.clientList(nil)
+	counts := make(map[string]int)
+	for _, c := range clients {
+		if c.userID == "" {
+			counts[""] = total
+		} else {
+			counts[c.userID] = byUser[""] + byUser[c.userID]
+		}
+	}
+
+	w.unreadMu.Lock()
+	w.unreadTimer = nil
+	changed := make(map[string][]byte)
+	for userID, count := range counts {
+		if last, ok := w.lastUnread[userID]; ok && last == count {
+			continue
+		}
+		data, err := json.Marshal(WSMessage{Type: "unread_count", Count: &count})
+		if err != nil {
+			slog.Error("Error encoding WebSocket message", "type", "unread_count", "error", err)
+			continue
+		}
+		changed[userID] = data
+	}
+	// 接続がなくなったユーザーは次に接続したときに送り直す
+	w.lastUnread = counts
+	w.unreadMu.Unlock()
+
+	for _, c := range clients {
+		if data, ok := changed[c.userID]; ok {
+			w.enqueue(c, data)
+		}
+	}
+}
+
+// sendAll は全クライアントにメッセージを送信する。状態を伝えるメッセージのため
+// 再送バッファには保持せず、ブロードキャストの統計にも含めない
+func (w *WSManagerImpl) sendAll(message WSMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Error encoding WebSocket message", "type", message.Type, "error", err)
+		return
+	}
+	for _, c := range w.clientList(nil) {
+		w.enqueue(c, data)
+	}
+}
+
+// acquireBroadcast はブロードキャストの実行枠を確保する。shedで上限に達している場合はfalseを返す
+func (w *WSManagerImpl) acquireBroadcast() bool {
+	if w.inFlight != nil {
+		if w.inFlightPolicy == InFlightShed {
+			select {
+			case w.inFlight <- struct{}{}:
+			default:
+				w.shedBroadcasts.Add(1)
+				return false
+			}
+		} else {
+			w.inFlight <- struct{}{}
+		}
+	}
+	w.inFlightCount.Add(1)
+	return true
+}
+
+func (w *WSManagerImpl) releaseBroadcast() {
+	w.inFlightCount.Add(-1)
+	if w.inFlight != nil {
+		<-w.inFlight
+	}
+}
+
+// broadcast はfilterがnilまたはtrueを返すクライアントにメッセージを送信し、送信できたクライアント数を返す
+// 破棄したメッセージは再送用にも保持しない
+func (w *WSManagerImpl) broadcast(message WSMessage, filter func(c *connWithMu) bool) int {
+	if !w.acquireBroadcast() {
+		return 0
+	}
+	defer w.releaseBroadcast()
+
+	w.replayMu.Lock()
+	unlock := sync.OnceFunc(w.replayMu.Unlock)
+	defer unlock()
+	message.Seq = w.record(message, filter)
+	clients := w.clientList(filter)
+	if !w.ordered {
+		unlock()
+	}
+
+	// 全クライアントで同じ内容を送るため、エンコードは1回だけ行う
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Error encoding WebSocket message", "type", message.Type, "error", err)
+		return 0
+	}
+
+	start := time.Now()
+	w.sendErrors.addSends(w.clock.Now(), len(clients))
+	delivered := 0
+	for _, c := range clients {
+		if w.enqueue(c, data) {
+			delivered++
+		}
+	}
+	w.fanoutNanos.Add(int64(time.Since(start)))
+	w.totalBroadcasts.Add(1)
+	return delivered
+}
+
+// recordAck は接続からのackを記録する。同じ接続からの重複は1回として数える
+func (w *WSManagerImpl) recordAck(id, connID string) {
+	w.acksMu.Lock()
+	defer w.acksMu.Unlock()
+	addReceipt(w.acks, id, connID)
+}
+
+// recordRead は通知を既読にした接続を記録する
+func (w *WSManagerImpl) recordRead(id, connID string) {
+	w.acksMu.Lock()
+	defer w.acksMu.Unlock()
+	addReceipt(w.reads, id, connID)
+}
+
+func addReceipt(receipts map[string]map[string]struct{}, id, connID string) {
+	conns, ok := receipts[id]
+	if !ok {
+		conns = make(map[string]struct{})
+		receipts[id] = conns
+	}
+	conns[connID] = struct{}{}
+}
+
+func (w *WSManagerImpl) ApplySubscription(userID string, sub *Subscription) {
+	for _, c := range w.clientList(func(c *connWithMu) bool { return c.userID == userID }) {
+		c.subscription.Store(sub)
+	}
+}
+
+func (w *WSManagerImpl) AckCount(id string) int {
+	w.acksMu.Lock()
+	defer w.acksMu.Unlock()
+	return len(w.acks[id])
+}
+
+func (w *WSManagerImpl) Engagement(notification Notification) Engagement {
+	clients := w.clientList(func(c *connWithMu) bool {
+		return visibleTo(notification, c.userID)
+	})
+	engagement := Engagement{NotificationID: notification.ID, Clients: len(clients)}
+
+	w.acksMu.Lock()
+	acks, reads := w.acks[notification.ID], w.reads[notification.ID]
+	for _, c := range clients {
+		if _, ok := acks[c.id]; ok {
+			engagement.Acked++
+		}
+		if _, ok := reads[c.id]; ok {
+			engagement.Read++
+		}
+	}
+	w.acksMu.Unlock()
+
+	if engagement.Clients > 0 {
+		engagement.AckRatio = float64(engagement.Acked) / float64(engagement.Clients)
+		engagement.ReadRatio = float64(engagement.Read) / float64(engagement.Clients)
+	}
+	return engagement
+}
+
+// Health は直近の送信がwsHealthMinSends件以上あり、失敗率がhealthErrorRateを超えている場合にdegradedを返す
+func (w *WSManagerImpl) Health() WSHealth {
+	w.mu.RLock()
+	clients := len(w.clients)
+	w.mu.RUnlock()
+
+	now := w.clock.Now()
+	health := WSHealth{Status: "ok", Initialized: true, Clients: clients}
+	var sends int64
+	health.ErrorRate, sends = w.sendErrors.Rate(now)
+	if w.healthErrorRate > 0 && sends >= wsHealthMinSends && health.ErrorRate > w.healthErrorRate {
+		health.Status = "degraded"
+	}
+	if err, at := w.sendErrors.LastFailure(); !at.IsZero() {
+		health.LastBroadcastError = err
+		health.LastBroadcastErrorAt = &at
+	}
+	return health
+}
+
+func (w *WSManagerImpl) Stats() WSStats {
+	w.mu.RLock()
+	clients := len(w.clients)
+	w.mu.RUnlock()
+
+	stats := WSStats{
+		Clients:           clients,
+		TotalConnections:  w.totalConnections.Load(),
+		TotalBroadcasts:   w.totalBroadcasts.Load(),
+		BroadcastFailures: w.broadcastFailures.Load(),
+		DroppedMessages:   w.droppedMessages.Load(),
+		InFlight:          w.inFlightCount.Load(),
+		ShedBroadcasts:    w.shedBroadcasts.Load(),
+	}
+	if stats.TotalBroadcasts > 0 {
+		avg := time.Duration(w.fanoutNanos.Load() / stats.TotalBroadcasts)
+		stats.AverageFanoutMillis = float64(avg) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// notificationsList はクライアントが受け取れる未読の通知の一覧を返す
+func (w *WSManagerImpl) notificationsList(c *connWithMu) WSMessage {
+	notifications := make([]Notification, 0)
+	for _, notification := range w.service.GetUnreadNotifications(ListOptions{}) {
+		if visibleTo(notification, c.userID) {
+			notifications = append(notifications, notification)
+		}
+	}
+	return WSMessage{
+		Type:          "notifications_list",
+		Notifications: notifications,
+	}
+}
+
+var errWSUnauthorized = errors.New("unauthorized")
+
+// errWSUserMismatch はAPIキーで認証した接続が、キーの名前と異なるユーザーとして接続しようとしたことを表す
+var errWSUserMismatch = errors.New("user_id does not match the API key")
+
+// wsUserAllowed はkeyNameで認証した接続がuserIDとして接続できるかを返す
+// user_idは認証されないため、APIキーを設定している場合はキーの名前と同じユーザーのみを許可する
+func wsUserAllowed(keyName, userID string) bool {
+	return keyName == "" || userID == "" || userID == keyName
+}
+
+// wsRequestToken はアップグレードのリクエストで指定されたAPIキーを返す
+// ブラウザのWebSocketはヘッダーを指定できないため、Bearerヘッダーに加えてtokenクエリも受け付ける
+func wsRequestToken(c *gin.Context) (string, bool) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return token, true
+	}
+	return c.GetQuery("token")
+}
+
+// authenticate はAPIキーが設定されている場合に、deadlineまでに最初のメッセージとしてauthを受信する
+// 認証に使用したキーの名前を返す
+func (w *WSManagerImpl) authenticate(conn *websocket.Conn, deadline time.Time) (string, error) {
+	if len(w.apiKeys) == 0 {
+		return "", nil
+	}
+	conn.SetReadDeadline(deadline)
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	msg, err := decodeWSMessage(data)
+	if err != nil || msg.Type != "auth" {
+		return "", errWSUnauthorized
+	}
+	name := matchAPIKey(w.apiKeys, msg.Token)
+	if name == "" {
+		return "", errWSUnauthorized
+	}
+	return name, nil
+}
+
+// handshakeCloseReason はハンドシェイクに失敗した接続に送るクローズフレームの理由を返す
+// 接続が既に切れている場合は空を返す
+func handshakeCloseReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errWSUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, errWSUserMismatch):
+		return err.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "handshake timeout"
+	}
+	return ""
+}
+
+func (w *WSManagerImpl) HandleMessage(conn *websocket.Conn, msg WSMessage) error {
+	switch msg.Type {
+	case "get_notifications":
+		c := w.GetClient(conn)
+		if c == nil {
+			return errors.New("client not found")
+		}
+		return c.WriteJSON(w.notificationsList(c))
+
+	case "mark_read":
+		c := w.GetClient(conn)
+		if c == nil {
+			return errors.New("client not found")
+		}
+		if msg.NotificationID == "" {
+			return errors.New("notification ID is required")
+		}
+		// 他のユーザー宛ての通知は既読にしない
+		notification, err := w.service.GetNotification(msg.NotificationID)
+		if err != nil {
+			return err
+		}
+		if !visibleTo(*notification, c.userID) {
+			return ErrNotificationNotFound
+		}
+		if err := w.service.MarkNotificationAsRead(msg.NotificationID, 0); err != nil {
+			return err
+		}
+		w.recordRead(msg.NotificationID, c.id)
+		// 他の端末にも既読状態を反映させる
+		w.BroadcastReadState(msg.NotificationID, true)
+		return nil
+
+	case "clear_all":
+		c := w.GetClient(conn)
+		if c == nil {
+			return errors.New("client not found")
+		}
+		// 他のユーザーの通知を消さないよう、自分宛ての通知のみをクリアする
+		if c.userID != "" {
+			return w.service.ClearNotificationsForUser(c.userID)
+		}
+		if !w.allowGlobalClear {
+			return errors.New("clear_all requires a user context")
+		}
+		return w.service.ClearAllNotifications()
+
+	case "ack":
+		c := w.GetClient(conn)
+		if c == nil {
+			return errors.New("client not found")
+		}
+		if msg.NotificationID == "" {
+			return errors.New("notification ID is required")
+		}
+		// 存在しない通知や他のユーザー宛ての通知へのackは記録しない
+		notification, err := w.service.GetNotification(msg.NotificationID)
+		if err != nil {
+			return err
+		}
+		if !visibleTo(*notification, c.userID) {
+			return ErrNotificationNotFound
+		}
+		w.recordAck(msg.NotificationID, c.id)
+		return nil
+
+	case "auth":
+		// 認証はハンドシェイク中にのみ行う
+		return errors.New("already authenticated")
+
+	case "subscribe":
+		c := w.GetClient(conn)
+		if c == nil {
+			return errors.New("client not found")
+		}
+		// ユーザーが特定されている場合は次回の接続でも適用するよう保存する
+		if c.userID != "" {
+			sub, err := w.service.SetUserSubscription(c.userID, UserSubscription{Categories: msg.Categories, Tags: msg.Tags})
+			if err != nil {
+				return err
+			}
+			w.ApplySubscription(c.userID, sub.Subscription())
+			return nil
+		}
+		c.subscription.Store(NewSubscription(msg.Categories, msg.Tags))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown message type: %s", msg.Type)
+	}
+}
+
+// Webhook configuration
+type WebhookConfig struct {
+	// 空の場合はWebhookを送信しない
+	URLs    []string
+	Timeout time.Duration
+	// 再送間隔の初期値。失敗するたびに倍にする
+	RetryInterval time.Duration
+	// 最初の送信からこの期間を過ぎても届かない場合は再送を諦める
+	MaxRetryAge time.Duration
+	// 空でない場合、再送待ちのキューをこのファイルに保存し、再起動後も再送する
+	QueuePath string
+	// URLごとに送信するイベント。含まれないURLには全てのイベントを送信する
+	Events map[string][]string
+}
+
+// Webhook events
+const (
+	WebhookEventCreated = "created"
+	WebhookEventRead    = "read"
+	WebhookEventDeleted = "deleted"
+	WebhookEventCleared = "cleared"
+)
+
+// webhookEvents はWebhookConfig.Eventsで指定できるイベント
+var webhookEvents = []string{WebhookEventCreated, WebhookEventRead, WebhookEventDeleted, WebhookEventCleared}
+
+const (
+	webhookRetryTick       = time.Second
+	webhookMaxRetryBackoff = 5 * time.Minute
+)
+
+// Webhook payload
+type WebhookEvent struct {
+	Event string `json:"event"`
+	// clearedではnil
+	Notification *Notification `json:"notification,omitempty"`
+	// clearedで、特定のユーザーの通知のみを削除した場合のユーザーID
+	UserID    string    `json:"user_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookDelivery は再送待ちの1件の送信
+type webhookDelivery struct {
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+// Webhook statistics
+type WebhookStats struct {
+	Delivered       int64 `json:"delivered"`
+	Failed          int64 `json:"failed"`
+	RetryQueueDepth int   `json:"retry_queue_depth"`
+	DeadLettered    int64 `json:"dead_lettered"`
+}
+
+// Webhook dispatcher
+// 送信に失敗した通知は再送キューに入れ、バックオフしながら再送する
+type WebhookDispatcher struct {
+	urls          []string
+	events        map[string][]string
+	client        *http.Client
+	retryInterval time.Duration
+	maxRetryAge   time.Duration
+	queuePath     string
+
+	queue   []webhookDelivery
+	queueMu sync.Mutex
+
+	delivered    atomic.Int64
+	failed       atomic.Int64
+	deadLettered atomic.Int64
+}
+
+func NewWebhookDispatcher(cfg WebhookConfig) (*WebhookDispatcher, error) {
+	for url, events := range cfg.Events {
+		if !slices.Contains(cfg.URLs, url) {
+			return nil, fmt.Errorf("webhook events specified for unknown url: %s", url)
+		}
+		for _, event := range events {
+			if !slices.Contains(webhookEvents, event) {
+				return nil, fmt.Errorf("unknown webhook event: %s (must be one of: %s)", event, strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+	d := &WebhookDispatcher{
+		urls:          cfg.URLs,
+		events:        cfg.Events,
+		client:        &http.Client{Timeout: cfg.Timeout},
+		retryInterval: cfg.RetryInterval,
+		maxRetryAge:   cfg.MaxRetryAge,
+		queuePath:     cfg.QueuePath,
+	}
+	if d.queuePath != "" {
+		data, err := os.ReadFile(d.queuePath)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &d.queue); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", d.queuePath, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Notify はイベントを全てのWebhookに非同期で送信する
+func (d *WebhookDispatcher) Notify(event string, notification Notification) {
+	d.NotifyEvent(WebhookEvent{Event: event, Notification: &notification})
+}
+
+// NotifyEvent はeventを受け取るURLに送信する。Timestampは送信時刻で上書きする
+func (d *WebhookDispatcher) NotifyEvent(event WebhookEvent) {
+	if !d.Wants(event.Event) {
+		return
+	}
+	now := time.Now()
+	event.Timestamp = now
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding webhook payload", "event", event.Event, "error", err)
+		return
+	}
+	for _, url := range d.urls {
+		if d.wants(url, event.Event) {
+			go d.attempt(webhookDelivery{URL: url, Payload: payload, CreatedAt: now})
+		}
+	}
+}
+
+// Wants はいずれかのURLがeventを受け取るかを返す。通知の内容を取得する前に確認する
+func (d *WebhookDispatcher) Wants(event string) bool {
+	if d == nil {
+		return false
+	}
+	return slices.ContainsFunc(d.urls, func(url string) bool {
+		return d.wants(url, event)
+	})
+}
+
+func (d *WebhookDispatcher) wants(url, event string) bool {
+	events, ok := d.events[url]
+	return !ok || slices.Contains(events, event)
+}
+
+// Run は停止されるまで再送キューを定期的に処理する
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(webhookRetryTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, delivery := range d.takeDue(now) {
+				d.attempt(delivery)
+			}
+		}
+	}
+}
+
+// attempt は1回送信し、一時的な失敗の場合は再送キューに戻す
+func (d *WebhookDispatcher) attempt(delivery webhookDelivery) {
+	delivery.Attempts++
+	retryable, err := d.post(delivery)
+	if err == nil {
+		d.delivered.Add(1)
+		return
+	}
+	d.failed.Add(1)
+
+	now := time.Now()
+	if !retryable || now.Sub(delivery.CreatedAt) >= d.maxRetryAge {
+		d.deadLetter(delivery, err)
+		return
+	}
+	backoff := d.retryInterval << (delivery.Attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxRetryBackoff {
+		backoff = webhookMaxRetryBackoff
+	}
+	delivery.NextAttempt = now.Add(backoff)
+	slog.Warn("Webhook delivery failed, will retry", "url", delivery.URL, "attempts", delivery.Attempts, "retry_in", backoff, "error", err)
+
+	d.queueMu.Lock()
+	d.queue = append(d.queue, delivery)
+	d.saveQueue()
+	d.queueMu.Unlock()
+}
+
+// post は送信結果を返す。4xx (429を除く) は再送しても成功しないためretryableをfalseにする
+func (d *WebhookDispatcher) post(delivery webhookDelivery) (retryable bool, err error) {
+	resp, err := d.client.Post(delivery.URL, "application/json", bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// deadLetter は再送を諦めた送信をログに残す
+func (d *WebhookDispatcher) deadLetter(delivery webhookDelivery, err error) {
+	d.deadLettered.Add(1)
+	payload := any(string(delivery.Payload))
+	if redactLogs {
+		// ペイロードには通知の内容が含まれるため、通知のログ表現に置き換える
+		var event WebhookEvent
+		if json.Unmarshal(delivery.Payload, &event) == nil {
+			payload = event.Event
+			if event.Notification != nil {
+				payload = *event.Notification
+			}
+		} else {
+			payload = fmt.Sprintf("%d bytes", len(delivery.Payload))
+		}
+	}
+	slog.Error("Webhook delivery dead-lettered",
+		"url", delivery.URL,
+		"attempts", delivery.Attempts,
+		"first_attempt", delivery.CreatedAt,
+		"payload", payload,
+		"error", err,
+	)
+}
+
+// takeDue は再送時刻を過ぎた送信をキューから取り出す
+func (d *WebhookDispatcher) takeDue(now time.Time) []webhookDelivery {
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	var due []webhookDelivery
+	remaining := d.queue[:0]
+	for _, delivery := range d.queue {
+		if now.Before(delivery.NextAttempt) {
+			remaining = append(remaining, delivery)
+		} else {
+			due = append(due, delivery)
+		}
+	}
+	d.queue = remaining
+	if len(due) > 0 {
+		d.saveQueue()
+	}
+	return due
+}
+
+// saveQueue は再送キューをファイルに書き出す。queueMuを保持した状態で呼び出す
+func (d *WebhookDispatcher) saveQueue() {
+	if d.queuePath == "" {
+		return
+	}
+	data, err := json.Marshal(d.queue)
+	if err == nil {
+		err = writeFileAtomic(d.queuePath, data)
+	}
+	if err != nil {
+		slog.Error("Error saving webhook retry queue", "path", d.queuePath, "error", err)
+	}
+}
+
+func (d *WebhookDispatcher) Stats() WebhookStats {
+	if d == nil {
+		return WebhookStats{}
+	}
+	d.queueMu.Lock()
+	depth := len(d.queue)
+	d.queueMu.Unlock()
+
+	return WebhookStats{
+		Delivered:       d.delivered.Load(),
+		Failed:          d.failed.Load(),
+		RetryQueueDepth: depth,
+		DeadLettered:    d.deadLettered.Load(),
+	}
+}
+
+// Ingestion queue
+// 作成リクエストを検証した後、保存と送信をワーカーで非同期に行う
+type IngestConfig struct {
+	// キューに保持できる通知の数 (0以下の場合はキューを使わずリクエスト内で処理する)
+	QueueSize int
+	// 0以下の場合は1
+	Workers int
+}
+
+type IngestStats struct {
+	QueueDepth int   `json:"queue_depth"`
+	Processed  int64 `json:"processed"`
+	// 保存されなかった通知 (重複、クールダウン、プロセッサーによる拒否など)
+	Failed int64 `json:"failed"`
+	// キューが一杯のため受け付けなかった通知
+	Rejected int64 `json:"rejected"`
+}
+
+type IngestQueue struct {
+	queue   chan Notification
+	process func(Notification) error
+	// closedの間はEnqueueを受け付けない。closeとの競合を避けるため送信はRLockで行う
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	processed atomic.Int64
+	failed    atomic.Int64
+	rejected  atomic.Int64
+}
+
+func NewIngestQueue(cfg IngestConfig, process func(Notification) error) *IngestQueue {
+	q := &IngestQueue{
+		queue:   make(chan Notification, cfg.QueueSize),
+		process: process,
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Enqueue はキューに空きがない場合やシャットダウン中の場合にfalseを返す
+func (q *IngestQueue) Enqueue(notification Notification) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.rejected.Add(1)
+		return false
+	}
+	select {
+	case q.queue <- notification:
+		return true
+	default:
+		q.rejected.Add(1)
+		return false
+	}
+}
+
+func (q *IngestQueue) worker() {
+	defer q.wg.Done()
+	for notification := range q.queue {
+		if err := q.process(notification); err != nil {
+			q.failed.Add(1)
+			continue
+		}
+		q.processed.Add(1)
+	}
+}
+
+// Shutdown は受付を止め、キューに残っている通知の処理が終わるかctxが終了するまで待つ
+func (q *IngestQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued notifications were not processed: %w", len(q.queue), ctx.Err())
+	}
+}
+
+// Stats はキューを使っていない (nil) 場合は0を返す
+func (q *IngestQueue) Stats() IngestStats {
+	if q == nil {
+		return IngestStats{}
+	}
+	return IngestStats{
+		QueueDepth: len(q.queue),
+		Processed:  q.processed.Load(),
+		Failed:     q.failed.Load(),
+		Rejected:   q.rejected.Load(),
+	}
+}
+
+// HTTP handler configuration
+type HandlerConfig struct {
+	// レスポンスのタイムスタンプを変換するタイムゾーン (nilの場合は変換しない)
+	Location *time.Location
+	// プレビュー時のメッセージの最大文字数
+	PreviewLength int
+	// trueの場合、作成した通知をWebSocketに配信しない (クライアントはポーリングで取得する)
+	DisableBroadcast bool
+	// メトリクスに送信状況を含める (nilの場合は0として扱う)
+	Webhooks *WebhookDispatcher
+	// QueueSizeが0より大きい場合、作成した通知の保存と送信をキューで非同期に行う
+	Ingest IngestConfig
+	// GET /api/config/categories で返す設定
+	Categories     []string
+	CategoryColors map[string]string
+	// GET /api/config/priorities で返す設定
+	Priorities map[string]PriorityHints
+	// 一覧でlimitを省略した場合の件数と、指定できる最大の件数 (0の場合は無制限)
+	DefaultLimit int
+	MaxLimit     int
+	// 名前空間のハンドラーと共有する状態。nilの場合はハンドラーごとに生成する
+	Drain *DrainState
+}
+
+// DrainState はローリングデプロイのため、新しいWebSocket接続の受け付けを止めている状態
+// 全ての名前空間で共有し、reconnectは全ての名前空間のクライアントに送信する
+type DrainState struct {
+	draining atomic.Bool
+	managers []*WSManagerImpl
+	mu       sync.Mutex
+}
+
+func (d *DrainState) add(m *WSManagerImpl) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.managers = append(d.managers, m)
+}
+
+func (d *DrainState) Draining() bool {
+	return d.draining.Load()
+}
+
+// Set は状態を変更し、変更があった場合はtrueを返す
+func (d *DrainState) Set(draining bool) bool {
+	return d.draining.Swap(draining) != draining
+}
+
+// SendReconnect は接続中のクライアントにreconnectを送信する
+func (d *DrainState) SendReconnect() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range d.managers {
+		// 再接続したクライアントに再送されないよう、再送バッファには保持しない
+		m.sendAll(WSMessage{Type: "reconnect"})
+	}
+}
+
+// Clients は全ての名前空間で接続中のクライアント数を返す
+func (d *DrainState) Clients() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clients := 0
+	for _, m := range d.managers {
+		clients += m.Stats().Clients
+	}
+	return clients
+}
+
+// Validate は起動時に設定値の整合性を確認する
+func (cfg HandlerConfig) Validate() error {
+	if cfg.DefaultLimit < 0 || cfg.MaxLimit < 0 {
+		return fmt.Errorf("invalid list limits: default %d, max %d", cfg.DefaultLimit, cfg.MaxLimit)
+	}
+	if cfg.MaxLimit > 0 && (cfg.DefaultLimit == 0 || cfg.DefaultLimit > cfg.MaxLimit) {
+		return fmt.Errorf("default list limit (%d) must be between 1 and max list limit (%d)", cfg.DefaultLimit, cfg.MaxLimit)
+	}
+	return nil
+}
+
+// HTTP handlers
+type NotificationHandler struct {
+	service       NotificationService
+	wsManager     WSManager
+	location      *time.Location
+	previewLength int
+	broadcast     bool
+	defaultLimit  int
+	maxLimit      int
+	webhooks      *WebhookDispatcher
+	ingest        *IngestQueue
+	categories    CategoriesConfigResponse
+	priorities    PrioritiesConfigResponse
+	maintenance   atomic.Bool
+	ready         atomic.Bool
+	drain         *DrainState
+}
+
+func NewNotificationHandler(service NotificationService, wsManager WSManager, cfg HandlerConfig) *NotificationHandler {
+	h := &NotificationHandler{
+		service:       service,
+		wsManager:     wsManager,
+		location:      cfg.Location,
+		previewLength: cfg.PreviewLength,
+		broadcast:     !cfg.DisableBroadcast,
+		defaultLimit:  cfg.DefaultLimit,
+		maxLimit:      cfg.MaxLimit,
+		webhooks:      cfg.Webhooks,
+		categories:    CategoriesConfigResponse{Allowed: cfg.Categories, Colors: cfg.CategoryColors},
+		drain:         cfg.Drain,
+	}
+	if h.drain == nil {
+		h.drain = &DrainState{}
+	}
+	if m, ok := wsManager.(*WSManagerImpl); ok {
+		h.drain.add(m)
+	}
+	if h.categories.Colors == nil {
+		h.categories.Colors = map[string]string{}
+	}
+	h.priorities.Priorities = make(map[string]PriorityHintsResponse, len(cfg.Priorities))
+	for priority, hints := range cfg.Priorities {
+		resp := PriorityHintsResponse{Sound: hints.Sound, RequiresAck: hints.RequiresAck}
+		if hints.TTL > 0 {
+			resp.TTL = hints.TTL.String()
+		}
+		h.priorities.Priorities[priority] = resp
+	}
+	if cfg.Ingest.QueueSize > 0 {
+		h.ingest = NewIngestQueue(cfg.Ingest, h.saveQueued)
+	}
+	return h
+}
+
+// saveQueued はキューから取り出した通知を保存して送信する
+func (h *NotificationHandler) saveQueued(notification Notification) error {
+	saved, err := h.service.SaveNotification(context.Background(), notification)
+	if err != nil {
+		slog.Info("Queued notification was not stored", "id", notification.ID, "error", err)
+		return err
+	}
+	delivered, held := 0, false
+	if h.broadcast {
+		delivered, held = h.wsManager.BroadcastNotification(*saved)
+	}
+	slog.Info("Notification created", "notification", *saved, "status", CreateStatusQueued, "delivered", delivered, "held", held)
+	return nil
+}
+
+// ShutdownIngest はキューに残っている通知の処理を待つ。キューを使っていない場合は何もしない
+func (h *NotificationHandler) ShutdownIngest(ctx context.Context) error {
+	if h.ingest == nil {
+		return nil
+	}
+	return h.ingest.Shutdown(ctx)
+}
+
+// responseLocation はtzクエリパラメータ、またはデフォルトのタイムゾーンを返す
+func (h *NotificationHandler) responseLocation(c *gin.Context) (*time.Location, error) {
+	tz := c.Query("tz")
+	if tz == "" {
+		return h.location, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone: %s", tz)
+	}
+	return loc, nil
+}
+
+// toPreview はメッセージをmaxRunes文字に切り詰めた通知のコピーを返す
+func toPreview(notifications []Notification, maxRunes int) []Notification {
+	result := make([]Notification, len(notifications))
+	for i, notification := range notifications {
+		if message, truncated := truncateRunes(notification.Message, maxRunes); truncated {
+			notification.Message = message
+			notification.Truncated = true
+		}
+		result[i] = notification
+	}
+	return result
+}
+
+// inLocation はタイムスタンプをlocに変換した通知のコピーを返す
+func inLocation(notifications []Notification, loc *time.Location) []Notification {
+	if loc == nil {
+		return notifications
+	}
+	result := make([]Notification, len(notifications))
+	for i, notification := range notifications {
+		notification.Timestamp = notification.Timestamp.In(loc)
+		if notification.ExpiresAt != nil {
+			t := notification.ExpiresAt.In(loc)
+			notification.ExpiresAt = &t
+		}
+		result[i] = notification
+	}
+	return result
+}
+
+// Build information
+// ビルド時に -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..." で埋め込む
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+func buildInfo() VersionResponse {
+	return VersionResponse{Version: version, Commit: commit, BuildTime: buildTime}
+}
+
+// HealthCheck はWebSocketの送信の失敗が多い場合もリクエストは処理できるため、200のままstatusをdegradedにする
+func (h *NotificationHandler) HealthCheck(c *gin.Context) {
+	ws := WSHealth{Status: "unavailable"}
+	if h.wsManager != nil {
+		ws = h.wsManager.Health()
+	}
+	status := "ok"
+	if ws.Status != "ok" {
+		status = "degraded"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":    status,
+		"message":   "Notibag server is running",
+		"build":     buildInfo(),
+		"websocket": ws,
+	})
+}
+
+func (h *NotificationHandler) GetVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, buildInfo())
+}
+
+// SetReady は起動処理の完了を通知する
+func (h *NotificationHandler) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+func (h *NotificationHandler) GetCategoriesConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, h.categories)
+}
+
+func (h *NotificationHandler) GetPrioritiesConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, h.priorities)
+}
+
+func (h *NotificationHandler) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *NotificationHandler) Readiness(c *gin.Context) {
+	if !h.ready.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting"})
+		return
+	}
+	// ロードバランサーが新しいリクエストを他のインスタンスに振り分けるよう、drain中は準備できていないとする
+	if h.drain.Draining() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	if err := h.service.CheckHealth(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// sourceHeader は通知の作成元を指定するヘッダー
+const sourceHeader = "X-Notibag-Source"
+
+// ValidateNotification は作成時と同じ検証のみを行い、通知の保存やブロードキャストはしない
+func (h *NotificationHandler) ValidateNotification(c *gin.Context) {
+	var req CreateNotificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if _, err := h.service.NewNotification(req); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ValidateResponse{Valid: true})
+}
+
+func (h *NotificationHandler) CreateNotification(c *gin.Context) {
+	if h.maintenance.Load() {
+		respondError(c, http.StatusServiceUnavailable, "server is in maintenance mode")
+		return
+	}
+
+	loc, err := h.responseLocation(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req CreateNotificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	// APIキーで認証している場合は、なりすましを防ぐためキーの名前を作成元とする
+	req.Source = c.GetString(apiKeyNameKey)
+	if req.Source == "" {
+		req.Source = strings.TrimSpace(c.GetHeader(sourceHeader))
+	}
+
+	if h.ingest != nil {
+		h.enqueueNotification(c, req, loc)
+		return
+	}
+
+	notification, err := h.service.CreateNotification(c.Request.Context(), req)
+	if errors.Is(err, ErrSuppressed) {
+		c.JSON(http.StatusAccepted, SuppressedResponse{Status: CreateStatusSuppressed, Reason: err.Error()})
+		return
+	}
+	if errors.Is(err, ErrDuplicate) {
+		if notification == nil {
+			c.JSON(http.StatusAccepted, SuppressedResponse{Status: CreateStatusDuplicate, Reason: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, CreateNotificationResponse{
+			Notification: inLocation([]Notification{*notification}, loc)[0],
+			Status:       CreateStatusDuplicate,
+		})
+		return
+	}
+	var fieldErr *InvalidFieldError
+	switch {
+	case errors.As(err, &fieldErr):
+		respondValidationError(c, err)
+		return
+	case errors.Is(err, ErrRejected):
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		requestLogger(c).Error("Failed to create notification", "error", err)
+		respondError(c, http.StatusInternalServerError, "failed to create notification")
+		return
+	}
+
+	// WebSocketクライアントに通知を送信
+	delivered, held := 0, false
+	if h.broadcast {
+		delivered, held = h.wsManager.BroadcastNotification(*notification)
+	}
+
+	status, createStatus := http.StatusCreated, CreateStatusDelivered
+	switch {
+	case held:
+		status, createStatus = http.StatusAccepted, CreateStatusHeld
+	case delivered == 0:
+		status, createStatus = http.StatusAccepted, CreateStatusStored
+	}
+	requestLogger(c).Info("Notification created", "notification", *notification, "status", createStatus, "delivered", delivered)
+	c.JSON(status, CreateNotificationResponse{
+		Notification: inLocation([]Notification{*notification}, loc)[0],
+		Status:       createStatus,
+	})
+}
+
+// enqueueNotification は検証した通知をキューに追加し、保存を待たずに202を返す
+func (h *NotificationHandler) enqueueNotification(c *gin.Context, req CreateNotificationRequest, loc *time.Location) {
+	notification, err := h.service.NewNotification(req)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	if !h.ingest.Enqueue(notification) {
+		respondError(c, http.StatusServiceUnavailable, "notification queue is full")
+		return
+	}
+	c.JSON(http.StatusAccepted, CreateNotificationResponse{
+		Notification: inLocation([]Notification{notification}, loc)[0],
+		Status:       CreateStatusQueued,
+	})
+}
+
+// unreadCountHeader は一覧のレスポンスに含める未読数のヘッダー
+const unreadCountHeader = "X-Unread-Count"
+
+// limitClampedHeader はlimitが最大の件数を超えたため切り詰めた場合に、適用した件数を返すヘッダー
+const limitClampedHeader = "X-Limit-Clamped"
+
+func (h *NotificationHandler) GetNotifications(c *gin.Context) {
+	var opts ListOptions
+	switch c.Query("sort") {
+	case "", "timestamp":
+	case "priority":
+		opts.SortByPriority = true
+	default:
+		respondError(c, http.StatusBadRequest, "sort must be one of: timestamp, priority")
+		return
+	}
+	switch c.Query("archived") {
+	case "", "false":
+	case "true":
+		opts.Archived = true
+	default:
+		respondError(c, http.StatusBadRequest, "archived must be true or false")
+		return
+	}
+	switch c.Query("preview") {
+	case "", "false":
+	case "true":
+		opts.Preview = true
+	default:
+		respondError(c, http.StatusBadRequest, "preview must be true or false")
+		return
+	}
+	if maxAge := c.Query("max_age"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			respondError(c, http.StatusBadRequest, "max_age must be a positive duration (e.g. 30m, 24h)")
+			return
+		}
+		opts.MaxAge = d
+	}
+	filter, err := parseFilterQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Filter = filter
+	opts.Source = c.Query("source")
+	switch c.Query("mine") {
+	case "", "false":
+	case "true":
+		identity := c.GetString(apiKeyNameKey)
+		if identity == "" {
+			respondError(c, http.StatusBadRequest, "mine=true requires an API key")
+			return
+		}
+		if opts.Source != "" && opts.Source != identity {
+			respondError(c, http.StatusBadRequest, "mine=true cannot be combined with a different source")
+			return
+		}
+		opts.Source = identity
+	default:
+		respondError(c, http.StatusBadRequest, "mine must be true or false")
+		return
+	}
+	if states := c.Query("states"); states != "" {
+		if opts.Archived {
+			respondError(c, http.StatusBadRequest, "states cannot be combined with archived=true")
+			return
+		}
+		for _, state := range splitList(states) {
+			switch state {
+			case "unread":
+				opts.States.Unread = true
+			case "read":
+				opts.States.Read = true
+			default:
+				respondError(c, http.StatusBadRequest, "states must be a comma-separated list of: unread, read")
+				return
+			}
+		}
+	}
+	var after *listCursor
+	if cursor := c.Query("after"); cursor != "" {
+		decoded, err := decodeListCursor(cursor)
+		if err != nil || decoded.SortByPriority != opts.SortByPriority {
+			respondError(c, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		after = &decoded
+	}
+	limit := h.defaultLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			respondError(c, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+		if h.maxLimit > 0 && limit > h.maxLimit {
+			limit = h.maxLimit
+			c.Header(limitClampedHeader, strconv.Itoa(limit))
+		}
+	}
+	loc, err := h.responseLocation(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var notifications []Notification
+	if opts.Archived {
+		notifications = h.service.GetArchivedNotifications(opts)
+	} else {
+		notifications = h.service.GetNotificationsByState(opts)
+	}
+	notifications, nextCursor := paginate(notifications, after, limit, opts.SortByPriority)
+	if opts.Preview {
+		notifications = toPreview(notifications, h.previewLength)
+	}
+
+	body, err := json.Marshal(NotificationsResponse{Notifications: inLocation(notifications, loc), NextCursor: nextCursor})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// ポーリングするクライアント向けに、内容が変わっていなければ304を返す
+	// HEADの場合もGETと同じヘッダーを返し、ボディはnet/httpが省略する
+	etag := computeETag(body)
+	c.Header("ETag", etag)
+	c.Header(unreadCountHeader, strconv.Itoa(h.service.CountUnreadNotifications()))
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// listCursor は一覧の最後に返した通知の並び順のキー
+// 位置ではなくキーで続きを探すため、ページの間に通知が追加されても重複や欠落が起きない
+type listCursor struct {
+	SortByPriority bool   `json:"s,omitempty"`
+	Pinned         bool   `json:"p,omitempty"`
+	Priority       string `json:"r,omitempty"`
+	Timestamp      int64  `json:"t"`
+	ID             string `json:"id"`
+}
+
+func newListCursor(n Notification, byPriority bool) listCursor {
+	return listCursor{
+		SortByPriority: byPriority,
+		Pinned:         n.Pinned,
+		Priority:       n.Priority,
+		Timestamp:      n.Timestamp.UnixNano(),
+		ID:             n.ID,
+	}
+}
+
+func (cur listCursor) encode() string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var cur listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(data, &cur)
+	return cur, err
+}
+
+// paginate は並び順でafterより後の通知を最大limit件返す (limitが0の場合は全件)
+// 残りがある場合は次のページのカーソルを返す
+func paginate(notifications []Notification, after *listCursor, limit int, byPriority bool) ([]Notification, string) {
+	if after != nil {
+		last := Notification{
+			ID:        after.ID,
+			Priority:  after.Priority,
+			Pinned:    after.Pinned,
+			Timestamp: time.Unix(0, after.Timestamp),
+		}
+		start := sort.Search(len(notifications), func(i int) bool {
+			return compareListOrder(notifications[i], last, byPriority) > 0
+		})
+		notifications = notifications[start:]
+	}
+	if limit == 0 || len(notifications) <= limit {
+		return notifications, ""
+	}
+	notifications = notifications[:limit]
+	return notifications, newListCursor(notifications[limit-1], byPriority).encode()
+}
+
+// countQueryParams のいずれかが指定された場合は、条件に一致する件数をcountで返す
+var countQueryParams = []string{"read", "archived", "category", "priority", "tag", "source", "since", "until"}
+
+func (h *NotificationHandler) CountUnread(c *gin.Context) {
+	resp := CountResponse{Unread: h.service.CountUnreadNotifications()}
+	resp.Count = resp.Unread
+	if !slices.ContainsFunc(countQueryParams, func(param string) bool { return c.Query(param) != "" }) {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	filter, err := parseFilterQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	read := false
+	filter.Read = &read
+	switch c.Query("read") {
+	case "", "false":
+	case "true":
+		read = true
+	case "any":
+		filter.Read = nil
+	default:
+		respondError(c, http.StatusBadRequest, "read must be true, false or any")
+		return
+	}
+	switch c.Query("archived") {
+	case "", "false":
+	case "true":
+		filter.Archived = true
+	default:
+		respondError(c, http.StatusBadRequest, "archived must be true or false")
+		return
+	}
+	filter.Source = c.Query("source")
+	resp.Count = h.service.CountNotifications(filter)
+	c.JSON(http.StatusOK, resp)
+}
+
+// parseFilterQuery はカテゴリ・優先度・タグ・期間のクエリパラメータを解析する
+func parseFilterQuery(c *gin.Context) (NotificationFilter, error) {
+	filter := NotificationFilter{
+		Category: c.Query("category"),
+		Priority: c.Query("priority"),
+		Tag:      c.Query("tag"),
+	}
+	if filter.Priority != "" {
+		if _, ok := priorityRanks[filter.Priority]; !ok {
+			return filter, fmt.Errorf("invalid priority: %s", filter.Priority)
+		}
+	}
+	var err error
+	if filter.Since, err = timeQuery(c, "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = timeQuery(c, "until"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// timeQuery はRFC3339のクエリパラメータを解析する。指定されていない場合はゼロ値を返す
+func timeQuery(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp", name)
+	}
+	return t, nil
+}
+
+func (h *NotificationHandler) GetNotification(c *gin.Context) {
+	loc, err := h.responseLocation(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	notification, err := h.service.GetNotification(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	c.Header("ETag", strconv.Quote(strconv.Itoa(notification.Version)))
+	c.JSON(http.StatusOK, NotificationDetailResponse{
+		Notification: inLocation([]Notification{*notification}, loc)[0],
+		AckedBy:      h.wsManager.AckCount(notification.ID),
+	})
+}
+
+// GetLatestNotification はcategory・priority・tag・readなどの条件に一致する最新の通知を返す
+// 一致する通知がない場合は204を返す
+func (h *NotificationHandler) GetLatestNotification(c *gin.Context) {
+	loc, err := h.responseLocation(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseFilterQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch c.Query("read") {
+	case "", "any":
+	case "true", "false":
+		read := c.Query("read") == "true"
+		filter.Read = &read
+	default:
+		respondError(c, http.StatusBadRequest, "read must be true, false or any")
+		return
+	}
+	filter.Source = c.Query("source")
+	notification, ok := h.service.GetLatestNotification(filter)
+	if !ok {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.Header("ETag", strconv.Quote(strconv.Itoa(notification.Version)))
+	c.JSON(http.StatusOK, NotificationDetailResponse{
+		Notification: inLocation([]Notification{*notification}, loc)[0],
+		AckedBy:      h.wsManager.AckCount(notification.ID),
+	})
+}
+
+// Stream はSSEで、作成された通知のうちcategory・priority・tagなどの条件に一致するものを送信する
+func (h *NotificationHandler) Stream(c *gin.Context) {
+	filter, err := parseFilterQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	notifications, unsubscribe := h.wsManager.SubscribeStream(c.Query("user_id"), filter)
+	defer unsubscribe()
+
+	// 長時間接続のため、HTTPサーバーの書き込みタイムアウトを解除
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		requestLogger(c).Warn("Could not clear write deadline for stream", "error", err)
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Nginxでバッファリングされないようにする
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(pingInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case notification := <-notifications:
+			data, err := json.Marshal(notification)
+			if err != nil {
+				requestLogger(c).Error("Error encoding stream event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: notification\ndata: %s\n\n", notification.ID, data); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// GetEngagement は接続中のクライアントのうち通知をack・既読にした割合を返す
+func (h *NotificationHandler) GetEngagement(c *gin.Context) {
+	notification, err := h.service.GetNotification(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, h.wsManager.Engagement(*notification))
+}
+
+func (h *NotificationHandler) ExportNotifications(c *gin.Context) {
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		var notifications []Notification
+		h.service.ExportNotifications(func(n Notification) error {
+			notifications = append(notifications, n)
+			return nil
+		})
+		if notifications == nil {
+			notifications = []Notification{}
+		}
+		c.JSON(http.StatusOK, notifications)
+
+	case "ndjson":
+		// 1件ずつ書き出してフラッシュするため、全件のJSONを組み立てずに送信できる
+		// 件数が多い場合は書き込みタイムアウトを超えるため解除する
+		if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+			requestLogger(c).Warn("Could not clear write deadline for export", "error", err)
+		}
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		err := h.service.ExportNotifications(func(n Notification) error {
+			if err := encoder.Encode(n); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		})
+		if err != nil {
+			requestLogger(c).Warn("Export aborted", "error", err)
+		}
+
+	default:
+		respondError(c, http.StatusBadRequest, "format must be one of: json, ndjson")
+	}
+}
+
+func (h *NotificationHandler) GetAllNotifications(c *gin.Context) {
+	// デバッグ用：全ての通知を返す
+	loc, err := h.responseLocation(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	repo := h.service.(*NotificationServiceImpl).repo
+	notifications := repo.GetAll()
+	c.JSON(http.StatusOK, NotificationsResponse{Notifications: inLocation(notifications, loc)})
+}
+
+// ifMatchVersion はIf-Matchヘッダーで指定されたバージョンを返す (指定がない場合は0)
+func ifMatchVersion(c *gin.Context) (int, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match version: %s", header)
+	}
+	return version, nil
+}
+
+// mutationStatus は通知の変更に失敗した場合のステータスコードを返す
+func mutationStatus(err error) int {
+	if errors.Is(err, ErrVersionConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+func (h *NotificationHandler) MarkAsRead(c *gin.Context) {
+	id := c.Param("id")
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.service.MarkNotificationAsRead(id, version); err != nil {
+		respondError(c, mutationStatus(err), err.Error())
+		return
+	}
+	h.wsManager.BroadcastReadState(id, true)
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+// MarkReadBefore はbeforeより前に作成された通知を全て既読にする
+func (h *NotificationHandler) MarkReadBefore(c *gin.Context) {
+	before := c.Query("before")
+	if before == "" {
+		respondError(c, http.StatusBadRequest, "before is required")
+		return
+	}
+	cutoff, err := time.Parse(time.RFC3339, before)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "before must be an RFC3339 timestamp")
+		return
+	}
+
+	marked := h.service.MarkNotificationsReadBefore(cutoff)
+	for _, id := range marked {
+		h.wsManager.BroadcastReadState(id, true)
+	}
+	c.JSON(http.StatusOK, MarkReadBeforeResponse{Marked: len(marked)})
+}
+
+func (h *NotificationHandler) ArchiveNotification(c *gin.Context) {
+	id := c.Param("id")
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.service.ArchiveNotification(id, version); err != nil {
+		respondError(c, mutationStatus(err), err.Error())
+		return
+	}
+	h.wsManager.BroadcastArchived(id)
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+func (h *NotificationHandler) PinNotification(c *gin.Context) {
+	h.setPinned(c, true)
+}
+
+func (h *NotificationHandler) UnpinNotification(c *gin.Context) {
+	h.setPinned(c, false)
+}
+
+func (h *NotificationHandler) setPinned(c *gin.Context, pinned bool) {
+	id := c.Param("id")
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.service.PinNotification(id, pinned, version); err != nil {
+		respondError(c, mutationStatus(err), err.Error())
+		return
+	}
+	h.wsManager.BroadcastPinState(id, pinned)
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+func (h *NotificationHandler) AddTag(c *gin.Context) {
+	h.updateNotification(c, func(version int) (*Notification, bool, error) {
+		return h.service.AddTag(c.Param("id"), c.Param("tag"), version)
+	})
+}
+
+func (h *NotificationHandler) RemoveTag(c *gin.Context) {
+	h.updateNotification(c, func(version int) (*Notification, bool, error) {
+		return h.service.RemoveTag(c.Param("id"), c.Param("tag"), version)
+	})
+}
+
+type SetMetadataRequest struct {
+	Value string `json:"value"`
+}
+
+func (h *NotificationHandler) SetMetadata(c *gin.Context) {
+	var req SetMetadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	h.updateNotification(c, func(version int) (*Notification, bool, error) {
+		return h.service.SetMetadata(c.Param("id"), c.Param("key"), req.Value, version)
+	})
+}
+
+func (h *NotificationHandler) UnsetMetadata(c *gin.Context) {
+	h.updateNotification(c, func(version int) (*Notification, bool, error) {
+		return h.service.UnsetMetadata(c.Param("id"), c.Param("key"), version)
+	})
+}
+
+// updateNotification は部分的な更新を行い、変更があった場合はnotification_updatedをブロードキャストする
+// 既に同じ状態の場合は何もせずに現在の通知を返す
+func (h *NotificationHandler) updateNotification(c *gin.Context, update func(version int) (*Notification, bool, error)) {
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	notification, changed, err := update(version)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrNotificationNotFound) || errors.Is(err, ErrVersionConflict) {
+			status = mutationStatus(err)
+		}
+		respondError(c, status, err.Error())
+		return
+	}
+	if changed {
+		h.wsManager.BroadcastUpdate(*notification)
+	}
+	c.Header("ETag", strconv.Quote(strconv.Itoa(notification.Version)))
+	c.JSON(http.StatusOK, *notification)
+}
+
+type TakeActionRequest struct {
+	ActionID string `json:"action_id" binding:"required"`
+}
+
+// TakeAction はクライアントで実行されたアクションを記録する
+func (h *NotificationHandler) TakeAction(c *gin.Context) {
+	var req TakeActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := h.service.TakeAction(c.Param("id"), req.ActionID, version); err != nil {
+		status := mutationStatus(err)
+		if errors.Is(err, ErrUnknownAction) {
+			status = http.StatusBadRequest
+		}
+		respondError(c, status, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+func (h *NotificationHandler) GetUserSubscription(c *gin.Context) {
+	c.JSON(http.StatusOK, h.service.GetUserSubscription(c.Param("id")))
+}
+
+// SetUserSubscription は購読条件を保存し、そのユーザーの接続中のクライアントにも適用する
+func (h *NotificationHandler) SetUserSubscription(c *gin.Context) {
+	var req UserSubscription
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	userID := c.Param("id")
+	sub, err := h.service.SetUserSubscription(userID, req)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.wsManager.ApplySubscription(userID, sub.Subscription())
+	c.JSON(http.StatusOK, sub)
+}
+
+func (h *NotificationHandler) GetDoNotDisturb(c *gin.Context) {
+	c.JSON(http.StatusOK, h.wsManager.DoNotDisturb(c.Param("id")))
+}
+
+// SetDoNotDisturb はユーザーのおやすみモードを設定する。untilを省略すると解除するまで続く
+func (h *NotificationHandler) SetDoNotDisturb(c *gin.Context) {
+	var req SetDoNotDisturbRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	userID := c.Param("id")
+	dnd := DoNotDisturb{Enabled: *req.Enabled, Until: req.Until, AllowCritical: req.AllowCritical}
+	if err := h.wsManager.SetDoNotDisturb(userID, dnd); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, h.wsManager.DoNotDisturb(userID))
+}
+
+// RebroadcastNotification は既存の通知を新しく作成せずに、WebSocketクライアントへ再送信する
+func (h *NotificationHandler) RebroadcastNotification(c *gin.Context) {
+	notification, err := h.service.GetNotification(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	delivered, held := h.wsManager.BroadcastNotification(*notification)
+	c.JSON(http.StatusOK, RebroadcastResponse{Delivered: delivered, Held: held})
+}
+
+func (h *NotificationHandler) DeleteNotifications(c *gin.Context) {
+	var req DeleteNotificationsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	deleted, notFound := h.service.DeleteNotifications(req.IDs)
+	for _, id := range deleted {
+		h.wsManager.Broadcast(WSMessage{
+			Type:           "notification_deleted",
+			NotificationID: id,
+		})
+	}
+
+	c.JSON(http.StatusOK, DeleteNotificationsResponse{Deleted: deleted, NotFound: notFound})
+}
+
+// DedupeNotifications は同じタイトル・メッセージの通知を最新の1件にまとめ、削除した通知をブロードキャストする
+func (h *NotificationHandler) DedupeNotifications(c *gin.Context) {
+	var window time.Duration
+	if value := c.Query("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			respondError(c, http.StatusBadRequest, "window must be a positive duration")
+			return
+		}
+		window = d
+	}
+
+	groups := h.service.DedupeNotifications(window)
+	deleted := 0
+	for _, group := range groups {
+		for _, id := range group.Deleted {
+			h.wsManager.Broadcast(WSMessage{
+				Type:           "notification_deleted",
+				NotificationID: id,
+			})
+		}
+		deleted += len(group.Deleted)
+	}
+	c.JSON(http.StatusOK, DedupeResponse{Groups: groups, Deleted: deleted})
+}
+
+func (h *NotificationHandler) ClearAll(c *gin.Context) {
+	if err := h.service.ClearAllNotifications(); err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+func (h *NotificationHandler) SetMaintenance(c *gin.Context) {
+	var req MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	enabled := *req.Enabled
+	if h.maintenance.Swap(enabled) != enabled {
+		requestLogger(c).Info("Maintenance mode changed", "enabled", enabled)
+		h.wsManager.Broadcast(WSMessage{
+			Type:        "maintenance",
+			Maintenance: &enabled,
+		})
+	}
+
+	c.JSON(http.StatusOK, MaintenanceResponse{Maintenance: enabled})
+}
+
+// Drain は新しいWebSocket接続の受け付けを停止・再開する。接続中のクライアントは切断しない
+func (h *NotificationHandler) Drain(c *gin.Context) {
+	var req DrainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	enabled := *req.Enabled
+	if h.drain.Set(enabled) {
+		requestLogger(c).Info("Drain mode changed", "enabled", enabled)
+	}
+	if enabled && req.Reconnect {
+		h.drain.SendReconnect()
+	}
+
+	c.JSON(http.StatusOK, DrainResponse{Draining: enabled, Clients: h.drain.Clients()})
+}
+
+func (h *NotificationHandler) GetWSStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.wsManager.Stats())
+}
+
+// Metrics response
+type MetricsResponse struct {
+	WebSocket WSStats      `json:"websocket"`
+	Webhooks  WebhookStats `json:"webhooks"`
+	Ingest    IngestStats  `json:"ingest"`
+}
+
+func (h *NotificationHandler) GetMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, MetricsResponse{
+		WebSocket: h.wsManager.Stats(),
+		Webhooks:  h.webhooks.Stats(),
+		Ingest:    h.ingest.Stats(),
+	})
+}
+
+// Debug response
+type DebugResponse struct {
+	Goroutines       int          `json:"goroutines"`
+	HeapAllocBytes   uint64       `json:"heap_alloc_bytes"`
+	HeapObjects      uint64       `json:"heap_objects"`
+	WebSocketClients int          `json:"websocket_clients"`
+	GC               DebugGCStats `json:"gc"`
+}
+
+type DebugGCStats struct {
+	NumGC        uint32     `json:"num_gc"`
+	PauseTotalNs uint64     `json:"pause_total_ns"`
+	LastGC       *time.Time `json:"last_gc,omitempty"`
+	NextGCBytes  uint64     `json:"next_gc_bytes"`
+}
+
+// GetDebug はgoroutineのリークなどを調べるため、ランタイムの状態を返す
+func (h *NotificationHandler) GetDebug(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gc := DebugGCStats{
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		NextGCBytes:  mem.NextGC,
+	}
+	if mem.LastGC > 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC))
+		gc.LastGC = &lastGC
+	}
+	c.JSON(http.StatusOK, DebugResponse{
+		Goroutines:       runtime.NumGoroutine(),
+		HeapAllocBytes:   mem.HeapAlloc,
+		HeapObjects:      mem.HeapObjects,
+		WebSocketClients: h.wsManager.Stats().Clients,
+		GC:               gc,
+	})
+}
+
+func (h *NotificationHandler) GetConnections(c *gin.Context) {
+	c.JSON(http.StatusOK, ConnectionsResponse{Connections: h.wsManager.Connections()})
+}
+
+func (h *NotificationHandler) DisconnectClient(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.wsManager.Disconnect(id); err != nil {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	requestLogger(c).Info("WebSocket connection disconnected by administrator", "connection_id", id)
+	c.JSON(http.StatusOK, SuccessResponse{Success: true})
+}
+
+const (
+	pingInterval = 30 * time.Second
+	pongWait     = 45 * time.Second
+	writeWait    = 10 * time.Second
+	// シャットダウン時にクライアントの切断を確認する間隔
+	shutdownPollInterval = 50 * time.Millisecond
+	// 静音時間の終了を確認する間隔
+	quietHoursCheckInterval = 30 * time.Second
+	// おやすみモードの終了を確認する間隔
+	doNotDisturbCheckInterval = 10 * time.Second
+	// ヘルスチェックで送信の失敗率を数える期間と、判定に必要な最小の送信数
+	wsHealthWindow   = time.Minute
+	wsHealthMinSends = 10
+	// ackを待っている通知の期限を確認する間隔
+	escalationCheckInterval = 5 * time.Second
+	// 続けて未読数が変わった場合にunread_countをまとめる期間
+	unreadCountDebounce = 200 * time.Millisecond
+	// -ws-handshake-timeoutが無効な場合に、APIキーのauthメッセージを待つ最大時間
+	defaultWSAuthTimeout = 10 * time.Second
+	// -ws-replay-pathに再送用のバッファを保存する間隔
+	replaySaveInterval = time.Second
+)
+
+func (h *NotificationHandler) HandleWebSocket(c *gin.Context) {
+	logger := requestLogger(c)
+	if h.drain.Draining() {
+		respondError(c, http.StatusServiceUnavailable, "server is draining")
+		return
+	}
+	// APIキーが設定されている場合、リクエストでキーを指定していればアップグレード前に認証する
+	// 指定していない場合はアップグレード後に最初のメッセージのauthで認証する
+	var keyName string
+	if keys := h.wsManager.(*WSManagerImpl).apiKeys; len(keys) > 0 {
+		if token, ok := wsRequestToken(c); ok {
+			if keyName = matchAPIKey(keys, token); keyName == "" {
+				respondError(c, http.StatusUnauthorized, "invalid or missing API key")
+				return
+			}
+			if !wsUserAllowed(keyName, c.Query("user_id")) {
+				respondError(c, http.StatusForbidden, errWSUserMismatch.Error())
+				return
+			}
+		}
+	}
+
+	// 1つのIPから大量に接続されないよう、アップグレード前に接続数を確認する
+	ip := clientIP(c)
+	if !h.wsManager.(*WSManagerImpl).acquireIP(ip) {
+		logger.Warn("Too many WebSocket connections from IP", "client_ip", ip)
+		respondError(c, http.StatusTooManyRequests, "too many WebSocket connections from this IP")
+		return
+	}
+	defer h.wsManager.(*WSManagerImpl).releaseIP(ip)
+
+	// サブプロトコルを指定していない場合は受け入れるが、対応していないものだけを指定した場合は拒否する
+	if requested := websocket.Subprotocols(c.Request); len(requested) > 0 && !slices.ContainsFunc(requested, func(p string) bool {
+		return slices.Contains(wsSubprotocols, p)
+	}) {
+		logger.Warn("Unsupported WebSocket subprotocol", "requested", requested)
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("unsupported subprotocol: %s (supported: %s)", strings.Join(requested, ", "), strings.Join(wsSubprotocols, ", ")))
+		return
+	}
+
+	conn, err := h.wsManager.(*WSManagerImpl).upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Warn("WebSocket upgrade error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// WebSocketは長時間接続のため、HTTPサーバーの書き込みタイムアウトを解除
+	conn.NetConn().SetWriteDeadline(time.Time{})
+
+	if limit := h.wsManager.(*WSManagerImpl).maxMessageSize; limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+
+	// 期限内に認証できない接続は登録せずに切断する。ハンドシェイクが無効な場合はdefaultWSAuthTimeoutまで待つ
+	var handshakeDeadline time.Time
+	if timeout := h.wsManager.(*WSManagerImpl).handshakeTimeout; timeout > 0 {
+		handshakeDeadline = time.Now().Add(timeout)
+	}
+	if keyName == "" {
+		authDeadline := handshakeDeadline
+		if authDeadline.IsZero() {
+			authDeadline = time.Now().Add(defaultWSAuthTimeout)
+		}
+		keyName, err = h.wsManager.(*WSManagerImpl).authenticate(conn, authDeadline)
+		if err == nil && !wsUserAllowed(keyName, c.Query("user_id")) {
+			err = errWSUserMismatch
+		}
+		if err != nil {
+			logger.Warn("WebSocket handshake failed", "client_ip", ip, "error", err)
+			if reason := handshakeCloseReason(err); reason != "" {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeWait))
+			}
+			return
+		}
+	}
+	if keyName != "" {
+		logger = logger.With("api_key_name", keyName)
+	}
+
+	// クライアントを登録。since_seqが指定された場合は切断中に送られたメッセージを再送する
+	if sinceSeq, ok := c.GetQuery("since_seq"); ok {
+		seq, err := strconv.ParseUint(sinceSeq, 10, 64)
+		if err != nil {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "invalid since_seq"))
+			return
+		}
+		replayed := h.wsManager.AddClientSince(conn, c.Query("user_id"), seq)
+		logger.Info("Replayed WebSocket messages", "since_seq", seq, "count", replayed)
+	} else {
+		h.wsManager.AddClient(conn, c.Query("user_id"))
+	}
+	cwm := h.wsManager.(*WSManagerImpl).GetClient(conn)
+	logger.Info("WebSocket connection established", "connection_id", cwm.id, "client_ip", clientIP(c), "protocol", cwm.protocol)
+
+	// 接続解除時にクライアントを削除
+	defer h.wsManager.RemoveClient(conn)
+
+	// ハンドシェイクの最後に、get_notificationsを待たずに未読の通知の一覧を送信する
+	if !handshakeDeadline.IsZero() {
+		if err := cwm.writeJSONBefore(h.wsManager.(*WSManagerImpl).notificationsList(cwm), handshakeDeadline); err != nil {
+			logger.Warn("WebSocket initial sync failed, closing connection", "connection_id", cwm.id, "error", err)
+			h.wsManager.(*WSManagerImpl).closeClient(cwm, websocket.ClosePolicyViolation, "handshake timeout")
+			return
+		}
+	}
 
 	// Pongを受信したら読み取り期限を延長
 	conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -402,76 +6278,1443 @@ func (h *NotificationHandler) HandleWebSocket(c *gin.Context) {
 		conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
+	// サーバーからのPingへの応答 (Pong) はブラウザが自動で返すため、クライアントからのPingのみをアクティビティとして扱う
+	conn.SetPingHandler(func(data string) error {
+		cwm.touch()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
+	// 定期的にPingを送信するgoroutine
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := cwm.WritePing(); err != nil {
+				return
+			}
+		}
+	}()
+
+	limiter := newRateLimiter(h.wsManager.(*WSManagerImpl).messageRate, h.wsManager.(*WSManagerImpl).messageBurst)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// gorilla/websocketがCloseMessageTooBigのクローズフレームを送信済み
+				logger.Warn("WebSocket message too big, closing connection", "client_ip", clientIP(c))
+				break
+			}
+			logger.Info("WebSocket read error", "error", err)
+			break
+		}
+		if !limiter.Allow(time.Now()) {
+			logger.Warn("WebSocket message rate exceeded, closing connection", "connection_id", cwm.id, "client_ip", clientIP(c))
+			h.wsManager.(*WSManagerImpl).closeClient(cwm, websocket.ClosePolicyViolation, "message rate exceeded")
+			break
+		}
+		cwm.touch()
+		msg, err := decodeWSMessage(data)
+		if err != nil {
+			logger.Warn("WebSocket message decoding error", "error", err)
+			continue
+		}
+
+		if err := h.wsManager.HandleMessage(conn, msg); err != nil {
+			logger.Warn("WebSocket message handling error", "type", msg.Type, "error", err)
+		}
+	}
+}
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	loggerKey       = "logger"
+)
+
+// requestID はX-Request-IDヘッダーを引き継ぐか新たに生成し、レスポンスとログに付与する
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = generateRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Set(loggerKey, slog.Default().With("request_id", id))
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID はヘッダーに安全に含められるIDかを判定する
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func generateRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger はリクエストIDを含むロガーを返す
+func requestLogger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+func newErrorResponse(c *gin.Context, message string) ErrorResponse {
+	return ErrorResponse{Error: message, RequestID: c.GetString(requestIDKey)}
+}
+
+func respondError(c *gin.Context, status int, message string) {
+	c.JSON(status, newErrorResponse(c, message))
+}
+
+// respondBindError はリクエストボディのバインドに失敗した場合に400を返す
+// 検証エラーや型の不一致の場合は、どのフィールドが不正かをerrorsに含める
+func respondBindError(c *gin.Context, err error) {
+	resp := newErrorResponse(c, err.Error())
+	var validationErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &validationErrs):
+		resp.Error = "validation failed"
+		for _, fe := range validationErrs {
+			reason := fe.Tag()
+			if fe.Param() != "" {
+				reason += "=" + fe.Param()
+			}
+			resp.Errors = append(resp.Errors, FieldError{Field: fieldPath(fe.Namespace()), Reason: reason})
+		}
+	case errors.As(err, &typeErr):
+		resp.Error = "validation failed"
+		resp.Errors = []FieldError{{Field: typeErr.Field, Reason: "must be " + typeErr.Type.String()}}
+	}
+	c.JSON(http.StatusBadRequest, resp)
+}
+
+// respondValidationError は通知の検証に失敗した場合に400を返す
+// InvalidFieldErrorの場合は、どのフィールドが不正かをerrorsに含める
+func respondValidationError(c *gin.Context, err error) {
+	resp := newErrorResponse(c, "validation failed")
+	var fieldErr *InvalidFieldError
+	if errors.As(err, &fieldErr) {
+		resp.Errors = []FieldError{{Field: fieldErr.Field, Reason: err.Error()}}
+	} else {
+		resp.Errors = []FieldError{{Reason: err.Error()}}
+	}
+	c.JSON(http.StatusBadRequest, resp)
+}
+
+// fieldPath は "CreateNotificationRequest.title" のような名前空間から構造体名を除く
+func fieldPath(namespace string) string {
+	if _, path, ok := strings.Cut(namespace, "."); ok {
+		return path
+	}
+	return namespace
+}
+
+// jsonFieldName は検証エラーのフィールド名に、構造体のフィールド名ではなくJSONのキーを使う
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+	return name
+}
+
+func abortWithError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, newErrorResponse(c, message))
+}
+
+// noRoute は存在しないパスへのリクエストにJSONで404を返す
+func noRoute(c *gin.Context) {
+	respondError(c, http.StatusNotFound, fmt.Sprintf("route not found: %s %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// noMethod は許可されていないメソッドでのリクエストにJSONで405を返す
+func noMethod(c *gin.Context) {
+	respondError(c, http.StatusMethodNotAllowed, fmt.Sprintf("method not allowed: %s %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// requireAdmin は管理用APIへのアクセスをBearerトークンで制限する
+func requireAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			abortWithError(c, http.StatusForbidden, "admin API is disabled")
+			return
+		}
+
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			abortWithError(c, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// apiKeyNameKey は認証したAPIキーの名前を保持するコンテキストのキー
+const apiKeyNameKey = "api_key_name"
+
+// requireAPIKey は通知APIへのアクセスをAPIキーで制限する。keysが空の場合は認証しない
+func requireAPIKey(keys map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(keys) == 0 {
+			c.Next()
+			return
+		}
+
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok {
+			if name := matchAPIKey(keys, provided); name != "" {
+				c.Set(apiKeyNameKey, name)
+				c.Next()
+				return
+			}
+		}
+		abortWithError(c, http.StatusUnauthorized, "invalid or missing API key")
+	}
+}
+
+// requireWSAPIKey はWebSocketのアップグレード前にAPIキーで認証する。keysが空の場合は認証しない
+// ブラウザから接続できるよう、wsRequestTokenと同じくtokenクエリも受け付ける
+func requireWSAPIKey(keys map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(keys) == 0 {
+			c.Next()
+			return
+		}
+
+		if provided, ok := wsRequestToken(c); ok {
+			if name := matchAPIKey(keys, provided); name != "" {
+				c.Set(apiKeyNameKey, name)
+				c.Next()
+				return
+			}
+		}
+		abortWithError(c, http.StatusUnauthorized, "invalid or missing API key")
+	}
+}
+
+// matchAPIKey は一致したキーの名前を返す。一致しない場合は空を返す
+func matchAPIKey(keys map[string]string, provided string) string {
+	// どのキーと一致したかで処理時間が変わらないよう、全てのキーと比較する
+	name := ""
+	for keyName, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
+			name = keyName
+		}
+	}
+	return name
+}
+
+// setupCORS はCORSヘッダーを付与する。maxAgeが0より大きい場合はプリフライトの結果をその期間キャッシュさせ、
+// exposeHeadersに指定したレスポンスヘッダーをブラウザのスクリプトから読めるようにする
+func setupCORS(origins []string, maxAge time.Duration, exposeHeaders []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	expose := strings.Join(exposeHeaders, ", ")
+	return func(c *gin.Context) {
+		if len(allowed) == 0 {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			// 許可していないオリジンにはヘッダーを返さず、ブラウザにブロックさせる
+			c.Header("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); allowed[origin] {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+		}
+		c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, X-Notibag-Source")
+		if expose != "" {
+			c.Header("Access-Control-Expose-Headers", expose)
+		}
+		
+		if c.Request.Method == "OPTIONS" {
+			if maxAge > 0 {
+				c.Header("Access-Control-Max-Age", strconv.Itoa(int(maxAge/time.Second)))
+			}
+			c.AbortWithStatus(204)
+			return
+		}
+		
+		c.Next()
+	}
+}
+
+// Response compression
+// compressedContentTypes は圧縮済みのため再圧縮しないContent-Type
+// SSEはイベントごとにすぐ届くよう圧縮しない
+var compressedContentTypes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip", "application/zstd", "text/event-stream"}
+
+// gzipResponse はAccept-Encodingでgzipを受け付けるクライアントに、minSizeバイト以上のレスポンスを圧縮して返す
+func gzipResponse(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// WebSocketは接続を引き継ぐため、HEADは本文がないため対象外とする
+		if c.Request.Method == http.MethodHead || c.IsWebsocket() {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = w
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// acceptsGzip はAccept-Encodingにq=0以外のgzipが含まれるかを判定する
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter はminSizeバイトに達するかフラッシュされるまで本文を保留し、圧縮するかを決める
+// 圧縮するかはヘッダーを送信する前に決める必要があるため、保留中はステータスも送信しない
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Unwrap はhttp.ResponseControllerで書き込み期限などを設定できるようにする
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush はストリーミングのレスポンスで、サイズが分からないまま送信を始める場合に圧縮する
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// start は圧縮するかを決め、保留していた本文を書き出す
+func (w *gzipWriter) start(compress bool) error {
+	w.decided = true
+	header := w.Header()
+	if compress && w.compressible() {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipWriter) compressible() bool {
+	if status := w.Status(); status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := w.Header().Get("Content-Type")
+	for _, prefix := range compressedContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
 
-	// 定期的にPingを送信するgoroutine
-	cwm := h.wsManager.(*WSManagerImpl).GetClient(conn)
-	go func() {
-		ticker := time.NewTicker(pingInterval)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := cwm.WritePing(); err != nil {
-				return
-			}
+// finish はminSizeに達しなかった本文をそのまま書き出し、圧縮していれば終端を書き込む
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		if err := w.start(false); err != nil {
+			slog.Warn("Error writing response", "error", err)
 		}
-	}()
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			slog.Warn("Error writing compressed response", "error", err)
+		}
+	}
+}
 
-	for {
-		var msg WSMessage
-		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("WebSocket read error: %v", err)
-			break
+// Server configuration
+type ServerConfig struct {
+	Addr         string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	Categories   []string
+	// 空の場合は全てのオリジンを許可する
+	CORSOrigins []string
+	// プリフライトの結果をキャッシュさせる期間。0の場合はAccess-Control-Max-Ageを返さない
+	CORSMaxAge time.Duration
+	// Access-Control-Expose-Headersで公開するレスポンスヘッダー
+	CORSExposeHeaders []string
+	// 空の場合はどのプロキシも信頼しない
+	TrustedProxies []string
+	// 空の場合は管理用APIを無効にする
+	AdminToken string
+	// 名前からAPIキーへのマップ。空の場合は通知APIに認証を要求しない
+	APIKeys            map[string]string
+	WSMessageVersion   int
+	WSMaxMessageSize   int64
+	WSReadBuffer       int
+	WSWriteBuffer      int
+	WSBufferPool       bool
+	WSGlobalClear      bool
+	WSSendBuffer       int
+	WSBackpressure     string
+	WSSendTimeout      time.Duration
+	WSBatchWindow      time.Duration
+	WSHeartbeat        time.Duration
+	WSIdleTimeout      time.Duration
+	WSHandshake        time.Duration
+	WSMaxInFlight      int
+	WSInFlightPolicy   string
+	MaxNamespaces      int
+	ListDefaultLimit   int
+	ListMaxLimit       int
+	WSMessageRate      float64
+	WSMessageBurst     int
+	WSMaxConnsPerIP    int
+	QuietHours         string
+	QuietHoursTZ       string
+	EscalateAfter      time.Duration
+	EscalateMax        int
+	EscalationURLs     []string
+	WSErrorLogLimit    int
+	WSHealthErrorRate  float64
+	WSErrorLogInterval time.Duration
+	WSReplayBuffer     int
+	WSReplayPath       string
+	WSOrdered          bool
+	WSReplayMaxAge     time.Duration
+	WSShutdownGrace    time.Duration
+	IngestQueueSize    int
+	IngestWorkers      int
+	CategoryColors     map[string]string
+	EmbedColors        bool
+	ShutdownTimeout    time.Duration
+	PreviewLength      int
+	Broadcast          bool
+	LogRedact          bool
+	GzipMinSize        int
+	SelfTest           bool
+	SelfTestDelay      time.Duration
+	Repository         RepositoryConfig
+	Webhooks           WebhookConfig
+	TimeZone           string
+	// 両方指定された場合はTLS (HTTP/2対応) で待ち受ける
+	TLSCert string
+	TLSKey  string
+	// カテゴリごとの通知の最小間隔
+	CategoryCooldowns map[string]time.Duration
+	DedupWindow       time.Duration
+	ArchiveOnClear    bool
+	DefaultPriority   string
+	DefaultCategory   string
+	MaxTags           int
+	MaxTagLength      int
+	MaxAttachments    int
+	MaxAttachmentSize int64
+	MaxAttachmentData int64
+	PriorityPolicy    map[string]PriorityHints
+	CategoryTTLs      map[string]time.Duration
+	AutoRead          bool
+	IDPrefixes        map[string]string
+}
+
+func parseServerConfig() *ServerConfig {
+	cfg := &ServerConfig{}
+	flag.StringVar(&cfg.Addr, "addr", ":8080", "Server listen address")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", 10*time.Second, "Maximum duration for reading the entire request")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", 10*time.Second, "Maximum duration before timing out writes of the response (not applied to WebSocket)")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 60*time.Second, "Maximum time to wait for the next request on keep-alive connections")
+	categories := flag.String("categories", "", "Comma-separated list of allowed notification categories (empty allows any)")
+	categoryColors := flag.String("category-colors", "", "Comma-separated category=#rrggbb pairs served at /api/config/categories")
+	flag.BoolVar(&cfg.EmbedColors, "embed-category-colors", false, "Add the category color to notifications broadcast to WebSocket clients")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated list of origins allowed by CORS (empty allows any)")
+	flag.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache CORS preflight responses (0 omits Access-Control-Max-Age)")
+	corsExposeHeaders := flag.String("cors-expose-headers", strings.Join([]string{unreadCountHeader, "ETag", requestIDHeader, limitClampedHeader}, ","), "Comma-separated list of response headers readable by browser scripts via CORS")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("NOTIBAG_TRUSTED_PROXIES"), "Comma-separated list of trusted proxy IPs/CIDRs whose X-Forwarded-For is honored")
+	apiKeys := flag.String("api-keys", os.Getenv("NOTIBAG_API_KEYS"), "Comma-separated name=key pairs required as Bearer tokens for the notification API (empty disables auth)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("NOTIBAG_ADMIN_TOKEN"), "Bearer token required for admin API (empty disables it)")
+	flag.IntVar(&cfg.GzipMinSize, "gzip-min-size", 1024, "Gzip-compress responses of at least this many bytes for clients that accept it (-1 disables)")
+	flag.BoolVar(&cfg.LogRedact, "log-redact", false, "Omit notification titles and messages from logs, logging only the ID, title length and category")
+	flag.IntVar(&cfg.WSMessageVersion, "ws-message-version", WSMessageVersionTyped, "WebSocket message format version (1: legacy flat format, 2: typed per-message format, 3: versioned envelope with a type-specific payload)")
+	flag.Int64Var(&cfg.WSMaxMessageSize, "ws-max-message-size", 32*1024, "Maximum size in bytes of a message received from a WebSocket client (0 for unlimited)")
+	flag.StringVar(&cfg.Repository.Store, "store", "memory", "Notification store backend (memory, file)")
+	flag.StringVar(&cfg.Repository.Path, "store-path", "notibag.json", "Path of the JSON file used by the file store")
+	flag.StringVar(&cfg.TimeZone, "tz", "", "Default IANA time zone for timestamps in responses (empty keeps stored values)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file (requires -tls-key)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file (requires -tls-cert)")
+	cooldowns := flag.String("category-cooldowns", "", "Comma-separated category=duration pairs for the minimum interval between notifications (e.g. deploy=1m)")
+	flag.DurationVar(&cfg.DedupWindow, "dedup-window", 0, "Suppress notifications whose title and message match one created within this window (0 disables)")
+	flag.BoolVar(&cfg.ArchiveOnClear, "archive-on-clear", false, "Archive notifications instead of deleting them when clearing all")
+	flag.BoolVar(&cfg.AutoRead, "auto-read-on-delivery", false, "Mark notifications read once broadcast to at least one client unless the request sets auto_read_on_delivery")
+	flag.IntVar(&cfg.WSReadBuffer, "ws-read-buffer-size", 0, "WebSocket read buffer size in bytes (0 for the default)")
+	flag.IntVar(&cfg.WSWriteBuffer, "ws-write-buffer-size", 0, "WebSocket write buffer size in bytes (0 for the default)")
+	flag.BoolVar(&cfg.WSBufferPool, "ws-buffer-pool", false, "Share WebSocket write buffers between connections to reduce allocations")
+	flag.StringVar(&cfg.DefaultPriority, "default-priority", PriorityNormal, "Priority applied when a request omits it (low, normal, high, critical)")
+	flag.StringVar(&cfg.DefaultCategory, "default-category", "", "Category applied when a request omits it")
+	flag.IntVar(&cfg.MaxTags, "max-tags", 20, "Maximum number of tags per notification (0 for unlimited)")
+	flag.IntVar(&cfg.MaxTagLength, "max-tag-length", 64, "Maximum length of a tag in characters (0 for unlimited)")
+	flag.IntVar(&cfg.MaxAttachments, "max-attachments", 10, "Maximum number of attachments per notification (0 for unlimited)")
+	flag.Int64Var(&cfg.MaxAttachmentSize, "max-attachment-size", 0, "Maximum declared size in bytes of an attachment (0 for unlimited)")
+	flag.Int64Var(&cfg.MaxAttachmentData, "max-attachment-data", defaultMaxAttachmentData, "Maximum decoded size in bytes of base64 data embedded in an attachment")
+	prioritySounds := flag.String("priority-sounds", "", "Comma-separated priority=sound pairs applied when a request omits the sound (e.g. critical=alert,low=silent)")
+	priorityAcks := flag.String("priority-requires-ack", "", "Comma-separated list of priorities whose notifications require an ack unless the request says otherwise")
+	idPrefixes := flag.String("id-prefixes", "", "Comma-separated source=prefix pairs prepended to IDs of notifications from that source (e.g. notibag-send=cli-,web=web-)")
+	categoryTTLs := flag.String("category-ttls", "", "Comma-separated category=duration pairs after which notifications expire unless the request sets a ttl; takes precedence over -priority-ttls, 0 never expires (e.g. system=10m,security=0)")
+	priorityTTLs := flag.String("priority-ttls", "", "Comma-separated priority=duration pairs after which notifications expire unless the request sets a ttl (e.g. low=1h)")
+	flag.IntVar(&cfg.WSSendBuffer, "ws-send-buffer", defaultSendBufferSize, "Number of messages queued per WebSocket client before the backpressure policy applies")
+	flag.IntVar(&cfg.WSMaxInFlight, "ws-max-inflight-broadcasts", 0, "Maximum number of WebSocket broadcasts running concurrently (0 for unlimited)")
+	flag.StringVar(&cfg.WSInFlightPolicy, "ws-inflight-policy", InFlightQueue, "Policy when -ws-max-inflight-broadcasts is reached (queue waits for a slot, shed drops the broadcast)")
+	flag.StringVar(&cfg.WSBackpressure, "ws-backpressure", BackpressureDropClient, "Policy when a client's send queue is full (drop_client, drop_oldest, drop_newest, block_with_timeout)")
+	flag.DurationVar(&cfg.WSSendTimeout, "ws-send-timeout", defaultSendTimeout, "Maximum time to wait for queue space with block_with_timeout before dropping the client")
+	flag.DurationVar(&cfg.WSBatchWindow, "ws-batch-window", 0, "Group notifications created within this window into a single notifications_batch message (0 disables)")
+	flag.IntVar(&cfg.WSErrorLogLimit, "ws-error-log-limit", 10, "Maximum number of per-client WebSocket send error logs per interval; the rest are summarized (0 for unlimited)")
+	flag.DurationVar(&cfg.WSErrorLogInterval, "ws-error-log-interval", 10*time.Second, "Interval for -ws-error-log-limit")
+	flag.Float64Var(&cfg.WSHealthErrorRate, "ws-health-error-rate", 0.1, "Report /api/health as degraded when more than this fraction of recent WebSocket sends failed (0 disables)")
+	flag.IntVar(&cfg.WSReplayBuffer, "ws-replay-buffer", 100, "Number of recent broadcasts kept for replay to clients reconnecting with since_seq (0 disables)")
+	flag.BoolVar(&cfg.WSOrdered, "ws-ordered-broadcasts", false, "Attach a seq to every WebSocket broadcast and deliver them to each client in seq order, serializing concurrent broadcasts")
+	flag.StringVar(&cfg.WSReplayPath, "ws-replay-path", "", "File to persist the -ws-replay-buffer history so it survives restarts (empty keeps it in memory)")
+	flag.DurationVar(&cfg.WSReplayMaxAge, "ws-replay-max-age", 0, "Do not replay broadcasts older than this (0 for no limit)")
+	flag.DurationVar(&cfg.WSShutdownGrace, "ws-shutdown-grace", 5*time.Second, "Time to wait for WebSocket clients to close after the shutdown close frame before force-closing them")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "Time to wait for in-flight HTTP requests to finish on shutdown")
+	flag.DurationVar(&cfg.WSHeartbeat, "ws-heartbeat-interval", 0, "Interval of application-level heartbeat messages sent to WebSocket clients (0 disables)")
+	flag.IntVar(&cfg.WSMaxConnsPerIP, "ws-max-connections-per-ip", 0, "Maximum number of concurrent WebSocket connections from a single client IP; excess upgrades get 429 (0 for unlimited)")
+	flag.StringVar(&cfg.QuietHours, "quiet-hours", "", "Daily HH:MM-HH:MM range during which non-critical notifications are stored but not pushed until it ends (e.g. 22:00-07:00)")
+	flag.StringVar(&cfg.QuietHoursTZ, "quiet-hours-tz", "", "IANA time zone of -quiet-hours (empty uses the local time zone)")
+	flag.DurationVar(&cfg.EscalateAfter, "escalate-after", 0, "Re-broadcast critical notifications that no client has acked within this duration (0 disables)")
+	flag.IntVar(&cfg.EscalateMax, "escalate-max", 3, "Maximum number of escalations of a single notification")
+	escalationURLs := flag.String("escalation-webhook-urls", "", "Comma-separated list of URLs that receive an escalated event for each escalation (e.g. a Slack relay)")
+	flag.Float64Var(&cfg.WSMessageRate, "ws-max-message-rate", 20, "Maximum messages per second a WebSocket client may send; clients exceeding it are closed with a policy violation (0 for unlimited)")
+	flag.IntVar(&cfg.WSMessageBurst, "ws-max-message-burst", 40, "Number of messages a WebSocket client may send in a burst above -ws-max-message-rate")
+	flag.DurationVar(&cfg.WSIdleTimeout, "ws-idle-timeout", 0, "Disconnect WebSocket clients that send no message or ping for this long (0 disables)")
+	flag.IntVar(&cfg.ListDefaultLimit, "list-default-limit", 0, "Number of notifications returned by GET /api/notifications when limit is omitted (0 returns all)")
+	flag.IntVar(&cfg.ListMaxLimit, "list-max-limit", 0, "Maximum limit accepted by GET /api/notifications; larger values are clamped (0 for unlimited, otherwise requires -list-default-limit between 1 and this)")
+	flag.IntVar(&cfg.MaxNamespaces, "max-namespaces", 100, "Maximum number of namespaces created on demand under /api/ns/:namespace (0 for unlimited)")
+	flag.DurationVar(&cfg.WSHandshake, "ws-handshake-timeout", 0, "Close WebSocket connections that do not authenticate (when -api-keys is set) and receive the initial notification list within this long (0 sends no initial list and allows 10s for auth)")
+	flag.BoolVar(&cfg.WSGlobalClear, "ws-allow-global-clear", false, "Allow clear_all from WebSocket connections without a user to delete all notifications")
+	flag.IntVar(&cfg.PreviewLength, "preview-length", 100, "Maximum number of characters of a message in list previews")
+	flag.IntVar(&cfg.IngestQueueSize, "ingest-queue-size", 0, "Queue created notifications and store and broadcast them in background workers, responding 202 immediately (0 disables)")
+	flag.IntVar(&cfg.IngestWorkers, "ingest-workers", 4, "Number of workers processing -ingest-queue-size")
+	flag.BoolVar(&cfg.Broadcast, "broadcast", true, "Push created notifications to WebSocket clients (disable to serve them only via polling)")
+	flag.BoolVar(&cfg.SelfTest, "self-test", false, "Emit a system notification after startup and log whether any client received it")
+	webhookURLs := flag.String("webhook-urls", "", "Comma-separated list of URLs that receive a POST for notification events (created, read, deleted, cleared)")
+	webhookEvents := flag.String("webhook-events", "", "Comma-separated url=event|event pairs limiting the events sent to a webhook URL (e.g. https://example.com/hook=read|deleted); unlisted URLs receive all events")
+	flag.DurationVar(&cfg.Webhooks.Timeout, "webhook-timeout", 5*time.Second, "Timeout of a single webhook request")
+	flag.DurationVar(&cfg.Webhooks.RetryInterval, "webhook-retry-interval", 10*time.Second, "Initial interval between webhook retries (doubled after each failure, up to 5m)")
+	flag.DurationVar(&cfg.Webhooks.MaxRetryAge, "webhook-max-retry-age", time.Hour, "Give up retrying a webhook delivery this long after the first attempt")
+	flag.StringVar(&cfg.Webhooks.QueuePath, "webhook-queue-path", "", "File to persist pending webhook retries across restarts (empty keeps them in memory)")
+	flag.DurationVar(&cfg.SelfTestDelay, "self-test-delay", 5*time.Second, "Time to wait for clients to connect before emitting the self-test notification")
+	configPath := flag.String("config", "", "JSON or YAML config file whose keys are flag names (flags given on the command line take precedence)")
+	flag.Parse()
+	if *configPath != "" {
+		if err := loadConfigFile(flag.CommandLine, *configPath); err != nil {
+			fatal("Invalid config file", "error", err)
 		}
+	}
+	cfg.Categories = splitList(*categories)
+	cfg.CORSOrigins = splitList(*corsOrigins)
+	cfg.CORSExposeHeaders = splitList(*corsExposeHeaders)
+	if cfg.CORSMaxAge < 0 {
+		fatal("Invalid -cors-max-age", "error", fmt.Errorf("must not be negative: %s", cfg.CORSMaxAge))
+	}
+	cfg.Webhooks.URLs = splitList(*webhookURLs)
+	cfg.EscalationURLs = splitList(*escalationURLs)
 
-		if err := h.wsManager.HandleMessage(conn, msg); err != nil {
-			log.Printf("WebSocket message handling error: %v", err)
+	var err error
+	if cfg.Webhooks.Events, err = parseWebhookEvents(*webhookEvents); err != nil {
+		fatal("Invalid -webhook-events", "error", err)
+	}
+	if cfg.CategoryCooldowns, err = parseDurationMap(*cooldowns); err != nil {
+		fatal("Invalid -category-cooldowns", "error", err)
+	}
+	if cfg.APIKeys, err = parseStringMap(*apiKeys); err != nil {
+		fatal("Invalid -api-keys", "error", err)
+	}
+	if cfg.CategoryColors, err = parseColorMap(*categoryColors, cfg.Categories); err != nil {
+		fatal("Invalid -category-colors", "error", err)
+	}
+	if cfg.CategoryTTLs, err = parseDurationMap(*categoryTTLs); err != nil {
+		fatal("Invalid -category-ttls", "error", err)
+	}
+	if cfg.IDPrefixes, err = parseStringMap(*idPrefixes); err != nil {
+		fatal("Invalid -id-prefixes", "error", err)
+	}
+	sounds, err := parseStringMap(*prioritySounds)
+	if err != nil {
+		fatal("Invalid -priority-sounds", "error", err)
+	}
+	ttls, err := parseDurationMap(*priorityTTLs)
+	if err != nil {
+		fatal("Invalid -priority-ttls", "error", err)
+	}
+	cfg.PriorityPolicy = map[string]PriorityHints{}
+	for priority, sound := range sounds {
+		hints := cfg.PriorityPolicy[priority]
+		hints.Sound = sound
+		cfg.PriorityPolicy[priority] = hints
+	}
+	for _, priority := range splitList(*priorityAcks) {
+		hints := cfg.PriorityPolicy[priority]
+		hints.RequiresAck = true
+		cfg.PriorityPolicy[priority] = hints
+	}
+	for priority, ttl := range ttls {
+		hints := cfg.PriorityPolicy[priority]
+		hints.TTL = ttl
+		cfg.PriorityPolicy[priority] = hints
+	}
+	cfg.TrustedProxies = splitList(*trustedProxies)
+	return cfg
+}
+
+// Namespaces
+// 1つのサーバーで複数のアプリケーションの通知を扱えるよう、名前空間ごとにリポジトリとWebSocketの接続を分ける
+type Namespaces struct {
+	create   func(name string) (*NotificationHandler, error)
+	max      int
+	handlers map[string]*NotificationHandler
+	mu       sync.Mutex
+}
+
+// ErrTooManyNamespaces は名前空間の数が上限に達したため生成できないことを表す
+var ErrTooManyNamespaces = errors.New("too many namespaces")
+
+// NewNamespaces はcreateで名前空間のハンドラーを生成する。maxが0以下の場合は無制限
+func NewNamespaces(max int, create func(name string) (*NotificationHandler, error)) *Namespaces {
+	return &Namespaces{
+		create:   create,
+		max:      max,
+		handlers: make(map[string]*NotificationHandler),
+	}
+}
+
+// Get は名前空間のハンドラーを返す。存在しない場合は生成する
+func (n *Namespaces) Get(name string) (*NotificationHandler, error) {
+	if !validNamespace(name) {
+		return nil, fmt.Errorf("invalid namespace: %q", name)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if h, ok := n.handlers[name]; ok {
+		return h, nil
+	}
+	if n.max > 0 && len(n.handlers) >= n.max {
+		return nil, fmt.Errorf("%w (max %d)", ErrTooManyNamespaces, n.max)
+	}
+	h, err := n.create(name)
+	if err != nil {
+		return nil, err
+	}
+	n.handlers[name] = h
+	slog.Info("Namespace created", "namespace", name)
+	return h, nil
+}
+
+// Handlers はシャットダウン用に生成済みのハンドラーを返す
+func (n *Namespaces) Handlers() []*NotificationHandler {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Collect(maps.Values(n.handlers))
+}
+
+// validNamespace はファイル名に使用できるよう、英小文字・数字・-・_のみを許可する
+func validNamespace(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
 		}
 	}
+	return true
 }
 
-func setupCORS() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+// namespacePath は名前空間ごとの保存先を返す (例: notibag.json → notibag.ns-app.json)
+func namespacePath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".ns-" + name + ext
+}
+
+const namespaceHandlerKey = "namespace_handler"
+
+// resolve は:namespaceのハンドラーを取得し、namespaceHandlerで参照できるようにする
+func (n *Namespaces) resolve(c *gin.Context) {
+	h, err := n.Get(c.Param("namespace"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrTooManyNamespaces):
+			status = http.StatusTooManyRequests
+		case !validNamespace(c.Param("namespace")):
+			status = http.StatusBadRequest
 		}
-		
-		c.Next()
+		abortWithError(c, status, err.Error())
+		return
 	}
+	c.Set(namespaceHandlerKey, h)
+	c.Next()
 }
 
-func main() {
-	// 依存関係の注入
-	repo := NewInMemoryNotificationRepository()
-	service := NewNotificationService(repo)
-	wsManager := NewWSManager(service)
-	handler := NewNotificationHandler(service, wsManager)
+func namespaceHandler(c *gin.Context) *NotificationHandler {
+	return c.MustGet(namespaceHandlerKey).(*NotificationHandler)
+}
+
+type NamespaceInfo struct {
+	Name        string `json:"name"`
+	UnreadCount int    `json:"unread_count"`
+	Clients     int    `json:"clients"`
+}
+
+type NamespacesResponse struct {
+	Namespaces []NamespaceInfo `json:"namespaces"`
+}
+
+// List は生成済みの名前空間を名前順に返す
+func (n *Namespaces) List(c *gin.Context) {
+	n.mu.Lock()
+	infos := make([]NamespaceInfo, 0, len(n.handlers))
+	for name, h := range n.handlers {
+		infos = append(infos, NamespaceInfo{
+			Name:        name,
+			UnreadCount: h.service.CountUnreadNotifications(),
+			Clients:     h.wsManager.(*WSManagerImpl).Stats().Clients,
+		})
+	}
+	n.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	c.JSON(http.StatusOK, NamespacesResponse{Namespaces: infos})
+}
+
+// newRouter はミドルウェアとAPI・WebSocketのルートを登録する
+// namespacesがnilの場合は名前空間のAPIを登録しない
+func newRouter(cfg *ServerConfig, handler *NotificationHandler, namespaces *Namespaces) (*gin.Engine, error) {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(jsonFieldName)
+	}
 
 	r := gin.Default()
-	r.Use(setupCORS())
+	// nilの場合、X-Forwarded-For等のヘッダーを無視して接続元IPを使用する
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	r.Use(requestID(), setupCORS(cfg.CORSOrigins, cfg.CORSMaxAge, cfg.CORSExposeHeaders))
+	if cfg.GzipMinSize >= 0 {
+		r.Use(gzipResponse(cfg.GzipMinSize))
+	}
+	// gin標準のテキストではなく、他のAPIと同じ形式のエラーを返す
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(noRoute)
+	r.NoMethod(noMethod)
 
 	// API routes
 	api := r.Group("/api")
 	{
 		api.GET("/health", handler.HealthCheck)
-		api.POST("/notifications", handler.CreateNotification)
-		api.GET("/notifications", handler.GetNotifications)
-		api.GET("/notifications/all", handler.GetAllNotifications) // デバッグ用
-		api.PUT("/notifications/:id/read", handler.MarkAsRead)
-		api.DELETE("/notifications", handler.ClearAll)
+		api.GET("/version", handler.GetVersion)
+		api.GET("/health/live", handler.Liveness)
+		api.GET("/health/ready", handler.Readiness)
+		api.GET("/config/categories", handler.GetCategoriesConfig)
+		api.GET("/config/priorities", handler.GetPrioritiesConfig)
+		registerNotificationRoutes(api, func(*gin.Context) *NotificationHandler { return handler }, requireAPIKey(cfg.APIKeys))
+
+		admin := api.Group("/admin", requireAdmin(cfg.AdminToken))
+		admin.POST("/maintenance", handler.SetMaintenance)
+		admin.POST("/drain", handler.Drain)
+		admin.GET("/ws-stats", handler.GetWSStats)
+		admin.GET("/metrics", handler.GetMetrics)
+		admin.GET("/connections", handler.GetConnections)
+		admin.GET("/debug", handler.GetDebug)
+		admin.POST("/connections/:id/disconnect", handler.DisconnectClient)
 	}
 
 	// WebSocket endpoint
 	r.GET("/ws", handler.HandleWebSocket)
 
-	log.Println("Server starting on :8080")
-	r.Run(":8080")
+	// 名前空間ごとのAPI。認証してから名前空間を生成する
+	if namespaces != nil {
+		api.GET("/namespaces", requireAPIKey(cfg.APIKeys), namespaces.List)
+		ns := api.Group("/ns/:namespace", requireAPIKey(cfg.APIKeys), namespaces.resolve)
+		registerNotificationRoutes(ns, namespaceHandler)
+		// 認証していない接続に名前空間を生成させないよう、名前空間のWebSocketはアップグレード前に認証してから接続させる
+		r.GET("/ws/:namespace", requireWSAPIKey(cfg.APIKeys), namespaces.resolve, func(c *gin.Context) {
+			namespaceHandler(c).HandleWebSocket(c)
+		})
+	}
+	return r, nil
+}
+
+// registerNotificationRoutes は通知API・SSE・購読条件のルートをapiに登録する
+// handlerはリクエストごとに呼び出し、処理する名前空間のハンドラーを返す
+func registerNotificationRoutes(api *gin.RouterGroup, handler func(c *gin.Context) *NotificationHandler, middleware ...gin.HandlerFunc) {
+	h := func(fn func(*NotificationHandler, *gin.Context)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			fn(handler(c), c)
+		}
+	}
+
+	notifications := api.Group("/notifications", middleware...)
+	notifications.POST("", h((*NotificationHandler).CreateNotification))
+	notifications.POST("/validate", h((*NotificationHandler).ValidateNotification))
+	notifications.GET("", h((*NotificationHandler).GetNotifications))
+	notifications.HEAD("", h((*NotificationHandler).GetNotifications))
+	notifications.GET("/all", h((*NotificationHandler).GetAllNotifications)) // デバッグ用
+	notifications.GET("/export", h((*NotificationHandler).ExportNotifications))
+	notifications.GET("/count", h((*NotificationHandler).CountUnread))
+	notifications.GET("/latest", h((*NotificationHandler).GetLatestNotification))
+	notifications.GET("/:id", h((*NotificationHandler).GetNotification))
+	notifications.GET("/:id/engagement", h((*NotificationHandler).GetEngagement))
+	notifications.PUT("/read", h((*NotificationHandler).MarkReadBefore))
+	notifications.PUT("/:id/read", h((*NotificationHandler).MarkAsRead))
+	notifications.POST("/:id/archive", h((*NotificationHandler).ArchiveNotification))
+	notifications.POST("/:id/pin", h((*NotificationHandler).PinNotification))
+	notifications.POST("/:id/action", h((*NotificationHandler).TakeAction))
+	notifications.POST("/:id/unpin", h((*NotificationHandler).UnpinNotification))
+	notifications.POST("/:id/tags/:tag", h((*NotificationHandler).AddTag))
+	notifications.DELETE("/:id/tags/:tag", h((*NotificationHandler).RemoveTag))
+	notifications.PUT("/:id/metadata/:key", h((*NotificationHandler).SetMetadata))
+	notifications.DELETE("/:id/metadata/:key", h((*NotificationHandler).UnsetMetadata))
+	notifications.POST("/:id/rebroadcast", h((*NotificationHandler).RebroadcastNotification))
+	notifications.POST("/delete", h((*NotificationHandler).DeleteNotifications))
+	notifications.POST("/dedupe", h((*NotificationHandler).DedupeNotifications))
+	notifications.DELETE("", h((*NotificationHandler).ClearAll))
+
+	api.GET("/stream", append(middleware, h((*NotificationHandler).Stream))...)
+
+	users := api.Group("/users", middleware...)
+	users.GET("/:id/subscriptions", h((*NotificationHandler).GetUserSubscription))
+	users.PUT("/:id/subscriptions", h((*NotificationHandler).SetUserSubscription))
+	users.GET("/:id/dnd", h((*NotificationHandler).GetDoNotDisturb))
+	users.PUT("/:id/dnd", h((*NotificationHandler).SetDoNotDisturb))
+}
+
+func newHTTPServer(cfg *ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// fatal はエラーをログに出力して終了する
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// runSelfTest は起動確認用の通知を作成・配信し、受信したクライアント数をログに出力する
+func runSelfTest(service NotificationService, wsManager WSManager) int {
+	notification, err := service.CreateNotification(context.Background(), CreateNotificationRequest{
+		Title:    "セルフテスト",
+		Message:  "Notibagの起動確認用の通知です",
+		Type:     "info",
+		Category: "system",
+	})
+	if err != nil {
+		slog.Error("Self-test failed to create notification", "error", err)
+		return 0
+	}
+
+	delivered, held := wsManager.BroadcastNotification(*notification)
+	switch {
+	case held:
+		slog.Warn("Self-test notification was held and not received yet", "id", notification.ID)
+	case delivered == 0:
+		slog.Warn("Self-test notification was not received by any client", "id", notification.ID)
+	default:
+		slog.Info("Self-test notification was received", "id", notification.ID, "clients", delivered)
+	}
+	return delivered
+}
+
+func main() {
+	cfg := parseServerConfig()
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fatal("-tls-cert and -tls-key must be provided together")
+	}
+
+	switch cfg.WSMessageVersion {
+	case WSMessageVersionLegacy, WSMessageVersionTyped, WSMessageVersionEnvelope:
+		wsMessageVersion = cfg.WSMessageVersion
+	default:
+		fatal("Invalid WebSocket message version", "version", cfg.WSMessageVersion)
+	}
+	redactLogs = cfg.LogRedact
+
+	// SIGINT/SIGTERMでバックグラウンド処理を止め、シャットダウンを開始する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 依存関係の注入
+	var err error
+	var webhooks *WebhookDispatcher
+	if len(cfg.Webhooks.URLs) > 0 {
+		if webhooks, err = NewWebhookDispatcher(cfg.Webhooks); err != nil {
+			fatal("Failed to initialize webhooks", "error", err)
+		}
+		go webhooks.Run(ctx)
+	}
+	serviceConfig := ServiceConfig{
+		AllowedCategories: cfg.Categories,
+		CategoryCooldowns: cfg.CategoryCooldowns,
+		DedupWindow:       cfg.DedupWindow,
+		ArchiveOnClear:    cfg.ArchiveOnClear,
+		DefaultPriority:   cfg.DefaultPriority,
+		DefaultCategory:   cfg.DefaultCategory,
+		MaxTags:           cfg.MaxTags,
+		MaxTagLength:      cfg.MaxTagLength,
+		MaxAttachments:    cfg.MaxAttachments,
+		MaxAttachmentSize: cfg.MaxAttachmentSize,
+		MaxAttachmentData: cfg.MaxAttachmentData,
+		PriorityPolicy:    cfg.PriorityPolicy,
+		CategoryTTLs:      cfg.CategoryTTLs,
+		AutoRead:          cfg.AutoRead,
+		IDPrefixes:        cfg.IDPrefixes,
+		Webhooks:          webhooks,
+	}
+	if err := serviceConfig.Validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	wsConfig := WSConfig{
+		MaxMessageSize:     cfg.WSMaxMessageSize,
+		MaxMessageRate:     cfg.WSMessageRate,
+		MaxMessageBurst:    cfg.WSMessageBurst,
+		ReadBufferSize:     cfg.WSReadBuffer,
+		WriteBufferSize:    cfg.WSWriteBuffer,
+		UseBufferPool:      cfg.WSBufferPool,
+		AllowGlobalClear:   cfg.WSGlobalClear,
+		SendBufferSize:     cfg.WSSendBuffer,
+		BackpressurePolicy: cfg.WSBackpressure,
+		SendTimeout:        cfg.WSSendTimeout,
+		BatchWindow:        cfg.WSBatchWindow,
+		ErrorLogLimit:      cfg.WSErrorLogLimit,
+		ErrorLogInterval:   cfg.WSErrorLogInterval,
+		HealthErrorRate:    cfg.WSHealthErrorRate,
+		ReplayBufferSize:   cfg.WSReplayBuffer,
+		ReplayMaxAge:       cfg.WSReplayMaxAge,
+		ReplayPath:         cfg.WSReplayPath,
+		OrderedBroadcasts:  cfg.WSOrdered,
+		MaxConnsPerIP:      cfg.WSMaxConnsPerIP,
+		HandshakeTimeout:   cfg.WSHandshake,
+		APIKeys:            cfg.APIKeys,
+		// 名前空間ごとに制限する
+		MaxInFlightBroadcasts: cfg.WSMaxInFlight,
+		InFlightPolicy:        cfg.WSInFlightPolicy,
+	}
+	if cfg.EmbedColors {
+		wsConfig.CategoryColors = cfg.CategoryColors
+	}
+	quietLocation := time.Local
+	if cfg.QuietHoursTZ != "" {
+		if quietLocation, err = time.LoadLocation(cfg.QuietHoursTZ); err != nil {
+			fatal("Invalid quiet hours time zone", "error", err)
+		}
+	}
+	if wsConfig.QuietHours, err = parseQuietHours(cfg.QuietHours, quietLocation); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if cfg.EscalateAfter > 0 {
+		wsConfig.Escalation = &EscalationPolicy{After: cfg.EscalateAfter, MaxEscalations: cfg.EscalateMax}
+		if len(cfg.EscalationURLs) > 0 {
+			// 再送の設定は-webhook-*と共通にし、キューは保存しない
+			escalationWebhooks := cfg.Webhooks
+			escalationWebhooks.URLs = cfg.EscalationURLs
+			escalationWebhooks.QueuePath = ""
+			escalationWebhooks.Events = nil
+			if wsConfig.Escalation.Webhooks, err = NewWebhookDispatcher(escalationWebhooks); err != nil {
+				fatal("Failed to initialize escalation webhooks", "error", err)
+			}
+			go wsConfig.Escalation.Webhooks.Run(ctx)
+		}
+	}
+	if err := wsConfig.Validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	var location *time.Location
+	if cfg.TimeZone != "" {
+		if location, err = time.LoadLocation(cfg.TimeZone); err != nil {
+			fatal("Invalid time zone", "error", err)
+		}
+	}
+	if cfg.PreviewLength <= 0 {
+		fatal("Invalid preview length", "length", cfg.PreviewLength)
+	}
+	handlerConfig := HandlerConfig{
+		Location:         location,
+		PreviewLength:    cfg.PreviewLength,
+		DisableBroadcast: !cfg.Broadcast,
+		Webhooks:         webhooks,
+		Ingest:           IngestConfig{QueueSize: cfg.IngestQueueSize, Workers: cfg.IngestWorkers},
+		Categories:       cfg.Categories,
+		CategoryColors:   cfg.CategoryColors,
+		DefaultLimit:     cfg.ListDefaultLimit,
+		MaxLimit:         cfg.ListMaxLimit,
+		Drain:            &DrainState{},
+	}
+	if err := handlerConfig.Validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	// newHandler は設定を共有し、リポジトリとWebSocketの接続を独立させた通知APIを生成する
+	newHandler := func(repoConfig RepositoryConfig, replayPath string) (*NotificationHandler, error) {
+		repo, err := NewRepository(repoConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize repository: %w", err)
+		}
+		service := NewNotificationService(repo, serviceConfig)
+		wsConfig := wsConfig
+		wsConfig.ReplayPath = replayPath
+		wsManager, err := NewWSManager(service, wsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize WebSocket manager: %w", err)
+		}
+		service.SetUnreadCountListener(wsManager.ScheduleUnreadCount)
+		if cfg.WSHeartbeat > 0 {
+			go wsManager.RunHeartbeat(ctx, cfg.WSHeartbeat)
+		}
+		if cfg.WSIdleTimeout > 0 {
+			go wsManager.RunIdleCheck(ctx, cfg.WSIdleTimeout)
+		}
+		if wsConfig.QuietHours != nil {
+			go wsManager.RunQuietHours(ctx)
+		}
+		go wsManager.RunDoNotDisturb(ctx)
+		if replayPath != "" {
+			go wsManager.RunReplayPersistence(ctx)
+		}
+		if wsConfig.Escalation != nil {
+			go wsManager.RunEscalation(ctx)
+		}
+		go service.RunExpiry(ctx, expiryInterval, func(ids []string) {
+			for _, id := range ids {
+				wsManager.Broadcast(WSMessage{
+					Type:           "notification_deleted",
+					NotificationID: id,
+				})
+			}
+		})
+		handlerConfig := handlerConfig
+		handlerConfig.Priorities = service.PriorityPolicy()
+		return NewNotificationHandler(service, wsManager, handlerConfig), nil
+	}
+	handler, err := newHandler(cfg.Repository, cfg.WSReplayPath)
+	if err != nil {
+		fatal("Failed to initialize notification API", "error", err)
+	}
+	namespaces := NewNamespaces(cfg.MaxNamespaces, func(name string) (*NotificationHandler, error) {
+		repoConfig := cfg.Repository
+		repoConfig.Empty = true
+		if repoConfig.Store == "file" {
+			repoConfig.Path = namespacePath(repoConfig.Path, name)
+		}
+		replayPath := cfg.WSReplayPath
+		if replayPath != "" {
+			replayPath = namespacePath(replayPath, name)
+		}
+		return newHandler(repoConfig, replayPath)
+	})
+
+	r, err := newRouter(cfg, handler, namespaces)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	srv := newHTTPServer(cfg, r)
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("Failed to listen", "addr", cfg.Addr, "error", err)
+	}
+
+	// リスナーの準備ができた時点でReadyとする
+	handler.SetReady(true)
+
+	if cfg.SelfTest {
+		go func() {
+			// クライアントが接続するまで待ってから送信する
+			time.Sleep(cfg.SelfTestDelay)
+			runSelfTest(handler.service, handler.wsManager)
+		}()
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSCert != "" {
+			// ServeTLSはALPNでHTTP/2を自動的に有効にする (WebSocketはHTTP/1.1で接続される)
+			slog.Info("Server starting", "addr", cfg.Addr, "tls", true, "version", version, "commit", commit)
+			serveErr <- srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			slog.Info("Server starting", "addr", cfg.Addr, "tls", false, "version", version, "commit", commit)
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server error", "error", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	// 2回目のシグナルではシャットダウンを待たずに終了する
+	stop()
+	slog.Info("Shutting down", "ws_grace", cfg.WSShutdownGrace, "http_timeout", cfg.ShutdownTimeout)
+	handler.SetReady(false)
+
+	// Shutdownはハイジャックされた接続を待たないため、WebSocketは別の期限で閉じる
+	wsDone := make(chan struct{})
+	go func() {
+		defer close(wsDone)
+		graceCtx, cancel := context.WithTimeout(context.Background(), cfg.WSShutdownGrace)
+		defer cancel()
+		// 名前空間のクライアントにも同じ猶予を与えるよう、並行して閉じる
+		var closed atomic.Int64
+		var wg sync.WaitGroup
+		for _, h := range append(namespaces.Handlers(), handler) {
+			wg.Go(func() {
+				closed.Add(int64(h.wsManager.(*WSManagerImpl).Shutdown(graceCtx)))
+			})
+		}
+		wg.Wait()
+		if n := closed.Load(); n > 0 {
+			slog.Warn("Force-closed WebSocket connections after grace period", "count", n)
+		}
+	}()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTP server did not shut down cleanly", "error", err)
+	}
+	// 受け付けた通知を失わないよう、リクエストの処理が終わってからキューを空にする
+	if err := handler.ShutdownIngest(shutdownCtx); err != nil {
+		slog.Warn("Notification queue did not drain", "error", err)
+	}
+	for _, h := range namespaces.Handlers() {
+		if err := h.ShutdownIngest(shutdownCtx); err != nil {
+			slog.Warn("Notification queue did not drain", "error", err)
+		}
+	}
+	<-wsDone
+	// キューを空にする間のブロードキャストも再起動後に再送できるよう、最後に保存する
+	for _, h := range append(namespaces.Handlers(), handler) {
+		h.wsManager.(*WSManagerImpl).SaveReplay()
+	}
+	slog.Info("Server stopped")
+}
+
+// Config file
+// キーはフラグ名 (ハイフンの代わりにアンダースコアも可) で、値はフラグと同じ形式で解釈する
+// コマンドラインで指定したフラグは設定ファイルより優先する
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		// 大きな整数が指数表記にならないよう、数値は文字列のまま受け取る
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var unknown []string
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || fs.Lookup(name) == nil {
+			unknown = append(unknown, key)
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		value, err := configValueString(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %w", path, key, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %w", path, key, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%s: unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// configValueString は設定ファイルの値をフラグの文字列表現に変換する
+// 配列はカンマ区切り、マップは key=value のカンマ区切りにする
+func configValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, float64, json.Number:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(v))
+		for _, key := range keys {
+			s, err := configValueString(v[key])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
 }
 
 // Utility functions
-func generateID() string {
-	return time.Now().Format("20060102150405") + "-" + time.Now().Format("000")
-}
\ No newline at end of file
+
+// truncateRunes はsをmaxRunes文字 (省略記号を含む) に切り詰める
+// マルチバイト文字の途中で切れないよう、バイト数ではなく文字数で数える
+func truncateRunes(s string, maxRunes int) (string, bool) {
+	if utf8.RuneCountInString(s) <= maxRunes {
+		return s, false
+	}
+	if maxRunes <= 1 {
+		return "…", true
+	}
+	runes := []rune(s)
+	return string(runes[:maxRunes-1]) + "…", true
+}
+
+// computeETag はレスポンスボディから強いETagを生成する
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches はIf-None-Matchヘッダーの値がetagに一致するかを判定する
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStringMap は "key=value" のカンマ区切りリストをマップに変換する
+func parseStringMap(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, item := range splitList(s) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("invalid entry: %s (expected key=value)", item)
+		}
+		result[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return result, nil
+}
+
+// parseWebhookEvents は "url=event|event" のカンマ区切りリストをマップに変換する
+// URLのクエリに=が含まれる場合があるため、最後の=で区切る
+func parseWebhookEvents(s string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i <= 0 || strings.TrimSpace(item[i+1:]) == "" {
+			return nil, fmt.Errorf("invalid entry: %s (expected url=event|event)", item)
+		}
+		url := strings.TrimSpace(item[:i])
+		for _, event := range strings.Split(item[i+1:], "|") {
+			result[url] = append(result[url], strings.TrimSpace(event))
+		}
+	}
+	return result, nil
+}
+
+// parseColorMap は "category=#rrggbb" のカンマ区切りリストをマップに変換する
+// allowedが空でない場合は、その中のカテゴリのみを指定できる
+func parseColorMap(s string, allowed []string) (map[string]string, error) {
+	colors, err := parseStringMap(s)
+	if err != nil {
+		return nil, err
+	}
+	for category, color := range colors {
+		if !validHexColor(color) {
+			return nil, fmt.Errorf("invalid color for %s: %s (expected #rgb or #rrggbb)", category, color)
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, category) {
+			return nil, fmt.Errorf("category not allowed: %s", category)
+		}
+		colors[category] = strings.ToLower(color)
+	}
+	return colors, nil
+}
+
+func validHexColor(s string) bool {
+	if !strings.HasPrefix(s, "#") || (len(s) != 4 && len(s) != 7) {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 16, 32)
+	return err == nil
+}
+
+// parseDurationMap は "key=duration" のカンマ区切りリストをマップに変換する
+func parseDurationMap(s string) (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration)
+	for _, item := range splitList(s) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid entry: %s (expected key=duration)", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %w", key, err)
+		}
+		result[strings.TrimSpace(key)] = d
+	}
+	return result, nil
+}
+
+// clientIP は信頼済みプロキシを考慮した実際のクライアントIPを返す
+func clientIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// writeFileAtomic は書き込み途中のファイルを読まれないよう、一時ファイルに書いてからリネームする
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// splitList はカンマ区切りの文字列を空要素を除いたスライスに変換する
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// idSeq は同じミリ秒内に作成された通知のIDを区別する
+// 作成元に関わらず共通の連番のため、prefixが異なっても重複しない
+var idSeq atomic.Uint64
+
+func generateID(prefix string, now time.Time) string {
+	return prefix + now.Format("20060102150405") + "-" + now.Format(".000")[1:] + "-" + strconv.FormatUint(idSeq.Add(1), 10)
+}
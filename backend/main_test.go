@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// logBuffer は複数のgoroutineから書き込まれるログを溜める
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs はテストの間、既定のロガーの出力をJSONで記録する
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+// FakeClock はテストで進める時刻。ゼロ値は使用できないためNewFakeClockで作成する
+// AfterFuncのタイマーは、Advanceで期限を過ぎた時点でAdvanceを呼び出したgoroutineで実行する
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	return true
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.done:
+		case !t.at.After(c.now):
+			t.done = true
+			due = append(due, t)
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	slices.SortStableFunc(due, func(a, b *fakeTimer) int { return a.at.Compare(b.at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// SequentialIDs は1から順に番号を振る
+type SequentialIDs struct {
+	seq atomic.Uint64
+}
+
+func (g *SequentialIDs) NewID(prefix string) string {
+	return prefix + strconv.FormatUint(g.seq.Add(1), 10)
+}
+
+// Test helpers
+// TestServer は結合テスト用に、空のメモリストア・FakeClock・SequentialIDsで起動したサーバー
+// 通知のIDは "1" から順に振られ、タイムスタンプはClockを進めない限り固定になる
+type TestServer struct {
+	*httptest.Server
+	Clock     *FakeClock
+	Handler   *NotificationHandler
+	Service   *NotificationServiceImpl
+	WSManager *WSManagerImpl
+	// 名前空間も同じClockを使用し、IDはそれぞれ "1" から振られる
+	Namespaces *Namespaces
+}
+
+// TestServerStart はTestServerの時刻の初期値
+var TestServerStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testConfig はNewTestServerで起動するサーバーの設定
+type testConfig struct {
+	Server  ServerConfig
+	Service ServiceConfig
+	WS      WSConfig
+	Handler HandlerConfig
+	// nilでない場合、空のメモリストアの代わりに使用するリポジトリを作成する
+	Repository func() NotificationRepository
+}
+
+// testOption はテストごとに既定の設定を変更する
+type testOption func(cfg *testConfig)
+
+func NewTestServer(opts ...testOption) *TestServer {
+	clock := NewFakeClock(TestServerStart)
+	cfg := testConfig{
+		Server:  ServerConfig{GzipMinSize: -1},
+		Service: ServiceConfig{Clock: clock},
+		WS:      WSConfig{Clock: clock, ReplayBufferSize: 100},
+		Handler: HandlerConfig{PreviewLength: 100, Drain: &DrainState{}},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	handler := newTestHandler(cfg)
+	namespaces := NewNamespaces(cfg.Server.MaxNamespaces, func(string) (*NotificationHandler, error) {
+		return newTestHandler(cfg), nil
+	})
+	r, err := newRouter(&cfg.Server, handler, namespaces)
+	if err != nil {
+		panic(err)
+	}
+	handler.SetReady(true)
+	return &TestServer{
+		Server:     httptest.NewServer(r),
+		Clock:      clock,
+		Handler:    handler,
+		Service:    handler.service.(*NotificationServiceImpl),
+		WSManager:  handler.wsManager.(*WSManagerImpl),
+		Namespaces: namespaces,
+	}
+}
+
+func newTestHandler(cfg testConfig) *NotificationHandler {
+	var repo NotificationRepository = &InMemoryNotificationRepository{notifications: []Notification{}}
+	if cfg.Repository != nil {
+		repo = cfg.Repository()
+	}
+	serviceConfig := cfg.Service
+	serviceConfig.IDs = &SequentialIDs{}
+	service := NewNotificationService(repo, serviceConfig)
+	wsManager, err := NewWSManager(service, cfg.WS)
+	if err != nil {
+		panic(err)
+	}
+	service.SetUnreadCountListener(wsManager.ScheduleUnreadCount)
+	return NewNotificationHandler(service, wsManager, cfg.Handler)
+}
+
+// startTestServer はテストの終了時に閉じるTestServerを起動する
+func startTestServer(t *testing.T, opts ...testOption) *TestServer {
+	t.Helper()
+	ts := NewTestServer(opts...)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// WebSocketURL は/wsに接続するためのws://のURLを返す
+func (ts *TestServer) WebSocketURL() string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+}
+
+// NamespaceWebSocketURL は/ws/:namespaceに接続するためのws://のURLを返す
+func (ts *TestServer) NamespaceWebSocketURL(namespace string) string {
+	return ts.WebSocketURL() + "/" + namespace
+}
+
+// request はbodyをJSONで送信し、レスポンスとボディを返す。bodyが文字列の場合はそのまま送信する
+// headerは名前と値を交互に指定する
+func (ts *TestServer) request(t *testing.T, method, path string, body any, header ...string) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, data
+}
+
+// expectStatus はrequestを送信し、ステータスコードが一致しない場合はテストを失敗させる
+func (ts *TestServer) expectStatus(t *testing.T, status int, method, path string, body any, header ...string) []byte {
+	t.Helper()
+	res, data := ts.request(t, method, path, body, header...)
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, res.StatusCode, status, data)
+	}
+	return data
+}
+
+// create は通知を作成し、レスポンスを返す。配信の有無に関わらず201と202を成功とする
+func (ts *TestServer) create(t *testing.T, req CreateNotificationRequest, header ...string) CreateNotificationResponse {
+	t.Helper()
+	res, data := ts.request(t, http.MethodPost, "/api/notifications", req, header...)
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /api/notifications: status %d: %s", res.StatusCode, data)
+	}
+	var created CreateNotificationResponse
+	decode(t, data, &created)
+	return created
+}
+
+func decode(t *testing.T, data []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+func ids(notifications []Notification) []string {
+	result := make([]string, len(notifications))
+	for i, notification := range notifications {
+		result[i] = notification.ID
+	}
+	return result
+}
+
+// wsTestTimeout はWebSocketのメッセージを待つ最大時間
+const wsTestTimeout = 2 * time.Second
+
+// testWSClient は受信したメッセージをチャネルに溜めるWebSocketクライアント
+// 読み取りの期限で接続が使えなくならないよう、受信は別のgoroutineで続ける
+type testWSClient struct {
+	conn     *websocket.Conn
+	messages chan []byte
+	done     chan struct{}
+	err      error
+}
+
+func dialWS(t *testing.T, url string, header http.Header) *testWSClient {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", url, err, status)
+	}
+	c := &testWSClient{conn: conn, messages: make(chan []byte, 1024), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.messages <- data
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// next はtypeのメッセージを受信するまで他のメッセージを読み飛ばす
+func (c *testWSClient) next(t *testing.T, typ string) WSMessage {
+	t.Helper()
+	timeout := time.After(wsTestTimeout)
+	for {
+		select {
+		case data := <-c.messages:
+			var msg WSMessage
+			decode(t, data, &msg)
+			if msg.Type == typ {
+				return msg
+			}
+		case <-c.done:
+			t.Fatalf("connection closed while waiting for %s: %v", typ, c.err)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", typ)
+		}
+	}
+}
+
+// expectNone はdの間にtypeのメッセージを受信しないことを確認する
+func (c *testWSClient) expectNone(t *testing.T, typ string, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case data := <-c.messages:
+			var msg WSMessage
+			decode(t, data, &msg)
+			if msg.Type == typ {
+				t.Fatalf("unexpected %s: %s", typ, data)
+			}
+		case <-c.done:
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (c *testWSClient) send(t *testing.T, msg any) {
+	t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sync はget_notificationsの応答を待ち、それまでに送信したメッセージをサーバーが処理したことを確認する
+func (c *testWSClient) sync(t *testing.T) {
+	t.Helper()
+	c.send(t, WSMessage{Type: "get_notifications"})
+	c.next(t, "notifications_list")
+}
+
+// waitClosed はサーバーが接続を閉じるまで待ち、受信したクローズフレームを返す
+func (c *testWSClient) waitClosed(t *testing.T) *websocket.CloseError {
+	t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(wsTestTimeout):
+		t.Fatal("connection was not closed")
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(c.err, &closeErr) {
+		return closeErr
+	}
+	return nil
+}
+
+// waitFor はcondがtrueを返すまで待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(wsTestTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitClients は接続がWSManagerに登録されるまで待つ
+func waitClients(t *testing.T, w *WSManagerImpl, n int) {
+	t.Helper()
+	waitFor(t, strconv.Itoa(n)+" clients", func() bool { return w.Stats().Clients == n })
+}
+
+func TestServerDeterministicIDsAndTimestamps(t *testing.T) {
+	ts := startTestServer(t)
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	first := ts.create(t, CreateNotificationRequest{Title: "first", Message: "m"})
+	ts.Clock.Advance(time.Minute)
+	second := ts.create(t, CreateNotificationRequest{Title: "second", Message: "m"})
+
+	if first.ID != "1" || !first.Timestamp.Equal(TestServerStart) {
+		t.Errorf("first = %s at %s, want 1 at %s", first.ID, first.Timestamp, TestServerStart)
+	}
+	if want := TestServerStart.Add(time.Minute); second.ID != "2" || !second.Timestamp.Equal(want) {
+		t.Errorf("second = %s at %s, want 2 at %s", second.ID, second.Timestamp, want)
+	}
+
+	for _, want := range []CreateNotificationResponse{first, second} {
+		msg := client.next(t, "notification")
+		if msg.Notification.ID != want.ID || !msg.Notification.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("broadcast %s at %s, want %s at %s", msg.Notification.ID, msg.Notification.Timestamp, want.ID, want.Timestamp)
+		}
+	}
+
+	var list NotificationsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications", nil), &list)
+	if got := ids(list.Notifications); !slicesEqual(got, []string{"2", "1"}) {
+		t.Errorf("list = %v, want [2 1]", got)
+	}
+}
+
+func slicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func typeName(v any) string {
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMessageVersion はテストの間だけWebSocketのメッセージ形式を変更する
+func withMessageVersion(t *testing.T, version int) {
+	t.Helper()
+	previous := wsMessageVersion
+	wsMessageVersion = version
+	t.Cleanup(func() { wsMessageVersion = previous })
+}
+
+func TestTypedMessageJSON(t *testing.T) {
+	withMessageVersion(t, WSMessageVersionTyped)
+	read, pinned, maintenance, count := true, false, true, 3
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		msg  WSMessage
+		want string
+	}{
+		{WSMessage{Type: "notifications_list"}, `{"type":"notifications_list","notifications":[]}`},
+		{WSMessage{Type: "notification_deleted", NotificationID: "1", Seq: 2}, `{"type":"notification_deleted","notification_id":"1","seq":2}`},
+		{WSMessage{Type: "notification_archived", NotificationID: "1"}, `{"type":"notification_archived","notification_id":"1"}`},
+		{WSMessage{Type: "notification_read", NotificationID: "1", Read: &read}, `{"type":"notification_read","notification_id":"1","read":true}`},
+		{WSMessage{Type: "notification_pinned", NotificationID: "1", Pinned: &pinned}, `{"type":"notification_pinned","notification_id":"1","pinned":false}`},
+		{WSMessage{Type: "heartbeat", Time: &at}, `{"type":"heartbeat","time":"2024-01-01T00:00:00Z"}`},
+		{WSMessage{Type: "unread_count", Count: &count}, `{"type":"unread_count","count":3}`},
+		{WSMessage{Type: "maintenance", Maintenance: &maintenance}, `{"type":"maintenance","maintenance":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg.Type, func(t *testing.T) {
+			data, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got  %s\nwant %s", data, tt.want)
+			}
+		})
+	}
+
+	// 通知を含むメッセージには通知の一覧のフィールドを含めない
+	for typ, want := range map[string][]string{
+		"notification":         {"notification", "type"},
+		"notification_updated": {"notification", "type"},
+		"notifications_batch":  {"notifications", "type"},
+	} {
+		notification := Notification{ID: "1", Title: "t", Message: "m"}
+		data, err := json.Marshal(WSMessage{Type: typ, Notification: &notification, Notifications: []Notification{notification}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		decode(t, data, &fields)
+		if got := slices.Sorted(maps.Keys(fields)); !slicesEqual(got, want) {
+			t.Errorf("%s fields = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestLegacyMessageJSON(t *testing.T) {
+	withMessageVersion(t, WSMessageVersionLegacy)
+	data, err := json.Marshal(WSMessage{Type: "notification_deleted", NotificationID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"notification_deleted","notification_id":"1"}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+	// 旧形式ではTypeに関係なく値のあるフィールドを全て出力する
+	count := 1
+	data, err = json.Marshal(WSMessage{Type: "notification_deleted", NotificationID: "1", Count: &count})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"notification_deleted","notification_id":"1","count":1}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestDecodeWSMessage(t *testing.T) {
+	tests := []struct {
+		data string
+		want WSMessage
+	}{
+		{`{"v":1,"type":"get_notifications"}`, WSMessage{Type: "get_notifications"}},
+		{`{"v":1,"type":"clear_all"}`, WSMessage{Type: "clear_all"}},
+		{`{"v":1,"type":"mark_read","payload":{"notification_id":"1"}}`, WSMessage{Type: "mark_read", NotificationID: "1"}},
+		{`{"v":1,"type":"ack","payload":{"notification_id":"2"}}`, WSMessage{Type: "ack", NotificationID: "2"}},
+		{`{"v":1,"type":"subscribe","payload":{"categories":["deploy"],"tags":["prod"]}}`, WSMessage{Type: "subscribe", Categories: []string{"deploy"}, Tags: []string{"prod"}}},
+		{`{"v":1,"type":"auth","payload":{"token":"secret"}}`, WSMessage{Type: "auth", Token: "secret"}},
+		// vのない旧来のフラットな形式
+		{`{"type":"mark_read","notification_id":"3"}`, WSMessage{Type: "mark_read", NotificationID: "3"}},
+		{`{"type":"subscribe","categories":["system"]}`, WSMessage{Type: "subscribe", Categories: []string{"system"}}},
+	}
+	for _, tt := range tests {
+		got, err := decodeWSMessage([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.data, err)
+			continue
+		}
+		if got.Type != tt.want.Type || got.NotificationID != tt.want.NotificationID || got.Token != tt.want.Token ||
+			!slicesEqual(got.Categories, tt.want.Categories) || !slicesEqual(got.Tags, tt.want.Tags) {
+			t.Errorf("%s: got %+v, want %+v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeWSMessageErrors(t *testing.T) {
+	tests := []struct {
+		data, want string
+	}{
+		{`{"v":2,"type":"get_notifications"}`, "unsupported message version: 2"},
+		{`{"v":0,"type":"get_notifications"}`, "unsupported message version: 0"},
+		{`{"v":1,"type":"shout"}`, "unknown message type: shout"},
+		{`{"v":1,"type":"mark_read"}`, "payload is required"},
+		{`{"v":1,"type":"mark_read","payload":{"notification_id":1}}`, "invalid payload"},
+		{`not json`, "invalid character"},
+	}
+	for _, tt := range tests {
+		_, err := decodeWSMessage([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.data, err, tt.want)
+		}
+	}
+}
+
+func TestEnvelopeMessageJSON(t *testing.T) {
+	withMessageVersion(t, WSMessageVersionEnvelope)
+	read, count := true, 2
+	notification := Notification{ID: "1", Title: "t", Message: "m"}
+	tests := []struct {
+		msg     WSMessage
+		payload string
+	}{
+		{WSMessage{Type: "notification", Notification: &notification}, `{"notification":`},
+		{WSMessage{Type: "notifications_list"}, `{"notifications":[]}`},
+		{WSMessage{Type: "notification_deleted", NotificationID: "1"}, `{"notification_id":"1"}`},
+		{WSMessage{Type: "notification_read", NotificationID: "1", Read: &read}, `{"notification_id":"1","read":true}`},
+		{WSMessage{Type: "unread_count", Count: &count}, `{"count":2}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var envelope struct {
+			V       int             `json:"v"`
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		decode(t, data, &envelope)
+		if envelope.V != wsEnvelopeVersion || envelope.Type != tt.msg.Type || !strings.HasPrefix(string(envelope.Payload), tt.payload) {
+			t.Errorf("%s: %s, want v %d and payload %s", tt.msg.Type, data, wsEnvelopeVersion, tt.payload)
+		}
+	}
+}
+
+func TestEnvelopeOverWebSocket(t *testing.T) {
+	withMessageVersion(t, WSMessageVersionEnvelope)
+	ts := startTestServer(t)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	client.send(t, map[string]any{"v": 1, "type": "mark_read", "payload": map[string]string{"notification_id": created.ID}})
+	waitFor(t, "the notification to be read", func() bool {
+		n, err := ts.Service.GetNotification(created.ID)
+		return err == nil && n.Read
+	})
+
+	// 未対応のバージョンのメッセージは処理せず、接続も維持する
+	client.send(t, map[string]any{"v": 2, "type": "clear_all"})
+	client.send(t, map[string]any{"v": 1, "type": "get_notifications"})
+	select {
+	case data := <-client.messages:
+		if !strings.Contains(string(data), `"v":1`) {
+			t.Errorf("response is not an envelope: %s", data)
+		}
+	case <-time.After(wsTestTimeout):
+		t.Fatal("no response after an unsupported message")
+	}
+	if _, err := ts.Service.GetNotification(created.ID); err != nil {
+		t.Errorf("unsupported clear_all was processed: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func namespaceWSManager(t *testing.T, ts *TestServer, name string) *WSManagerImpl {
+	t.Helper()
+	h, err := ts.Namespaces.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.wsManager.(*WSManagerImpl)
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	ts := startTestServer(t)
+	clientA := dialWS(t, ts.NamespaceWebSocketURL("a"), nil)
+	clientB := dialWS(t, ts.NamespaceWebSocketURL("b"), nil)
+	clientDefault := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, namespaceWSManager(t, ts, "a"), 1)
+	waitClients(t, namespaceWSManager(t, ts, "b"), 1)
+	waitClients(t, ts.WSManager, 1)
+
+	ts.expectStatus(t, http.StatusCreated, http.MethodPost, "/api/ns/a/notifications", CreateNotificationRequest{Title: "only a", Message: "m"})
+
+	if msg := clientA.next(t, "notification"); msg.Notification.Title != "only a" {
+		t.Errorf("a received %q", msg.Notification.Title)
+	}
+	clientB.expectNone(t, "notification", 100*time.Millisecond)
+	clientDefault.expectNone(t, "notification", 100*time.Millisecond)
+
+	for path, want := range map[string]int{
+		"/api/ns/a/notifications": 1,
+		"/api/ns/b/notifications": 0,
+		"/api/notifications":      0,
+	} {
+		var list NotificationsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &list)
+		if len(list.Notifications) != want {
+			t.Errorf("%s: %d notifications, want %d", path, len(list.Notifications), want)
+		}
+	}
+	ts.expectStatus(t, http.StatusNotFound, http.MethodGet, "/api/ns/b/notifications/1", nil)
+}
+
+func TestNamespaceWebSocketRequiresAPIKey(t *testing.T) {
+	ts := startTestServer(t, withAPIKeys(map[string]string{"ci": "secret"}))
+
+	_, res, err := websocket.DefaultDialer.Dial(ts.NamespaceWebSocketURL("a"), nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without a key: err = %v, response = %v, want 401", err, res)
+	}
+	var list NamespacesResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/namespaces", nil, "Authorization", "Bearer secret"), &list)
+	if len(list.Namespaces) != 0 {
+		t.Fatalf("namespaces = %v, want none to be created without a key", list.Namespaces)
+	}
+
+	_, res, err = websocket.DefaultDialer.Dial(ts.NamespaceWebSocketURL("a")+"?token=wrong", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial with a wrong token: err = %v, response = %v, want 401", err, res)
+	}
+
+	dialWS(t, ts.NamespaceWebSocketURL("a"), http.Header{"Authorization": {"Bearer secret"}})
+	waitClients(t, namespaceWSManager(t, ts, "a"), 1)
+
+	// ブラウザはヘッダーを指定できないため、tokenクエリでも接続できる
+	dialWS(t, ts.NamespaceWebSocketURL("b")+"?token=secret", nil)
+	waitClients(t, namespaceWSManager(t, ts, "b"), 1)
+}
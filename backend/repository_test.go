@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notibag.json")
+	tests := []struct {
+		cfg  RepositoryConfig
+		want string
+	}{
+		{RepositoryConfig{}, "*main.InMemoryNotificationRepository"},
+		{RepositoryConfig{Store: "memory"}, "*main.InMemoryNotificationRepository"},
+		{RepositoryConfig{Store: "file", Path: path}, "*main.FileNotificationRepository"},
+	}
+	for _, tt := range tests {
+		repo, err := NewRepository(tt.cfg)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.cfg, err)
+		}
+		if got := typeName(repo); got != tt.want {
+			t.Errorf("%+v: %s, want %s", tt.cfg, got, tt.want)
+		}
+	}
+
+	// サンプルの通知なしで開始する
+	repo, err := NewRepository(RepositoryConfig{Store: "memory", Empty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(repo.GetAll()); n != 0 {
+		t.Errorf("empty memory store has %d notifications", n)
+	}
+
+	for _, cfg := range []RepositoryConfig{{Store: "postgres"}, {Store: "file"}} {
+		if _, err := NewRepository(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
+
+// unhealthyRepository はPingに失敗する
+type unhealthyRepository struct {
+	*InMemoryNotificationRepository
+}
+
+func (unhealthyRepository) Ping() error {
+	return errors.New("database is unreachable")
+}
+
+// checkUnreadCount は差分更新した未読数が全件の走査結果と一致することを確認する
+func checkUnreadCount(t *testing.T, repo *InMemoryNotificationRepository) {
+	t.Helper()
+	want := countUnread(repo.GetAll())
+	if got := repo.CountUnread(); got != want {
+		t.Errorf("CountUnread() = %d, full scan = %d", got, want)
+	}
+	if got := len(repo.GetUnread()); got != want {
+		t.Errorf("len(GetUnread()) = %d, full scan = %d", got, want)
+	}
+}
+
+func TestUnreadCountMatchesFullScan(t *testing.T) {
+	repo := newTestRepository()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		repo.Create(Notification{ID: strconv.Itoa(i), Timestamp: now, UserID: []string{"", "alice"}[i%2]})
+	}
+	checkUnreadCount(t, repo)
+
+	steps := []struct {
+		name string
+		fn   func()
+	}{
+		{"mark read", func() { repo.MarkAsRead("0", 0); repo.MarkAsRead("0", 0) }},
+		{"archive", func() { repo.Archive("1", now, 0); repo.Archive("0", now, 0) }},
+		{"mark read before", func() { repo.MarkReadBefore(now.Add(-time.Second)) }},
+		{"delete", func() { repo.DeleteMany([]string{"2", "3", "missing"}) }},
+		{"archive for user", func() { repo.MarkAsRead("5", 0); repo.ArchiveForUser("alice", now) }},
+		{"clear for user", func() { repo.ClearForUser("alice") }},
+		{"archive all", func() { repo.Create(Notification{ID: "new", Timestamp: now}); repo.ArchiveAll(now) }},
+		{"clear", func() { repo.Create(Notification{ID: "after", Timestamp: now}); repo.Clear() }},
+	}
+	for _, step := range steps {
+		step.fn()
+		t.Run(step.name, func(t *testing.T) { checkUnreadCount(t, repo) })
+	}
+}
+
+func TestUnreadCountUnderConcurrency(t *testing.T) {
+	repo := newTestRepository()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				repo.Create(Notification{ID: id, Timestamp: time.Now()})
+				switch i % 4 {
+				case 1:
+					repo.MarkAsRead(id, 0)
+				case 2:
+					repo.Archive(id, time.Now(), 0)
+				case 3:
+					repo.DeleteMany([]string{id})
+				}
+				repo.CountUnread()
+			}
+		}()
+	}
+	wg.Wait()
+	checkUnreadCount(t, repo)
+	if got := repo.CountUnread(); got != 8*50 {
+		t.Errorf("CountUnread() = %d, want %d", got, 8*50)
+	}
+}
+
+// newLargeRepository はnotifications件の通知のうち、新しいunread件だけが未読のリポジトリを作成する
+func newLargeRepository(notifications, unread int) *InMemoryNotificationRepository {
+	repo := newTestRepository()
+	now := time.Now()
+	for i := 0; i < notifications; i++ {
+		repo.Create(Notification{ID: strconv.Itoa(i), Timestamp: now, Read: i < notifications-unread})
+	}
+	return repo
+}
+
+// BenchmarkCountUnread は差分更新した未読数と全件の走査を比較する
+func BenchmarkCountUnread(b *testing.B) {
+	repo := newLargeRepository(100_000, 100)
+	b.Run("maintained", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			repo.CountUnread()
+		}
+	})
+	b.Run("full scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			repo.mu.RLock()
+			countUnread(repo.notifications)
+			repo.mu.RUnlock()
+		}
+	})
+}
+
+// BenchmarkGetUnread は未読を集め終えた時点で走査を打ち切る場合と全件を走査する場合を比較する
+func BenchmarkGetUnread(b *testing.B) {
+	repo := newLargeRepository(100_000, 100)
+	b.Run("maintained", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			repo.GetUnread()
+		}
+	})
+	b.Run("full scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			repo.mu.RLock()
+			unread := make([]Notification, 0)
+			for _, notification := range slices.Backward(repo.notifications) {
+				if isUnread(notification) {
+					unread = append(unread, notification)
+				}
+			}
+			repo.mu.RUnlock()
+		}
+	})
+}
+
+func TestRepositoryOrderIsNewestFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.json")
+	file, err := NewFileNotificationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := map[string]NotificationRepository{"memory": newTestRepository(), "file": file}
+	for name, repo := range repos {
+		t.Run(name, func(t *testing.T) {
+			for i := 1; i <= 5; i++ {
+				if err := repo.Create(Notification{ID: strconv.Itoa(i), Timestamp: TestServerStart.Add(time.Duration(i) * time.Second)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			repo.DeleteMany([]string{"3"})
+			if err := repo.MarkAsRead("2", 0); err != nil {
+				t.Fatal(err)
+			}
+			// 削除や更新の後も新しい順のまま
+			if got := ids(repo.GetAll()); !slicesEqual(got, []string{"5", "4", "2", "1"}) {
+				t.Errorf("GetAll = %v, want [5 4 2 1]", got)
+			}
+			if got := ids(repo.GetUnread()); !slicesEqual(got, []string{"5", "4", "1"}) {
+				t.Errorf("GetUnread = %v, want [5 4 1]", got)
+			}
+			var visited []string
+			repo.ForEach(func(n Notification) error {
+				visited = append(visited, n.ID)
+				return nil
+			})
+			if !slicesEqual(visited, []string{"5", "4", "2", "1"}) {
+				t.Errorf("ForEach = %v, want [5 4 2 1]", visited)
+			}
+			repo.Create(Notification{ID: "6", Timestamp: TestServerStart.Add(6 * time.Second)})
+			if got := ids(repo.GetAll()); !slicesEqual(got, []string{"6", "5", "4", "2", "1"}) {
+				t.Errorf("GetAll after another create = %v", got)
+			}
+		})
+	}
+
+	// 再起動後も順序は変わらない
+	restarted, err := NewFileNotificationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(restarted.GetAll()); !slicesEqual(got, []string{"6", "5", "4", "2", "1"}) {
+		t.Errorf("restored order = %v", got)
+	}
+}
+
+// BenchmarkCreate は末尾への追加と、以前の先頭への挿入を10万件の時点で比較する
+func BenchmarkCreate(b *testing.B) {
+	now := time.Now()
+	b.Run("append", func(b *testing.B) {
+		repo := newLargeRepository(100_000, 0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			repo.Create(Notification{ID: "new", Timestamp: now})
+		}
+	})
+	b.Run("prepend", func(b *testing.B) {
+		repo := newLargeRepository(100_000, 0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			repo.mu.Lock()
+			repo.notifications = append([]Notification{{ID: "new", Timestamp: now}}, repo.notifications...)
+			repo.mu.Unlock()
+		}
+	})
+}
+
+// BenchmarkGetAll は新しい順に並べ替えて返すコストを10万件で計測する
+func BenchmarkGetAll(b *testing.B) {
+	repo := newLargeRepository(100_000, 0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		repo.GetAll()
+	}
+}
+
+func TestRepositoryLatest(t *testing.T) {
+	repo := newTestRepository()
+	// 保存順とTimestampの順が異なる通知を含める
+	for i, offset := range []int{1, 3, 2, 3} {
+		repo.Create(Notification{ID: strconv.Itoa(i + 1), Category: []string{"a", "b"}[i%2], Timestamp: TestServerStart.Add(time.Duration(offset) * time.Second)})
+	}
+	tests := []struct {
+		filter NotificationFilter
+		want   string
+	}{
+		// Timestampが同じ場合はIDで比較する
+		{NotificationFilter{}, "4"},
+		{NotificationFilter{Category: "a"}, "3"},
+		{NotificationFilter{Category: "b"}, "4"},
+		{NotificationFilter{Until: TestServerStart.Add(3 * time.Second)}, "3"},
+	}
+	for _, tt := range tests {
+		latest, ok := repo.Latest(tt.filter)
+		if !ok || latest.ID != tt.want {
+			t.Errorf("Latest(%+v) = %s, %v, want %s", tt.filter, latest.ID, ok, tt.want)
+		}
+	}
+	if _, ok := repo.Latest(NotificationFilter{Category: "c"}); ok {
+		t.Error("Latest found a notification for an unknown category")
+	}
+}
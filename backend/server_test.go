@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// serveHTTP はnewHTTPServerで作成したサーバーをローカルのポートで起動する
+func serveHTTP(t *testing.T, cfg *ServerConfig, handler http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(cfg, handler)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestServerClosesSlowHeaderClient(t *testing.T) {
+	addr := serveHTTP(t, &ServerConfig{ReadTimeout: 100 * time.Millisecond, WriteTimeout: time.Second, IdleTimeout: time.Second}, http.NotFoundHandler())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// ヘッダーを送り終えずに待つ
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection was not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("closed after %s, want about the read timeout", elapsed)
+	}
+}
+
+func TestServerAcceptsRequestWithinTimeout(t *testing.T) {
+	addr := serveHTTP(t, &ServerConfig{ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second}, http.NotFoundHandler())
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", res.StatusCode)
+	}
+}
+
+// writeSelfSignedCert は127.0.0.1の自己署名証明書と鍵をdirに書き出し、証明書を信頼するプールを返す
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "notibag test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	ts := startTestServer(t)
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(&ServerConfig{ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second}, ts.Config.Handler)
+	go srv.ServeTLS(ln, certFile, keyFile)
+	t.Cleanup(func() { srv.Close() })
+	addr := ln.Addr().String()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	res, err := client.Get("https://" + addr + "/api/health/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Errorf("status = %d over %s, want 200 over HTTP/2", res.StatusCode, res.Proto)
+	}
+
+	// WebSocketはALPNでHTTP/1.1を選んでアップグレードする
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	conn, _, err := dialer.Dial("wss://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("wss upgrade: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSelfTest(t *testing.T) {
+	t.Run("received", func(t *testing.T) {
+		ts := startTestServer(t)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+		logs := captureLogs(t)
+
+		if delivered := runSelfTest(ts.Service, ts.WSManager); delivered != 1 {
+			t.Errorf("delivered = %d, want 1", delivered)
+		}
+		msg := client.next(t, "notification")
+		if msg.Notification.Category != "system" {
+			t.Errorf("category = %q, want system", msg.Notification.Category)
+		}
+		var stored Notification
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+msg.Notification.ID, nil), &stored)
+		if stored.Category != "system" {
+			t.Errorf("stored category = %q, want system", stored.Category)
+		}
+		if !strings.Contains(logs.String(), "Self-test notification was received") {
+			t.Errorf("logs = %s", logs)
+		}
+	})
+
+	t.Run("no clients", func(t *testing.T) {
+		ts := startTestServer(t)
+		logs := captureLogs(t)
+		if delivered := runSelfTest(ts.Service, ts.WSManager); delivered != 0 {
+			t.Errorf("delivered = %d, want 0", delivered)
+		}
+		if got := ts.listIDs(t, "?category=system"); len(got) != 1 {
+			t.Errorf("stored self-test notifications = %v, want 1", got)
+		}
+		if !strings.Contains(logs.String(), "not received by any client") {
+			t.Errorf("logs = %s", logs)
+		}
+	})
+}
+
+func TestGzipResponse(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Server.GzipMinSize = 1024 })
+	for i := 0; i < 30; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "Deploy finished", Message: "api v2 was deployed to production"})
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		res, body := ts.request(t, http.MethodGet, "/api/notifications", nil, "Accept-Encoding", "gzip")
+		if res.Header.Get("Content-Encoding") != "gzip" || !strings.Contains(res.Header.Get("Vary"), "Accept-Encoding") {
+			t.Fatalf("Content-Encoding %q, Vary %q, want a gzipped response", res.Header.Get("Content-Encoding"), res.Header.Get("Vary"))
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list NotificationsResponse
+		decode(t, data, &list)
+		if len(list.Notifications) != 30 || len(body) >= len(data) {
+			t.Errorf("decompressed %d notifications, %d bytes from %d", len(list.Notifications), len(data), len(body))
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		for _, encoding := range []string{"identity", "gzip;q=0"} {
+			res, body := ts.request(t, http.MethodGet, "/api/notifications", nil, "Accept-Encoding", encoding)
+			if res.Header.Get("Content-Encoding") != "" {
+				t.Errorf("%s: Content-Encoding = %q", encoding, res.Header.Get("Content-Encoding"))
+			}
+			var list NotificationsResponse
+			decode(t, body, &list)
+		}
+	})
+
+	t.Run("below the minimum size", func(t *testing.T) {
+		res, body := ts.request(t, http.MethodGet, "/api/version", nil, "Accept-Encoding", "gzip")
+		if res.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Content-Encoding = %q for %d bytes", res.Header.Get("Content-Encoding"), len(body))
+		}
+		var version VersionResponse
+		decode(t, body, &version)
+	})
+}
+
+func TestGzipSkipsCompressedContent(t *testing.T) {
+	r := gin.New()
+	r.Use(gzipResponse(0))
+	image := bytes.Repeat([]byte{0x89}, 4096)
+	r.GET("/image", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", image) })
+	r.GET("/text", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("a", 4096)) })
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	for path, want := range map[string]string{"/image": "", "/text": "gzip"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Content-Encoding"); got != want {
+			t.Errorf("%s: Content-Encoding = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"gzip":              true,
+		"br, gzip;q=0.5":    true,
+		"gzip; q=1.0":       true,
+		"gzip;q=0":          false,
+		"deflate, br":       false,
+		"":                  false,
+		"x-gzip":            false,
+		"identity, gzip;q=": false,
+	}
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Server.CORSOrigins = []string{"https://app.example"}
+		cfg.Server.CORSMaxAge = 5 * time.Minute
+		cfg.Server.CORSExposeHeaders = []string{unreadCountHeader, "ETag"}
+	})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+
+	t.Run("preflight", func(t *testing.T) {
+		res, _ := ts.request(t, http.MethodOptions, "/api/notifications", nil, "Origin", "https://app.example", "Access-Control-Request-Method", "POST")
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("status = %d, want 204", res.StatusCode)
+		}
+		if got := res.Header.Get("Access-Control-Max-Age"); got != "300" {
+			t.Errorf("Access-Control-Max-Age = %q, want 300", got)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+			t.Errorf("Access-Control-Allow-Origin = %q", got)
+		}
+	})
+
+	t.Run("exposed headers", func(t *testing.T) {
+		res, _ := ts.request(t, http.MethodGet, "/api/notifications", nil, "Origin", "https://app.example")
+		if got := res.Header.Get("Access-Control-Expose-Headers"); got != "X-Unread-Count, ETag" {
+			t.Errorf("Access-Control-Expose-Headers = %q", got)
+		}
+		// 公開したヘッダーは実際に返している
+		if res.Header.Get(unreadCountHeader) != "1" {
+			t.Errorf("%s = %q, want 1", unreadCountHeader, res.Header.Get(unreadCountHeader))
+		}
+		if res.Header.Get("Access-Control-Max-Age") != "" {
+			t.Error("Access-Control-Max-Age was set on a non-preflight response")
+		}
+	})
+}
+
+func TestCORSHeadersDisabled(t *testing.T) {
+	r := gin.New()
+	r.Use(setupCORS(nil, 0, nil))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		req, _ := http.NewRequest(method, ts.URL, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		for _, header := range []string{"Access-Control-Max-Age", "Access-Control-Expose-Headers"} {
+			if got := res.Header.Get(header); got != "" {
+				t.Errorf("%s: %s = %q, want none", method, header, got)
+			}
+		}
+		if res.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", method, res.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingRepository はfailがtrueの間、通知の作成に失敗する
+type failingRepository struct {
+	*InMemoryNotificationRepository
+	fail bool
+}
+
+var errCreateFailed = errors.New("create failed")
+
+func (r *failingRepository) Create(notification Notification) error {
+	if r.fail {
+		return errCreateFailed
+	}
+	return r.InMemoryNotificationRepository.Create(notification)
+}
+
+// newTestService はFakeClockとSequentialIDsを使用するサービスを作成する
+func newTestService(repo NotificationRepository, cfg ServiceConfig) (*NotificationServiceImpl, *FakeClock) {
+	clock := NewFakeClock(TestServerStart)
+	cfg.Clock = clock
+	cfg.IDs = &SequentialIDs{}
+	return NewNotificationService(repo, cfg), clock
+}
+
+func newTestRepository() *InMemoryNotificationRepository {
+	return &InMemoryNotificationRepository{notifications: []Notification{}}
+}
+
+func TestFailedCreateDoesNotRecordDedupOrCooldown(t *testing.T) {
+	repo := &failingRepository{InMemoryNotificationRepository: newTestRepository(), fail: true}
+	service, _ := newTestService(repo, ServiceConfig{
+		DedupWindow:       time.Minute,
+		CategoryCooldowns: map[string]time.Duration{"deploy": time.Minute},
+	})
+	req := CreateNotificationRequest{Title: "deployed", Message: "v1", Category: "deploy"}
+
+	if _, err := service.CreateNotification(t.Context(), req); !errors.Is(err, errCreateFailed) {
+		t.Fatalf("err = %v, want %v", err, errCreateFailed)
+	}
+
+	// 保存に失敗した通知は重複判定とクールダウンに残らないため、再送できる
+	repo.fail = false
+	if _, err := service.CreateNotification(t.Context(), req); err != nil {
+		t.Fatalf("retry after a failed create: %v", err)
+	}
+
+	// 保存できた通知は記録される
+	if _, err := service.CreateNotification(t.Context(), req); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("same content: err = %v, want %v", err, ErrDuplicate)
+	}
+	if _, err := service.CreateNotification(t.Context(), CreateNotificationRequest{Title: "deployed", Message: "v2", Category: "deploy"}); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("same category: err = %v, want %v", err, ErrSuppressed)
+	}
+}
+
+func TestFailedCreateDoesNotRecordCooldown(t *testing.T) {
+	repo := &failingRepository{InMemoryNotificationRepository: newTestRepository(), fail: true}
+	service, clock := newTestService(repo, ServiceConfig{
+		CategoryCooldowns: map[string]time.Duration{"deploy": time.Minute},
+	})
+	req := CreateNotificationRequest{Title: "deployed", Message: "v1", Category: "deploy"}
+
+	if _, err := service.CreateNotification(t.Context(), req); !errors.Is(err, errCreateFailed) {
+		t.Fatalf("err = %v, want %v", err, errCreateFailed)
+	}
+	repo.fail = false
+	clock.Advance(time.Second)
+	if _, err := service.CreateNotification(t.Context(), req); err != nil {
+		t.Fatalf("retry after a failed create: %v", err)
+	}
+	if _, err := service.CreateNotification(t.Context(), req); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("err = %v, want %v", err, ErrSuppressed)
+	}
+	clock.Advance(time.Minute)
+	if _, err := service.CreateNotification(t.Context(), req); err != nil {
+		t.Errorf("after the cooldown: %v", err)
+	}
+}
+
+func TestCategoryCooldown(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.CategoryCooldowns = map[string]time.Duration{"deploy": time.Minute}
+	})
+	create := func(category string) string {
+		t.Helper()
+		res, data := ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Category: category})
+		var created CreateNotificationResponse
+		decode(t, data, &created)
+		if created.Status == CreateStatusSuppressed && res.StatusCode != http.StatusAccepted {
+			t.Errorf("suppressed with status %d, want 202", res.StatusCode)
+		}
+		return created.Status
+	}
+
+	if status := create("deploy"); status != CreateStatusStored {
+		t.Fatalf("first: %s", status)
+	}
+	ts.Clock.Advance(59 * time.Second)
+	if status := create("deploy"); status != CreateStatusSuppressed {
+		t.Errorf("within the cooldown: %s, want %s", status, CreateStatusSuppressed)
+	}
+	// クールダウンのないカテゴリは抑制しない
+	if status := create("system"); status != CreateStatusStored {
+		t.Errorf("other category: %s", status)
+	}
+	ts.Clock.Advance(time.Second)
+	if status := create("deploy"); status != CreateStatusStored {
+		t.Errorf("after the cooldown: %s, want %s", status, CreateStatusStored)
+	}
+	if got := ts.listIDs(t, ""); len(got) != 3 {
+		t.Errorf("stored %v, want 3 notifications", got)
+	}
+}
+
+func TestDefaultPriorityAndCategory(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.DefaultPriority = PriorityHigh
+		cfg.Service.DefaultCategory = "ops"
+	})
+
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if created.Priority != PriorityHigh || created.Category != "ops" {
+		t.Errorf("omitted fields = %s/%s, want high/ops", created.Priority, created.Category)
+	}
+	created = ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityLow, Category: "deploy"})
+	if created.Priority != PriorityLow || created.Category != "deploy" {
+		t.Errorf("provided fields = %s/%s, want low/deploy", created.Priority, created.Category)
+	}
+}
+
+func TestValidateDefaultPriorityAndCategory(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ServiceConfig
+		ok   bool
+	}{
+		{"valid", ServiceConfig{DefaultPriority: PriorityCritical, DefaultCategory: "ops"}, true},
+		{"empty", ServiceConfig{}, true},
+		{"unknown priority", ServiceConfig{DefaultPriority: "urgent"}, false},
+		{"allowed category", ServiceConfig{DefaultCategory: "ops", AllowedCategories: []string{"ops"}}, true},
+		{"disallowed category", ServiceConfig{DefaultCategory: "ops", AllowedCategories: []string{"deploy"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// processorFunc は関数をNotificationProcessorとして使う
+type processorFunc func(ctx context.Context, notification *Notification) error
+
+func (f processorFunc) Process(ctx context.Context, notification *Notification) error {
+	return f(ctx, notification)
+}
+
+func TestNotificationProcessors(t *testing.T) {
+	var order []string
+	enrich := processorFunc(func(ctx context.Context, n *Notification) error {
+		order = append(order, "enrich")
+		if n.Metadata == nil {
+			n.Metadata = map[string]string{}
+		}
+		n.Metadata["region"] = "ap-northeast-1"
+		n.Category = "routed"
+		return nil
+	})
+	reject := processorFunc(func(ctx context.Context, n *Notification) error {
+		order = append(order, "reject")
+		if strings.Contains(n.Message, "spam") {
+			return errors.New("message looks like spam")
+		}
+		return nil
+	})
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.Processors = []NotificationProcessor{enrich, reject}
+	})
+
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if created.Category != "routed" || created.Metadata["region"] != "ap-northeast-1" {
+		t.Errorf("processed = %s/%v, want the enriched notification", created.Category, created.Metadata)
+	}
+	var stored Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &stored)
+	if stored.Category != "routed" {
+		t.Errorf("stored category = %q, want routed", stored.Category)
+	}
+	if !slicesEqual(order, []string{"enrich", "reject"}) {
+		t.Errorf("processor order = %v", order)
+	}
+
+	var resp ErrorResponse
+	decode(t, ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "buy spam"}), &resp)
+	if !strings.Contains(resp.Error, "message looks like spam") {
+		t.Errorf("error = %q", resp.Error)
+	}
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{created.ID}) {
+		t.Errorf("list = %v, want only the accepted notification", got)
+	}
+}
+
+func TestNoProcessorsByDefault(t *testing.T) {
+	ts := startTestServer(t)
+	if len(ts.Service.processors) != 0 {
+		t.Errorf("default processors = %d, want none", len(ts.Service.processors))
+	}
+	if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy"}); created.Category != "deploy" {
+		t.Errorf("category = %q, want deploy", created.Category)
+	}
+}
+
+func TestContentDedup(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.DedupWindow = time.Minute })
+	first := ts.create(t, CreateNotificationRequest{Title: "Disk full", Message: "/var is at 95%"})
+
+	// 空白の違いは同じ内容として扱う
+	res, data := ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: " Disk  full", Message: "/var is at 95%\n"})
+	var duplicate CreateNotificationResponse
+	decode(t, data, &duplicate)
+	if res.StatusCode != http.StatusOK || duplicate.Status != CreateStatusDuplicate || duplicate.ID != first.ID {
+		t.Errorf("identical content: %d %s %s, want 200 duplicate of %s", res.StatusCode, duplicate.Status, duplicate.ID, first.ID)
+	}
+
+	differing := []CreateNotificationRequest{
+		{Title: "Disk full", Message: "/home is at 95%"},
+		{Title: "Disk almost full", Message: "/var is at 95%"},
+		{Title: "Disk full", Message: "/var is at 95%", UserID: "alice"},
+	}
+	for _, req := range differing {
+		if created := ts.create(t, req); created.Status == CreateStatusDuplicate || created.ID == first.ID {
+			t.Errorf("%+v was deduplicated", req)
+		}
+	}
+
+	ts.Clock.Advance(time.Minute)
+	if created := ts.create(t, CreateNotificationRequest{Title: "Disk full", Message: "/var is at 95%"}); created.Status == CreateStatusDuplicate {
+		t.Error("identical content after the window was deduplicated")
+	}
+	if got := ts.listIDs(t, ""); len(got) != 5 {
+		t.Errorf("stored %v, want 5 notifications", got)
+	}
+}
+
+func TestContentDedupDisabled(t *testing.T) {
+	ts := startTestServer(t)
+	for i := 0; i < 2; i++ {
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}); created.Status == CreateStatusDuplicate {
+			t.Fatal("deduplicated without a window")
+		}
+	}
+}
+
+func TestTagLimits(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.MaxTags = 3
+		cfg.Service.MaxTagLength = 5
+	})
+
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Tags: []string{" prod ", "api", "東京リージ"}})
+	if !slicesEqual(created.Tags, []string{"prod", "api", "東京リージ"}) {
+		t.Errorf("within limits: tags = %q, want trimmed tags", created.Tags)
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{"too many", []string{"a", "b", "c", "d"}, "too many tags: 4 (max 3)"},
+		{"too long", []string{"staging"}, `tag too long: "staging" (max 5 characters)`},
+		{"too long multibyte", []string{"東京リージョン"}, "tag too long"},
+		{"empty", []string{"a", ""}, "tags must not be empty"},
+		{"whitespace", []string{"  "}, "tags must not be empty"},
+	}
+	for _, tt := range tests {
+		var resp ErrorResponse
+		decode(t, ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Tags: tt.tags}), &resp)
+		if len(resp.Errors) != 1 || resp.Errors[0].Field != "tags" || !strings.Contains(resp.Errors[0].Reason, tt.want) {
+			t.Errorf("%s: errors = %+v, want %q for tags", tt.name, resp.Errors, tt.want)
+		}
+	}
+
+	// 追加するタグにも同じ上限を適用する
+	ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications/"+created.ID+"/tags/extra", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/"+created.ID+"/tags/api", nil)
+	if got := ts.listIDs(t, ""); len(got) != 1 {
+		t.Errorf("stored %v, want only the valid notification", got)
+	}
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	policy := map[string]PriorityHints{
+		PriorityCritical: {Sound: SoundAlert, RequiresAck: true, TTL: time.Hour},
+	}
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.PriorityPolicy = policy
+		cfg.Handler.Priorities = NewNotificationService(newTestRepository(), ServiceConfig{PriorityPolicy: policy}).PriorityPolicy()
+	})
+
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical})
+	if created.Sound != SoundAlert || !created.RequiresAck {
+		t.Errorf("critical hints = %s/%v, want alert/requires ack", created.Sound, created.RequiresAck)
+	}
+	if want := TestServerStart.Add(time.Hour); created.ExpiresAt == nil || !created.ExpiresAt.Equal(want) {
+		t.Errorf("expires_at = %v, want %s", created.ExpiresAt, want)
+	}
+
+	// リクエストで指定した値を優先する
+	requiresAck := false
+	created = ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical, Sound: SoundSilent, RequiresAck: &requiresAck})
+	if created.Sound != SoundSilent || created.RequiresAck {
+		t.Errorf("explicit fields = %s/%v, want silent/no ack", created.Sound, created.RequiresAck)
+	}
+	created = ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityLow})
+	if created.Sound != SoundDefault || created.RequiresAck || created.ExpiresAt != nil {
+		t.Errorf("low without a policy = %s/%v/%v", created.Sound, created.RequiresAck, created.ExpiresAt)
+	}
+
+	var config PrioritiesConfigResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/config/priorities", nil), &config)
+	if got := config.Priorities[PriorityCritical]; got != (PriorityHintsResponse{Sound: SoundAlert, RequiresAck: true, TTL: "1h0m0s"}) {
+		t.Errorf("critical policy = %+v", got)
+	}
+	if got := config.Priorities[PriorityLow]; got != (PriorityHintsResponse{Sound: SoundDefault}) {
+		t.Errorf("low policy = %+v", got)
+	}
+}
+
+func TestValidatePriorityPolicy(t *testing.T) {
+	for _, policy := range []map[string]PriorityHints{
+		{"urgent": {}},
+		{PriorityHigh: {Sound: "bell"}},
+		{PriorityHigh: {TTL: -time.Second}},
+	} {
+		if err := (ServiceConfig{PriorityPolicy: policy}).Validate(); err == nil {
+			t.Errorf("Validate(%v) = nil, want an error", policy)
+		}
+	}
+}
+
+func TestCategoryTTLs(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.CategoryTTLs = map[string]time.Duration{"system": 10 * time.Minute, "security": 0}
+		cfg.Service.PriorityPolicy = map[string]PriorityHints{PriorityCritical: {TTL: time.Minute}}
+	})
+	system := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "system"})
+	// カテゴリの有効期間は優先度の有効期間より優先する
+	security := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "security", Priority: PriorityCritical})
+	explicit := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "system", TTL: "1h"})
+
+	if security.ExpiresAt != nil {
+		t.Errorf("security expires_at = %v, want no expiry", security.ExpiresAt)
+	}
+	if want := TestServerStart.Add(time.Hour); explicit.ExpiresAt == nil || !explicit.ExpiresAt.Equal(want) {
+		t.Errorf("explicit expires_at = %v, want %s", explicit.ExpiresAt, want)
+	}
+
+	ts.Clock.Advance(9 * time.Minute)
+	if expired := ts.Service.ExpireNotifications(); len(expired) != 0 {
+		t.Errorf("expired before the category ttl: %v", expired)
+	}
+	ts.Clock.Advance(time.Minute)
+	if expired := ts.Service.ExpireNotifications(); !slicesEqual(expired, []string{system.ID}) {
+		t.Errorf("expired = %v, want [%s]", expired, system.ID)
+	}
+	ts.Clock.Advance(24 * time.Hour)
+	if expired := ts.Service.ExpireNotifications(); !slicesEqual(expired, []string{explicit.ID}) {
+		t.Errorf("expired = %v, want [%s]", expired, explicit.ID)
+	}
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{security.ID}) {
+		t.Errorf("remaining = %v, want the security notification", got)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.Service.MaxAttachments = 2
+		cfg.Service.MaxAttachmentSize = 1024
+	})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	attachments := []Attachment{
+		{URL: "https://example.com/report.pdf", ContentType: "application/pdf", Size: 1024},
+		{URL: "http://example.com/chart.png", ContentType: "image/png"},
+	}
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Attachments: attachments})
+	var stored Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &stored)
+	msg := client.next(t, "notification")
+	for name, got := range map[string][]Attachment{"stored": stored.Attachments, "broadcast": msg.Notification.Attachments} {
+		if len(got) != 2 || got[0] != attachments[0] || got[1] != attachments[1] {
+			t.Errorf("%s attachments = %+v, want %+v", name, got, attachments)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		attachments []Attachment
+		want        string
+	}{
+		{"relative url", []Attachment{{URL: "/report.pdf", ContentType: "application/pdf"}}, "invalid attachment url"},
+		{"unsupported scheme", []Attachment{{URL: "file:///etc/passwd", ContentType: "text/plain"}}, "invalid attachment url"},
+		{"missing host", []Attachment{{URL: "https://", ContentType: "text/plain"}}, "invalid attachment url"},
+		{"missing content type", []Attachment{{URL: "https://example.com/a"}}, "invalid attachment content type"},
+		{"negative size", []Attachment{{URL: "https://example.com/a", ContentType: "text/plain", Size: -1}}, "invalid attachment size"},
+		{"too large", []Attachment{{URL: "https://example.com/a", ContentType: "text/plain", Size: 1025}}, "attachment too large: 1025 bytes (max 1024)"},
+		{"too many", append(attachments, attachments[0]), "too many attachments: 3 (max 2)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Attachments: tt.attachments})
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("error = %s, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineAttachmentData(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.MaxAttachmentData = 64 })
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	// URLを省略しても、埋め込んだ内容を保存して配信する
+	thumbnail := Attachment{ContentType: "image/png", Size: 64, Data: base64.StdEncoding.EncodeToString(make([]byte, 64))}
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Attachments: []Attachment{thumbnail}})
+	var stored Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &stored)
+	msg := client.next(t, "notification")
+	for name, got := range map[string][]Attachment{"stored": stored.Attachments, "broadcast": msg.Notification.Attachments} {
+		if len(got) != 1 || got[0] != thumbnail {
+			t.Errorf("%s attachments = %+v, want %+v", name, got, thumbnail)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		attachment Attachment
+		want       string
+	}{
+		{"oversized", Attachment{ContentType: "image/png", Data: base64.StdEncoding.EncodeToString(make([]byte, 65))}, "inline attachment too large (max 64 bytes)"},
+		{"far oversized", Attachment{ContentType: "image/png", Data: strings.Repeat("A", 4096)}, "inline attachment too large (max 64 bytes)"},
+		{"invalid base64", Attachment{ContentType: "image/png", Data: "not base64!"}, "invalid attachment data"},
+		{"url-safe alphabet", Attachment{ContentType: "image/png", Data: "-_-_"}, "invalid attachment data"},
+		{"line breaks", Attachment{ContentType: "image/png", Data: "AAAA\nAAAA"}, "invalid attachment data"},
+		{"size mismatch", Attachment{ContentType: "image/png", Size: 10, Data: "AAAA"}, "attachment size 10 does not match data (3 bytes)"},
+		{"invalid url with data", Attachment{URL: "/a.png", ContentType: "image/png", Data: "AAAA"}, "invalid attachment url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ts.expectStatus(t, http.StatusBadRequest, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m", Attachments: []Attachment{tt.attachment}})
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("error = %s, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDPrefixes(t *testing.T) {
+	prefixes := map[string]string{"notibag-send": "cli-", "web": "web-"}
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.IDPrefixes = prefixes })
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"notibag-send", "cli-1"},
+		{"web", "web-2"},
+		{"", "3"},
+		{"deploy-bot", "4"},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.source != "" {
+			header = []string{sourceHeader, tt.source}
+		}
+		created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, header...)
+		if created.ID != tt.want {
+			t.Errorf("source %q: id = %s, want %s", tt.source, created.ID, tt.want)
+		}
+		// プレフィックス付きのIDでもURLから参照できる
+		ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil)
+	}
+
+	// 同じ時刻に作成しても作成元をまたいで重複しない
+	service := NewNotificationService(newTestRepository(), ServiceConfig{Clock: NewFakeClock(TestServerStart), IDPrefixes: prefixes})
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		for _, source := range []string{"notibag-send", "web", ""} {
+			n, err := service.CreateNotification(context.Background(), CreateNotificationRequest{Title: "t", Message: "m", Source: source})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := prefixes[source]; !strings.HasPrefix(n.ID, want) || (want == "" && (strings.HasPrefix(n.ID, "cli-") || strings.HasPrefix(n.ID, "web-"))) {
+				t.Errorf("source %q: id %s", source, n.ID)
+			}
+			if seen[n.ID] {
+				t.Fatalf("duplicate id %s", n.ID)
+			}
+			seen[n.ID] = true
+		}
+	}
+}
+
+func TestValidateIDPrefixes(t *testing.T) {
+	for _, prefix := range []string{"cli/", "a b-", "ü-", strings.Repeat("a", 33)} {
+		if err := (ServiceConfig{IDPrefixes: map[string]string{"cli": prefix}}).Validate(); err == nil {
+			t.Errorf("Validate() accepted the prefix %q", prefix)
+		}
+	}
+	if err := (ServiceConfig{IDPrefixes: map[string]string{"cli": "cli_2-"}}).Validate(); err != nil {
+		t.Errorf("Validate() = %v for a valid prefix", err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver はstatusに応答し、受信したイベントを記録するWebhookの送信先
+type webhookReceiver struct {
+	*httptest.Server
+	status atomic.Int32
+	mu     sync.Mutex
+	events []WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{}
+	r.status.Store(int32(status))
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		var event WebhookEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Errorf("invalid webhook payload %q: %v", data, err)
+		}
+		r.mu.Lock()
+		r.events = append(r.events, event)
+		r.mu.Unlock()
+		w.WriteHeader(int(r.status.Load()))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) received() []WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+// retryDue はRunの代わりに、再送キューの全ての送信をすぐに再送する
+func retryDue(d *WebhookDispatcher) {
+	for _, delivery := range d.takeDue(time.Now().Add(webhookMaxRetryBackoff)) {
+		d.attempt(delivery)
+	}
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	d, err := NewWebhookDispatcher(WebhookConfig{
+		URLs:          []string{receiver.URL},
+		Timeout:       time.Second,
+		RetryInterval: time.Millisecond,
+		MaxRetryAge:   100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+
+	d.Notify(WebhookEventCreated, Notification{ID: "1", Title: "t", Message: "m"})
+	waitFor(t, "the failed delivery to be queued", func() bool { return d.Stats().RetryQueueDepth == 1 })
+
+	retryDue(d)
+	if got := len(receiver.received()); got != 2 {
+		t.Fatalf("attempts = %d, want 2", got)
+	}
+	if s := d.Stats(); s.RetryQueueDepth != 1 || s.Failed != 2 || s.DeadLettered != 0 {
+		t.Fatalf("after a retry: %+v", s)
+	}
+
+	// 最大期間を過ぎても失敗した場合は再送を諦める
+	time.Sleep(100 * time.Millisecond)
+	retryDue(d)
+	if s := d.Stats(); s.RetryQueueDepth != 0 || s.Failed != 3 || s.DeadLettered != 1 || s.Delivered != 0 {
+		t.Fatalf("after the max age: %+v", s)
+	}
+	if !strings.Contains(logs.String(), "Webhook delivery dead-lettered") {
+		t.Errorf("dead letter was not logged: %s", logs)
+	}
+	for _, event := range receiver.received() {
+		if event.Event != WebhookEventCreated || event.Notification == nil || event.Notification.ID != "1" {
+			t.Errorf("retried payload = %+v", event)
+		}
+	}
+}
+
+func TestWebhookRetrySucceeds(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	d, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{receiver.URL}, Timeout: time.Second, RetryInterval: time.Millisecond, MaxRetryAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Notify(WebhookEventCreated, Notification{ID: "1"})
+	waitFor(t, "the failed delivery to be queued", func() bool { return d.Stats().RetryQueueDepth == 1 })
+
+	receiver.status.Store(http.StatusOK)
+	retryDue(d)
+	if s := d.Stats(); s.Delivered != 1 || s.RetryQueueDepth != 0 || s.DeadLettered != 0 {
+		t.Errorf("after recovering: %+v", s)
+	}
+}
+
+func TestWebhookClientErrorIsNotRetried(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+	d, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{receiver.URL}, Timeout: time.Second, RetryInterval: time.Millisecond, MaxRetryAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Notify(WebhookEventCreated, Notification{ID: "1"})
+	waitFor(t, "the delivery to be dead-lettered", func() bool { return d.Stats().DeadLettered == 1 })
+	if s := d.Stats(); s.RetryQueueDepth != 0 {
+		t.Errorf("retry queue depth = %d, want 0", s.RetryQueueDepth)
+	}
+}
+
+func TestWebhookRetryQueueIsPersisted(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	cfg := WebhookConfig{
+		URLs:          []string{receiver.URL},
+		Timeout:       time.Second,
+		RetryInterval: time.Millisecond,
+		MaxRetryAge:   time.Hour,
+		QueuePath:     filepath.Join(t.TempDir(), "webhooks.json"),
+	}
+	d, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Notify(WebhookEventCreated, Notification{ID: "1"})
+	waitFor(t, "the failed delivery to be queued", func() bool { return d.Stats().RetryQueueDepth == 1 })
+	if _, err := os.Stat(cfg.QueuePath); err != nil {
+		t.Fatalf("retry queue was not saved: %v", err)
+	}
+
+	// 再起動後も再送する
+	restarted, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := restarted.Stats().RetryQueueDepth; depth != 1 {
+		t.Fatalf("restored queue depth = %d, want 1", depth)
+	}
+	receiver.status.Store(http.StatusOK)
+	retryDue(restarted)
+	if s := restarted.Stats(); s.Delivered != 1 || s.RetryQueueDepth != 0 {
+		t.Errorf("after retrying the restored queue: %+v", s)
+	}
+}
+
+func TestMetricsIncludeWebhookQueueDepth(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	d, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{receiver.URL}, Timeout: time.Second, RetryInterval: time.Hour, MaxRetryAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, withAdminToken("admin"), func(cfg *testConfig) { cfg.Handler.Webhooks = d })
+	d.Notify(WebhookEventCreated, Notification{ID: "1"})
+	waitFor(t, "the failed delivery to be queued", func() bool { return d.Stats().RetryQueueDepth == 1 })
+
+	var metrics MetricsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/admin/metrics", nil, "Authorization", "Bearer admin"), &metrics)
+	if metrics.Webhooks.RetryQueueDepth != 1 || metrics.Webhooks.Failed != 1 {
+		t.Errorf("webhook metrics = %+v, want 1 queued failure", metrics.Webhooks)
+	}
+}
+
+func TestWebhookDeadLetterRedaction(t *testing.T) {
+	withRedactedLogs(t)
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+	d, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{receiver.URL}, Timeout: time.Second, MaxRetryAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+	d.Notify(WebhookEventCreated, Notification{ID: "1", Title: "secret title", Message: "token=hunter2"})
+	waitFor(t, "the delivery to be dead-lettered", func() bool { return d.Stats().DeadLettered == 1 })
+
+	output := logs.String()
+	if strings.Contains(output, "hunter2") || strings.Contains(output, "secret title") {
+		t.Errorf("dead letter log contains the notification content: %s", output)
+	}
+	if !strings.Contains(output, `"title_length":12`) {
+		t.Errorf("dead letter log does not describe the notification: %s", output)
+	}
+}
+
+// eventsOf はreceiverが受信したeventのイベントを返す
+func eventsOf(r *webhookReceiver, event string) []WebhookEvent {
+	var events []WebhookEvent
+	for _, e := range r.received() {
+		if e.Event == event {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestReadWebhook(t *testing.T) {
+	all := newWebhookReceiver(t, http.StatusOK)
+	readOnly := newWebhookReceiver(t, http.StatusOK)
+	d, err := NewWebhookDispatcher(WebhookConfig{
+		URLs:    []string{all.URL, readOnly.URL},
+		Timeout: time.Second,
+		Events:  map[string][]string{readOnly.URL: {WebhookEventRead}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.Webhooks = d })
+
+	id := ts.create(t, CreateNotificationRequest{Title: "Deploy finished", Message: "api v2", Category: "deploy"}).ID
+	waitFor(t, "the created event", func() bool { return len(eventsOf(all, WebhookEventCreated)) == 1 })
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+id+"/read", nil)
+	for name, r := range map[string]*webhookReceiver{"all": all, "read only": readOnly} {
+		waitFor(t, name+" to receive the read event", func() bool { return len(eventsOf(r, WebhookEventRead)) == 1 })
+		event := eventsOf(r, WebhookEventRead)[0]
+		if n := event.Notification; n == nil || n.ID != id || !n.Read || n.Title != "Deploy finished" || n.Category != "deploy" {
+			t.Errorf("%s: read payload = %+v", name, n)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("%s: read event has no timestamp", name)
+		}
+	}
+
+	// 既読の通知を再度既読にしてもイベントは送らない
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+id+"/read", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/delete", DeleteNotificationsRequest{IDs: []string{id}})
+	ts.expectStatus(t, http.StatusOK, http.MethodDelete, "/api/notifications", nil)
+	waitFor(t, "the deleted and cleared events", func() bool {
+		return len(eventsOf(all, WebhookEventDeleted)) == 1 && len(eventsOf(all, WebhookEventCleared)) == 1
+	})
+	if deleted := eventsOf(all, WebhookEventDeleted)[0]; deleted.Notification == nil || deleted.Notification.ID != id {
+		t.Errorf("deleted payload = %+v", deleted.Notification)
+	}
+	if got := len(eventsOf(all, WebhookEventRead)); got != 1 {
+		t.Errorf("read events after marking twice = %d, want 1", got)
+	}
+	// 購読していないイベントは送らない
+	for _, event := range readOnly.received() {
+		if event.Event != WebhookEventRead {
+			t.Errorf("read-only subscriber received %s", event.Event)
+		}
+	}
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	events, err := parseWebhookEvents("https://a.example/hook=read|deleted, https://b.example/hook?x=1=created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := events["https://a.example/hook"]; !slices.Equal(got, []string{"read", "deleted"}) {
+		t.Errorf("a = %v", got)
+	}
+	if got := events["https://b.example/hook?x=1"]; !slices.Equal(got, []string{"created"}) {
+		t.Errorf("b = %v", got)
+	}
+
+	for _, s := range []string{"https://a.example/hook", "https://a.example/hook=", "=read"} {
+		if _, err := parseWebhookEvents(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if _, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{"https://a.example"}, Events: map[string][]string{"https://a.example": {"updated"}}}); err == nil || !strings.Contains(err.Error(), "unknown webhook event: updated") {
+		t.Errorf("unknown event: error = %v", err)
+	}
+}
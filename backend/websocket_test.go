@@ -0,0 +1,1956 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withAPIKeys はREST APIとWebSocketにAPIキーを要求する
+func withAPIKeys(keys map[string]string) testOption {
+	return func(cfg *testConfig) {
+		cfg.Server.APIKeys = keys
+		cfg.WS.APIKeys = keys
+	}
+}
+
+func TestWebSocketRequiresAPIKey(t *testing.T) {
+	keys := map[string]string{"ci": "secret"}
+	auth := []string{"Authorization", "Bearer secret"}
+
+	t.Run("bearer header", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		client := dialWS(t, ts.WebSocketURL(), http.Header{"Authorization": {"Bearer secret"}})
+		waitClients(t, ts.WSManager, 1)
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, auth...)
+		if msg := client.next(t, "notification"); msg.Notification.ID != "1" {
+			t.Errorf("notification = %s, want 1", msg.Notification.ID)
+		}
+	})
+
+	t.Run("token query", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		client := dialWS(t, ts.WebSocketURL()+"?token=secret", nil)
+		waitClients(t, ts.WSManager, 1)
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, auth...)
+		client.next(t, "notification")
+	})
+
+	t.Run("auth message", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		client.send(t, WSMessage{Type: "auth", Token: "secret"})
+		waitClients(t, ts.WSManager, 1)
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, auth...)
+		client.next(t, "notification")
+	})
+
+	for name, url := range map[string]func(*TestServer) (string, http.Header){
+		"invalid bearer header": func(ts *TestServer) (string, http.Header) {
+			return ts.WebSocketURL(), http.Header{"Authorization": {"Bearer wrong"}}
+		},
+		"invalid token query": func(ts *TestServer) (string, http.Header) {
+			return ts.WebSocketURL() + "?token=wrong", nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := startTestServer(t, withAPIKeys(keys))
+			u, header := url(ts)
+			_, res, err := websocket.DefaultDialer.Dial(u, header)
+			if err == nil {
+				t.Fatal("dial succeeded without a valid key")
+			}
+			if res == nil || res.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("response = %v, want 401", res)
+			}
+		})
+	}
+
+	t.Run("invalid auth message", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		client.send(t, WSMessage{Type: "auth", Token: "wrong"})
+		if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "unauthorized" {
+			t.Fatalf("close = %v, want 1008 unauthorized", closeErr)
+		}
+	})
+
+	t.Run("unauthenticated client cannot read notifications", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, auth...)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		// authの代わりに送った最初のメッセージは認証の失敗として扱う
+		client.send(t, WSMessage{Type: "get_notifications"})
+		client.expectNone(t, "notifications_list", 100*time.Millisecond)
+		if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Text != "unauthorized" {
+			t.Fatalf("close = %v, want unauthorized", closeErr)
+		}
+		if clients := ts.WSManager.Stats().Clients; clients != 0 {
+			t.Errorf("clients = %d, want 0", clients)
+		}
+	})
+
+	t.Run("auth timeout", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys), func(cfg *testConfig) { cfg.WS.HandshakeTimeout = 50 * time.Millisecond })
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Text != "handshake timeout" {
+			t.Fatalf("close = %v, want handshake timeout", closeErr)
+		}
+	})
+}
+
+func TestReplaySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	withReplayPath := func(cfg *testConfig) { cfg.WS.ReplayPath = path }
+
+	before := startTestServer(t, withReplayPath)
+	for _, title := range []string{"a", "b", "c"} {
+		before.create(t, CreateNotificationRequest{Title: title, Message: "m"})
+	}
+	// ブロードキャストではファイルに書き込まず、SaveReplayでまとめて保存する
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("replay file written during broadcast: %v", err)
+	}
+	before.WSManager.SaveReplay()
+	before.Close()
+
+	after := startTestServer(t, withReplayPath)
+	client := dialWS(t, after.WebSocketURL()+"?since_seq=1", nil)
+	for _, want := range []struct {
+		seq   uint64
+		title string
+	}{{2, "b"}, {3, "c"}} {
+		msg := client.next(t, "notification")
+		if msg.Seq != want.seq || msg.Notification.Title != want.title {
+			t.Errorf("replayed seq %d %q, want seq %d %q", msg.Seq, msg.Notification.Title, want.seq, want.title)
+		}
+	}
+
+	// 再起動前のseqの続きから採番する
+	waitClients(t, after.WSManager, 1)
+	after.create(t, CreateNotificationRequest{Title: "d", Message: "m"})
+	if msg := client.next(t, "notification"); msg.Seq != 4 {
+		t.Errorf("seq after restart = %d, want 4", msg.Seq)
+	}
+}
+
+func TestReplayMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	withMaxAge := func(cfg *testConfig) {
+		cfg.WS.ReplayPath = path
+		cfg.WS.ReplayMaxAge = time.Minute
+	}
+	expectReplayed := func(t *testing.T, ts *TestServer, want ...string) {
+		t.Helper()
+		client := dialWS(t, ts.WebSocketURL()+"?since_seq=0", nil)
+		for _, title := range want {
+			if msg := client.next(t, "notification"); msg.Notification.Title != title {
+				t.Errorf("replayed %q, want %q", msg.Notification.Title, title)
+			}
+		}
+		client.expectNone(t, "notification", 50*time.Millisecond)
+	}
+
+	before := startTestServer(t, withMaxAge)
+	before.create(t, CreateNotificationRequest{Title: "a", Message: "m"})
+	before.Clock.Advance(90 * time.Second)
+	before.create(t, CreateNotificationRequest{Title: "b", Message: "m"})
+	expectReplayed(t, before, "b")
+	before.WSManager.SaveReplay()
+	before.Close()
+
+	// 再起動後も、保存したメッセージの時刻から期限を判定する
+	after := startTestServer(t, withMaxAge, func(cfg *testConfig) { cfg.WS.Clock = NewFakeClock(TestServerStart.Add(140 * time.Second)) })
+	expectReplayed(t, after, "b")
+	after.WSManager.clock.(*FakeClock).Advance(time.Minute)
+	expectReplayed(t, after)
+}
+
+func TestBatchWindow(t *testing.T) {
+	withBatchWindow := func(cfg *testConfig) { cfg.WS.BatchWindow = time.Second }
+
+	t.Run("notifications within the window are sent as one batch", func(t *testing.T) {
+		ts := startTestServer(t, withBatchWindow)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		for _, title := range []string{"a", "b", "c"} {
+			if created := ts.create(t, CreateNotificationRequest{Title: title, Message: "m"}); created.Status != CreateStatusHeld {
+				t.Errorf("status = %s, want %s", created.Status, CreateStatusHeld)
+			}
+		}
+		client.expectNone(t, "notification", 50*time.Millisecond)
+
+		ts.Clock.Advance(time.Second)
+		msg := client.next(t, "notifications_batch")
+		if got := ids(msg.Notifications); !slicesEqual(got, []string{"1", "2", "3"}) {
+			t.Errorf("batch = %v, want [1 2 3]", got)
+		}
+		client.expectNone(t, "notification", 50*time.Millisecond)
+	})
+
+	t.Run("a single notification is sent on its own", func(t *testing.T) {
+		ts := startTestServer(t, withBatchWindow)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		ts.create(t, CreateNotificationRequest{Title: "a", Message: "m"})
+		ts.Clock.Advance(time.Second)
+		if msg := client.next(t, "notification"); msg.Notification.ID != "1" {
+			t.Errorf("notification = %s, want 1", msg.Notification.ID)
+		}
+
+		// 期間の後の通知は新しい期間を始める
+		ts.create(t, CreateNotificationRequest{Title: "b", Message: "m"})
+		client.expectNone(t, "notification", 50*time.Millisecond)
+		ts.Clock.Advance(time.Second)
+		if msg := client.next(t, "notification"); msg.Notification.ID != "2" {
+			t.Errorf("notification = %s, want 2", msg.Notification.ID)
+		}
+	})
+
+	t.Run("auto read applies when the batch is delivered", func(t *testing.T) {
+		ts := startTestServer(t, withBatchWindow)
+		dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		autoRead := true
+		ts.create(t, CreateNotificationRequest{Title: "a", Message: "m", AutoRead: &autoRead})
+		ts.create(t, CreateNotificationRequest{Title: "b", Message: "m", AutoRead: &autoRead})
+		unread := func() int { return ts.Service.repo.CountUnread() }
+		if n := unread(); n != 2 {
+			t.Fatalf("unread before the window closed = %d, want 2", n)
+		}
+		ts.Clock.Advance(time.Second)
+		if n := unread(); n != 0 {
+			t.Errorf("unread after delivery = %d, want 0", n)
+		}
+	})
+}
+
+func TestSubscribeByCategory(t *testing.T) {
+	ts := startTestServer(t)
+	subscriber := dialWS(t, ts.WebSocketURL(), nil)
+	everyone := dialWS(t, ts.WebSocketURL(), nil)
+	subscriber.send(t, WSMessage{Type: "subscribe", Categories: []string{"deploy"}})
+	subscriber.sync(t)
+	waitClients(t, ts.WSManager, 2)
+
+	for _, category := range []string{"deploy", "system", "deploy"} {
+		ts.create(t, CreateNotificationRequest{Title: category, Message: "m", Category: category})
+	}
+
+	for _, want := range []string{"1", "3"} {
+		if msg := subscriber.next(t, "notification"); msg.Notification.ID != want {
+			t.Errorf("subscriber received %s (%s), want %s", msg.Notification.ID, msg.Notification.Category, want)
+		}
+	}
+	subscriber.expectNone(t, "notification", 50*time.Millisecond)
+	for _, want := range []string{"1", "2", "3"} {
+		if msg := everyone.next(t, "notification"); msg.Notification.ID != want {
+			t.Errorf("unsubscribed client received %s, want %s", msg.Notification.ID, want)
+		}
+	}
+}
+
+// dialStatus はWebSocketの接続を試み、アップグレードできなかった場合のステータスコードを返す (成功した場合は101)
+func dialStatus(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if res == nil {
+			t.Fatalf("dial %s: %v", url, err)
+		}
+		return res.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return http.StatusSwitchingProtocols
+}
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	forwardedFor := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+	onePerIP := func(cfg *testConfig) { cfg.WS.MaxConnsPerIP = 1 }
+
+	t.Run("without a trusted proxy the header is ignored", func(t *testing.T) {
+		ts := startTestServer(t, onePerIP)
+		if status := dialStatus(t, ts.WebSocketURL(), forwardedFor("10.0.0.1")); status != http.StatusSwitchingProtocols {
+			t.Fatalf("first connection: %d", status)
+		}
+		// 接続元はどちらも127.0.0.1として数える
+		if status := dialStatus(t, ts.WebSocketURL(), forwardedFor("10.0.0.2")); status != http.StatusTooManyRequests {
+			t.Errorf("second connection: %d, want 429", status)
+		}
+	})
+
+	t.Run("with a trusted proxy the forwarded IP is used", func(t *testing.T) {
+		ts := startTestServer(t, onePerIP, func(cfg *testConfig) { cfg.Server.TrustedProxies = []string{"127.0.0.1"} })
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			if status := dialStatus(t, ts.WebSocketURL(), forwardedFor(ip)); status != http.StatusSwitchingProtocols {
+				t.Errorf("connection from %s: %d", ip, status)
+			}
+		}
+		if status := dialStatus(t, ts.WebSocketURL(), forwardedFor("10.0.0.1")); status != http.StatusTooManyRequests {
+			t.Errorf("second connection from 10.0.0.1: %d, want 429", status)
+		}
+	})
+}
+
+func TestWebSocketMessageSizeLimit(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.WS.MaxMessageSize = 64 })
+	client := dialWS(t, ts.WebSocketURL(), nil)
+
+	// 上限以内のメッセージは処理される
+	client.sync(t)
+
+	if err := client.conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"get_notifications","padding":"`+strings.Repeat("x", 128)+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("close = %v, want %d", closeErr, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestReadStateSync(t *testing.T) {
+	ts := startTestServer(t)
+	device := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	device.next(t, "notification")
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/1/read", nil)
+	msg := device.next(t, "notification_read")
+	if msg.NotificationID != "1" || msg.Read == nil || !*msg.Read {
+		t.Errorf("notification_read = %s read=%v, want 1 read=true", msg.NotificationID, msg.Read)
+	}
+}
+
+// stallWriters はサーバー側の全ての接続の書き込みを止め、再開する関数を返す
+// 送信goroutineが書き込みで待つため、送信キューが一杯になる
+func stallWriters(t *testing.T, w *WSManagerImpl) func() {
+	t.Helper()
+	w.mu.RLock()
+	conns := make([]*connWithMu, 0, len(w.clients))
+	for _, c := range w.clients {
+		conns = append(conns, c)
+	}
+	w.mu.RUnlock()
+	for _, c := range conns {
+		c.mu.Lock()
+	}
+	return sync.OnceFunc(func() {
+		for _, c := range conns {
+			c.mu.Unlock()
+		}
+	})
+}
+
+// queuedMessages は全ての接続の送信キューに残っているメッセージの数を返す
+func queuedMessages(w *WSManagerImpl) int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	n := 0
+	for _, c := range w.clients {
+		n += len(c.send)
+	}
+	return n
+}
+
+func TestWSStats(t *testing.T) {
+	ts := startTestServer(t, withAdminToken("admin"), func(cfg *testConfig) {
+		cfg.WS.SendBufferSize = 1
+	})
+	stats := func() WSStats {
+		t.Helper()
+		var s WSStats
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/admin/ws-stats", nil, "Authorization", "Bearer admin"), &s)
+		return s
+	}
+
+	a := dialWS(t, ts.WebSocketURL(), nil)
+	b := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 2)
+	if s := stats(); s.Clients != 2 || s.TotalConnections != 2 || s.TotalBroadcasts != 0 {
+		t.Fatalf("after connecting: %+v", s)
+	}
+
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	a.next(t, "notification")
+	b.next(t, "notification")
+	if s := stats(); s.TotalBroadcasts != 1 || s.BroadcastFailures != 0 {
+		t.Fatalf("after broadcasting: %+v", s)
+	}
+
+	// 書き込みが止まった接続は送信キューが溢れた時点で切断される
+	resume := stallWriters(t, ts.WSManager)
+	defer resume()
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	waitFor(t, "writers to block", func() bool { return queuedMessages(ts.WSManager) == 0 })
+	for i := 0; i < 2; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	}
+	resume()
+	waitClients(t, ts.WSManager, 0)
+	s := stats()
+	if s.TotalBroadcasts != 4 || s.BroadcastFailures != 2 || s.TotalConnections != 2 {
+		t.Fatalf("after evicting: %+v", s)
+	}
+	if s.AverageFanoutMillis <= 0 {
+		t.Errorf("average fan-out = %g, want > 0", s.AverageFanoutMillis)
+	}
+	ts.expectStatus(t, http.StatusUnauthorized, http.MethodGet, "/api/admin/ws-stats", nil)
+}
+
+func TestUpgraderBufferSizes(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.ReadBufferSize = 256
+		cfg.WS.WriteBufferSize = 512
+		cfg.WS.UseBufferPool = true
+	})
+	upgrader := ts.WSManager.upgrader
+	if upgrader.ReadBufferSize != 256 || upgrader.WriteBufferSize != 512 {
+		t.Errorf("buffer sizes = %d/%d, want 256/512", upgrader.ReadBufferSize, upgrader.WriteBufferSize)
+	}
+	if upgrader.WriteBufferPool == nil {
+		t.Error("buffer pool is not enabled")
+	}
+
+	// バッファより大きいメッセージも分割して送受信できる
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	message := strings.Repeat("x", 2000)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: message})
+	if msg := client.next(t, "notification"); msg.Notification.Message != message {
+		t.Errorf("message length = %d, want %d", len(msg.Notification.Message), len(message))
+	}
+
+	defaults := startTestServer(t)
+	if upgrader := defaults.WSManager.upgrader; upgrader.ReadBufferSize != 0 || upgrader.WriteBufferSize != 0 || upgrader.WriteBufferPool != nil {
+		t.Errorf("default upgrader = %d/%d pool %v, want gorilla defaults without a pool", upgrader.ReadBufferSize, upgrader.WriteBufferSize, upgrader.WriteBufferPool)
+	}
+}
+
+// BenchmarkWebSocketBufferPool は接続ごとに書き込みバッファを確保する場合と共有する場合のアロケーションを比較する
+func BenchmarkWebSocketBufferPool(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		name := "without pool"
+		if pool {
+			name = "with pool"
+		}
+		b.Run(name, func(b *testing.B) {
+			ts := NewTestServer(func(cfg *testConfig) {
+				cfg.WS.WriteBufferSize = 64 << 10
+				cfg.WS.UseBufferPool = pool
+			})
+			defer ts.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, _, err := websocket.DefaultDialer.Dial(ts.WebSocketURL(), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := conn.WriteJSON(WSMessage{Type: "get_notifications"}); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := conn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestClearAllIsScopedToUser(t *testing.T) {
+	remaining := func(ts *TestServer) []string {
+		return ids(ts.Service.repo.GetAll())
+	}
+	seed := func(t *testing.T, ts *TestServer) {
+		ts.create(t, CreateNotificationRequest{Title: "a", Message: "m", UserID: "alice"})
+		ts.create(t, CreateNotificationRequest{Title: "b", Message: "m", UserID: "bob"})
+		ts.create(t, CreateNotificationRequest{Title: "all", Message: "m"})
+	}
+
+	t.Run("user", func(t *testing.T) {
+		ts := startTestServer(t)
+		seed(t, ts)
+		alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+		alice.send(t, WSMessage{Type: "clear_all"})
+		alice.sync(t)
+		if got := remaining(ts); !slicesEqual(got, []string{"3", "2"}) {
+			t.Errorf("after alice cleared: %v, want bob's and the broadcast notification", got)
+		}
+	})
+
+	t.Run("archive on clear", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.ArchiveOnClear = true })
+		seed(t, ts)
+		alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+		alice.send(t, WSMessage{Type: "clear_all"})
+		alice.sync(t)
+		// 削除せずにアーカイブする
+		if got := remaining(ts); len(got) != 3 {
+			t.Errorf("after alice cleared: %v, want all 3 kept", got)
+		}
+		if got := ts.listIDs(t, "?archived=true"); !slicesEqual(got, []string{"1"}) {
+			t.Errorf("archived = %v, want only alice's notification", got)
+		}
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"3", "2"}) {
+			t.Errorf("unread = %v, want bob's and the broadcast notification", got)
+		}
+	})
+
+	t.Run("without a user", func(t *testing.T) {
+		ts := startTestServer(t)
+		seed(t, ts)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		client.send(t, WSMessage{Type: "clear_all"})
+		client.sync(t)
+		if got := remaining(ts); len(got) != 3 {
+			t.Errorf("anonymous clear_all removed notifications: %v remain", got)
+		}
+	})
+
+	t.Run("global clear allowed", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.WS.AllowGlobalClear = true })
+		seed(t, ts)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		client.send(t, WSMessage{Type: "clear_all"})
+		client.sync(t)
+		if got := remaining(ts); len(got) != 0 {
+			t.Errorf("after a global clear: %v remain", got)
+		}
+	})
+}
+
+func TestBroadcastToggle(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		ts := startTestServer(t)
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}); created.Status != CreateStatusDelivered {
+			t.Errorf("status = %s, want %s", created.Status, CreateStatusDelivered)
+		}
+		client.next(t, "notification")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ts := startTestServer(t, func(cfg *testConfig) { cfg.Handler.DisableBroadcast = true })
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+		if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}); created.Status != CreateStatusStored {
+			t.Errorf("status = %s, want %s", created.Status, CreateStatusStored)
+		}
+		client.expectNone(t, "notification", 100*time.Millisecond)
+
+		// 配信しない場合もget_notificationsとRESTで取得できる
+		client.send(t, WSMessage{Type: "get_notifications"})
+		if msg := client.next(t, "notifications_list"); len(msg.Notifications) != 1 {
+			t.Errorf("notifications_list = %v, want the stored notification", ids(msg.Notifications))
+		}
+		if got := ts.listIDs(t, ""); !slicesEqual(got, []string{"1"}) {
+			t.Errorf("list = %v, want [1]", got)
+		}
+	})
+}
+
+func TestAckCount(t *testing.T) {
+	ts := startTestServer(t)
+	a := dialWS(t, ts.WebSocketURL(), nil)
+	b := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 2)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ackedBy := func() int {
+		t.Helper()
+		var detail NotificationDetailResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &detail)
+		return detail.AckedBy
+	}
+	if n := ackedBy(); n != 0 {
+		t.Fatalf("acked_by before acks = %d", n)
+	}
+
+	ack := WSMessage{Type: "ack", NotificationID: created.ID}
+	a.next(t, "notification")
+	a.send(t, ack)
+	a.send(t, ack) // 同じ接続からの重複したackは数えない
+	a.sync(t)
+	if n := ackedBy(); n != 1 {
+		t.Errorf("acked_by after one client = %d, want 1", n)
+	}
+
+	b.next(t, "notification")
+	b.send(t, ack)
+	b.sync(t)
+	if n := ackedBy(); n != 2 {
+		t.Errorf("acked_by after both clients = %d, want 2", n)
+	}
+
+	// 存在しない通知へのackは記録しない
+	b.send(t, WSMessage{Type: "ack", NotificationID: "missing"})
+	b.sync(t)
+	if n := ts.WSManager.AckCount("missing"); n != 0 {
+		t.Errorf("ack count for a missing notification = %d", n)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	ts := startTestServer(t, withAdminToken("admin"))
+	admin := []string{"Authorization", "Bearer admin"}
+	kicked := dialWS(t, ts.WebSocketURL()+"?user_id=abuser", nil)
+	other := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 2)
+
+	var list ConnectionsResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/admin/connections", nil, admin...), &list)
+	var id string
+	for _, conn := range list.Connections {
+		if conn.UserID == "abuser" {
+			id = conn.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("connection not listed: %+v", list.Connections)
+	}
+
+	ts.expectStatus(t, http.StatusUnauthorized, http.MethodPost, "/api/admin/connections/"+id+"/disconnect", nil)
+	ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/admin/connections/"+id+"/disconnect", nil, admin...)
+	if closeErr := kicked.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "disconnected by administrator" {
+		t.Fatalf("close = %v, want 1008 disconnected by administrator", closeErr)
+	}
+	waitClients(t, ts.WSManager, 1)
+
+	// 他の接続には影響しない
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	other.next(t, "notification")
+
+	ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/admin/connections/"+id+"/disconnect", nil, admin...)
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	// 書き込みを止めた状態で5件を配信する。1件目は送信goroutineが保持し、2・3件目で送信キューが一杯になる
+	run := func(t *testing.T, policy string, whileStalled func(resume func())) (*TestServer, *testWSClient) {
+		t.Helper()
+		ts := startTestServer(t, func(cfg *testConfig) {
+			cfg.WS.SendBufferSize = 2
+			cfg.WS.BackpressurePolicy = policy
+			cfg.WS.SendTimeout = 100 * time.Millisecond
+		})
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		resume := stallWriters(t, ts.WSManager)
+		defer resume()
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		waitFor(t, "the writer to block", func() bool { return queuedMessages(ts.WSManager) == 0 })
+		for i := 0; i < 2; i++ {
+			ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		}
+		if whileStalled != nil {
+			whileStalled(resume)
+		}
+		for i := 0; i < 2; i++ {
+			ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		}
+		resume()
+		return ts, client
+	}
+	received := func(t *testing.T, client *testWSClient, n int) []string {
+		t.Helper()
+		var got []string
+		for i := 0; i < n; i++ {
+			got = append(got, client.next(t, "notification").Notification.ID)
+		}
+		client.expectNone(t, "notification", 50*time.Millisecond)
+		return got
+	}
+
+	t.Run(BackpressureDropClient, func(t *testing.T) {
+		ts, client := run(t, BackpressureDropClient, nil)
+		client.waitClosed(t)
+		waitClients(t, ts.WSManager, 0)
+		if s := ts.WSManager.Stats(); s.BroadcastFailures == 0 || s.DroppedMessages != 0 {
+			t.Errorf("stats = %+v, want the client evicted without dropping messages", s)
+		}
+	})
+
+	t.Run(BackpressureDropNewest, func(t *testing.T) {
+		ts, client := run(t, BackpressureDropNewest, nil)
+		if got := received(t, client, 3); !slicesEqual(got, []string{"1", "2", "3"}) {
+			t.Errorf("received %v, want [1 2 3]", got)
+		}
+		if s := ts.WSManager.Stats(); s.DroppedMessages != 2 || s.Clients != 1 {
+			t.Errorf("stats = %+v, want 2 dropped and the client connected", s)
+		}
+	})
+
+	t.Run(BackpressureDropOldest, func(t *testing.T) {
+		ts, client := run(t, BackpressureDropOldest, nil)
+		if got := received(t, client, 3); !slicesEqual(got, []string{"1", "4", "5"}) {
+			t.Errorf("received %v, want [1 4 5]", got)
+		}
+		if s := ts.WSManager.Stats(); s.DroppedMessages != 2 || s.Clients != 1 {
+			t.Errorf("stats = %+v, want 2 dropped and the client connected", s)
+		}
+	})
+
+	t.Run(BackpressureBlockWithTimeout+" recovers", func(t *testing.T) {
+		// 待っている間に書き込みが再開すれば破棄しない
+		ts, client := run(t, BackpressureBlockWithTimeout, func(resume func()) {
+			time.AfterFunc(20*time.Millisecond, resume)
+		})
+		if got := received(t, client, 5); !slicesEqual(got, []string{"1", "2", "3", "4", "5"}) {
+			t.Errorf("received %v, want all 5", got)
+		}
+		if s := ts.WSManager.Stats(); s.BroadcastFailures != 0 || s.Clients != 1 {
+			t.Errorf("stats = %+v, want no failures", s)
+		}
+	})
+
+	t.Run(BackpressureBlockWithTimeout+" times out", func(t *testing.T) {
+		ts, client := run(t, BackpressureBlockWithTimeout, nil)
+		client.waitClosed(t)
+		waitClients(t, ts.WSManager, 0)
+	})
+}
+
+func TestBroadcastErrorLogSampling(t *testing.T) {
+	const clients = 20
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.SendBufferSize = 1
+		cfg.WS.ErrorLogLimit = 3
+		cfg.WS.ErrorLogInterval = 100 * time.Millisecond
+	})
+	for i := 0; i < clients; i++ {
+		dialWS(t, ts.WebSocketURL(), nil)
+	}
+	waitClients(t, ts.WSManager, clients)
+	logs := captureLogs(t)
+
+	// 全てのクライアントの送信キューを溢れさせ、同時に切断させる
+	resume := stallWriters(t, ts.WSManager)
+	defer resume()
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	waitFor(t, "writers to block", func() bool { return queuedMessages(ts.WSManager) == 0 })
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	resume()
+	waitClients(t, ts.WSManager, 0)
+
+	if n := strings.Count(logs.String(), "WebSocket client too slow"); n != 3 {
+		t.Errorf("logged %d client errors, want 3", n)
+	}
+	waitFor(t, "the summary", func() bool { return strings.Contains(logs.String(), "Suppressed WebSocket client error logs") })
+	if !strings.Contains(logs.String(), `"count":17`) {
+		t.Errorf("summary does not count the 17 suppressed errors: %s", logs)
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	s := &logSampler{limit: 2, interval: 50 * time.Millisecond}
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if s.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d in one interval, want 2", allowed)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow() {
+		t.Error("not allowed in the next interval")
+	}
+
+	var unlimited *logSampler
+	for i := 0; i < 10; i++ {
+		if !unlimited.Allow() || !(&logSampler{}).Allow() {
+			t.Fatal("sampling without a limit")
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	ts := startTestServer(t)
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	const interval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	go ts.WSManager.RunHeartbeat(ctx, interval)
+
+	msg := client.next(t, "heartbeat")
+	if elapsed := time.Since(started); elapsed > interval+100*time.Millisecond {
+		t.Errorf("first heartbeat after %s, want within %s", elapsed, interval)
+	}
+	if msg.Time == nil || msg.Time.Before(started) {
+		t.Errorf("heartbeat time = %v, want the send time", msg.Time)
+	}
+
+	// heartbeatの間も通知は順に届く
+	for i := 0; i < 3; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		time.Sleep(interval / 2)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if got := client.next(t, "notification").Notification.ID; got != want {
+			t.Errorf("notification %s, want %s", got, want)
+		}
+	}
+	client.next(t, "heartbeat")
+
+	cancel()
+	time.Sleep(interval)
+	for len(client.messages) > 0 {
+		<-client.messages
+	}
+	client.expectNone(t, "heartbeat", 2*interval)
+}
+
+func TestReplayOnReconnect(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.WS.ReplayBufferSize = 3 })
+	client := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	waitClients(t, ts.WSManager, 1)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	last := client.next(t, "notification").Seq
+	if last != 1 {
+		t.Fatalf("seq = %d, want 1", last)
+	}
+	client.conn.Close()
+	waitClients(t, ts.WSManager, 0)
+
+	// 切断中の4件のうち、バッファに残る直近の3件を再送する。他のユーザー宛ての通知は含めない
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "bob"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "alice"})
+
+	client = dialWS(t, ts.WebSocketURL()+"?user_id=alice&since_seq=1", nil)
+	for _, want := range []uint64{4, 5} {
+		if msg := client.next(t, "notification"); msg.Seq != want {
+			t.Errorf("replayed seq %d, want %d", msg.Seq, want)
+		}
+	}
+	waitClients(t, ts.WSManager, 1)
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	if msg := client.next(t, "notification"); msg.Seq != 6 {
+		t.Errorf("live seq after replay = %d, want 6", msg.Seq)
+	}
+
+	upToDate := dialWS(t, ts.WebSocketURL()+"?since_seq=6", nil)
+	upToDate.expectNone(t, "notification", 50*time.Millisecond)
+
+	invalid := dialWS(t, ts.WebSocketURL()+"?since_seq=latest", nil)
+	if closeErr := invalid.waitClosed(t); closeErr == nil || closeErr.Code != websocket.CloseUnsupportedData {
+		t.Errorf("invalid since_seq: close = %v, want 1003", closeErr)
+	}
+}
+
+func TestRebroadcast(t *testing.T) {
+	ts := startTestServer(t)
+	created := ts.create(t, CreateNotificationRequest{Title: "before reconnect", Message: "m"})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	var resp RebroadcastResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/"+created.ID+"/rebroadcast", nil), &resp)
+	if resp.Delivered != 1 || resp.Held {
+		t.Errorf("rebroadcast = %+v, want delivered to 1 client", resp)
+	}
+	if msg := client.next(t, "notification"); msg.Notification.ID != created.ID || msg.Notification.Title != "before reconnect" {
+		t.Errorf("rebroadcast %s %q, want %s", msg.Notification.ID, msg.Notification.Title, created.ID)
+	}
+	// 新しい通知は作成しない
+	if got := ts.listIDs(t, ""); !slicesEqual(got, []string{created.ID}) {
+		t.Errorf("list after rebroadcast = %v, want [%s]", got, created.ID)
+	}
+
+	ts.expectStatus(t, http.StatusNotFound, http.MethodPost, "/api/notifications/missing/rebroadcast", nil)
+	client.expectNone(t, "notification", 50*time.Millisecond)
+}
+
+func TestShutdownClosesWebSocketClients(t *testing.T) {
+	const grace = 200 * time.Millisecond
+
+	t.Run("clients close in time", func(t *testing.T) {
+		ts := startTestServer(t)
+		clients := []*testWSClient{dialWS(t, ts.WebSocketURL(), nil), dialWS(t, ts.WebSocketURL(), nil)}
+		waitClients(t, ts.WSManager, 2)
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		started := time.Now()
+		if forced := ts.WSManager.Shutdown(ctx); forced != 0 {
+			t.Errorf("force-closed %d connections, want 0", forced)
+		}
+		if elapsed := time.Since(started); elapsed >= grace {
+			t.Errorf("shutdown took %s, want less than the grace period", elapsed)
+		}
+		for _, client := range clients {
+			if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "server shutting down" {
+				t.Errorf("close = %v, want 1001 server shutting down", closeErr)
+			}
+		}
+	})
+
+	t.Run("unresponsive client is force-closed", func(t *testing.T) {
+		ts := startTestServer(t)
+		// 受信しないクライアントはクローズフレームを返さない
+		conn, _, err := websocket.DefaultDialer.Dial(ts.WebSocketURL(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		waitClients(t, ts.WSManager, 1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		started := time.Now()
+		if forced := ts.WSManager.Shutdown(ctx); forced != 1 {
+			t.Errorf("force-closed %d connections, want 1", forced)
+		}
+		if elapsed := time.Since(started); elapsed < grace || elapsed > grace+time.Second {
+			t.Errorf("shutdown took %s, want about %s", elapsed, grace)
+		}
+		if n := ts.WSManager.Stats().Clients; n != 0 {
+			t.Errorf("%d clients remain after shutdown", n)
+		}
+
+		// クローズフレームを受信した後に、接続が閉じられている
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("first read = %v, want the close frame", err)
+		}
+	})
+}
+
+func TestUnreadCountEvents(t *testing.T) {
+	ts := startTestServer(t)
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	expectCount := func(want int) {
+		t.Helper()
+		// 続いた変更はunreadCountDebounceの後に1回のイベントにまとめる
+		client.expectNone(t, "unread_count", 50*time.Millisecond)
+		ts.Clock.Advance(unreadCountDebounce)
+		if msg := client.next(t, "unread_count"); msg.Count == nil || *msg.Count != want {
+			t.Errorf("unread_count = %v, want %d", msg.Count, want)
+		}
+		ts.Clock.Advance(unreadCountDebounce)
+		client.expectNone(t, "unread_count", 50*time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	}
+	expectCount(3)
+
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/1/read", nil)
+	expectCount(2)
+
+	// 未読数が変わらない操作では送信しない
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/1/read", nil)
+	ts.Clock.Advance(unreadCountDebounce)
+	client.expectNone(t, "unread_count", 50*time.Millisecond)
+
+	ts.expectStatus(t, http.StatusOK, http.MethodDelete, "/api/notifications", nil)
+	expectCount(0)
+}
+
+func TestUnreadCountPerUser(t *testing.T) {
+	ts := startTestServer(t)
+	alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	bob := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+	everyone := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 3)
+	expectCount := func(name string, client *testWSClient, want int) {
+		t.Helper()
+		if msg := client.next(t, "unread_count"); msg.Count == nil || *msg.Count != want {
+			t.Errorf("%s: unread_count = %v, want %d", name, msg.Count, want)
+		}
+	}
+
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "alice"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "alice"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "bob"})
+	ts.Clock.Advance(unreadCountDebounce)
+	// 他のユーザー宛ての通知は数えず、接続時の一覧と一致する
+	expectCount("alice", alice, 3)
+	expectCount("bob", bob, 2)
+	expectCount("no user", everyone, 4)
+	alice.send(t, WSMessage{Type: "get_notifications"})
+	if list := alice.next(t, "notifications_list"); len(list.Notifications) != 3 {
+		t.Errorf("alice's list = %v, want 3", ids(list.Notifications))
+	}
+
+	// 未読数が変わったユーザーにのみ送信する
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/2/read", nil)
+	ts.Clock.Advance(unreadCountDebounce)
+	expectCount("alice", alice, 2)
+	expectCount("no user", everyone, 3)
+	bob.expectNone(t, "unread_count", 50*time.Millisecond)
+}
+
+func TestIdleDisconnect(t *testing.T) {
+	ts := startTestServer(t)
+	idle := dialWS(t, ts.WebSocketURL(), nil)
+	active := dialWS(t, ts.WebSocketURL(), nil)
+	pinging := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 3)
+
+	time.Sleep(100 * time.Millisecond)
+	cutoff := time.Now()
+	active.sync(t)
+	// クライアントからのPingもアクティビティとして扱う
+	if err := pinging.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the ping to be received", func() bool {
+		return len(ts.WSManager.clientList(func(c *connWithMu) bool { return c.lastActivityAt().After(cutoff) })) == 2
+	})
+
+	if n := ts.WSManager.disconnectIdle(time.Now(), 50*time.Millisecond); n != 1 {
+		t.Errorf("disconnected %d clients, want 1", n)
+	}
+	if closeErr := idle.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "idle timeout" {
+		t.Errorf("close = %v, want policy violation (idle timeout)", closeErr)
+	}
+	waitClients(t, ts.WSManager, 2)
+	active.sync(t)
+	pinging.sync(t)
+}
+
+func TestRunIdleCheck(t *testing.T) {
+	ts := startTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ts.WSManager.RunIdleCheck(ctx, 100*time.Millisecond)
+
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	start := time.Now()
+	if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("close = %v, want policy violation", closeErr)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("disconnected after %s, before the idle timeout", elapsed)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.MaxConnsPerIP = 3
+		cfg.Server.TrustedProxies = []string{"127.0.0.1"}
+	})
+	header := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+
+	var clients []*testWSClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, dialWS(t, ts.WebSocketURL(), header))
+	}
+	if status := dialStatus(t, ts.WebSocketURL(), header); status != http.StatusTooManyRequests {
+		t.Errorf("connection over the limit: %d, want 429", status)
+	}
+	// 他のIPからの接続は制限しない
+	if status := dialStatus(t, ts.WebSocketURL(), http.Header{"X-Forwarded-For": {"10.0.0.2"}}); status != http.StatusSwitchingProtocols {
+		t.Errorf("connection from another IP: %d", status)
+	}
+
+	// 切断すると再び接続できる
+	clients[0].conn.Close()
+	waitFor(t, "the connection count to be decremented", func() bool {
+		ts.WSManager.ipMu.Lock()
+		defer ts.WSManager.ipMu.Unlock()
+		return ts.WSManager.ipConns["10.0.0.1"] == 2
+	})
+	if status := dialStatus(t, ts.WebSocketURL(), header); status != http.StatusSwitchingProtocols {
+		t.Errorf("connection after a disconnect: %d", status)
+	}
+	if status := dialStatus(t, ts.WebSocketURL(), header); status != http.StatusTooManyRequests {
+		t.Errorf("connection over the limit again: %d, want 429", status)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	// テストの開始時刻 (0:00 UTC) は静音時間内
+	quiet, err := parseQuietHours("22:00-01:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, func(cfg *testConfig) { cfg.WS.QuietHours = quiet })
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	held := ts.create(t, CreateNotificationRequest{Title: "held", Message: "m"})
+	if held.Status != CreateStatusHeld {
+		t.Errorf("normal notification status = %s, want held", held.Status)
+	}
+	read := ts.create(t, CreateNotificationRequest{Title: "read", Message: "m"})
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+read.ID+"/read", nil)
+
+	// criticalは静音時間中も配信する
+	critical := ts.create(t, CreateNotificationRequest{Title: "critical", Message: "m", Priority: PriorityCritical})
+	if critical.Status != CreateStatusDelivered {
+		t.Errorf("critical status = %s, want delivered", critical.Status)
+	}
+	if msg := client.next(t, "notification"); msg.Notification.ID != critical.ID {
+		t.Errorf("received %s, want the critical notification first", msg.Notification.ID)
+	}
+	// 保留中の通知も保存はされている
+	if got := ts.listIDs(t, "?states=unread,read"); len(got) != 3 {
+		t.Errorf("stored = %v, want 3", got)
+	}
+
+	if released := ts.WSManager.releaseHeld(); released != 0 {
+		t.Errorf("released %d during quiet hours", released)
+	}
+	ts.Clock.Advance(time.Hour)
+	// 保留中に既読にした通知は送信しない
+	if released := ts.WSManager.releaseHeld(); released != 1 {
+		t.Errorf("released = %d, want 1", released)
+	}
+	if msg := client.next(t, "notification"); msg.Notification.ID != held.ID {
+		t.Errorf("released %s, want %s", msg.Notification.ID, held.ID)
+	}
+	if created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}); created.Status != CreateStatusDelivered {
+		t.Errorf("status after quiet hours = %s, want delivered", created.Status)
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	overnight, err := parseQuietHours("22:00-07:00", jst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daytime, err := parseQuietHours("12:00-13:30", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		quiet *QuietHours
+		now   time.Time
+		want  bool
+	}{
+		{overnight, time.Date(2024, 1, 1, 23, 0, 0, 0, jst), true},
+		{overnight, time.Date(2024, 1, 1, 6, 59, 59, 0, jst), true},
+		{overnight, time.Date(2024, 1, 1, 7, 0, 0, 0, jst), false},
+		// 00:00 UTC は 09:00 JST
+		{overnight, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{overnight, time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC), true},
+		{daytime, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), true},
+		{daytime, time.Date(2024, 1, 1, 13, 30, 0, 0, time.UTC), false},
+		{nil, time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := tt.quiet.Active(tt.now); got != tt.want {
+			t.Errorf("Active(%s) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"22:00", "25:00-07:00", "22:00-22:00", "late-early"} {
+		if _, err := parseQuietHours(s, time.UTC); err == nil {
+			t.Errorf("parseQuietHours(%q) = nil error", s)
+		}
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	ts := startTestServer(t)
+	tests := []struct {
+		name      string
+		requested []string
+		want      string
+	}{
+		{"supported", []string{WSSubprotocolV1}, WSSubprotocolV1},
+		{"supported among others", []string{"notibag.v2", WSSubprotocolV1}, WSSubprotocolV1},
+		{"none", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.requested}
+			conn, _, err := dialer.Dial(ts.WebSocketURL(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Errorf("negotiated %q, want %q", got, tt.want)
+			}
+			waitClients(t, ts.WSManager, 1)
+			if connections := ts.WSManager.Connections(); len(connections) != 1 || connections[0].Protocol != tt.want {
+				t.Errorf("connections = %+v, want protocol %q", connections, tt.want)
+			}
+			conn.Close()
+			waitClients(t, ts.WSManager, 0)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		dialer := websocket.Dialer{Subprotocols: []string{"notibag.v2"}}
+		_, res, err := dialer.Dial(ts.WebSocketURL(), nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("dial: %v, response %v, want 400", err, res)
+		}
+		var body ErrorResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body.Error, "unsupported subprotocol: notibag.v2") || !strings.Contains(body.Error, WSSubprotocolV1) {
+			t.Errorf("error = %q", body.Error)
+		}
+		if n := ts.WSManager.Stats().Clients; n != 0 {
+			t.Errorf("clients = %d, want 0", n)
+		}
+	})
+}
+
+func TestEngagement(t *testing.T) {
+	ts := startTestServer(t)
+	clients := make([]*testWSClient, 4)
+	for i := range clients {
+		clients[i] = dialWS(t, ts.WebSocketURL(), nil)
+	}
+	// 宛先が異なるユーザーのクライアントは数えない
+	dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+	waitClients(t, ts.WSManager, 5)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "alice"})
+	path := "/api/notifications/" + created.ID + "/engagement"
+
+	var engagement Engagement
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &engagement)
+	if engagement != (Engagement{NotificationID: created.ID, Clients: 4}) {
+		t.Errorf("before acks = %+v", engagement)
+	}
+
+	ack := WSMessage{Type: "ack", NotificationID: created.ID}
+	read := WSMessage{Type: "mark_read", NotificationID: created.ID}
+	clients[0].send(t, ack)
+	clients[1].send(t, ack)
+	clients[1].send(t, read)
+	clients[2].send(t, read)
+	for _, c := range clients {
+		c.sync(t)
+	}
+	engagement = Engagement{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &engagement)
+	if want := (Engagement{NotificationID: created.ID, Clients: 4, Acked: 2, Read: 2, AckRatio: 0.5, ReadRatio: 0.5}); engagement != want {
+		t.Errorf("engagement = %+v, want %+v", engagement, want)
+	}
+
+	// 切断したクライアントは数えない
+	clients[0].conn.Close()
+	clients[3].conn.Close()
+	waitClients(t, ts.WSManager, 3)
+	engagement = Engagement{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, path, nil), &engagement)
+	if want := (Engagement{NotificationID: created.ID, Clients: 2, Acked: 1, Read: 2, AckRatio: 0.5, ReadRatio: 1}); engagement != want {
+		t.Errorf("after disconnects = %+v, want %+v", engagement, want)
+	}
+
+	ts.expectStatus(t, http.StatusNotFound, http.MethodGet, "/api/notifications/missing/engagement", nil)
+}
+
+func TestAutoReadOnDelivery(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name     string
+		global   bool
+		request  *bool
+		clients  int
+		wantRead bool
+	}{
+		{"enabled", true, nil, 1, true},
+		{"enabled without clients", true, nil, 0, false},
+		{"disabled", false, nil, 1, false},
+		{"enabled by the request", false, &enabled, 1, true},
+		{"disabled by the request", true, &disabled, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startTestServer(t, func(cfg *testConfig) { cfg.Service.AutoRead = tt.global })
+			var clients []*testWSClient
+			for i := 0; i < tt.clients; i++ {
+				clients = append(clients, dialWS(t, ts.WebSocketURL(), nil))
+			}
+			waitClients(t, ts.WSManager, tt.clients)
+
+			created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", AutoRead: tt.request})
+			var got Notification
+			decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &got)
+			if got.Read != tt.wantRead {
+				t.Errorf("read = %v, want %v", got.Read, tt.wantRead)
+			}
+			for _, c := range clients {
+				// 配信した通知自体は未読のまま届き、既読状態の変更が続く
+				if msg := c.next(t, "notification"); msg.Notification.Read {
+					t.Errorf("delivered notification is already read")
+				}
+				if tt.wantRead {
+					c.next(t, "notification_read")
+				}
+			}
+		})
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.MaxMessageRate = 1
+		cfg.WS.MaxMessageBurst = 5
+	})
+	flooder := dialWS(t, ts.WebSocketURL(), nil)
+	other := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 2)
+
+	for i := 0; i < 20; i++ {
+		if err := flooder.conn.WriteJSON(WSMessage{Type: "get_notifications"}); err != nil {
+			break
+		}
+	}
+	if closeErr := flooder.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "message rate exceeded" {
+		t.Errorf("close = %v, want policy violation (message rate exceeded)", closeErr)
+	}
+	// 他の接続には影響しない
+	waitClients(t, ts.WSManager, 1)
+	other.sync(t)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := TestServerStart
+	limiter := newRateLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("message %d within the burst was rejected", i)
+		}
+	}
+	if limiter.Allow(now) {
+		t.Error("message over the burst was allowed")
+	}
+	// 2件/秒で回復する
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow(now) || limiter.Allow(now) {
+		t.Error("want exactly one message after 500ms")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(now) {
+			t.Fatalf("message %d after recovering was rejected", i)
+		}
+	}
+	if limiter.Allow(now) {
+		t.Error("recovered tokens exceed the burst")
+	}
+
+	if newRateLimiter(0, 0) != nil || !newRateLimiter(0, 0).Allow(now) {
+		t.Error("a zero rate should allow every message")
+	}
+	if err := (WSConfig{MaxMessageRate: 1}).Validate(); err == nil {
+		t.Error("Validate() accepted a rate without a burst")
+	}
+}
+
+func TestStoredSubscription(t *testing.T) {
+	ts := startTestServer(t)
+	var sub UserSubscription
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/users/alice/subscriptions", nil), &sub)
+	if len(sub.Categories) != 0 || len(sub.Tags) != 0 {
+		t.Errorf("unset subscription = %+v, want empty", sub)
+	}
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/users/alice/subscriptions", UserSubscription{Categories: []string{"deploy"}})
+	sub = UserSubscription{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/users/alice/subscriptions", nil), &sub)
+	if !slicesEqual(sub.Categories, []string{"deploy"}) {
+		t.Errorf("stored categories = %v, want [deploy]", sub.Categories)
+	}
+
+	// subscribeを送らなくても保存した条件が適用される
+	alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	bob := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+	waitClients(t, ts.WSManager, 2)
+	deploy := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "deploy"})
+	system := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Category: "system"})
+
+	if msg := alice.next(t, "notification"); msg.Notification.ID != deploy.ID {
+		t.Errorf("alice received %s, want %s", msg.Notification.ID, deploy.ID)
+	}
+	alice.expectNone(t, "notification", 50*time.Millisecond)
+	for _, want := range []string{deploy.ID, system.ID} {
+		if msg := bob.next(t, "notification"); msg.Notification.ID != want {
+			t.Errorf("bob received %s, want %s", msg.Notification.ID, want)
+		}
+	}
+}
+
+func TestStoredSubscriptionSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.json")
+	repo, err := NewFileNotificationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetSubscription("alice", UserSubscription{Categories: []string{"deploy"}, Tags: []string{"ci"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewFileNotificationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, ok := restarted.GetSubscription("alice")
+	if !ok || !slicesEqual(sub.Categories, []string{"deploy"}) || !slicesEqual(sub.Tags, []string{"ci"}) {
+		t.Errorf("restored subscription = %+v (%v)", sub, ok)
+	}
+	if _, ok := restarted.GetSubscription("bob"); ok {
+		t.Error("subscription for bob should not exist")
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	webhooks, err := NewWebhookDispatcher(WebhookConfig{URLs: []string{receiver.URL}, Timeout: time.Second, MaxRetryAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.Escalation = &EscalationPolicy{After: 5 * time.Minute, MaxEscalations: 2, Webhooks: webhooks}
+	})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+
+	unacked := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical})
+	acked := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical})
+	read := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityHigh})
+	for i := 0; i < 4; i++ {
+		client.next(t, "notification")
+	}
+	client.send(t, WSMessage{Type: "ack", NotificationID: acked.ID})
+	client.send(t, WSMessage{Type: "mark_read", NotificationID: read.ID})
+	client.sync(t)
+
+	if n := ts.WSManager.escalate(); n != 0 {
+		t.Errorf("escalated %d before the interval", n)
+	}
+	// ackも既読もされないcriticalの通知のみ、間隔ごとに最大回数まで再送する
+	for level := 1; level <= 2; level++ {
+		ts.Clock.Advance(5 * time.Minute)
+		if n := ts.WSManager.escalate(); n != 1 {
+			t.Fatalf("level %d: escalated %d, want 1", level, n)
+		}
+		msg := client.next(t, "notification")
+		if msg.Notification.ID != unacked.ID || msg.Notification.Escalation != level {
+			t.Errorf("re-broadcast %s at escalation %d, want %s at %d", msg.Notification.ID, msg.Notification.Escalation, unacked.ID, level)
+		}
+	}
+	ts.Clock.Advance(5 * time.Minute)
+	if n := ts.WSManager.escalate(); n != 0 {
+		t.Errorf("escalated %d after the max escalations", n)
+	}
+
+	waitFor(t, "the escalated webhooks", func() bool { return len(receiver.received()) == 2 })
+	levels := make(map[int]bool)
+	for _, event := range receiver.received() {
+		if event.Event != "escalated" || event.Notification == nil || event.Notification.ID != unacked.ID {
+			t.Errorf("webhook = %+v", event)
+			continue
+		}
+		levels[event.Notification.Escalation] = true
+	}
+	if !levels[1] || !levels[2] {
+		t.Errorf("webhook escalation levels = %v, want 1 and 2", levels)
+	}
+}
+
+func TestEscalationStopsOnAck(t *testing.T) {
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.Escalation = &EscalationPolicy{After: time.Minute, MaxEscalations: 5}
+	})
+	client := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", Priority: PriorityCritical})
+	client.next(t, "notification")
+
+	ts.Clock.Advance(time.Minute)
+	if n := ts.WSManager.escalate(); n != 1 {
+		t.Fatalf("escalated %d, want 1", n)
+	}
+	client.send(t, WSMessage{Type: "ack", NotificationID: created.ID})
+	client.sync(t)
+	ts.Clock.Advance(time.Minute)
+	if n := ts.WSManager.escalate(); n != 0 {
+		t.Errorf("escalated %d after the ack", n)
+	}
+}
+
+func TestHandshakeDeadline(t *testing.T) {
+	t.Run("completed in time", func(t *testing.T) {
+		keys := map[string]string{"ci": "secret"}
+		ts := startTestServer(t, withAPIKeys(keys), func(cfg *testConfig) { cfg.WS.HandshakeTimeout = 200 * time.Millisecond })
+		created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"}, "Authorization", "Bearer secret")
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		client.send(t, WSMessage{Type: "auth", Token: "secret"})
+
+		// get_notificationsを送らなくても最初に一覧が届く
+		if msg := client.next(t, "notifications_list"); len(msg.Notifications) != 1 || msg.Notifications[0].ID != created.ID {
+			t.Errorf("initial list = %v, want [%s]", ids(msg.Notifications), created.ID)
+		}
+		// 期限を過ぎても接続は閉じない
+		time.Sleep(300 * time.Millisecond)
+		client.sync(t)
+		if clients := ts.WSManager.Stats().Clients; clients != 1 {
+			t.Errorf("clients = %d, want 1", clients)
+		}
+	})
+
+	t.Run("stalled initial sync", func(t *testing.T) {
+		// 受信しないクライアントには、ソケットのバッファ (Linuxの送信側は最大4MiB) を超える一覧を送れない
+		message := strings.Repeat("x", 16*1024)
+		ts := startTestServer(t, func(cfg *testConfig) {
+			cfg.WS.HandshakeTimeout = 200 * time.Millisecond
+			cfg.Repository = func() NotificationRepository {
+				repo := newTestRepository()
+				for i := 0; i < 600; i++ {
+					repo.Create(Notification{ID: strconv.Itoa(i), Title: "t", Message: message, Timestamp: TestServerStart})
+				}
+				return repo
+			}
+		})
+		logs := captureLogs(t)
+		dialer := websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conn.(*net.TCPConn).SetReadBuffer(4096)
+			}
+			return conn, err
+		}}
+		conn, _, err := dialer.Dial(ts.WebSocketURL(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		waitFor(t, "the stalled connection to be closed", func() bool {
+			return strings.Contains(logs.String(), "WebSocket initial sync failed")
+		})
+		waitClients(t, ts.WSManager, 0)
+	})
+}
+
+func TestDrain(t *testing.T) {
+	ts := startTestServer(t, withAdminToken("admin"))
+	admin := []string{"Authorization", "Bearer admin"}
+	existing := dialWS(t, ts.WebSocketURL(), nil)
+	waitClients(t, ts.WSManager, 1)
+	ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health/ready", nil)
+	ts.expectStatus(t, http.StatusUnauthorized, http.MethodPost, "/api/admin/drain", `{"enabled": true}`)
+
+	var resp DrainResponse
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/admin/drain", `{"enabled": true, "reconnect": true}`, admin...), &resp)
+	if resp != (DrainResponse{Draining: true, Clients: 1}) {
+		t.Errorf("drain = %+v", resp)
+	}
+	existing.next(t, "reconnect")
+	// 接続中のクライアントは切断しない
+	existing.sync(t)
+
+	if status := dialStatus(t, ts.WebSocketURL(), nil); status != http.StatusServiceUnavailable {
+		t.Errorf("new connection while draining: %d, want 503", status)
+	}
+	var ready struct {
+		Status string `json:"status"`
+	}
+	decode(t, ts.expectStatus(t, http.StatusServiceUnavailable, http.MethodGet, "/api/health/ready", nil), &ready)
+	if ready.Status != "draining" {
+		t.Errorf("readiness status = %q, want draining", ready.Status)
+	}
+	// drain中もREST APIは使える
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	existing.next(t, "notification")
+
+	resp = DrainResponse{}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/admin/drain", `{"enabled": false}`, admin...), &resp)
+	if resp.Draining {
+		t.Errorf("drain after disabling = %+v", resp)
+	}
+	ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health/ready", nil)
+	if status := dialStatus(t, ts.WebSocketURL(), nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("new connection after draining: %d", status)
+	}
+}
+
+func TestMaxInFlightBroadcasts(t *testing.T) {
+	const limit, burst = 2, 6
+	// 書き込みを止めた状態で同時に作成し、ブロードキャストを送信キューの空き待ちで止める
+	run := func(t *testing.T, policy string) (*TestServer, *testWSClient, func()) {
+		t.Helper()
+		ts := startTestServer(t, withAdminToken("admin"), func(cfg *testConfig) {
+			cfg.WS.SendBufferSize = 1
+			cfg.WS.BackpressurePolicy = BackpressureBlockWithTimeout
+			cfg.WS.SendTimeout = 10 * time.Second
+			cfg.WS.MaxInFlightBroadcasts = limit
+			cfg.WS.InFlightPolicy = policy
+		})
+		client := dialWS(t, ts.WebSocketURL(), nil)
+		waitClients(t, ts.WSManager, 1)
+
+		resume := stallWriters(t, ts.WSManager)
+		t.Cleanup(resume)
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+		waitFor(t, "the writer to block", func() bool { return queuedMessages(ts.WSManager) == 0 })
+		ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+
+		var wg sync.WaitGroup
+		for i := 0; i < burst; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"})
+			}()
+		}
+		return ts, client, func() {
+			resume()
+			wg.Wait()
+		}
+	}
+
+	t.Run(InFlightQueue, func(t *testing.T) {
+		ts, client, finish := run(t, InFlightQueue)
+		waitFor(t, "the limit to be reached", func() bool { return ts.WSManager.Stats().InFlight == limit })
+		time.Sleep(50 * time.Millisecond)
+		var metrics MetricsResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/admin/metrics", nil, "Authorization", "Bearer admin"), &metrics)
+		if metrics.WebSocket.InFlight != limit {
+			t.Errorf("in-flight broadcasts = %d, want %d", metrics.WebSocket.InFlight, limit)
+		}
+
+		finish()
+		// 待っていたブロードキャストも全て配信する
+		for i := 0; i < burst+2; i++ {
+			client.next(t, "notification")
+		}
+		if s := ts.WSManager.Stats(); s.InFlight != 0 || s.ShedBroadcasts != 0 {
+			t.Errorf("after the burst: %+v", s)
+		}
+	})
+
+	t.Run(InFlightShed, func(t *testing.T) {
+		ts, client, finish := run(t, InFlightShed)
+		waitFor(t, "the excess to be shed", func() bool {
+			s := ts.WSManager.Stats()
+			return s.InFlight == limit && s.ShedBroadcasts == burst-limit
+		})
+
+		finish()
+		for i := 0; i < limit+2; i++ {
+			client.next(t, "notification")
+		}
+		client.expectNone(t, "notification", 50*time.Millisecond)
+		if s := ts.WSManager.Stats(); s.InFlight != 0 {
+			t.Errorf("in-flight broadcasts after the burst = %d", s.InFlight)
+		}
+		// 破棄しても通知は保存する
+		if got := ts.listIDs(t, ""); len(got) != burst+2 {
+			t.Errorf("stored %d notifications, want %d", len(got), burst+2)
+		}
+	})
+
+	if err := (WSConfig{MaxInFlightBroadcasts: 1, InFlightPolicy: "drop"}).Validate(); err == nil {
+		t.Error("invalid in-flight policy was accepted")
+	}
+}
+
+func TestDoNotDisturb(t *testing.T) {
+	ts := startTestServer(t)
+	alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	waitClients(t, ts.WSManager, 1)
+
+	until := ts.Clock.Now().Add(time.Hour)
+	var dnd DoNotDisturb
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/users/alice/dnd", map[string]any{"enabled": true, "until": until, "allow_critical": true}), &dnd)
+	if !dnd.Enabled || dnd.Until == nil || !dnd.Until.Equal(until) || !dnd.AllowCritical {
+		t.Fatalf("dnd = %+v", dnd)
+	}
+
+	held := ts.create(t, CreateNotificationRequest{Title: "held", Message: "m", UserID: "alice"})
+	if held.Status != CreateStatusHeld {
+		t.Errorf("status = %s, want held", held.Status)
+	}
+	read := ts.create(t, CreateNotificationRequest{Title: "read", Message: "m", UserID: "alice"})
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/notifications/"+read.ID+"/read", nil)
+	// allow_criticalの場合、criticalはおやすみモード中も配信する
+	critical := ts.create(t, CreateNotificationRequest{Title: "critical", Message: "m", Priority: PriorityCritical, UserID: "alice"})
+	if msg := alice.next(t, "notification"); msg.Notification.ID != critical.ID {
+		t.Errorf("received %s, want the critical notification", msg.Notification.ID)
+	}
+	// 全員宛ての通知は保留しない
+	everyone := ts.create(t, CreateNotificationRequest{Title: "everyone", Message: "m"})
+	if msg := alice.next(t, "notification"); msg.Notification.ID != everyone.ID {
+		t.Errorf("received %s, want the notification for everyone", msg.Notification.ID)
+	}
+	alice.expectNone(t, "notification", 50*time.Millisecond)
+	// 保留中の通知も保存はされている
+	if got := ts.listIDs(t, "?states=unread,read&user_id=alice"); len(got) != 4 {
+		t.Errorf("stored = %v, want 4", got)
+	}
+
+	if released := ts.WSManager.releaseDoNotDisturb(); released != 0 {
+		t.Errorf("released %d during do not disturb", released)
+	}
+	ts.Clock.Advance(time.Hour)
+	// 保留中に既読にした通知は送信しない
+	if released := ts.WSManager.releaseDoNotDisturb(); released != 1 {
+		t.Errorf("released = %d, want 1", released)
+	}
+	if msg := alice.next(t, "notification"); msg.Notification.ID != held.ID {
+		t.Errorf("released %s, want %s", msg.Notification.ID, held.ID)
+	}
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/users/alice/dnd", nil), &dnd)
+	if dnd.Enabled {
+		t.Errorf("dnd after until = %+v, want disabled", dnd)
+	}
+}
+
+func TestDoNotDisturbUntilDisabled(t *testing.T) {
+	ts := startTestServer(t)
+	alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	waitClients(t, ts.WSManager, 1)
+
+	// untilとallow_criticalを省略すると、解除するまでcriticalも保留する
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/users/alice/dnd", map[string]any{"enabled": true})
+	critical := ts.create(t, CreateNotificationRequest{Title: "critical", Message: "m", Priority: PriorityCritical, UserID: "alice"})
+	ts.Clock.Advance(24 * time.Hour)
+	ts.WSManager.releaseDoNotDisturb()
+	alice.expectNone(t, "notification", 50*time.Millisecond)
+
+	// 解除するとすぐに送信する
+	ts.expectStatus(t, http.StatusOK, http.MethodPut, "/api/users/alice/dnd", map[string]any{"enabled": false})
+	if msg := alice.next(t, "notification"); msg.Notification.ID != critical.ID {
+		t.Errorf("received %s, want %s", msg.Notification.ID, critical.ID)
+	}
+
+	for _, body := range []map[string]any{
+		{"enabled": true, "until": ts.Clock.Now().Add(-time.Minute)},
+		{"until": ts.Clock.Now().Add(time.Hour)},
+	} {
+		ts.expectStatus(t, http.StatusBadRequest, http.MethodPut, "/api/users/alice/dnd", body)
+	}
+}
+
+func TestOrderedBroadcasts(t *testing.T) {
+	const n = 50
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.OrderedBroadcasts = true
+		cfg.WS.ReplayBufferSize = 0
+	})
+	clients := []*testWSClient{dialWS(t, ts.WebSocketURL(), nil), dialWS(t, ts.WebSocketURL(), nil)}
+	waitClients(t, ts.WSManager, len(clients))
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.request(t, http.MethodPost, "/api/notifications", CreateNotificationRequest{Title: "t", Message: "m"})
+		}()
+	}
+	wg.Wait()
+
+	// 再送が無効でもseqを付与し、どのクライアントもseqの順に受信する
+	for i, client := range clients {
+		seen := make(map[string]bool)
+		for want := uint64(1); want <= n; want++ {
+			msg := client.next(t, "notification")
+			if msg.Seq != want {
+				t.Fatalf("client %d: seq %d, want %d", i, msg.Seq, want)
+			}
+			seen[msg.Notification.ID] = true
+		}
+		if len(seen) != n {
+			t.Errorf("client %d received %d distinct notifications, want %d", i, len(seen), n)
+		}
+	}
+}
+
+func TestHealthDegradedOnBroadcastErrors(t *testing.T) {
+	const clients = 20
+	ts := startTestServer(t, func(cfg *testConfig) {
+		cfg.WS.SendBufferSize = 1
+		cfg.WS.HealthErrorRate = 0.1
+	})
+	for i := 0; i < clients; i++ {
+		dialWS(t, ts.WebSocketURL(), nil)
+	}
+	waitClients(t, ts.WSManager, clients)
+
+	type healthResponse struct {
+		Status    string   `json:"status"`
+		WebSocket WSHealth `json:"websocket"`
+	}
+	health := func() healthResponse {
+		t.Helper()
+		var res healthResponse
+		decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/health", nil), &res)
+		return res
+	}
+	if h := health(); h.Status != "ok" || h.WebSocket.Status != "ok" || !h.WebSocket.Initialized || h.WebSocket.Clients != clients {
+		t.Fatalf("health before errors = %+v", h)
+	}
+
+	// 全てのクライアントの送信キューを溢れさせ、3回目のブロードキャストを全て失敗させる
+	resume := stallWriters(t, ts.WSManager)
+	defer resume()
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	waitFor(t, "writers to block", func() bool { return queuedMessages(ts.WSManager) == 0 })
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+	resume()
+	waitClients(t, ts.WSManager, 0)
+
+	h := health()
+	if h.Status != "degraded" || h.WebSocket.Status != "degraded" {
+		t.Errorf("status = %s/%s, want degraded", h.Status, h.WebSocket.Status)
+	}
+	if h.WebSocket.ErrorRate <= 0.1 || !strings.Contains(h.WebSocket.LastBroadcastError, "client too slow") || h.WebSocket.LastBroadcastErrorAt == nil {
+		t.Errorf("websocket health = %+v", h.WebSocket)
+	}
+
+	// 失敗が期間外になれば回復する。最後のエラーは残す
+	ts.Clock.Advance(2 * wsHealthWindow)
+	if h := health(); h.Status != "ok" || h.WebSocket.ErrorRate != 0 || h.WebSocket.LastBroadcastError == "" {
+		t.Errorf("health after the window = %+v", h)
+	}
+}
+
+func TestSendErrorRate(t *testing.T) {
+	r := &sendErrorRate{window: time.Minute}
+	now := TestServerStart
+	r.addSends(now, 10)
+	r.addFailure(now, "first")
+	r.addFailure(now, "second")
+	if rate, sends := r.Rate(now); rate != 0.2 || sends != 10 {
+		t.Errorf("rate = %g of %d sends, want 0.2 of 10", rate, sends)
+	}
+
+	// 直前の期間の件数も含める
+	now = now.Add(90 * time.Second)
+	r.addSends(now, 10)
+	if rate, sends := r.Rate(now); rate != 0.1 || sends != 20 {
+		t.Errorf("rate in the next window = %g of %d sends, want 0.1 of 20", rate, sends)
+	}
+	if rate, sends := r.Rate(now.Add(2 * time.Minute)); rate != 0 || sends != 0 {
+		t.Errorf("rate after two windows = %g of %d sends, want 0", rate, sends)
+	}
+	if err, at := r.LastFailure(); err != "second" || !at.Equal(TestServerStart) {
+		t.Errorf("last failure = %q at %s", err, at)
+	}
+
+	if err := (WSConfig{HealthErrorRate: 1.5}).Validate(); err == nil {
+		t.Error("health error rate above 1 was accepted")
+	}
+}
+
+func TestMarkReadIsScopedToUser(t *testing.T) {
+	ts := startTestServer(t)
+	logs := captureLogs(t)
+	alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+	bob := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+	waitClients(t, ts.WSManager, 2)
+	created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "bob"})
+	bob.next(t, "notification")
+
+	// 他のユーザー宛ての通知は既読にできない
+	alice.send(t, WSMessage{Type: "mark_read", NotificationID: created.ID})
+	alice.sync(t)
+	var stored Notification
+	decode(t, ts.expectStatus(t, http.StatusOK, http.MethodGet, "/api/notifications/"+created.ID, nil), &stored)
+	if stored.Read {
+		t.Error("alice marked bob's notification as read")
+	}
+	bob.expectNone(t, "notification_read", 50*time.Millisecond)
+	if !strings.Contains(logs.String(), "notification not found") {
+		t.Errorf("logs = %s", logs)
+	}
+
+	bob.send(t, WSMessage{Type: "mark_read", NotificationID: created.ID})
+	if msg := bob.next(t, "notification_read"); msg.NotificationID != created.ID {
+		t.Errorf("notification_read for %s, want %s", msg.NotificationID, created.ID)
+	}
+}
+
+func TestStateChangesAreScopedToUser(t *testing.T) {
+	tests := []struct {
+		name, path, message string
+	}{
+		{"archive", "/archive", "notification_archived"},
+		{"pin", "/pin", "notification_pinned"},
+		{"unpin", "/unpin", "notification_pinned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startTestServer(t)
+			alice := dialWS(t, ts.WebSocketURL()+"?user_id=alice", nil)
+			bob := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+			waitClients(t, ts.WSManager, 2)
+
+			// 他のユーザー宛ての通知の状態は送らない
+			created := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m", UserID: "bob"})
+			ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/"+created.ID+tt.path, nil)
+			if msg := bob.next(t, tt.message); msg.NotificationID != created.ID {
+				t.Errorf("bob received %s for %s", tt.message, msg.NotificationID)
+			}
+			alice.expectNone(t, tt.message, 50*time.Millisecond)
+
+			everyone := ts.create(t, CreateNotificationRequest{Title: "t", Message: "m"})
+			ts.expectStatus(t, http.StatusOK, http.MethodPost, "/api/notifications/"+everyone.ID+tt.path, nil)
+			for name, client := range map[string]*testWSClient{"alice": alice, "bob": bob} {
+				if msg := client.next(t, tt.message); msg.NotificationID != everyone.ID {
+					t.Errorf("%s received %s for %s", name, tt.message, msg.NotificationID)
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketUserMatchesAPIKey(t *testing.T) {
+	keys := map[string]string{"alice": "alice-key", "bob": "bob-key"}
+
+	t.Run("own user", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		dialWS(t, ts.WebSocketURL()+"?user_id=alice&token=alice-key", nil)
+		client := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+		client.send(t, WSMessage{Type: "auth", Token: "bob-key"})
+		waitClients(t, ts.WSManager, 2)
+	})
+
+	t.Run("another user with the token query", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		_, res, err := websocket.DefaultDialer.Dial(ts.WebSocketURL()+"?user_id=bob&token=alice-key", nil)
+		if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+			t.Fatalf("dial as another user: response %v, error %v, want 403", res, err)
+		}
+	})
+
+	t.Run("another user with the auth message", func(t *testing.T) {
+		ts := startTestServer(t, withAPIKeys(keys))
+		client := dialWS(t, ts.WebSocketURL()+"?user_id=bob", nil)
+		client.send(t, WSMessage{Type: "auth", Token: "alice-key"})
+		if closeErr := client.waitClosed(t); closeErr == nil || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "user_id does not match the API key" {
+			t.Fatalf("close = %v, want 1008 user_id does not match the API key", closeErr)
+		}
+		// 他のユーザーとしては登録しないため、そのユーザーの通知の受信やclear_allはできない
+		if clients := ts.WSManager.Stats().Clients; clients != 0 {
+			t.Errorf("clients = %d, want 0", clients)
+		}
+	})
+}